@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Points adjustment imports credit or debit customers in bulk, for example
+// goodwill points after an incident. The CSV has a header row with
+// customerId and points columns and an optional reason column; points may
+// be negative. Each row becomes an "adjustment" ledger entry on the
+// customer's most recently accepted receipt in the request's tenant, so it
+// shows up in balances and emits points.adjusted like other ledger entries.
+//
+// Imports are all or nothing: the rows are checked and written in one
+// store transaction, so either every entry is added or none is. With
+// ?dryRun=true the import is only checked. The same file cannot be applied
+// twice: each applied file's hash is a store record written in the import's
+// transaction, so neither a restart nor another replica lets it through
+// again. Import reports are kept in the store too.
+
+var adjustmentMaxRows = envInt("ADJUSTMENT_IMPORT_MAX_ROWS", 10000)
+
+type adjustmentRow struct {
+	Line          int    `json:"line"`
+	CustomerID    string `json:"customerId"`
+	Points        int    `json:"points"`
+	Reason        string `json:"reason,omitempty"`
+	Status        string `json:"status"` // applied, valid, invalid or rolled_back
+	ReceiptID     string `json:"receiptId,omitempty"`
+	BalanceBefore int    `json:"balanceBefore"`
+	BalanceAfter  int    `json:"balanceAfter"`
+	Error         string `json:"error,omitempty"`
+}
+
+type adjustmentImport struct {
+	ID        string          `json:"id"`
+	Tenant    string          `json:"tenant"`
+	DryRun    bool            `json:"dryRun"`
+	Status    string          `json:"status"` // applied, valid, rejected or failed
+	FileHash  string          `json:"fileHash"`
+	Rows      int             `json:"rows"`
+	Points    int             `json:"points"`
+	Error     string          `json:"error,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Results   []adjustmentRow `json:"results"`
+}
+
+// appliedAdjustmentFile is the record of an applied file, by tenant and
+// file hash.
+type appliedAdjustmentFile struct {
+	ImportID string `json:"importId"`
+}
+
+// errAdjustmentFileApplied is returned from the import transaction when the
+// file was applied before.
+var errAdjustmentFileApplied = errors.New("adjustment file already applied")
+
+// importAdjustments serves POST /admin/adjustments with the CSV as the body
+// or as the "file" part of a multipart form.
+func importAdjustments(c *gin.Context) {
+	data, err := readAdjustmentFile(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read request body"})
+		return
+	}
+	rows, err := parseAdjustments(data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid adjustments CSV: " + err.Error()})
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	imp := &adjustmentImport{
+		ID:        uuid.New().String(),
+		Tenant:    tenantID(c),
+		DryRun:    c.Query("dryRun") == "true",
+		FileHash:  hex.EncodeToString(sum[:]),
+		Rows:      len(rows),
+		CreatedAt: clock.Now().UTC(),
+		Results:   rows,
+	}
+	ctx := c.Request.Context()
+	fileKey := imp.Tenant + "/" + imp.FileHash
+	var previous appliedAdjustmentFile
+	planned := false
+	err = store.Transact(ctx, func(tx storeTx) error {
+		if !imp.DryRun {
+			applied, err := getTxRecordJSON(tx, recordAdjustmentFiles, fileKey, &previous)
+			if err != nil {
+				return err
+			}
+			if applied {
+				return errAdjustmentFileApplied
+			}
+		}
+		if err := planAdjustments(tx, imp); err != nil {
+			return err
+		}
+		planned = true
+		if imp.Status != "valid" || imp.DryRun {
+			return nil
+		}
+		if err := applyAdjustments(tx, imp); err != nil {
+			return err
+		}
+		return putTxRecordJSON(tx, recordAdjustmentFiles, fileKey, appliedAdjustmentFile{ImportID: imp.ID})
+	})
+	switch {
+	case errors.Is(err, errAdjustmentFileApplied):
+		c.JSON(http.StatusConflict, gin.H{"error": "This file was already applied", "importId": previous.ImportID})
+		return
+	case err != nil && !planned:
+		storeFailure(c, err)
+		return
+	case err != nil:
+		imp.Status, imp.Error = "failed", err.Error()
+		for i := range imp.Results {
+			if imp.Results[i].Status == "applied" {
+				imp.Results[i].Status = "rolled_back"
+			}
+		}
+	case imp.Status == "valid" && !imp.DryRun:
+		imp.Status = "applied"
+	}
+	if err := putRecordJSON(ctx, recordAdjustments, imp.ID, imp); err != nil {
+		log.Printf("adjustments: saving the report of import %s: %v", imp.ID, err)
+	}
+
+	c.Header("Location", "/admin/adjustments/"+imp.ID)
+	status := http.StatusOK
+	switch imp.Status {
+	case "rejected":
+		status = http.StatusUnprocessableEntity
+	case "failed":
+		status = http.StatusInternalServerError
+	}
+	c.JSON(status, imp)
+}
+
+func readAdjustmentFile(c *gin.Context) ([]byte, error) {
+	body := io.Reader(c.Request.Body)
+	if c.ContentType() == "multipart/form-data" {
+		fh, err := c.FormFile("file")
+		if err != nil {
+			return nil, err
+		}
+		f, err := fh.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		body = f
+	}
+	return io.ReadAll(io.LimitReader(body, 16<<20))
+}
+
+func parseAdjustments(data []byte) ([]adjustmentRow, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("missing header row")
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	customerCol, ok1 := columns["customerId"]
+	pointsCol, ok2 := columns["points"]
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("header must have customerId and points columns")
+	}
+	reasonCol, hasReason := columns["reason"]
+
+	var rows []adjustmentRow
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == adjustmentMaxRows {
+			return nil, fmt.Errorf("more than %d rows", adjustmentMaxRows)
+		}
+		field := func(i int) string {
+			if i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		row := adjustmentRow{Line: line, CustomerID: field(customerCol), Status: "valid"}
+		if hasReason {
+			row.Reason = field(reasonCol)
+		}
+		points, err := strconv.Atoi(field(pointsCol))
+		switch {
+		case row.CustomerID == "":
+			row.Status, row.Error = "invalid", "customerId is required"
+		case err != nil || points == 0:
+			row.Status, row.Error = "invalid", "points must be a non-zero integer"
+		}
+		row.Points = points
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("no rows")
+	}
+	return rows, nil
+}
+
+// planAdjustments picks each row's receipt and checks that no balance goes
+// negative, marking the import rejected when any row is invalid.
+func planAdjustments(tx storeTx, imp *adjustmentImport) error {
+	customers := make(map[string]bool)
+	for _, row := range imp.Results {
+		customers[row.CustomerID] = true
+	}
+	receipts, err := tx.List(func(s *storedReceipt) bool {
+		return s.Tenant == imp.Tenant && s.Status == receiptAccepted && customers[s.Receipt.CustomerID]
+	})
+	if err != nil {
+		return err
+	}
+	balances := make(map[string]int)
+	latest := make(map[string]*storedReceipt)
+	for _, s := range receipts {
+		customer := s.Receipt.CustomerID
+		balances[customer] += s.netPoints()
+		if prev := latest[customer]; prev == nil || !s.AcceptedAt.Before(prev.AcceptedAt) {
+			latest[customer] = s
+		}
+	}
+
+	imp.Status = "valid"
+	for i := range imp.Results {
+		row := &imp.Results[i]
+		if row.Status == "invalid" {
+			imp.Status = "rejected"
+			continue
+		}
+		target := latest[row.CustomerID]
+		if target == nil {
+			row.Status, row.Error = "invalid", "customer has no accepted receipts"
+			imp.Status = "rejected"
+			continue
+		}
+		row.ReceiptID = target.ID
+		row.BalanceBefore = balances[row.CustomerID]
+		row.BalanceAfter = row.BalanceBefore + row.Points
+		if row.BalanceAfter < 0 {
+			row.Status, row.Error = "invalid", "adjustment would make the balance negative"
+			imp.Status = "rejected"
+			continue
+		}
+		balances[row.CustomerID] = row.BalanceAfter
+		imp.Points += row.Points
+	}
+	return nil
+}
+
+// applyAdjustments adds the planned entries within tx.
+func applyAdjustments(tx storeTx, imp *adjustmentImport) error {
+	for i := range imp.Results {
+		row := &imp.Results[i]
+		s, err := tx.Get(row.ReceiptID)
+		if err == nil {
+			entry := ledgerEntry{
+				ID:        uuid.New().String(),
+				Kind:      "adjustment",
+				Points:    row.Points,
+				Reason:    row.Reason,
+				CreatedAt: clock.Now().UTC(),
+			}
+			s.Ledger = append(s.Ledger, entry)
+			tx.Emit(pointsAdjustedEvents(s, entry)...)
+			err = tx.Put(s)
+		}
+		if err != nil {
+			row.Error = err.Error()
+			return fmt.Errorf("line %d: %w", row.Line, err)
+		}
+		row.Status = "applied"
+	}
+	return nil
+}
+
+func listAdjustmentImports(c *gin.Context) {
+	imports, err := listRecordsJSON[adjustmentImport](c.Request.Context(), recordAdjustments)
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	list := make([]adjustmentImport, 0, len(imports))
+	for _, imp := range imports {
+		imp.Results = nil
+		list = append(list, imp)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	c.JSON(http.StatusOK, gin.H{"imports": list})
+}
+
+// getAdjustmentImport serves GET /admin/adjustments/:id, as CSV for
+// download with ?format=csv.
+func getAdjustmentImport(c *gin.Context) {
+	var imp adjustmentImport
+	ok, err := getRecordJSON(c.Request.Context(), recordAdjustments, c.Param("id"), &imp)
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Adjustment import not found"})
+		return
+	}
+	if c.Query("format") != "csv" {
+		c.JSON(http.StatusOK, imp)
+		return
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"line", "customer_id", "points", "reason", "status", "receipt_id", "balance_before", "balance_after", "error"})
+	for _, row := range imp.Results {
+		w.Write([]string{
+			strconv.Itoa(row.Line), row.CustomerID, strconv.Itoa(row.Points), row.Reason, row.Status, row.ReceiptID,
+			strconv.Itoa(row.BalanceBefore), strconv.Itoa(row.BalanceAfter), row.Error,
+		})
+	}
+	w.Flush()
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="adjustments-%s.csv"`, imp.ID))
+	c.Data(http.StatusOK, "text/csv", buf.Bytes())
+}
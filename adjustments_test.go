@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAdjustmentFileAppliesOnce(t *testing.T) {
+	saved := store
+	defer func() { store = saved }()
+	store = newMemoryStore()
+
+	now := time.Now()
+	receipt := &storedReceipt{ID: receiptID(defaultTenant, testUUID(1)), Tenant: defaultTenant, Receipt: Receipt{CustomerID: "c1"}, Hash: "a", Status: receiptAccepted, Points: 10, CreatedAt: now, AcceptedAt: now}
+	if _, err := store.Create(context.Background(), receipt, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/admin/adjustments", importAdjustments)
+	upload := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/adjustments", strings.NewReader("customerId,points\nc1,5\n"))
+		req.Header.Set("Content-Type", "text/csv")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	if w := upload(); w.Code != http.StatusOK {
+		t.Fatalf("first import: %d %s", w.Code, w.Body)
+	}
+	// Nothing about the import is held in memory, so this stands for a
+	// retry after a restart or on another replica.
+	if w := upload(); w.Code != http.StatusConflict {
+		t.Fatalf("second import: %d %s", w.Code, w.Body)
+	}
+	stored, err := store.Get(context.Background(), receipt.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stored.netPoints(); got != 15 {
+		t.Errorf("points after importing the file twice = %d, want 15", got)
+	}
+}
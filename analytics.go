@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Analytics are maintained incrementally as receipts are ingested, keyed by
+// processing time in UTC, so queries never walk the receipt store.
+
+type seriesBucket struct {
+	Receipts int
+	Points   int64
+}
+
+const maxSeriesBuckets = 2000
+
+var (
+	analyticsMu  sync.RWMutex
+	hourlySeries = make(map[int64]*seriesBucket)
+	dailySeries  = make(map[int64]*seriesBucket)
+
+	errBadTimeParam = errors.New("invalid time parameter")
+)
+
+// recordIngest folds a newly stored receipt into every analytics rollup.
+func recordIngest(stored *storedReceipt) {
+	at := stored.CreatedAt.UTC()
+	analyticsMu.Lock()
+	defer analyticsMu.Unlock()
+
+	day := startOfDay(at).Unix()
+	addToSeries(hourlySeries, at.Truncate(time.Hour).Unix(), stored.Points)
+	addToSeries(dailySeries, day, stored.Points)
+	recordRetailerRollup(retailerDaily, day, stored)
+	recordItemRollup(day, stored)
+	recordRuleRollup(ruleDaily, day, stored)
+	recordGeoRollup(day, stored)
+	recordChannelRollup(day, stored)
+	recordPointsFrequency(stored.Points)
+	recordCohortActivity(stored)
+}
+
+func addToSeries(series map[int64]*seriesBucket, key int64, points int) {
+	bucket, ok := series[key]
+	if !ok {
+		bucket = &seriesBucket{}
+		series[key] = bucket
+	}
+	bucket.Receipts++
+	bucket.Points += int64(points)
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// getTimeSeries serves GET /analytics/timeseries.
+func getTimeSeries(c *gin.Context) {
+	metric := c.DefaultQuery("metric", "receipts")
+	if metric != "receipts" && metric != "points" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Metric must be receipts or points"})
+		return
+	}
+
+	var step time.Duration
+	var series map[int64]*seriesBucket
+	var defaultSpan time.Duration
+	switch c.DefaultQuery("interval", "hour") {
+	case "hour":
+		step, series, defaultSpan = time.Hour, hourlySeries, 24*time.Hour
+	case "day":
+		step, series, defaultSpan = 24*time.Hour, dailySeries, 30*24*time.Hour
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Interval must be hour or day"})
+		return
+	}
+
+	from, to, err := timeRange(c, defaultSpan)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid time range: use RFC 3339 timestamps or YYYY-MM-DD dates with from before to"})
+		return
+	}
+	if step == time.Hour {
+		from = from.Truncate(time.Hour)
+	} else {
+		from = startOfDay(from)
+	}
+	if to.Sub(from)/step > maxSeriesBuckets {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Requested range has too many buckets"})
+		return
+	}
+
+	type point struct {
+		Start      time.Time `json:"start"`
+		Value      int64     `json:"value"`
+		Suppressed bool      `json:"suppressed,omitempty"`
+	}
+	privacy := privacyFor(c)
+	interval := c.DefaultQuery("interval", "hour")
+	points := make([]point, 0)
+	analyticsMu.RLock()
+	for start := from; start.Before(to); start = start.Add(step) {
+		var receipts int
+		var total int64
+		if bucket, ok := series[start.Unix()]; ok {
+			receipts, total = bucket.Receipts, bucket.Points
+		}
+		figure := "timeseries/" + interval + "/" + strconv.FormatInt(start.Unix(), 10)
+		p := point{Start: start}
+		n, ok := privacy.count(figure, receipts)
+		switch {
+		case !ok:
+			p.Suppressed = true
+		case metric == "receipts":
+			p.Value = int64(n)
+		default:
+			p.Value = privacy.points(figure, total)
+		}
+		points = append(points, p)
+	}
+	analyticsMu.RUnlock()
+
+	resp := gin.H{
+		"metric":   metric,
+		"interval": interval,
+		"from":     from,
+		"to":       to,
+		"buckets":  points,
+	}
+	privacy.describe(resp)
+	c.JSON(http.StatusOK, resp)
+}
+
+// timeRange reads the from/to query parameters. A missing to means now; a
+// missing from means defaultSpan before to. Dates are taken as UTC midnight.
+func timeRange(c *gin.Context, defaultSpan time.Duration) (time.Time, time.Time, error) {
+	to := clock.Now().UTC()
+	if raw := c.Query("to"); raw != "" {
+		t, err := parseTimeParam(raw)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		to = t
+	}
+	from := to.Add(-defaultSpan)
+	if raw := c.Query("from"); raw != "" {
+		t, err := parseTimeParam(raw)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, errBadTimeParam
+	}
+	return from, to, nil
+}
+
+func parseTimeParam(raw string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t.UTC(), nil
+	}
+	if t, err := time.Parse("2006-01-02", raw); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errBadTimeParam
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// volumeDetector keeps an exponentially weighted baseline of receipts per
+// minute for every tenant and retailer and flags minutes that deviate from
+// it by more than the configured ratios.
+type volumeDetector struct {
+	mu        sync.Mutex
+	current   map[volumeKey]int
+	baselines map[volumeKey]*volumeBaseline
+	recent    []volumeAnomaly
+
+	alpha       float64
+	highRatio   float64
+	lowRatio    float64
+	minBaseline float64
+	warmup      int
+	webhookURL  string
+}
+
+type volumeKey struct {
+	Dimension string
+	Value     string
+}
+
+type volumeBaseline struct {
+	rate    float64
+	minutes int
+}
+
+type volumeAnomaly struct {
+	Dimension string    `json:"dimension"`
+	Value     string    `json:"value"`
+	Direction string    `json:"direction"`
+	Observed  int       `json:"observed"`
+	Baseline  float64   `json:"baseline"`
+	At        time.Time `json:"at"`
+}
+
+const recentAnomalyLimit = 100
+
+var volume = newVolumeDetectorFromEnv()
+
+// newVolumeDetectorFromEnv reads ANOMALY_ALPHA (baseline smoothing),
+// ANOMALY_HIGH_RATIO / ANOMALY_LOW_RATIO (alert when a minute exceeds
+// baseline*high or falls under baseline*low), ANOMALY_MIN_BASELINE (ignore
+// keys quieter than this many receipts per minute), ANOMALY_WARMUP_MINUTES
+// and ANOMALY_WEBHOOK_URL.
+func newVolumeDetectorFromEnv() *volumeDetector {
+	return &volumeDetector{
+		current:     make(map[volumeKey]int),
+		baselines:   make(map[volumeKey]*volumeBaseline),
+		alpha:       envFloat("ANOMALY_ALPHA", 0.1),
+		highRatio:   envFloat("ANOMALY_HIGH_RATIO", 3),
+		lowRatio:    envFloat("ANOMALY_LOW_RATIO", 0.2),
+		minBaseline: envFloat("ANOMALY_MIN_BASELINE", 5),
+		warmup:      envInt("ANOMALY_WARMUP_MINUTES", 30),
+		webhookURL:  os.Getenv("ANOMALY_WEBHOOK_URL"),
+	}
+}
+
+func (d *volumeDetector) record(stored *storedReceipt) {
+	d.mu.Lock()
+	d.current[volumeKey{"tenant", stored.Tenant}]++
+	d.current[volumeKey{"retailer", stored.Retailer}]++
+	d.mu.Unlock()
+}
+
+// evaluate closes the current minute: it compares each key's count with its
+// baseline, raises anomalies, and then folds the count into the baseline.
+func (d *volumeDetector) evaluate(now time.Time) {
+	d.mu.Lock()
+	counts := d.current
+	d.current = make(map[volumeKey]int)
+	for key := range counts {
+		if _, ok := d.baselines[key]; !ok {
+			d.baselines[key] = &volumeBaseline{}
+		}
+	}
+
+	var raised []volumeAnomaly
+	for key, baseline := range d.baselines {
+		observed := counts[key]
+		if baseline.minutes >= d.warmup && baseline.rate >= d.minBaseline {
+			direction := ""
+			switch {
+			case float64(observed) > baseline.rate*d.highRatio:
+				direction = "spike"
+			case float64(observed) < baseline.rate*d.lowRatio:
+				direction = "drop"
+			}
+			if direction != "" {
+				raised = append(raised, volumeAnomaly{
+					Dimension: key.Dimension,
+					Value:     key.Value,
+					Direction: direction,
+					Observed:  observed,
+					Baseline:  baseline.rate,
+					At:        now.UTC(),
+				})
+			}
+		}
+
+		if baseline.minutes == 0 {
+			baseline.rate = float64(observed)
+		} else {
+			baseline.rate += d.alpha * (float64(observed) - baseline.rate)
+		}
+		baseline.minutes++
+		if observed == 0 && baseline.rate < 0.01 {
+			delete(d.baselines, key)
+		}
+	}
+
+	d.recent = append(d.recent, raised...)
+	if len(d.recent) > recentAnomalyLimit {
+		d.recent = d.recent[len(d.recent)-recentAnomalyLimit:]
+	}
+	d.mu.Unlock()
+
+	for _, anomaly := range raised {
+		volumeAnomalies.WithLabelValues(anomaly.Dimension, anomaly.Direction).Inc()
+		log.Printf("volume %s for %s %q: %d receipts this minute against a baseline of %.1f",
+			anomaly.Direction, anomaly.Dimension, anomaly.Value, anomaly.Observed, anomaly.Baseline)
+		if d.webhookURL != "" {
+			d.notify(anomaly)
+		}
+	}
+}
+
+func (d *volumeDetector) notify(anomaly volumeAnomaly) {
+	body, err := json.Marshal(gin.H{"type": "volume.anomaly", "anomaly": anomaly})
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := postWebhook(ctx, d.webhookURL, "application/json", body); err != nil {
+		log.Printf("anomaly webhook: %v", err)
+	}
+}
+
+// getAnomalies serves GET /analytics/anomalies with the most recent alerts.
+func getAnomalies(c *gin.Context) {
+	volume.mu.Lock()
+	recent := append([]volumeAnomaly{}, volume.recent...)
+	volume.mu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"anomalies": recent})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Exporters with "anonymize": true in EXPORTERS_FILE deliver pseudonymized
+// datasets for analysis. This is pseudonymization, not anonymization: the
+// records still describe individual receipts, and whoever holds the key
+// can recompute a pseudonym from a known ID and so re-identify records.
+//
+// Receipt and customer IDs are replaced with pseudonyms, and item
+// descriptions, which are otherwise not exported, are included as hashes
+// with their prices. Pseudonyms and hashes are HMAC-SHA256 under
+// EXPORT_PSEUDONYM_KEY, so they are the same in every export and across
+// exporters: receipts per customer, repeat purchases of an item and joins
+// between datasets survive. Without the key a guess cannot be tested.
+// Customer pseudonyms are per tenant. Rotating the key breaks that linkage
+// with earlier exports.
+//
+// Values that could single out a receipt when matched against other data
+// are coarsened: the purchase date becomes its ISO week ("2022-W01"), the
+// purchase time its hour ("13:00"), the processing time its day, the total
+// a multiple of 10.00 and item prices whole units, each rounded down. The
+// raw retailer text, which can carry a store address, is dropped. The
+// normalized retailer, points, tags and costs are exported unchanged.
+
+var exportPseudonymKey = []byte(os.Getenv("EXPORT_PSEUDONYM_KEY"))
+
+// exportItem is an item of an anonymized export record.
+type exportItem struct {
+	Description string `json:"description"` // hash of the canonical description
+	Price       string `json:"price"`
+}
+
+func anonymizeRecords(records []exportRecord) []exportRecord {
+	out := make([]exportRecord, len(records))
+	for i, r := range records {
+		r.ID = "r_" + pseudonym("receipt", r.ID)
+		if r.CustomerID != "" {
+			r.CustomerID = "c_" + pseudonym("customer", r.Tenant+"/"+r.CustomerID)
+		}
+		r.RetailerRaw = ""
+		if date, err := time.Parse("2006-01-02", r.PurchaseDate); err == nil {
+			year, week := date.ISOWeek()
+			r.PurchaseDate = fmt.Sprintf("%d-W%02d", year, week)
+		}
+		if len(r.PurchaseTime) >= 2 {
+			r.PurchaseTime = r.PurchaseTime[:2] + ":00"
+		}
+		r.ProcessedAt = r.ProcessedAt.UTC().Truncate(24 * time.Hour)
+		r.Total = roundDownAmount(r.Total, 1000)
+		r.Items = make([]exportItem, len(r.items))
+		for j, item := range r.items {
+			r.Items[j] = exportItem{
+				Description: pseudonym("item", strings.ToLower(canonicalText(item.ShortDescription))),
+				Price:       roundDownAmount(item.Price, 100),
+			}
+		}
+		r.items = nil
+		r.anonymized = true
+		out[i] = r
+	}
+	return out
+}
+
+// roundDownAmount rounds an amount down to a multiple of step cents.
+func roundDownAmount(amount string, step int64) string {
+	cents, err := parseCents(amount)
+	if err != nil {
+		return ""
+	}
+	return formatCents(cents / step * step)
+}
+
+// pseudonym is the keyed hash of value within a namespace, so equal values
+// of different kinds do not share a pseudonym.
+func pseudonym(namespace, value string) string {
+	mac := hmac.New(sha256.New, exportPseudonymKey)
+	mac.Write([]byte(namespace + "|" + value))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// csvItems packs items into one CSV cell as description:price pairs.
+func csvItems(items []exportItem) string {
+	pairs := make([]string, len(items))
+	for i, item := range items {
+		pairs[i] = item.Description + ":" + item.Price
+	}
+	return strings.Join(pairs, ";")
+}
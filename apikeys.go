@@ -0,0 +1,458 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Integrations authenticate with API keys managed through the admin API:
+// POST /admin/api-keys {"tenant": "acme", "name": "pos", "expiresAt": "…"}
+// issues one, showing the key only in that response; GET /admin/api-keys
+// (?tenant=) lists them with when each was last used; POST
+// /admin/api-keys/:id/rotate issues a replacement, keeping the old key
+// working for an overlap window ({"overlap": "24h"}, by default
+// API_KEY_ROTATION_OVERLAP) so clients can switch over; and DELETE
+// /admin/api-keys/:id revokes a key at once.
+//
+// A request whose X-API-Key is a managed key ("rpk_…") acts for the key's
+// tenant whatever its X-Tenant-ID says; one whose managed key is unknown,
+// expired or revoked is refused. With API_KEYS_REQUIRED=true, every request
+// outside the admin API and UI, metrics and the published documents must
+// present a valid managed key. Other keys, such as sandbox keys, are
+// unaffected.
+//
+// Keys are kept as SHA-256 hashes in the store, and each replica reloads
+// them every API_KEYS_REFRESH, so a key issued or revoked on one is honoured
+// by the others within that time. Last use is recorded in memory and
+// written back every minute. Every change is logged and appended to the
+// key's audit trail with the address it came from, and emitted as an
+// api_key.changed event; see events.go.
+
+const (
+	apiKeyPrefix    = "rpk_"
+	apiKeyTenantKey = "apiKeyTenant"
+	apiKeyOwnerKey  = "apiKeyOwner"
+
+	apiKeyActive   = "active"
+	apiKeyRotating = "rotating"
+	apiKeyExpired  = "expired"
+	apiKeyRevoked  = "revoked"
+)
+
+var (
+	apiKeysRequired       = os.Getenv("API_KEYS_REQUIRED") == "true"
+	apiKeyRotationOverlap = envDuration("API_KEY_ROTATION_OVERLAP", 24*time.Hour)
+	apiKeysRefresh        = envDuration("API_KEYS_REFRESH", 30*time.Second)
+
+	// apiKeyExemptPaths need no API key, having their own credentials or
+	// none.
+	apiKeyExemptPaths = []string{"/admin", "/ui", "/metrics", "/capabilities", "/openapi.yaml", "/events/schemas", "/.well-known/"}
+)
+
+type apiKeyAuditEntry struct {
+	Action string    `json:"action"`
+	At     time.Time `json:"at"`
+	From   string    `json:"from,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+type apiKey struct {
+	ID         string     `json:"id"`
+	Tenant     string     `json:"tenant"`
+	Name       string     `json:"name,omitempty"`
+	Hash       string     `json:"hash"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	// ReplacedBy is the key issued when this one was rotated.
+	ReplacedBy  string `json:"replacedBy,omitempty"`
+	RotatedFrom string `json:"rotatedFrom,omitempty"`
+	// Lineage is the ID of the first key in the rotation chain.
+	Lineage string             `json:"lineage,omitempty"`
+	Audit   []apiKeyAuditEntry `json:"audit"`
+}
+
+// owner identifies the key across rotations, for what it creates, such
+// as webhook subscriptions.
+func (k *apiKey) owner() string { return cmp.Or(k.Lineage, k.ID) }
+
+func (k *apiKey) status(now time.Time) string {
+	switch {
+	case k.RevokedAt != nil:
+		return apiKeyRevoked
+	case k.ExpiresAt != nil && !now.Before(*k.ExpiresAt):
+		return apiKeyExpired
+	case k.ReplacedBy != "":
+		return apiKeyRotating
+	}
+	return apiKeyActive
+}
+
+func (k *apiKey) usable(now time.Time) bool {
+	status := k.status(now)
+	return status == apiKeyActive || status == apiKeyRotating
+}
+
+// apiKeyView is a key as the admin API shows it, without its hash and with
+// the key itself only when it has just been issued.
+type apiKeyView struct {
+	apiKey
+	Hash   string `json:"hash,omitempty"`
+	Status string `json:"status"`
+	APIKey string `json:"apiKey,omitempty"`
+}
+
+func (k *apiKey) view(now time.Time) apiKeyView {
+	return apiKeyView{apiKey: *k, Status: k.status(now)}
+}
+
+func (k *apiKey) audit(c *gin.Context, action, detail string, at time.Time) {
+	k.Audit = append(k.Audit, apiKeyAuditEntry{Action: action, At: at, From: c.ClientIP(), Detail: detail})
+	if detail != "" {
+		detail = ": " + detail
+	}
+	log.Printf("api keys: %s key %s for tenant %s from %s%s", action, k.ID, k.Tenant, c.ClientIP(), detail)
+}
+
+var apiKeys = struct {
+	sync.Mutex
+	byID map[string]*apiKey
+	// used holds the keys whose LastUsedAt has not been saved yet.
+	used map[string]bool
+	// saves counts the changes saved here, so a reload that overlaps one
+	// does not undo it.
+	saves int
+}{byID: make(map[string]*apiKey), used: make(map[string]bool)}
+
+// loadStoredAPIKeys replaces the registry with the keys in the store,
+// keeping last-use times recorded here and not yet saved.
+func loadStoredAPIKeys(ctx context.Context) error {
+	apiKeys.Lock()
+	saves := apiKeys.saves
+	apiKeys.Unlock()
+	records, err := listRecordsJSON[apiKey](ctx, recordAPIKeys)
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]*apiKey, len(records))
+	for id, k := range records {
+		byID[id] = &k
+	}
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+	if apiKeys.saves != saves {
+		return nil // the next refresh sees the change
+	}
+	for id := range apiKeys.used {
+		if k, ok := byID[id]; ok {
+			k.LastUsedAt = laterTime(k.LastUsedAt, apiKeys.byID[id].LastUsedAt)
+		}
+	}
+	apiKeys.byID = byID
+	return nil
+}
+
+func refreshAPIKeys(time.Time) {
+	if err := loadStoredAPIKeys(context.Background()); err != nil {
+		log.Printf("refreshing api keys: %v", err)
+	}
+}
+
+func laterTime(a, b *time.Time) *time.Time {
+	if a == nil || (b != nil && b.After(*a)) {
+		return b
+	}
+	return a
+}
+
+func apiKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKey returns a key record for tenant and the key itself.
+func newAPIKey(tenant, name string, now time.Time, expires *time.Time) (*apiKey, string) {
+	id := make([]byte, 8)
+	secret := make([]byte, 24)
+	rand.Read(id)
+	rand.Read(secret)
+	k := &apiKey{
+		ID:        hex.EncodeToString(id),
+		Tenant:    tenant,
+		Name:      name,
+		CreatedAt: now,
+		ExpiresAt: expires,
+	}
+	key := apiKeyPrefix + k.ID + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	k.Hash = apiKeyHash(key)
+	return k, key
+}
+
+// lookupAPIKey returns the usable key record for key.
+func lookupAPIKey(key string, now time.Time) (*apiKey, bool) {
+	rest, _ := strings.CutPrefix(key, apiKeyPrefix)
+	id, _, ok := strings.Cut(rest, "_")
+	if !ok {
+		return nil, false
+	}
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+	k, ok := apiKeys.byID[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(k.Hash), []byte(apiKeyHash(key))) != 1 || !k.usable(now) {
+		return nil, false
+	}
+	used := now.UTC()
+	k.LastUsedAt = &used
+	apiKeys.used[id] = true
+	return k, true
+}
+
+func apiKeyExempt(path string) bool {
+	for _, prefix := range apiKeyExemptPaths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateAPIKey is middleware binding a request with a managed key to
+// the key's tenant, and refusing one whose key is not usable, or, with
+// API_KEYS_REQUIRED, one without a key.
+func authenticateAPIKey(c *gin.Context) {
+	key := strings.TrimSpace(c.GetHeader("X-API-Key"))
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		if apiKeysRequired && !strings.HasPrefix(key, sandboxKeyPrefix) && !apiKeyExempt(c.Request.URL.Path) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "An API key is required"})
+			return
+		}
+		c.Next()
+		return
+	}
+	k, ok := lookupAPIKey(key, clock.Now())
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid, expired or revoked API key"})
+		return
+	}
+	c.Set(apiKeyTenantKey, k.Tenant)
+	c.Set(apiKeyOwnerKey, k.owner())
+	c.Next()
+}
+
+// flushAPIKeyUsage saves the last-used times recorded since the last run.
+// Only LastUsedAt is written, so changes made on other replicas stand.
+func flushAPIKeyUsage(time.Time) {
+	apiKeys.Lock()
+	used := make(map[string]*time.Time, len(apiKeys.used))
+	for id := range apiKeys.used {
+		if k, ok := apiKeys.byID[id]; ok {
+			used[id] = k.LastUsedAt
+		}
+	}
+	apiKeys.used = make(map[string]bool)
+	apiKeys.Unlock()
+	if len(used) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err := store.Transact(ctx, func(tx storeTx) error {
+		for id, at := range used {
+			var k apiKey
+			ok, err := getTxRecordJSON(tx, recordAPIKeys, id, &k)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			k.LastUsedAt = laterTime(k.LastUsedAt, at)
+			if err := putTxRecordJSON(tx, recordAPIKeys, id, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("api keys: saving last use: %v", err)
+	}
+}
+
+// saveAPIKeysLocked saves changed keys in one transaction, putting the
+// previous versions back if that fails. apiKeys must be locked.
+func saveAPIKeysLocked(ctx context.Context, previous map[string]*apiKey, keys ...*apiKey) error {
+	err := store.Transact(ctx, func(tx storeTx) error {
+		for _, k := range keys {
+			if err := putTxRecordJSON(tx, recordAPIKeys, k.ID, k); err != nil {
+				return err
+			}
+			tx.Emit(apiKeyEvents(k, previous[k.ID])...)
+		}
+		return nil
+	})
+	apiKeys.saves++
+	if err != nil {
+		for _, k := range keys {
+			if old, ok := previous[k.ID]; ok {
+				apiKeys.byID[k.ID] = old
+			} else {
+				delete(apiKeys.byID, k.ID)
+			}
+		}
+		log.Printf("api keys: saving: %v", err)
+		return err
+	}
+	return nil
+}
+
+func createAPIKey(c *gin.Context) {
+	var req struct {
+		Tenant    string     `json:"tenant"`
+		Name      string     `json:"name"`
+		ExpiresAt *time.Time `json:"expiresAt"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+	if !tenantPattern.MatchString(req.Tenant) || isSandboxTenant(req.Tenant) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Tenant must be a valid tenant ID outside the sandbox"})
+		return
+	}
+	now := clock.Now().UTC()
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(now) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expiresAt must be in the future"})
+		return
+	}
+	k, key := newAPIKey(req.Tenant, strings.TrimSpace(req.Name), now, req.ExpiresAt)
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+	k.audit(c, "created", "", now)
+	apiKeys.byID[k.ID] = k
+	if err := saveAPIKeysLocked(c.Request.Context(), nil, k); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Could not save the API key"})
+		return
+	}
+	view := k.view(now)
+	view.APIKey = key
+	c.JSON(http.StatusCreated, view)
+}
+
+func listAPIKeys(c *gin.Context) {
+	tenant := c.Query("tenant")
+	now := clock.Now()
+	apiKeys.Lock()
+	list := make([]apiKeyView, 0, len(apiKeys.byID))
+	keys := make([]*apiKey, 0, len(apiKeys.byID))
+	for _, k := range apiKeys.byID {
+		if tenant == "" || k.Tenant == tenant {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	for _, k := range keys {
+		list = append(list, k.view(now))
+	}
+	apiKeys.Unlock()
+	c.JSON(http.StatusOK, gin.H{"keys": list})
+}
+
+func rotateAPIKey(c *gin.Context) {
+	var req struct {
+		Overlap string `json:"overlap"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+			return
+		}
+	}
+	overlap := apiKeyRotationOverlap
+	if req.Overlap != "" {
+		d, err := time.ParseDuration(req.Overlap)
+		if err != nil || d < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Overlap must be a duration such as 24h"})
+			return
+		}
+		overlap = d
+	}
+	now := clock.Now().UTC()
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+	old, ok := apiKeys.byID[c.Param("id")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	if old.status(now) != apiKeyActive {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only an active API key can be rotated"})
+		return
+	}
+	// The replacement keeps the old key's lifetime.
+	var expires *time.Time
+	if old.ExpiresAt != nil {
+		at := now.Add(old.ExpiresAt.Sub(old.CreatedAt))
+		expires = &at
+	}
+	k, key := newAPIKey(old.Tenant, old.Name, now, expires)
+	k.RotatedFrom = old.ID
+	k.Lineage = old.owner()
+	k.audit(c, "created", "rotated from "+old.ID, now)
+
+	rotated := *old
+	rotated.Audit = append([]apiKeyAuditEntry(nil), old.Audit...)
+	rotated.ReplacedBy = k.ID
+	ends := now.Add(overlap)
+	if rotated.ExpiresAt == nil || ends.Before(*rotated.ExpiresAt) {
+		rotated.ExpiresAt = &ends
+	}
+	rotated.audit(c, "rotated", "replaced by "+k.ID+", usable until "+rotated.ExpiresAt.Format(time.RFC3339), now)
+	apiKeys.byID[old.ID], apiKeys.byID[k.ID] = &rotated, k
+	if err := saveAPIKeysLocked(c.Request.Context(), map[string]*apiKey{old.ID: old}, &rotated, k); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Could not save the API key"})
+		return
+	}
+	view := k.view(now)
+	view.APIKey = key
+	c.JSON(http.StatusCreated, gin.H{"key": view, "previous": rotated.view(now)})
+}
+
+func revokeAPIKey(c *gin.Context) {
+	now := clock.Now().UTC()
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+	old, ok := apiKeys.byID[c.Param("id")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	if old.RevokedAt != nil {
+		c.JSON(http.StatusOK, old.view(now))
+		return
+	}
+	revoked := *old
+	revoked.Audit = append([]apiKeyAuditEntry(nil), old.Audit...)
+	revoked.RevokedAt = &now
+	revoked.audit(c, "revoked", "", now)
+	apiKeys.byID[old.ID] = &revoked
+	if err := saveAPIKeysLocked(c.Request.Context(), map[string]*apiKey{old.ID: old}, &revoked); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Could not save the API key"})
+		return
+	}
+	c.JSON(http.StatusOK, revoked.view(now))
+}
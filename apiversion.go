@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	apiVersion1 = 1
+	apiVersion2 = 2
+)
+
+// apiVersion reports which API version a client asked for, via the
+// API-Version header or an Accept media type of the form
+// application/vnd.receipts.v2+json. Clients that say nothing get version 1,
+// the original behaviour.
+func apiVersion(c *gin.Context) int {
+	if raw := strings.TrimSpace(c.GetHeader("API-Version")); raw != "" {
+		if v, err := strconv.Atoi(strings.TrimPrefix(raw, "v")); err == nil && v >= apiVersion1 {
+			return v
+		}
+	}
+	for _, accept := range strings.Split(c.GetHeader("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(strings.TrimSpace(accept), ";")
+		rest, ok := strings.CutPrefix(mediaType, "application/vnd.receipts.v")
+		if !ok {
+			continue
+		}
+		if v, err := strconv.Atoi(strings.TrimSuffix(rest, "+json")); err == nil && v >= apiVersion1 {
+			return v
+		}
+	}
+	return apiVersion1
+}
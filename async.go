@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Asynchronous submissions are queued and processed by a pool of
+// ASYNC_WORKERS workers. Each submission declares a priority: interactive
+// (the default) or bulk. Workers always take an interactive receipt when
+// one is waiting, so bulk backfills only use capacity live traffic leaves
+// idle. Each priority queue holds at most ASYNC_QUEUE_LIMIT receipts.
+//
+// The receipt ID is assigned when the job is queued, so clients can go
+// straight to GET /receipts/:id/points?wait=30s and have it block until the
+// worker is done instead of polling the job.
+//
+// Jobs live in a jobBackend (see jobqueue.go). A job that fails for a
+// reason worth retrying, such as the store being unavailable, is queued
+// again after a backoff that doubles from ASYNC_RETRY_BACKOFF; after
+// ASYNC_MAX_ATTEMPTS attempts it is "dead", the dead letter state, and
+// waits for an operator: GET /admin/jobs lists jobs by status and POST
+// /admin/jobs/:id/retry queues a failed or dead job again. Receipts the
+// service refuses fail at once.
+
+const (
+	priorityInteractive = "interactive"
+	priorityBulk        = "bulk"
+
+	asyncQueued     = "queued"
+	asyncProcessing = "processing"
+	asyncDone       = "done"
+	asyncFailed     = "failed"
+	asyncDead       = "dead"
+)
+
+var asyncStatuses = []string{asyncQueued, asyncProcessing, asyncDone, asyncFailed, asyncDead}
+
+var errQueueFull = errors.New("async queue is full")
+
+var asyncQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "receipt_async_queue_depth",
+	Help: "Asynchronous submissions waiting for a worker, by priority.",
+}, []string{"priority"})
+
+var asyncDeadLetters = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "receipt_async_dead_letters_total",
+	Help: "Asynchronous submissions given up on after ASYNC_MAX_ATTEMPTS attempts.",
+})
+
+type asyncJob struct {
+	ID            string     `json:"id"`
+	ReceiptID     string     `json:"receiptId"`
+	Priority      string     `json:"priority"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	Result        gin.H      `json:"result,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	EnqueuedAt    time.Time  `json:"enqueuedAt"`
+	NextAttemptAt *time.Time `json:"nextAttemptAt,omitempty"`
+	FinishedAt    *time.Time `json:"finishedAt,omitempty"`
+}
+
+type asyncQueue struct {
+	backend jobBackend
+	limit   int
+	wake    chan struct{}
+
+	mu sync.Mutex
+	// waiters are closed when the job with their ID finishes.
+	waiters map[string][]chan struct{}
+}
+
+var (
+	asyncWorkers     = envInt("ASYNC_WORKERS", 4)
+	asyncRetain      = envInt("ASYNC_RETAIN_JOBS", 10000)
+	asyncVisibility  = envDuration("ASYNC_VISIBILITY_TIMEOUT", 2*time.Minute)
+	asyncMaxAttempts = envInt("ASYNC_MAX_ATTEMPTS", 5)
+	asyncBackoff     = envDuration("ASYNC_RETRY_BACKOFF", time.Second)
+	asyncPoll        = envDuration("ASYNC_POLL_INTERVAL", time.Second)
+	async            = newAsyncQueue(newMemoryJobs(), envInt("ASYNC_QUEUE_LIMIT", 10000))
+)
+
+func newAsyncQueue(backend jobBackend, limit int) *asyncQueue {
+	return &asyncQueue{
+		backend: backend,
+		limit:   limit,
+		wake:    make(chan struct{}, 1),
+		waiters: make(map[string][]chan struct{}),
+	}
+}
+
+// start launches the workers; they exit when ctx is done.
+func (q *asyncQueue) start(ctx context.Context, workers int) {
+	q.observeDepth()
+	for range workers {
+		go q.work(ctx)
+	}
+}
+
+func (q *asyncQueue) enqueue(ctx context.Context, tenant, priority, channel string, receipt Receipt) (asyncJob, error) {
+	now := clock.Now().UTC()
+	job := &storedJob{
+		asyncJob: asyncJob{
+			ID:         uuid.New().String(),
+			ReceiptID:  receiptID(tenant, uuid.New()),
+			Priority:   priority,
+			Status:     asyncQueued,
+			EnqueuedAt: now,
+		},
+		Tenant:    tenant,
+		Channel:   channel,
+		Receipt:   receipt,
+		VisibleAt: now,
+		TraceID:   traceID(ctx),
+	}
+	if err := q.backend.add(job, q.limit); err != nil {
+		return asyncJob{}, err
+	}
+	q.observeDepth()
+	q.signal()
+	return job.asyncJob, nil
+}
+
+func (q *asyncQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *asyncQueue) observeDepth() {
+	for _, priority := range []string{priorityInteractive, priorityBulk} {
+		asyncQueueDepth.WithLabelValues(priority).Set(float64(q.backend.queued(priority)))
+	}
+}
+
+func (q *asyncQueue) work(ctx context.Context) {
+	for {
+		job, err := q.backend.claim(clock.Now().UTC(), asyncVisibility)
+		if err != nil {
+			log.Printf("async queue: claiming a job: %v", err)
+		}
+		if job == nil {
+			select {
+			case <-q.wake:
+			case <-time.After(asyncPoll):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		q.observeDepth()
+		q.process(ctx, job)
+	}
+}
+
+func (q *asyncQueue) process(ctx context.Context, job *storedJob) {
+	// An earlier attempt may have stored the receipt and then lost its
+	// lease, e.g. to a restart.
+	if stored, err := store.Get(ctx, job.ReceiptID); err == nil {
+		q.finish(job, asyncDone, jobResult(&submissionResult{stored: stored}), "")
+		return
+	}
+
+	jobCtx, cancel := context.WithTimeout(withTraceID(ctx, job.TraceID), routeTimeouts["/receipts/process"])
+	result, err := submitReceipt(jobCtx, submission{id: job.ReceiptID, tenant: job.Tenant, receipt: job.Receipt, channel: job.Channel})
+	cancel()
+	var refused *submissionError
+	switch {
+	case err == nil:
+		q.finish(job, asyncDone, jobResult(result), "")
+	case ctx.Err() != nil:
+		// Shutting down: hand the job back without counting the attempt.
+		job.Status, job.Attempts, job.VisibleAt = asyncQueued, job.Attempts-1, clock.Now().UTC()
+		q.save(job)
+	case errors.As(err, &refused):
+		q.finish(job, asyncFailed, nil, err.Error())
+	case job.Attempts >= asyncMaxAttempts:
+		asyncDeadLetters.Inc()
+		q.finish(job, asyncDead, nil, err.Error())
+	default:
+		next := clock.Now().UTC().Add(asyncBackoff << min(job.Attempts-1, 16))
+		job.Status, job.Error, job.VisibleAt, job.NextAttemptAt = asyncQueued, err.Error(), next, &next
+		q.save(job)
+	}
+}
+
+func jobResult(result *submissionResult) gin.H {
+	resp := result.response()
+	resp["status"] = result.stored.Status
+	resp["points"] = result.stored.Points
+	return resp
+}
+
+func (q *asyncQueue) save(job *storedJob) {
+	if err := q.backend.save(job); err != nil {
+		log.Printf("async queue: saving job %s: %v", job.ID, err)
+	}
+	q.observeDepth()
+}
+
+func (q *asyncQueue) finish(job *storedJob, status string, result gin.H, errMsg string) {
+	at := clock.Now().UTC()
+	job.Status, job.Result, job.Error, job.FinishedAt, job.NextAttemptAt = status, result, errMsg, &at, nil
+	q.mu.Lock()
+	q.save(job)
+	for _, waiter := range q.waiters[job.ID] {
+		close(waiter)
+	}
+	delete(q.waiters, job.ID)
+	q.mu.Unlock()
+	if err := q.backend.prune(asyncRetain); err != nil {
+		log.Printf("async queue: pruning finished jobs: %v", err)
+	}
+}
+
+// get returns the job with id if tenant enqueued it. Other tenants' jobs
+// are reported as missing, like their receipts.
+func (q *asyncQueue) get(id, tenant string) (asyncJob, bool) {
+	job, err := q.backend.get(id)
+	if err != nil || job.Tenant != tenant {
+		return asyncJob{}, false
+	}
+	return job.asyncJob, true
+}
+
+// waitForReceipt blocks until the job storing receiptID finishes or ctx is
+// done, and returns the job as it then stands. ok is false when no job
+// stores that receipt.
+func (q *asyncQueue) waitForReceipt(ctx context.Context, receiptID string) (job asyncJob, ok bool) {
+	q.mu.Lock()
+	pending, err := q.backend.byReceipt(receiptID)
+	if err != nil {
+		q.mu.Unlock()
+		return asyncJob{}, false
+	}
+	if !pending.active() {
+		q.mu.Unlock()
+		return pending.asyncJob, true
+	}
+	done := make(chan struct{})
+	q.waiters[pending.ID] = append(q.waiters[pending.ID], done)
+	q.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		q.mu.Lock()
+		waiters := q.waiters[pending.ID]
+		for i, waiter := range waiters {
+			if waiter == done {
+				q.waiters[pending.ID] = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(q.waiters[pending.ID]) == 0 {
+			delete(q.waiters, pending.ID)
+		}
+		q.mu.Unlock()
+	}
+	if current, err := q.backend.get(pending.ID); err == nil {
+		return current.asyncJob, true
+	}
+	return pending.asyncJob, true
+}
+
+// processReceiptAsync serves POST /receipts/process/async. The priority
+// comes from the priority query parameter or the X-Receipt-Priority header.
+// The receipt is validated before it is queued; scoring and storage happen
+// on a worker, and GET /receipts/jobs/:id reports the outcome.
+func processReceiptAsync(c *gin.Context) {
+	priority := c.Query("priority")
+	if priority == "" {
+		priority = c.GetHeader("X-Receipt-Priority")
+	}
+	if priority == "" {
+		priority = priorityInteractive
+	}
+	if priority != priorityInteractive && priority != priorityBulk {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Priority must be interactive or bulk"})
+		return
+	}
+	receipt, err := decodeReceipt(c.Request.Body)
+	if err != nil {
+		recordDecodeQuality(tenantID(c), err)
+	}
+	if errors.Is(err, errUnsupportedSchema) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported schemaVersion"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+
+	channel, ok := submissionChannel(c, channelAPI)
+	if !ok {
+		return
+	}
+	// Validate what the worker will: the receipt after total correction.
+	checked := receipt
+	if _, err := correctTotal(c.Request.Context(), &checked); err != nil {
+		submissionFailure(c, err)
+		return
+	}
+	if errs := validateReceipt(checked); errs != nil {
+		recordSubmissionQuality(tenantID(c), errs)
+		submissionFailure(c, invalidReceipt(errs))
+		return
+	}
+	job, err := async.enqueue(c.Request.Context(), tenantID(c), priority, channel, receipt)
+	if err != nil {
+		c.Header("Retry-After", "5")
+		errorResponse(c, http.StatusServiceUnavailable, "queue_full", "Async queue is full")
+		return
+	}
+	c.Header("Location", "/receipts/jobs/"+job.ID)
+	c.JSON(http.StatusAccepted, job)
+}
+
+func getAsyncJob(c *gin.Context) {
+	job, ok := async.get(c.Param("id"), tenantID(c))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// listJobs serves GET /admin/jobs: up to ?limit= (100) jobs, newest first,
+// optionally only those with ?status=, including their receipts.
+func listJobs(c *gin.Context) {
+	status := c.Query("status")
+	if status != "" && !slices.Contains(asyncStatuses, status) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown job status", "statuses": asyncStatuses})
+		return
+	}
+	limit := 100
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 1000 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Limit must be between 1 and 1000"})
+			return
+		}
+		limit = n
+	}
+	jobs, err := async.backend.list(status, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not list jobs"})
+		return
+	}
+	counts := gin.H{}
+	for _, priority := range []string{priorityInteractive, priorityBulk} {
+		counts[priority] = async.backend.queued(priority)
+	}
+	c.JSON(http.StatusOK, gin.H{"jobs": jobs, "queued": counts})
+}
+
+// retryJob serves POST /admin/jobs/:id/retry, queueing a failed or dead
+// job again with a fresh set of attempts.
+func retryJob(c *gin.Context) {
+	job, err := async.backend.get(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	if job.Status != asyncFailed && job.Status != asyncDead {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only failed or dead jobs can be retried", "status": job.Status})
+		return
+	}
+	job.Status, job.Attempts, job.Error, job.Result, job.FinishedAt = asyncQueued, 0, "", nil, nil
+	job.VisibleAt = clock.Now().UTC()
+	async.save(job)
+	async.signal()
+	c.JSON(http.StatusOK, job.asyncJob)
+}
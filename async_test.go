@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAsyncSubmissionValidatedBeforeQueueing(t *testing.T) {
+	saved := async
+	defer func() { async = saved }()
+	async = newAsyncQueue(newMemoryJobs(), 10)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/receipts/process/async", processReceiptAsync)
+	submit := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/receipts/process/async", strings.NewReader(body)))
+		return w
+	}
+
+	invalid := `{"retailer": "", "purchaseDate": "2022-01-01", "purchaseTime": "13:01", "items": [], "total": "x"}`
+	if w := submit(invalid); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_receipt") {
+		t.Errorf("invalid receipt: %d %s", w.Code, w.Body)
+	}
+	if n := async.backend.queued(priorityInteractive); n != 0 {
+		t.Errorf("invalid receipt queued %d jobs", n)
+	}
+
+	valid := `{"retailer": "Target", "purchaseDate": "2022-01-01", "purchaseTime": "13:01",
+		"items": [{"shortDescription": "Pizza", "price": "6.49", "quantity": 1}], "total": "6.49"}`
+	if w := submit(valid); w.Code != http.StatusAccepted {
+		t.Errorf("valid receipt: %d %s", w.Code, w.Body)
+	}
+	if n := async.backend.queued(priorityInteractive); n != 1 {
+		t.Errorf("valid receipt queued %d jobs", n)
+	}
+}
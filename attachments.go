@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	attachments   blobStore
+	maxImageBytes = int64(envInt("IMAGE_MAX_BYTES", 10<<20))
+	// maxMultipartBytes bounds a whole multipart submission: the image and
+	// room for the receipt.
+	maxMultipartBytes = maxImageBytes + 1<<20
+
+	allowedImageTypes = map[string]bool{
+		"image/jpeg": true,
+		"image/png":  true,
+		"image/gif":  true,
+		"image/webp": true,
+	}
+
+	errImageTooLarge   = errors.New("image too large")
+	errImageType       = errors.New("unsupported image type")
+	errMissingReceipt  = errors.New("missing receipt part")
+	errMultipartFormat = errors.New("malformed multipart body")
+)
+
+// requireUploadKey refuses image uploads from callers without a managed or
+// sandbox API key: decoding and stripping images is the most expensive work
+// the service does, so anonymous callers only get plain JSON submissions.
+func requireUploadKey(c *gin.Context) bool {
+	if c.GetString(apiKeyTenantKey) != "" || c.GetString(sandboxTenantKey) != "" || adminCredentials(c) {
+		return true
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "An API key is required for image uploads"})
+	return false
+}
+
+// readSubmission splits a process request into the receipt JSON and an
+// optional image. Plain JSON bodies carry no image; multipart bodies carry
+// the receipt in a "receipt" field or file part and the image in "image".
+func readSubmission(c *gin.Context) (io.Reader, *blob, error) {
+	if c.ContentType() != "multipart/form-data" {
+		return c.Request.Body, nil, nil
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxMultipartBytes)
+	if err := c.Request.ParseMultipartForm(maxMultipartBytes); err != nil {
+		if errors.As(err, new(*http.MaxBytesError)) {
+			return nil, nil, errImageTooLarge
+		}
+		return nil, nil, errMultipartFormat
+	}
+
+	var receipt io.Reader
+	if value := c.Request.FormValue("receipt"); value != "" {
+		receipt = strings.NewReader(value)
+	} else if fh, err := c.FormFile("receipt"); err == nil {
+		f, err := fh.Open()
+		if err != nil {
+			return nil, nil, errMultipartFormat
+		}
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return nil, nil, errMultipartFormat
+		}
+		receipt = bytes.NewReader(data)
+	} else {
+		return nil, nil, errMissingReceipt
+	}
+
+	fh, err := c.FormFile("image")
+	if errors.Is(err, http.ErrMissingFile) {
+		return receipt, nil, nil
+	}
+	if err != nil {
+		return nil, nil, errMultipartFormat
+	}
+	image, err := readImageFile(fh)
+	if err != nil {
+		return nil, nil, err
+	}
+	return receipt, &image, nil
+}
+
+func readImageFile(fh *multipart.FileHeader) (blob, error) {
+	if fh.Size > maxImageBytes {
+		return blob{}, errImageTooLarge
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return blob{}, errMultipartFormat
+	}
+	defer f.Close()
+	return readImage(f)
+}
+
+func readImage(r io.Reader) (blob, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxImageBytes+1))
+	if err != nil {
+		return blob{}, errMultipartFormat
+	}
+	if int64(len(data)) > maxImageBytes {
+		return blob{}, errImageTooLarge
+	}
+	contentType := http.DetectContentType(data)
+	if !allowedImageTypes[contentType] {
+		return blob{}, errImageType
+	}
+	img := blob{ContentType: contentType, Data: data}
+	if err := checkImageDimensions(img); err != nil {
+		return blob{}, err
+	}
+	return cleanImage(img)
+}
+
+func imageErrorResponse(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errImageTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Image exceeds the size limit"})
+	case errors.Is(err, errImageType):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Image must be JPEG, PNG, GIF or WebP"})
+	case errors.Is(err, errImageUnreadable):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Image could not be read"})
+	case errors.Is(err, errMissingReceipt):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Multipart body must include a receipt part"})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid multipart body"})
+	}
+}
+
+// uploadImage attaches an image to an already processed receipt. The body
+// is either multipart with an "image" file or the raw image bytes.
+func uploadImage(c *gin.Context) {
+	if !requireUploadKey(c) {
+		return
+	}
+	id := c.Param("id")
+	if _, err := store.Get(c.Request.Context(), id); err != nil {
+		storeFailure(c, err)
+		return
+	}
+
+	done := beginStage(c.Request.Context(), stageUpload)
+	var image blob
+	var thumbnail bool
+	var err error
+	if c.ContentType() == "multipart/form-data" {
+		var fh *multipart.FileHeader
+		if fh, err = c.FormFile("image"); err == nil {
+			image, err = readImageFile(fh)
+		} else {
+			err = errMultipartFormat
+		}
+	} else {
+		image, err = readImage(c.Request.Body)
+	}
+	if err == nil {
+		thumbnail, err = storeImage(c.Request.Context(), id, image)
+		if err != nil {
+			done(err)
+			if requestExpired(c, err) {
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not store image"})
+			return
+		}
+	}
+	done(err)
+	if err != nil {
+		imageErrorResponse(c, err)
+		return
+	}
+
+	if _, err := store.Update(c.Request.Context(), id, func(stored *storedReceipt) {
+		stored.HasImage, stored.HasThumbnail = true, thumbnail
+	}); err != nil {
+		storeFailure(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": id, "contentType": image.ContentType, "size": len(image.Data)})
+}
+
+func getImage(c *gin.Context) {
+	id := c.Param("id")
+	stored, err := store.Get(c.Request.Context(), id)
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	if !stored.HasImage {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Receipt has no image"})
+		return
+	}
+
+	image, err := attachments.Get(c.Request.Context(), id)
+	if errors.Is(err, errBlobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Receipt has no image"})
+		return
+	}
+	if requestExpired(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not load image"})
+		return
+	}
+
+	c.Header("Cache-Control", "private, no-store")
+	c.Data(http.StatusOK, image.ContentType, image.Data)
+}
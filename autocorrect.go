@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// With RECEIPT_TOTAL_AUTOCORRECT=true, a total that is the item sum with its
+// decimal point dropped or misplaced (3525, 352.5 or 35,25 for items adding
+// up to 35.25) is replaced by the sum before the receipt is validated. Only
+// that slip is corrected; any other mismatch meets validation and
+// quarantine as before. The submission response lists the correction under
+// "corrections", and the stored receipt keeps the original value with it.
+
+var autocorrectTotals = os.Getenv("RECEIPT_TOTAL_AUTOCORRECT") == "true"
+
+var totalCorrections = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "receipt_total_corrections_total",
+	Help: "Receipt totals corrected to the item sum because their decimal point was missing or misplaced.",
+})
+
+// receiptCorrection is a change the service made to a submitted field.
+type receiptCorrection struct {
+	Field     string `json:"field"`
+	Original  string `json:"original"`
+	Corrected string `json:"corrected"`
+	Reason    string `json:"reason"`
+}
+
+// correctTotal replaces a mistyped total with the item sum and describes
+// the change, or returns nil when there is nothing to correct. It stops,
+// leaving the receipt as it was, once ctx is done.
+func correctTotal(ctx context.Context, receipt *Receipt) (*receiptCorrection, error) {
+	if !autocorrectTotals || len(receipt.Items) == 0 {
+		return nil, nil
+	}
+	var sum int64
+	for _, item := range receipt.Items {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !amountPattern.MatchString(item.Price) {
+			return nil, nil
+		}
+		cents, _ := parseCents(item.Price)
+		sum += cents
+	}
+	if sum <= 0 || receipt.Total == formatCents(sum) {
+		return nil, nil
+	}
+	if total, err := parseCents(receipt.Total); err == nil && total == sum {
+		return nil, nil
+	}
+	digits, separators := "", 0
+	for _, r := range strings.TrimSpace(receipt.Total) {
+		switch {
+		case r >= '0' && r <= '9':
+			digits += string(r)
+		case r == '.' || r == ',':
+			separators++
+		default:
+			return nil, nil
+		}
+	}
+	if separators > 1 || strings.TrimLeft(digits, "0") != strings.TrimLeft(strings.Replace(formatCents(sum), ".", "", 1), "0") {
+		return nil, nil
+	}
+	correction := &receiptCorrection{
+		Field:     "total",
+		Original:  receipt.Total,
+		Corrected: formatCents(sum),
+		Reason:    "decimal point missing or misplaced; the items sum to " + formatCents(sum),
+	}
+	receipt.Total = correction.Corrected
+	totalCorrections.Inc()
+	return correction, nil
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// A backfill imports historical receipts from an NDJSON or CSV file on
+// disk or in S3 (s3://bucket/key). Progress is checkpointed to
+// BACKFILL_CHECKPOINT_DIR every BACKFILL_CHECKPOINT_EVERY records, and
+// running the same source again resumes after the last checkpoint. Every
+// record gets an ID derived from the source and its position, so records
+// imported between the last checkpoint and a crash are recognised and
+// skipped rather than stored twice.
+//
+// NDJSON sources hold one receipt document per line. CSV sources hold one
+// item per row under the header
+//
+//	receipt,retailer,purchaseDate,purchaseTime,total,shortDescription,price[,customerId]
+//
+// where consecutive rows with the same receipt value form one receipt.
+
+var (
+	backfillCheckpointDir   = envString("BACKFILL_CHECKPOINT_DIR", filepath.Join(os.TempDir(), "receipt-backfill"))
+	backfillCheckpointEvery = envInt("BACKFILL_CHECKPOINT_EVERY", 500)
+
+	backfillNamespace = uuid.MustParse("6f1d2c9e-7b0a-4c55-9a53-2f0c1d2b8e41")
+
+	backfillMu   sync.Mutex
+	backfillRuns = map[string]*backfillRun{}
+)
+
+const backfillFailureLimit = 100
+
+type backfillFailure struct {
+	Record int    `json:"record"`
+	Error  string `json:"error"`
+}
+
+// backfillCheckpoint is the persisted progress of one source. Records counts
+// the records consumed so far, whatever their outcome.
+type backfillCheckpoint struct {
+	ID              string            `json:"id"`
+	Source          string            `json:"source"`
+	Format          string            `json:"format"`
+	Tenant          string            `json:"tenant"`
+	Records         int               `json:"records"`
+	Imported        int               `json:"imported"`
+	AlreadyImported int               `json:"alreadyImported"`
+	Duplicates      int               `json:"duplicates"`
+	Quarantined     int               `json:"quarantined"`
+	Failed          int               `json:"failed"`
+	Points          int64             `json:"points"`
+	Failures        []backfillFailure `json:"failures"`
+	StartedAt       time.Time         `json:"startedAt"`
+	UpdatedAt       time.Time         `json:"updatedAt"`
+	Status          string            `json:"status"`
+	Error           string            `json:"error,omitempty"`
+	Report          *backfillReport   `json:"report,omitempty"`
+}
+
+// backfillReport reconciles a finished import: every record read must be
+// accounted for, and the store must hold exactly the receipts imported.
+type backfillReport struct {
+	RecordsRead    int   `json:"recordsRead"`
+	AccountedFor   int   `json:"accountedFor"`
+	StoredReceipts int   `json:"storedReceipts"`
+	StoredPoints   int64 `json:"storedPoints"`
+	ExpectedStored int   `json:"expectedStored"`
+	Reconciled     bool  `json:"reconciled"`
+}
+
+type backfillRun struct {
+	mu sync.Mutex
+	cp backfillCheckpoint
+}
+
+func backfillID(source string) string {
+	sum := sha256.Sum256([]byte(source))
+	return hex.EncodeToString(sum[:8])
+}
+
+func backfillCheckpointPath(id string) string {
+	return filepath.Join(backfillCheckpointDir, id+".json")
+}
+
+func loadBackfillCheckpoint(id string) (*backfillCheckpoint, error) {
+	data, err := os.ReadFile(backfillCheckpointPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp backfillCheckpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("parse checkpoint %s: %w", id, err)
+	}
+	return &cp, nil
+}
+
+// save writes the checkpoint atomically, so a crash leaves either the old
+// or the new one.
+func (cp *backfillCheckpoint) save() error {
+	if err := os.MkdirAll(backfillCheckpointDir, 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := backfillCheckpointPath(cp.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, backfillCheckpointPath(cp.ID))
+}
+
+// newBackfill prepares a run for source, resuming its checkpoint when one
+// exists and is unfinished.
+func newBackfill(source, format, tenant string) (*backfillRun, error) {
+	if format == "" {
+		format = "ndjson"
+		if strings.HasSuffix(strings.ToLower(source), ".csv") {
+			format = "csv"
+		}
+	}
+	if format != "ndjson" && format != "csv" {
+		return nil, fmt.Errorf("format must be ndjson or csv")
+	}
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+	id := backfillID(source)
+	cp, err := loadBackfillCheckpoint(id)
+	if err != nil {
+		return nil, err
+	}
+	if cp == nil || cp.Status == "done" {
+		now := clock.Now().UTC()
+		cp = &backfillCheckpoint{ID: id, Source: source, Format: format, Tenant: tenant, StartedAt: now, Failures: []backfillFailure{}}
+	}
+	cp.Status, cp.Error = "running", ""
+	return &backfillRun{cp: *cp}, nil
+}
+
+func (r *backfillRun) snapshot() backfillCheckpoint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cp := r.cp
+	cp.Failures = append([]backfillFailure{}, r.cp.Failures...)
+	return cp
+}
+
+// run imports the source from the checkpoint onwards and writes the
+// reconciliation report once the source is exhausted.
+func (r *backfillRun) run(ctx context.Context) error {
+	err := r.importRecords(ctx)
+	if err == nil {
+		err = r.reconcile(ctx)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cp.UpdatedAt = clock.Now().UTC()
+	if err != nil {
+		r.cp.Status, r.cp.Error = "failed", err.Error()
+	} else {
+		r.cp.Status = "done"
+	}
+	if saveErr := r.cp.save(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+func (r *backfillRun) importRecords(ctx context.Context) error {
+	src, err := openBackfillSource(ctx, r.cp.Source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	next := ndjsonRecords(src)
+	if r.cp.Format == "csv" {
+		next = csvRecords(src)
+	}
+
+	for n := 0; ; n++ {
+		receipt, recordErr, err := next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n < r.cp.Records {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if recordErr == nil {
+			if recordErr, err = r.importRecord(ctx, n, receipt); err != nil {
+				return err
+			}
+		}
+
+		r.mu.Lock()
+		r.cp.Records = n + 1
+		if recordErr != nil {
+			r.cp.Failed++
+			if len(r.cp.Failures) < backfillFailureLimit {
+				r.cp.Failures = append(r.cp.Failures, backfillFailure{Record: n, Error: recordErr.Error()})
+			}
+		}
+		var saveErr error
+		if r.cp.Records%backfillCheckpointEvery == 0 {
+			r.cp.UpdatedAt = clock.Now().UTC()
+			saveErr = r.cp.save()
+		}
+		r.mu.Unlock()
+		if saveErr != nil {
+			return saveErr
+		}
+	}
+}
+
+// importRecord stores record n unless an earlier, interrupted run already
+// did. A refused receipt fails only the record; store errors end the run.
+func (r *backfillRun) importRecord(ctx context.Context, n int, receipt Receipt) (recordErr, err error) {
+	id := receiptID(r.cp.Tenant, uuid.NewSHA1(backfillNamespace, []byte(fmt.Sprintf("%s#%d", r.cp.Source, n))))
+	if _, err := store.Get(ctx, id); err == nil {
+		r.mu.Lock()
+		r.cp.AlreadyImported++
+		r.mu.Unlock()
+		return nil, nil
+	} else if !errors.Is(err, errReceiptNotFound) {
+		return nil, err
+	}
+
+	result, err := submitReceipt(ctx, submission{id: id, tenant: r.cp.Tenant, receipt: receipt, backfill: r.cp.Source, channel: channelBatch})
+	var refused *submissionError
+	if errors.As(err, &refused) {
+		return refused, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("record %d: %w", n, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cp.Imported++
+	r.cp.Points += int64(result.stored.Points)
+	if result.duplicateOf != "" {
+		r.cp.Duplicates++
+	}
+	if result.stored.Status == receiptQuarantined {
+		r.cp.Quarantined++
+	}
+	return nil, nil
+}
+
+func (r *backfillRun) reconcile(ctx context.Context) error {
+	stored, err := store.List(ctx, func(s *storedReceipt) bool { return s.Backfill == r.cp.Source })
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := &backfillReport{
+		RecordsRead:    r.cp.Records,
+		AccountedFor:   r.cp.Imported + r.cp.AlreadyImported + r.cp.Failed,
+		StoredReceipts: len(stored),
+		ExpectedStored: r.cp.Imported + r.cp.AlreadyImported,
+	}
+	for _, s := range stored {
+		report.StoredPoints += int64(s.Points)
+	}
+	report.Reconciled = report.AccountedFor == report.RecordsRead && report.StoredReceipts == report.ExpectedStored
+	r.cp.Report = report
+	return nil
+}
+
+func openBackfillSource(ctx context.Context, source string) (io.ReadCloser, error) {
+	if rest, ok := strings.CutPrefix(source, "s3://"); ok {
+		bucket, key, ok := strings.Cut(rest, "/")
+		if !ok || bucket == "" || key == "" {
+			return nil, fmt.Errorf("s3 sources look like s3://bucket/key")
+		}
+		client, err := s3FromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return client.GetObject(ctx, bucket, key)
+	}
+	return os.Open(strings.TrimPrefix(source, "file://"))
+}
+
+// A backfillReader returns the next receipt. A malformed record is reported
+// as recordErr so the import can skip it; err ends the import, with io.EOF
+// at the end of the source.
+type backfillReader func() (receipt Receipt, recordErr, err error)
+
+func ndjsonRecords(src io.Reader) backfillReader {
+	br := bufio.NewReader(src)
+	return func() (Receipt, error, error) {
+		for {
+			line, err := br.ReadBytes('\n')
+			if len(strings.TrimSpace(string(line))) == 0 {
+				if err != nil {
+					return Receipt{}, nil, err
+				}
+				continue
+			}
+			if err != nil && !errors.Is(err, io.EOF) {
+				return Receipt{}, nil, err
+			}
+			receipt, decodeErr := decodeReceipt(strings.NewReader(string(line)))
+			return receipt, decodeErr, nil
+		}
+	}
+}
+
+func csvRecords(src io.Reader) backfillReader {
+	r := csv.NewReader(src)
+	r.FieldsPerRecord = -1
+	var columns map[string]int
+	var pending []string
+	return func() (Receipt, error, error) {
+		if columns == nil {
+			header, err := r.Read()
+			if err != nil {
+				return Receipt{}, nil, err
+			}
+			columns = make(map[string]int)
+			for i, name := range header {
+				columns[strings.TrimSpace(name)] = i
+			}
+			for _, name := range []string{"receipt", "retailer", "purchaseDate", "purchaseTime", "total", "shortDescription", "price"} {
+				if _, ok := columns[name]; !ok {
+					return Receipt{}, nil, fmt.Errorf("csv header is missing %s", name)
+				}
+			}
+		}
+		field := func(row []string, name string) string {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+
+		var rows [][]string
+		if pending != nil {
+			rows, pending = append(rows, pending), nil
+		}
+		for {
+			row, err := r.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return Receipt{}, nil, err
+			}
+			if len(rows) > 0 && field(row, "receipt") != field(rows[0], "receipt") {
+				pending = row
+				break
+			}
+			rows = append(rows, row)
+		}
+		if len(rows) == 0 {
+			return Receipt{}, nil, io.EOF
+		}
+
+		first := rows[0]
+		doc := map[string]any{
+			"retailer":     field(first, "retailer"),
+			"purchaseDate": field(first, "purchaseDate"),
+			"purchaseTime": field(first, "purchaseTime"),
+			"total":        field(first, "total"),
+		}
+		if customer := field(first, "customerId"); customer != "" {
+			doc["customerId"] = customer
+		}
+		items := make([]map[string]string, 0, len(rows))
+		for _, row := range rows {
+			items = append(items, map[string]string{"shortDescription": field(row, "shortDescription"), "price": field(row, "price")})
+		}
+		doc["items"] = items
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return Receipt{}, nil, err
+		}
+		receipt, decodeErr := decodeReceipt(strings.NewReader(string(data)))
+		return receipt, decodeErr, nil
+	}
+}
+
+// runBackfillCommand implements the backfill subcommand, which imports a
+// source in the foreground and prints the final checkpoint.
+func runBackfillCommand(args []string) int {
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	format := fs.String("format", "", "ndjson or csv (default: from the file extension)")
+	tenant := fs.String("tenant", defaultTenant, "tenant to import into")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: backfill [-format ndjson|csv] [-tenant name] SOURCE")
+		return 2
+	}
+	run, err := newBackfill(fs.Arg(0), *format, *tenant)
+	if err != nil {
+		log.Printf("backfill: %v", err)
+		return 1
+	}
+	err = run.run(context.Background())
+	out, _ := json.MarshalIndent(run.snapshot(), "", "  ")
+	fmt.Println(string(out))
+	if err != nil {
+		log.Printf("backfill: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// startBackfill serves POST /admin/backfill with {"source": "...",
+// "format": "csv", "tenant": "..."}. The import runs in the background;
+// posting a source whose run was interrupted resumes it.
+func startBackfill(c *gin.Context) {
+	var req struct {
+		Source string `json:"source"`
+		Format string `json:"format"`
+		Tenant string `json:"tenant"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+	if req.Source == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A source is required"})
+		return
+	}
+
+	backfillMu.Lock()
+	defer backfillMu.Unlock()
+	if current, ok := backfillRuns[backfillID(req.Source)]; ok && current.snapshot().Status == "running" {
+		c.JSON(http.StatusConflict, gin.H{"error": "A backfill of this source is already running"})
+		return
+	}
+	run, err := newBackfill(req.Source, req.Format, req.Tenant)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid backfill: " + err.Error()})
+		return
+	}
+	backfillRuns[run.cp.ID] = run
+	go func() {
+		if err := run.run(context.Background()); err != nil {
+			log.Printf("backfill %s: %v", run.cp.Source, err)
+		}
+	}()
+	c.Header("Location", "/admin/backfill/"+run.cp.ID)
+	c.JSON(http.StatusAccepted, run.snapshot())
+}
+
+func listBackfills(c *gin.Context) {
+	backfillMu.Lock()
+	runs := make([]backfillCheckpoint, 0, len(backfillRuns))
+	for _, run := range backfillRuns {
+		runs = append(runs, run.snapshot())
+	}
+	backfillMu.Unlock()
+	sort.Slice(runs, func(i, j int) bool { return runs[i].StartedAt.Before(runs[j].StartedAt) })
+	c.JSON(http.StatusOK, gin.H{"backfills": runs})
+}
+
+// getBackfill serves GET /admin/backfill/:id, falling back to the
+// checkpoint on disk for runs started by another process.
+func getBackfill(c *gin.Context) {
+	backfillMu.Lock()
+	run, ok := backfillRuns[c.Param("id")]
+	backfillMu.Unlock()
+	if ok {
+		c.JSON(http.StatusOK, run.snapshot())
+		return
+	}
+	cp, err := loadBackfillCheckpoint(filepath.Base(c.Param("id")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read checkpoint"})
+		return
+	}
+	if cp == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Backfill not found"})
+		return
+	}
+	c.JSON(http.StatusOK, cp)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+var batchMaxReceipts = envInt("BATCH_MAX_RECEIPTS", 1000)
+
+type batchEntry struct {
+	CorrelationKey string          `json:"correlationKey"`
+	Receipt        json.RawMessage `json:"receipt"`
+}
+
+type batchResult struct {
+	Index          int          `json:"index"`
+	Line           int          `json:"line,omitempty"`
+	CorrelationKey string       `json:"correlationKey,omitempty"`
+	Status         string       `json:"status"`
+	ID             string       `json:"id,omitempty"`
+	Points         *int         `json:"points,omitempty"`
+	DuplicateOf    string       `json:"duplicateOf,omitempty"`
+	Error          string       `json:"error,omitempty"`
+	Errors         []fieldError `json:"errors,omitempty"`
+}
+
+// processBatch serves POST /receipts/process/batch. The body is an array of
+// {"correlationKey": ..., "receipt": {...}} entries, each submitted as if
+// posted to /receipts/process. A refused entry does not fail the batch:
+// every entry gets its own result, in request order, with status accepted,
+// quarantined or rejected.
+func processBatch(c *gin.Context) {
+	var entries []batchEntry
+	if err := json.NewDecoder(c.Request.Body).Decode(&entries); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+	if len(entries) == 0 || len(entries) > batchMaxReceipts {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A batch must have between 1 and " + strconv.Itoa(batchMaxReceipts) + " receipts"})
+		return
+	}
+
+	channel, ok := submissionChannel(c, channelBatch)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	tenant := tenantID(c)
+	results := make([]batchResult, len(entries))
+	counts := map[string]int{receiptAccepted: 0, receiptQuarantined: 0, receiptRejected: 0}
+	for i, entry := range entries {
+		result, _ := submitBatchEntry(ctx, tenant, channel, i, entry)
+		if ctx.Err() != nil {
+			submissionFailure(c, ctx.Err())
+			return
+		}
+		counts[result.Status]++
+		results[i] = result
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"accepted":    counts[receiptAccepted],
+		"quarantined": counts[receiptQuarantined],
+		"rejected":    counts[receiptRejected],
+		"results":     results,
+	})
+}
+
+// submitBatchEntry submits one entry of a batch or stream, returning
+// submitReceipt's error alongside the result. When that is a context error
+// the result is meaningless.
+func submitBatchEntry(ctx context.Context, tenant, channel string, index int, entry batchEntry) (batchResult, error) {
+	result := batchResult{Index: index, CorrelationKey: entry.CorrelationKey, Status: receiptRejected}
+	receipt, err := decodeReceipt(bytes.NewReader(entry.Receipt))
+	if err != nil {
+		recordDecodeQuality(tenant, err)
+		result.Error = decodeFailure(err)
+		return result, nil
+	}
+	submitted, err := submitReceipt(ctx, submission{tenant: tenant, receipt: receipt, channel: channel})
+	return result.outcome(submitted, err), err
+}
+
+// decodeFailure is the error message for a receipt decodeReceipt refused.
+func decodeFailure(err error) string {
+	if errors.Is(err, errUnsupportedSchema) {
+		return "Unsupported schemaVersion"
+	}
+	return "Invalid JSON format"
+}
+
+// outcome fills in a result from submitReceipt's return values.
+func (result batchResult) outcome(submitted *submissionResult, err error) batchResult {
+	var refused *submissionError
+	switch {
+	case errors.As(err, &refused):
+		result.Error, _ = refused.body["error"].(string)
+		result.Errors, _ = refused.body["errors"].([]fieldError)
+	case err != nil:
+		result.Error = "Receipt store error"
+		if isTransientStoreError(err) {
+			result.Error = "Receipt store is temporarily unavailable"
+		}
+	default:
+		stored := submitted.stored
+		result.Status, result.ID, result.DuplicateOf = stored.Status, stored.ID, submitted.duplicateOf
+		if stored.Status == receiptAccepted {
+			points := stored.Points
+			result.Points = &points
+		}
+	}
+	return result
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var errBlobNotFound = errors.New("blob not found")
+
+type blob struct {
+	ContentType string
+	Data        []byte
+}
+
+// blobStore holds receipt attachments. Keys are opaque to the store.
+type blobStore interface {
+	Put(ctx context.Context, key string, b blob) error
+	Get(ctx context.Context, key string) (blob, error)
+	// Delete removes a blob; deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+func newBlobStore(dir string) (blobStore, error) {
+	if dir == "" {
+		return &memoryBlobStore{blobs: make(map[string]blob)}, nil
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &fileBlobStore{dir: dir}, nil
+}
+
+type memoryBlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string]blob
+}
+
+func (s *memoryBlobStore) Put(ctx context.Context, key string, b blob) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.blobs[key] = b
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryBlobStore) Get(ctx context.Context, key string) (blob, error) {
+	if err := ctx.Err(); err != nil {
+		return blob{}, err
+	}
+	s.mu.RLock()
+	b, ok := s.blobs[key]
+	s.mu.RUnlock()
+	if !ok {
+		return blob{}, errBlobNotFound
+	}
+	return b, nil
+}
+
+func (s *memoryBlobStore) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.blobs, key)
+	s.mu.Unlock()
+	return nil
+}
+
+// fileBlobStore keeps each blob as a data file plus a sidecar holding its
+// content type.
+type fileBlobStore struct {
+	dir string
+}
+
+func (s *fileBlobStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.Base(key))
+}
+
+func (s *fileBlobStore) Put(ctx context.Context, key string, b blob) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path := s.path(key)
+	if err := os.WriteFile(path+".type", []byte(b.ContentType), 0o640); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b.Data, 0o640); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *fileBlobStore) Get(ctx context.Context, key string) (blob, error) {
+	if err := ctx.Err(); err != nil {
+		return blob{}, err
+	}
+	path := s.path(key)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return blob{}, errBlobNotFound
+	}
+	if err != nil {
+		return blob{}, err
+	}
+	contentType, err := os.ReadFile(path + ".type")
+	if err != nil {
+		contentType = []byte("application/octet-stream")
+	}
+	return blob{ContentType: string(contentType), Data: data}, nil
+}
+
+func (s *fileBlobStore) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path := s.path(key)
+	for _, name := range []string{path, path + ".type"} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
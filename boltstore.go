@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// openStoreFromEnv opens the receipt store named by STORE_BACKEND: "memory"
+// (the default) keeps receipts in process and loses them on restart; "bolt"
+// keeps them in the BoltDB file at STORE_DSN.
+func openStoreFromEnv() (receiptStore, error) {
+	var backend receiptStore
+	switch kind := os.Getenv("STORE_BACKEND"); kind {
+	case "", "memory":
+		backend = newMemoryStore()
+	case "bolt":
+		dsn := os.Getenv("STORE_DSN")
+		if dsn == "" {
+			return nil, fmt.Errorf("STORE_DSN must name the database file for the bolt backend")
+		}
+		bs, err := openBoltStore(dsn)
+		if err != nil {
+			return nil, err
+		}
+		backend = bs
+	default:
+		return nil, fmt.Errorf("STORE_BACKEND: unknown backend %q (want memory or bolt)", kind)
+	}
+	return &breakerStore{next: &sealedStore{next: backend}, breaker: breakerFor("store")}, nil
+}
+
+var (
+	boltReceipts = []byte("receipts")
+	boltHashes   = []byte("hashes")
+	boltOutbox   = []byte("outbox")
+	boltRecords  = []byte("records")
+)
+
+// boltStore keeps each receipt as JSON in a single-file BoltDB database,
+// with an index from receipt hash to the first ID stored under it and the
+// outbox keyed by insertion sequence. Every write is one transaction, so a
+// receipt and its events are committed together.
+type boltStore struct {
+	path string
+
+	// swapMu is held shared by every operation and exclusively while
+	// compaction replaces db; see compaction.go.
+	swapMu sync.RWMutex
+	db     *bolt.DB
+	// journal, while compaction runs, collects the keys each committed
+	// write touched; touched collects them for the write in progress,
+	// which bolt runs one at a time.
+	journal   *compactionJournal
+	touched   []boltKey
+	compactor boltCompaction
+
+	// Counted once at open and kept up to date by writes, for metrics.
+	receiptCount, outboxCount atomic.Int64
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	// The timeout keeps a second process from waiting forever on the file
+	// lock held by the first.
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	s := &boltStore{path: path, db: db}
+	s.compactor.s = s
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltReceipts, boltHashes, boltOutbox, boltRecords} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		s.receiptCount.Store(int64(tx.Bucket(boltReceipts).Stats().KeyN))
+		s.outboxCount.Store(int64(tx.Bucket(boltOutbox).Stats().KeyN))
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// view and update run fn in a read-only or read-write transaction on the
+// current database file. Writes note the keys they touch for compaction.
+func (s *boltStore) view(fn func(*bolt.Tx) error) error {
+	s.swapMu.RLock()
+	defer s.swapMu.RUnlock()
+	return s.db.View(fn)
+}
+
+func (s *boltStore) update(fn func(*bolt.Tx) error) error {
+	s.swapMu.RLock()
+	defer s.swapMu.RUnlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		s.touched = s.touched[:0]
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if journal := s.journal; journal != nil {
+			touched := slices.Clone(s.touched)
+			tx.OnCommit(func() { journal.add(touched) })
+		}
+		return nil
+	})
+}
+
+// note records a key the write in progress puts or deletes.
+func (s *boltStore) note(bucket []byte, key []byte) {
+	if s.journal != nil {
+		s.touched = append(s.touched, boltKey{string(bucket), string(key)})
+	}
+}
+
+func (s *boltStore) failure(op string, err error) error {
+	return &storeError{Op: op, Err: err, Transient: errors.Is(err, bolt.ErrTimeout)}
+}
+
+func (s *boltStore) Create(ctx context.Context, stored *storedReceipt, events []outboxEvent) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	var duplicateOf string
+	var added bool
+	err := s.update(func(tx *bolt.Tx) error {
+		added = tx.Bucket(boltReceipts).Get([]byte(stored.ID)) == nil
+		if err := s.put(tx, stored); err != nil {
+			return err
+		}
+		hashes := tx.Bucket(boltHashes)
+		if first := hashes.Get([]byte(stored.duplicateKey())); first != nil {
+			duplicateOf = string(first)
+		} else if err := hashes.Put([]byte(stored.duplicateKey()), []byte(stored.ID)); err != nil {
+			return err
+		}
+		s.note(boltHashes, []byte(stored.duplicateKey()))
+		return s.appendEvents(tx, events)
+	})
+	if err != nil {
+		return "", s.failure("create", err)
+	}
+	if added {
+		s.receiptCount.Add(1)
+	}
+	s.outboxCount.Add(int64(len(events)))
+	return duplicateOf, nil
+}
+
+func (s *boltStore) Get(ctx context.Context, id string) (*storedReceipt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var stored *storedReceipt
+	err := s.view(func(tx *bolt.Tx) error {
+		var err error
+		stored, err = boltGet(tx, id)
+		return err
+	})
+	if errors.Is(err, errReceiptNotFound) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, s.failure("get", err)
+	}
+	return stored, nil
+}
+
+func (s *boltStore) Update(ctx context.Context, id string, fn func(*storedReceipt)) (*storedReceipt, error) {
+	return s.Apply(ctx, id, func(stored *storedReceipt) ([]outboxEvent, error) {
+		fn(stored)
+		return nil, nil
+	})
+}
+
+func (s *boltStore) Apply(ctx context.Context, id string, fn func(*storedReceipt) ([]outboxEvent, error)) (*storedReceipt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var updated *storedReceipt
+	var queued int
+	var refused error
+	err := s.update(func(tx *bolt.Tx) error {
+		stored, err := boltGet(tx, id)
+		if errors.Is(err, errReceiptNotFound) {
+			refused = err
+		}
+		if err != nil {
+			return err
+		}
+		events, err := fn(stored)
+		if err != nil {
+			refused = err
+			return err
+		}
+		if err := s.put(tx, stored); err != nil {
+			return err
+		}
+		updated, queued = stored, len(events)
+		return s.appendEvents(tx, events)
+	})
+	if refused != nil {
+		return nil, refused
+	}
+	if err != nil {
+		return nil, s.failure("apply", err)
+	}
+	s.outboxCount.Add(int64(queued))
+	return updated, nil
+}
+
+func (s *boltStore) List(ctx context.Context, match func(*storedReceipt) bool) ([]*storedReceipt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	matched := make([]*storedReceipt, 0)
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltReceipts).ForEach(func(_, data []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			stored := new(storedReceipt)
+			if err := json.Unmarshal(data, stored); err != nil {
+				return err
+			}
+			if match == nil || match(stored) {
+				matched = append(matched, stored)
+			}
+			return nil
+		})
+	})
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, s.failure("list", err)
+	}
+	sort.Slice(matched, func(i, j int) bool { return cursorOf(matched[i]).before(cursorOf(matched[j])) })
+	return matched, nil
+}
+
+func (s *boltStore) PendingEvents(ctx context.Context, limit int) ([]outboxEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var events []outboxEvent
+	err := s.view(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltOutbox).Cursor()
+		for key, data := cursor.First(); key != nil && len(events) < limit; key, data = cursor.Next() {
+			var event outboxEvent
+			if err := json.Unmarshal(data, &event); err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, s.failure("pending events", err)
+	}
+	return events, nil
+}
+
+func (s *boltStore) AckEvents(ctx context.Context, ids []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	acked := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		acked[id] = true
+	}
+	var delivered [][]byte
+	err := s.update(func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(boltOutbox)
+		delivered = nil
+		err := outbox.ForEach(func(key, data []byte) error {
+			var event outboxEvent
+			if err := json.Unmarshal(data, &event); err != nil {
+				return err
+			}
+			if acked[event.ID] {
+				delivered = append(delivered, bytes.Clone(key))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range delivered {
+			if err := outbox.Delete(key); err != nil {
+				return err
+			}
+			s.note(boltOutbox, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return s.failure("ack events", err)
+	}
+	s.outboxCount.Add(-int64(len(delivered)))
+	return nil
+}
+
+// Transact runs fn in one bolt read-write transaction, so it is atomic and
+// serialized with every other write.
+func (s *boltStore) Transact(ctx context.Context, fn func(tx storeTx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var refused error
+	var emitted, deleted int
+	err := s.update(func(btx *bolt.Tx) error {
+		tx := &boltTx{ctx: ctx, s: s, tx: btx}
+		if err := fn(tx); err != nil {
+			refused = err
+			return err
+		}
+		emitted, deleted = len(tx.events), tx.deleted
+		return s.appendEvents(btx, tx.events)
+	})
+	if refused != nil {
+		return refused
+	}
+	if err != nil {
+		return s.failure("transact", err)
+	}
+	s.outboxCount.Add(int64(emitted))
+	s.receiptCount.Add(-int64(deleted))
+	return nil
+}
+
+type boltTx struct {
+	ctx     context.Context
+	s       *boltStore
+	tx      *bolt.Tx
+	events  []outboxEvent
+	deleted int
+}
+
+func (tx *boltTx) Get(id string) (*storedReceipt, error) {
+	return boltGet(tx.tx, id)
+}
+
+func (tx *boltTx) List(match func(*storedReceipt) bool) ([]*storedReceipt, error) {
+	matched := make([]*storedReceipt, 0)
+	err := tx.tx.Bucket(boltReceipts).ForEach(func(_, data []byte) error {
+		if err := tx.ctx.Err(); err != nil {
+			return err
+		}
+		stored := new(storedReceipt)
+		if err := json.Unmarshal(data, stored); err != nil {
+			return err
+		}
+		if match == nil || match(stored) {
+			matched = append(matched, stored)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(matched, func(i, j int) bool { return cursorOf(matched[i]).before(cursorOf(matched[j])) })
+	return matched, nil
+}
+
+func (tx *boltTx) Put(stored *storedReceipt) error {
+	if tx.tx.Bucket(boltReceipts).Get([]byte(stored.ID)) == nil {
+		return errReceiptNotFound
+	}
+	return tx.s.put(tx.tx, stored)
+}
+
+func (tx *boltTx) Delete(id string) error {
+	stored, err := boltGet(tx.tx, id)
+	if err != nil {
+		return err
+	}
+	if err := tx.tx.Bucket(boltReceipts).Delete([]byte(id)); err != nil {
+		return err
+	}
+	tx.s.note(boltReceipts, []byte(id))
+	hashes := tx.tx.Bucket(boltHashes)
+	if string(hashes.Get([]byte(stored.duplicateKey()))) == id {
+		if err := hashes.Delete([]byte(stored.duplicateKey())); err != nil {
+			return err
+		}
+		tx.s.note(boltHashes, []byte(stored.duplicateKey()))
+	}
+	tx.deleted++
+	return nil
+}
+
+func (tx *boltTx) Emit(events ...outboxEvent) {
+	tx.events = append(tx.events, events...)
+}
+
+// Records are kept in one bucket under kind, NUL, key.
+func boltRecordKey(kind, key string) []byte { return []byte(kind + "\x00" + key) }
+
+func (s *boltStore) GetRecord(ctx context.Context, kind, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var value []byte
+	err := s.view(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltRecords).Get(boltRecordKey(kind, key))
+		if data == nil {
+			return errRecordNotFound
+		}
+		value = bytes.Clone(data)
+		return nil
+	})
+	if errors.Is(err, errRecordNotFound) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, s.failure("get record", err)
+	}
+	return value, nil
+}
+
+func (s *boltStore) PutRecord(ctx context.Context, kind, key string, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := s.update(func(tx *bolt.Tx) error { return s.putRecord(tx, kind, key, value) })
+	if err != nil {
+		return s.failure("put record", err)
+	}
+	return nil
+}
+
+func (s *boltStore) DeleteRecord(ctx context.Context, kind, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := s.update(func(tx *bolt.Tx) error { return s.deleteRecord(tx, kind, key) })
+	if err != nil {
+		return s.failure("delete record", err)
+	}
+	return nil
+}
+
+func (s *boltStore) ListRecords(ctx context.Context, kind string) (map[string][]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	records := make(map[string][]byte)
+	prefix := boltRecordKey(kind, "")
+	err := s.view(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltRecords).Cursor()
+		for key, data := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, data = cursor.Next() {
+			records[string(key[len(prefix):])] = bytes.Clone(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, s.failure("list records", err)
+	}
+	return records, nil
+}
+
+func (s *boltStore) putRecord(tx *bolt.Tx, kind, key string, value []byte) error {
+	k := boltRecordKey(kind, key)
+	s.note(boltRecords, k)
+	return tx.Bucket(boltRecords).Put(k, value)
+}
+
+func (s *boltStore) deleteRecord(tx *bolt.Tx, kind, key string) error {
+	k := boltRecordKey(kind, key)
+	s.note(boltRecords, k)
+	return tx.Bucket(boltRecords).Delete(k)
+}
+
+func (tx *boltTx) GetRecord(kind, key string) ([]byte, error) {
+	data := tx.tx.Bucket(boltRecords).Get(boltRecordKey(kind, key))
+	if data == nil {
+		return nil, errRecordNotFound
+	}
+	return bytes.Clone(data), nil
+}
+
+func (tx *boltTx) PutRecord(kind, key string, value []byte) error {
+	return tx.s.putRecord(tx.tx, kind, key, value)
+}
+
+func (tx *boltTx) DeleteRecord(kind, key string) error {
+	return tx.s.deleteRecord(tx.tx, kind, key)
+}
+
+// size reports the database file size as retained bytes; the file is
+// memory-mapped, so none of it counts against the Go heap.
+func (s *boltStore) size() storeSize {
+	var bytes int64
+	s.view(func(tx *bolt.Tx) error {
+		bytes = tx.Size()
+		return nil
+	})
+	return storeSize{Receipts: s.receiptCount.Load(), Outbox: s.outboxCount.Load(), Bytes: bytes}
+}
+
+func boltGet(tx *bolt.Tx, id string) (*storedReceipt, error) {
+	data := tx.Bucket(boltReceipts).Get([]byte(id))
+	if data == nil {
+		return nil, errReceiptNotFound
+	}
+	stored := new(storedReceipt)
+	if err := json.Unmarshal(data, stored); err != nil {
+		return nil, fmt.Errorf("receipt %s: %w", id, err)
+	}
+	return stored, nil
+}
+
+func (s *boltStore) put(tx *bolt.Tx, stored *storedReceipt) error {
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	s.note(boltReceipts, []byte(stored.ID))
+	return tx.Bucket(boltReceipts).Put([]byte(stored.ID), data)
+}
+
+func (s *boltStore) appendEvents(tx *bolt.Tx, events []outboxEvent) error {
+	outbox := tx.Bucket(boltOutbox)
+	for _, event := range events {
+		seq, err := outbox.NextSequence()
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		key := binary.BigEndian.AppendUint64(nil, seq)
+		if err := outbox.Put(key, data); err != nil {
+			return err
+		}
+		s.note(boltOutbox, key)
+	}
+	return nil
+}
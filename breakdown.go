@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// getReceipt serves GET /receipts/:id: the receipt as submitted, with its
+// status and when it was processed. Fields the service corrected are listed
+// under "corrections" with their original values.
+func getReceipt(c *gin.Context) {
+	stored, err := store.Get(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	resp := gin.H{
+		"id":          stored.ID,
+		"status":      stored.Status,
+		"receipt":     stored.Receipt,
+		"retailer":    stored.Retailer,
+		"channel":     stored.Channel,
+		"points":      stored.netPoints(),
+		"hash":        stored.Hash,
+		"hasImage":    stored.HasImage,
+		"tags":        append([]string{}, stored.Tags...),
+		"processedAt": stored.CreatedAt.UTC(),
+	}
+	if len(stored.Corrections) > 0 {
+		resp["corrections"] = stored.Corrections
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+type breakdownLine struct {
+	Rule            string `json:"rule"`
+	Description     string `json:"description"`
+	Item            *int   `json:"item,omitempty"`
+	ItemDescription string `json:"itemDescription,omitempty"`
+	Points          int    `json:"points"`
+	// Fraction is kept back for the customer's carry; see fractions.go.
+	Fraction float64 `json:"fraction,omitempty"`
+}
+
+// getBreakdown serves GET /receipts/:id/breakdown: each rule that awarded
+// points, in the order they were applied, and any later ledger
+// adjustments. The lines add up to "earned"; "points" includes the ledger.
+func getBreakdown(c *gin.Context) {
+	stored, err := store.Get(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	if stored.Status != receiptAccepted {
+		c.JSON(http.StatusConflict, gin.H{"error": "Receipt has not been accepted", "status": stored.Status})
+		return
+	}
+	lines := make([]breakdownLine, 0, len(stored.Breakdown))
+	for _, result := range stored.Breakdown {
+		line := breakdownLine{Rule: result.Rule, Description: ruleDescription(result.Rule), Item: result.Item, Points: result.Points, Fraction: result.Fraction}
+		if result.Item != nil && *result.Item < len(stored.Receipt.Items) {
+			line.ItemDescription = strings.TrimSpace(stored.Receipt.Items[*result.Item].ShortDescription)
+		}
+		lines = append(lines, line)
+	}
+	resp := gin.H{
+		"id":           stored.ID,
+		"rulesVersion": stored.RulesVersion,
+		"rules":        lines,
+		"earned":       stored.Points,
+		"points":       stored.netPoints(),
+		"ledger":       append([]ledgerEntry{}, stored.Ledger...),
+	}
+	displayPoints(resp, stored.Tenant, "points", "earned")
+	c.JSON(http.StatusOK, resp)
+}
+
+func ruleDescription(name string) string {
+	if promo, ok := strings.CutPrefix(name, "promotion:"); ok {
+		return "Retailer promotion " + promo + "."
+	}
+	for _, rule := range pointsRules {
+		if rule.name == name {
+			return rule.description
+		}
+	}
+	return ""
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var errCircuitOpen = errors.New("circuit breaker open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+var (
+	breakerStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "circuit_breaker_state",
+		Help: "Circuit breaker state per dependency: 0 closed, 1 half-open, 2 open.",
+	}, []string{"name"})
+	breakerRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "circuit_breaker_rejections_total",
+		Help: "Calls refused without being attempted because the breaker was open.",
+	}, []string{"name"})
+)
+
+// circuitBreaker stops calling a dependency after BREAKER_FAILURES
+// consecutive failures. After BREAKER_OPEN_FOR it lets a single probe
+// through; success closes the breaker and failure reopens it.
+type circuitBreaker struct {
+	name        string
+	maxFailures int
+	openFor     time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = make(map[string]*circuitBreaker)
+
+	breakerFailures = envInt("BREAKER_FAILURES", 5)
+	breakerOpenFor  = envDuration("BREAKER_OPEN_FOR", 30*time.Second)
+)
+
+// breakerFor returns the shared breaker for a dependency, creating it on
+// first use.
+func breakerFor(name string) *circuitBreaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[name]
+	if !ok {
+		b = &circuitBreaker{name: name, maxFailures: breakerFailures, openFor: breakerOpenFor}
+		breakers[name] = b
+		breakerStateGauge.WithLabelValues(name).Set(float64(breakerClosed))
+	}
+	return b
+}
+
+// webhookBreaker keys webhook breakers by host, so one slow receiver does
+// not stop deliveries to the others.
+func webhookBreaker(rawURL string) *circuitBreaker {
+	host := rawURL
+	if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	return breakerFor("webhook:" + host)
+}
+
+// Do runs fn unless the breaker is open. Every error returned by fn counts
+// as a failure except cancellation by the caller.
+func (b *circuitBreaker) Do(fn func() error) error {
+	return b.DoCounting(fn, func(err error) bool { return !errors.Is(err, context.Canceled) })
+}
+
+// DoCounting is Do with a custom notion of which errors are failures.
+func (b *circuitBreaker) DoCounting(fn func() error, isFailure func(error) bool) error {
+	if !b.allow() {
+		breakerRejections.WithLabelValues(b.name).Inc()
+		return errCircuitOpen
+	}
+	err := fn()
+	b.record(err != nil && isFailure(err))
+	return err
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.openFor {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasProbe := b.state == breakerHalfOpen
+	if wasProbe {
+		b.probing = false
+	}
+	if !failed {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+	b.failures++
+	if wasProbe || b.failures >= b.maxFailures {
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+func (b *circuitBreaker) setState(state breakerState) {
+	b.state = state
+	breakerStateGauge.WithLabelValues(b.name).Set(float64(state))
+}
+
+// breakerStore guards a receiptStore. Only transient errors trip it; while
+// open, calls fail fast with a transient storeError so clients get 503.
+type breakerStore struct {
+	next    receiptStore
+	breaker *circuitBreaker
+}
+
+func (s *breakerStore) size() storeSize {
+	if sized, ok := s.next.(sizedStore); ok {
+		return sized.size()
+	}
+	return storeSize{}
+}
+
+func (s *breakerStore) compaction() *boltCompaction {
+	if c, ok := s.next.(compactableStore); ok {
+		return c.compaction()
+	}
+	return nil
+}
+
+func (s *breakerStore) guard(ctx context.Context, op string, fn func() error) error {
+	storeOp(ctx)
+	err := s.breaker.DoCounting(fn, isTransientStoreError)
+	if errors.Is(err, errCircuitOpen) {
+		return &storeError{Op: op, Err: err, Transient: true}
+	}
+	return err
+}
+
+func (s *breakerStore) Create(ctx context.Context, stored *storedReceipt, events []outboxEvent) (duplicateOf string, err error) {
+	err = s.guard(ctx, "create", func() (err error) {
+		duplicateOf, err = s.next.Create(ctx, stored, events)
+		return err
+	})
+	return duplicateOf, err
+}
+
+func (s *breakerStore) Get(ctx context.Context, id string) (stored *storedReceipt, err error) {
+	err = s.guard(ctx, "get", func() (err error) {
+		stored, err = s.next.Get(ctx, id)
+		return err
+	})
+	return stored, err
+}
+
+func (s *breakerStore) Update(ctx context.Context, id string, fn func(*storedReceipt)) (stored *storedReceipt, err error) {
+	err = s.guard(ctx, "update", func() (err error) {
+		stored, err = s.next.Update(ctx, id, fn)
+		return err
+	})
+	return stored, err
+}
+
+func (s *breakerStore) Apply(ctx context.Context, id string, fn func(*storedReceipt) ([]outboxEvent, error)) (stored *storedReceipt, err error) {
+	err = s.guard(ctx, "apply", func() (err error) {
+		stored, err = s.next.Apply(ctx, id, fn)
+		return err
+	})
+	return stored, err
+}
+
+func (s *breakerStore) List(ctx context.Context, match func(*storedReceipt) bool) (matched []*storedReceipt, err error) {
+	err = s.guard(ctx, "list", func() (err error) {
+		matched, err = s.next.List(ctx, match)
+		return err
+	})
+	return matched, err
+}
+
+func (s *breakerStore) PendingEvents(ctx context.Context, limit int) (events []outboxEvent, err error) {
+	err = s.guard(ctx, "pending events", func() (err error) {
+		events, err = s.next.PendingEvents(ctx, limit)
+		return err
+	})
+	return events, err
+}
+
+func (s *breakerStore) AckEvents(ctx context.Context, ids []string) error {
+	return s.guard(ctx, "ack events", func() error { return s.next.AckEvents(ctx, ids) })
+}
+
+func (s *breakerStore) Transact(ctx context.Context, fn func(tx storeTx) error) error {
+	return s.guard(ctx, "transact", func() error { return s.next.Transact(ctx, fn) })
+}
+
+func (s *breakerStore) GetRecord(ctx context.Context, kind, key string) (value []byte, err error) {
+	err = s.guard(ctx, "get record", func() (err error) {
+		value, err = s.next.GetRecord(ctx, kind, key)
+		return err
+	})
+	return value, err
+}
+
+func (s *breakerStore) PutRecord(ctx context.Context, kind, key string, value []byte) error {
+	return s.guard(ctx, "put record", func() error { return s.next.PutRecord(ctx, kind, key, value) })
+}
+
+func (s *breakerStore) DeleteRecord(ctx context.Context, kind, key string) error {
+	return s.guard(ctx, "delete record", func() error { return s.next.DeleteRecord(ctx, kind, key) })
+}
+
+func (s *breakerStore) ListRecords(ctx context.Context, kind string) (records map[string][]byte, err error) {
+	err = s.guard(ctx, "list records", func() (err error) {
+		records, err = s.next.ListRecords(ctx, kind)
+		return err
+	})
+	return records, err
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// cache is the in-process cache subsystems share: a typed map whose
+// entries expire after a TTL and which, once it holds max entries, evicts
+// the least recently used. Expired entries are dropped when they are next
+// read, or from the cold end as new ones are added. Each cache is named,
+// and its hits, misses, evictions and size are exported by that name.
+//
+// A ttl or max of 0 means none; set can override the TTL per entry.
+// Entries for which pinned, when set, reports true are never evicted for
+// capacity, only on expiry, so the cache may hold more than max of them.
+type cache[K comparable, V any] struct {
+	name   string
+	max    int
+	ttl    time.Duration
+	pinned func(V) bool
+
+	mu    sync.Mutex
+	items map[K]*list.Element
+	order *list.List // most recently used first
+}
+
+type cacheEntry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time // zero: never
+}
+
+var (
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "receipt_cache_lookups_total",
+		Help: "In-process cache lookups by cache and result: hit or miss.",
+	}, []string{"cache", "result"})
+	cacheEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "receipt_cache_evictions_total",
+		Help: "Entries evicted from in-process caches, by cache and reason: expired or capacity.",
+	}, []string{"cache", "reason"})
+	cacheEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "receipt_cache_entries",
+		Help: "Entries held by each in-process cache.",
+	}, []string{"cache"})
+)
+
+func newCache[K comparable, V any](name string, max int, ttl time.Duration) *cache[K, V] {
+	return &cache[K, V]{name: name, max: max, ttl: ttl, items: make(map[K]*list.Element), order: list.New()}
+}
+
+func (c *cache[K, V]) get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.lookupLocked(key, time.Now())
+	if !ok {
+		cacheLookups.WithLabelValues(c.name, "miss").Inc()
+		var zero V
+		return zero, false
+	}
+	cacheLookups.WithLabelValues(c.name, "hit").Inc()
+	return entry.value, true
+}
+
+// set stores value under key for ttl, or the cache's TTL when ttl is 0.
+func (c *cache[K, V]) set(key K, value V, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setLocked(key, value, ttl, time.Now())
+}
+
+// getOrSet returns the live value under key, or stores value there when
+// there is none, in one step.
+func (c *cache[K, V]) getOrSet(key K, value V, ttl time.Duration) (existing V, loaded bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if entry, ok := c.lookupLocked(key, now); ok {
+		cacheLookups.WithLabelValues(c.name, "hit").Inc()
+		return entry.value, true
+	}
+	cacheLookups.WithLabelValues(c.name, "miss").Inc()
+	c.setLocked(key, value, ttl, now)
+	var zero V
+	return zero, false
+}
+
+func (c *cache[K, V]) delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.removeLocked(el)
+	}
+}
+
+func (c *cache[K, V]) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
+
+func (c *cache[K, V]) lookupLocked(key K, now time.Time) (*cacheEntry[K, V], bool) {
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry[K, V])
+	if entry.expired(now) {
+		c.removeLocked(el)
+		cacheEvictions.WithLabelValues(c.name, "expired").Inc()
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return entry, true
+}
+
+func (c *cache[K, V]) setLocked(key K, value V, ttl time.Duration, now time.Time) {
+	if ttl == 0 {
+		ttl = c.ttl
+	}
+	var expires time.Time
+	if ttl > 0 {
+		expires = now.Add(ttl)
+	}
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*cacheEntry[K, V])
+		entry.value, entry.expires = value, expires
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(&cacheEntry[K, V]{key: key, value: value, expires: expires})
+	for el := c.order.Back(); el != nil && el.Value.(*cacheEntry[K, V]).expired(now); el = c.order.Back() {
+		c.removeLocked(el)
+		cacheEvictions.WithLabelValues(c.name, "expired").Inc()
+	}
+	for el := c.order.Back(); el != nil && c.max > 0 && len(c.items) > c.max; {
+		prev := el.Prev()
+		if c.pinned == nil || !c.pinned(el.Value.(*cacheEntry[K, V]).value) {
+			c.removeLocked(el)
+			cacheEvictions.WithLabelValues(c.name, "capacity").Inc()
+		}
+		el = prev
+	}
+	cacheEntries.WithLabelValues(c.name).Set(float64(len(c.items)))
+}
+
+func (c *cache[K, V]) removeLocked(el *list.Element) {
+	delete(c.items, el.Value.(*cacheEntry[K, V]).key)
+	c.order.Remove(el)
+	cacheEntries.WithLabelValues(c.name).Set(float64(len(c.items)))
+}
+
+func (e *cacheEntry[K, V]) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
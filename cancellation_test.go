@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// countdownContext reports itself cancelled once Err has been asked n
+// times, so a test can cancel work part way through a loop.
+type countdownContext struct {
+	context.Context
+	left atomic.Int64
+}
+
+func cancelAfterChecks(n int64) *countdownContext {
+	ctx := &countdownContext{Context: context.Background()}
+	ctx.left.Store(n)
+	return ctx
+}
+
+func (c *countdownContext) Err() error {
+	if c.left.Add(-1) < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func testUUID(i int) uuid.UUID {
+	return uuid.NewSHA1(uuid.Nil, []byte{byte(i)})
+}
+
+func cancelledContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+func TestScoreStopsWhenCancelled(t *testing.T) {
+	for _, receipt := range []Receipt{smallBenchReceipt, largeBenchReceipt} {
+		results, err := scoreReceipt(cancelledContext(), receipt)
+		if !errors.Is(err, context.Canceled) || results != nil {
+			t.Errorf("%d items, cancelled before scoring: %v, %v", len(receipt.Items), results, err)
+		}
+		// Two rules in, the rest must not run.
+		ctx := cancelAfterChecks(2)
+		results, err = scoreReceipt(ctx, receipt)
+		if !errors.Is(err, context.Canceled) || results != nil {
+			t.Errorf("%d items, cancelled while scoring: %v, %v", len(receipt.Items), results, err)
+		}
+		if left := ctx.left.Load(); left != -1 {
+			t.Errorf("%d items: scoring checked the context %d more times after it was cancelled", len(receipt.Items), -1-left)
+		}
+	}
+}
+
+func TestCalculatePointsReturnsContextError(t *testing.T) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if _, err := calculatePoints(ctx, largeBenchReceipt); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("calculatePoints past its deadline returned %v", err)
+	}
+}
+
+func TestReceiptHashStopsWhenCancelled(t *testing.T) {
+	if _, err := receiptHash(cancelAfterChecks(1), largeBenchReceipt); !errors.Is(err, context.Canceled) {
+		t.Errorf("hashing cancelled after the first item returned %v", err)
+	}
+}
+
+func TestCorrectTotalStopsWhenCancelled(t *testing.T) {
+	saved := autocorrectTotals
+	defer func() { autocorrectTotals = saved }()
+	autocorrectTotals = true
+
+	receipt := largeBenchReceipt
+	receipt.Total = "3535"
+	correction, err := correctTotal(cancelAfterChecks(2), &receipt)
+	if !errors.Is(err, context.Canceled) || correction != nil || receipt.Total != "3535" {
+		t.Errorf("cancelled correction: %v, %v, total %q", correction, err, receipt.Total)
+	}
+	correction, err = correctTotal(context.Background(), &receipt)
+	if err != nil || correction == nil || receipt.Total != "35.35" {
+		t.Errorf("correction: %v, %v, total %q", correction, err, receipt.Total)
+	}
+}
+
+func TestStoreListStopsWhenCancelled(t *testing.T) {
+	bolt, err := openBoltStore(filepath.Join(t.TempDir(), "receipts.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bolt.db.Close()
+	for name, backend := range map[string]receiptStore{"memory": newMemoryStore(), "bolt": bolt} {
+		ctx := context.Background()
+		for i := range 3 {
+			stored := &storedReceipt{ID: receiptID(defaultTenant, testUUID(i)), Tenant: defaultTenant, Receipt: largeBenchReceipt, Hash: string(rune('a' + i)), CreatedAt: time.Now()}
+			if _, err := backend.Create(ctx, stored, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := backend.List(cancelledContext(), nil); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: list with a cancelled context returned %v", name, err)
+		}
+		visited := 0
+		_, err := backend.List(cancelAfterChecks(2), func(*storedReceipt) bool {
+			visited++
+			return true
+		})
+		if !errors.Is(err, context.Canceled) || visited == 3 {
+			t.Errorf("%s: list cancelled part way visited %d receipts and returned %v", name, visited, err)
+		}
+		if _, err := backend.Get(cancelledContext(), receiptID(defaultTenant, testUUID(0))); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: get with a cancelled context returned %v", name, err)
+		}
+	}
+}
+
+func TestSubmitReceiptStoresNothingWhenCancelled(t *testing.T) {
+	saved := store
+	defer func() { store = saved }()
+	store = newMemoryStore()
+
+	receipt := largeBenchReceipt
+	receipt.Items = make([]Item, len(largeBenchReceipt.Items))
+	for i, item := range largeBenchReceipt.Items {
+		item.Quantity = 1
+		receipt.Items[i] = item
+	}
+	for _, checks := range []int64{0, 1, 3} {
+		_, err := submitReceipt(cancelAfterChecks(checks), submission{tenant: defaultTenant, receipt: receipt, channel: channelAPI})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("cancelled after %d checks: submitReceipt returned %v", checks, err)
+		}
+	}
+	stored, err := store.List(context.Background(), nil)
+	if err != nil || len(stored) != 0 {
+		t.Errorf("cancelled submissions stored %d receipts (%v)", len(stored), err)
+	}
+	if _, err := submitReceipt(context.Background(), submission{tenant: defaultTenant, receipt: receipt, channel: channelAPI}); err != nil {
+		t.Errorf("uncancelled submission failed: %v", err)
+	}
+}
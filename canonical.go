@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+var decimalPattern = regexp.MustCompile(`^(-?)(\d+)(?:\.(\d*))?$`)
+
+// canonicalJSON renders a receipt in the canonical form used for receipt
+// identity. Two submissions describing the same purchase produce identical
+// bytes, so clients can compute the same hash we do:
+//
+//   - object keys are sorted lexicographically at every level
+//   - no insignificant whitespace; HTML characters are not escaped
+//   - string values are trimmed and inner whitespace runs collapse to one space
+//   - money values (total, price) written as plain decimals lose leading
+//     integer zeros and are padded to at least two fraction digits, e.g. "9",
+//     "09.0" and "9.00" all become "9.00"; extra fraction digits are kept
+//     (without trailing zeros past the second) rather than rounded away
+//   - item order is preserved, since it is part of the receipt
+//   - the receipt is hashed after schema migration, so a version 1 payload and
+//     the equivalent current-version payload share an identity; schemaVersion
+//     itself is not part of the canonical form
+//   - customerId and location are excluded: the same purchase submitted by
+//     two customers, or with and without store details, is the same receipt
+//   - timeZone and metadata are excluded too: the zone only says how to read
+//     the purchase time, and metadata is the submitter's own reference data
+//
+// It stops early, returning ctx's error, once ctx is done.
+func canonicalJSON(ctx context.Context, receipt Receipt) ([]byte, error) {
+	items := make([]any, 0, len(receipt.Items))
+	for _, item := range receipt.Items {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		items = append(items, map[string]any{
+			"category":         canonicalText(item.Category),
+			"price":            canonicalAmount(item.Price),
+			"quantity":         item.Quantity,
+			"shortDescription": canonicalText(item.ShortDescription),
+		})
+	}
+	doc := map[string]any{
+		"currency":     canonicalText(receipt.Currency),
+		"items":        items,
+		"purchaseDate": canonicalText(receipt.PurchaseDate),
+		"purchaseTime": canonicalText(receipt.PurchaseTime),
+		"retailer":     canonicalText(receipt.Retailer),
+		"total":        canonicalAmount(receipt.Total),
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// receiptHash is the hex SHA-256 of the receipt's canonical JSON.
+func receiptHash(ctx context.Context, receipt Receipt) (string, error) {
+	data, err := canonicalJSON(ctx, receipt)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func canonicalText(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func canonicalAmount(s string) string {
+	s = strings.TrimSpace(s)
+	m := decimalPattern.FindStringSubmatch(s)
+	if m == nil {
+		return s
+	}
+	whole := strings.TrimLeft(m[2], "0")
+	if whole == "" {
+		whole = "0"
+	}
+	frac := m[3]
+	for len(frac) > 2 && strings.HasSuffix(frac, "0") {
+		frac = frac[:len(frac)-1]
+	}
+	for len(frac) < 2 {
+		frac += "0"
+	}
+	return m[1] + whole + "." + frac
+}
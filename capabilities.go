@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /capabilities tells a client, before it sends anything, what this
+// deployment accepts: the receipt schema versions, which optional receipt
+// fields and features are on, and the limits in force for the requesting
+// tenant, so one generic client can adapt to each deployment at runtime
+// instead of being configured per environment. It reports configuration
+// only, never data, and needs no credentials. A limit of 0 is no limit.
+
+type capability struct {
+	Enabled bool   `json:"enabled"`
+	Default string `json:"default,omitempty"`
+	// Since is the first schema version with the field.
+	Since int `json:"since,omitempty"`
+}
+
+func getCapabilities(c *gin.Context) {
+	tenant := tenantID(c)
+	languages := make([]string, len(supportedLanguages))
+	for i, tag := range supportedLanguages {
+		languages[i] = tag.String()
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"schemaVersions": gin.H{"min": 1, "current": currentSchemaVersion},
+		"fields": gin.H{
+			"quantity":   capability{Enabled: true, Default: "1", Since: 2},
+			"currency":   capability{Enabled: true, Default: "USD", Since: 2},
+			"categories": capability{Enabled: true, Default: "uncategorized", Since: 3},
+		},
+		"features": gin.H{
+			"async":             capability{Enabled: asyncWorkers > 0},
+			"webhooks":          capability{Enabled: subscriptionsEnabled},
+			"batch":             capability{Enabled: batchMaxReceipts > 0},
+			"stream":            capability{Enabled: true},
+			"images":            capability{Enabled: true},
+			"gzip":              capability{Enabled: true},
+			"connect":           capability{Enabled: true},
+			"tenantPrefixedIds": capability{Enabled: tenantPrefixedIDs},
+			"itemTotalChecks":   capability{Enabled: validateItemTotals},
+			"totalAutocorrect":  capability{Enabled: autocorrectTotals},
+			"sandboxClock":      capability{Enabled: sandboxMode},
+			"quarantineFuture":  capability{Enabled: quarantineFuture},
+			"customerEmails":    capability{Enabled: customerEmails},
+			"apiKeysRequired":   capability{Enabled: apiKeysRequired},
+		},
+		"limits": gin.H{
+			"batchMaxReceipts":       batchMaxReceipts,
+			"streamMaxLineBytes":     streamMaxLineBytes,
+			"maxDecompressedBytes":   maxDecompressedBytes,
+			"imageMaxBytes":          maxImageBytes,
+			"metadataMaxKeys":        metadataMaxKeys,
+			"metadataMaxBytes":       metadataMaxBytes,
+			"asyncQueueLimit":        async.limit,
+			"pointsMaxWait":          pointsMaxWait.String(),
+			"requestTimeout":         defaultRequestTimeout.String(),
+			"processTimeout":         routeTimeouts["/receipts/process"].String(),
+			"submissionDeadlineDays": submissionDeadlineDays,
+			"tenantMaxInFlight":      tenantLimit(tenant),
+			"tenantQueueWait":        tenantQueueWait.String(),
+			"quarantineMaxItems":     quarantineMaxItems,
+			"pointsExpireAfter":      pointsExpireAfter.String(),
+		},
+		"languages": languages,
+		"tenant":    tenant,
+	})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Rejected payload capture keeps a redacted copy of JSON bodies that were
+// answered with 400, under a reference ID returned in the error, so support
+// can see exactly what an integrator sent. It is off unless
+// REJECTED_CAPTURE_TTL is set; captures are held in memory until they
+// expire.
+var (
+	rejectedCaptureTTL      = envDuration("REJECTED_CAPTURE_TTL", 0)
+	rejectedCaptureMaxBytes = envInt("REJECTED_CAPTURE_MAX_BYTES", 64<<10)
+	rejectedCaptureLimit    = envInt("REJECTED_CAPTURE_LIMIT", 10000)
+
+	capturesMu sync.Mutex
+	captures   = make(map[string]*rejectedCapture)
+)
+
+type rejectedCapture struct {
+	Reference  string    `json:"reference"`
+	Client     string    `json:"client"`
+	Tenant     string    `json:"tenant"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Error      string    `json:"error"`
+	Body       string    `json:"body"`
+	Truncated  bool      `json:"truncated"`
+	ReceivedAt time.Time `json:"receivedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+var (
+	redactedKeys = map[string]bool{"customerid": true, "email": true, "phone": true, "cardnumber": true, "card": true}
+
+	cardNumberPattern = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+	emailPattern      = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+)
+
+const redacted = "[redacted]"
+
+// rejectionWriter holds back a 400 response body so the capture reference
+// can be added to it.
+type rejectionWriter struct {
+	gin.ResponseWriter
+	held bytes.Buffer
+}
+
+func (w *rejectionWriter) Write(data []byte) (int, error) {
+	if w.Status() == http.StatusBadRequest {
+		return w.held.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *rejectionWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Unwrap lets http.ResponseController reach the connection, as streaming
+// responses need.
+func (w *rejectionWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+type replayBody struct {
+	io.Reader
+	io.Closer
+}
+
+// captureRejected is middleware implementing rejected payload capture.
+func captureRejected(c *gin.Context) {
+	if rejectedCaptureTTL <= 0 || c.Request.Body == nil || !capturableContentType(c.ContentType()) {
+		c.Next()
+		return
+	}
+	body := c.Request.Body
+	data, _ := io.ReadAll(io.LimitReader(body, int64(rejectedCaptureMaxBytes)+1))
+	c.Request.Body = replayBody{io.MultiReader(bytes.NewReader(data), body), body}
+	truncated := len(data) > rejectedCaptureMaxBytes
+	if truncated {
+		data = data[:rejectedCaptureMaxBytes]
+	}
+
+	w := &rejectionWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	c.Next()
+	c.Writer = w.ResponseWriter
+
+	if w.Status() != http.StatusBadRequest {
+		return
+	}
+	var resp map[string]any
+	if json.Unmarshal(w.held.Bytes(), &resp) != nil {
+		w.ResponseWriter.Write(w.held.Bytes())
+		return
+	}
+	now := clock.Now().UTC()
+	capture := &rejectedCapture{
+		Reference:  "rej_" + uuid.New().String(),
+		Client:     clientID(c),
+		Tenant:     tenantID(c),
+		Method:     c.Request.Method,
+		Path:       c.Request.URL.Path,
+		Body:       string(redactPayload(data)),
+		Truncated:  truncated,
+		ReceivedAt: now,
+		ExpiresAt:  now.Add(rejectedCaptureTTL),
+	}
+	capture.Error, _ = resp["error"].(string)
+	capturesMu.Lock()
+	if len(captures) < rejectedCaptureLimit {
+		captures[capture.Reference] = capture
+		resp["reference"] = capture.Reference
+	}
+	capturesMu.Unlock()
+
+	out, _ := json.Marshal(resp)
+	w.ResponseWriter.Write(out)
+}
+
+// capturableContentType skips uploads; receipt bodies are parsed as JSON
+// whatever their declared type.
+func capturableContentType(contentType string) bool {
+	return contentType != "multipart/form-data" && !strings.HasPrefix(contentType, "image/") && contentType != "application/octet-stream"
+}
+
+// redactPayload masks customer identifiers, emails and card-like digit runs.
+// JSON bodies are redacted field by field; anything that does not parse is
+// redacted as text.
+func redactPayload(data []byte) []byte {
+	var doc any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		text := cardNumberPattern.ReplaceAll(data, []byte(redacted))
+		return emailPattern.ReplaceAll(text, []byte(redacted))
+	}
+	out, err := json.Marshal(redactValue(doc))
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+func redactValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if redactedKeys[strings.ToLower(key)] {
+				v[key] = redacted
+			} else {
+				v[key] = redactValue(value)
+			}
+		}
+		return v
+	case []any:
+		for i, value := range v {
+			v[i] = redactValue(value)
+		}
+		return v
+	case string:
+		return emailPattern.ReplaceAllString(cardNumberPattern.ReplaceAllString(v, redacted), redacted)
+	default:
+		return v
+	}
+}
+
+// expireCaptures drops captures past their TTL.
+func expireCaptures(now time.Time) {
+	capturesMu.Lock()
+	for ref, capture := range captures {
+		if now.After(capture.ExpiresAt) {
+			delete(captures, ref)
+		}
+	}
+	capturesMu.Unlock()
+}
+
+// getRejectedCapture serves GET /admin/rejections/:ref.
+func getRejectedCapture(c *gin.Context) {
+	capturesMu.Lock()
+	capture, ok := captures[c.Param("ref")]
+	if ok && clock.Now().After(capture.ExpiresAt) {
+		ok = false
+	}
+	capturesMu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rejected payload not found or expired"})
+		return
+	}
+	c.JSON(http.StatusOK, capture)
+}
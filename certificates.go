@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Point certificates let downstream systems verify awards offline. GET
+// /receipts/:id/certificate returns the statement {receiptId, points,
+// rulesVersion, timestamp} as a compact JWS signed with Ed25519 ("EdDSA"),
+// and GET /.well-known/jwks.json publishes the public key. The key is the
+// PKCS #8 PEM file at POINTS_SIGNING_KEY_FILE (openssl genpkey -algorithm
+// ed25519); without one a key is generated at startup, which only suits
+// development since its certificates stop verifying after a restart.
+
+var (
+	signingKey   ed25519.PrivateKey
+	signingKeyID string
+)
+
+func loadSigningKey(path string) error {
+	if path == "" {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		log.Printf("POINTS_SIGNING_KEY_FILE is not set; signing point certificates with a temporary key")
+		setSigningKey(key)
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("%s: no PEM block", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return errors.New(path + ": not an Ed25519 private key")
+	}
+	setSigningKey(key)
+	return nil
+}
+
+// setSigningKey installs key; its ID is derived from the public key so it
+// stays the same across restarts with the same key file.
+func setSigningKey(key ed25519.PrivateKey) {
+	sum := sha256.Sum256(key.Public().(ed25519.PublicKey))
+	signingKey, signingKeyID = key, base64.RawURLEncoding.EncodeToString(sum[:8])
+}
+
+type pointsStatement struct {
+	ReceiptID    string `json:"receiptId"`
+	Points       int    `json:"points"`
+	RulesVersion string `json:"rulesVersion"`
+	Timestamp    int64  `json:"timestamp"` // Unix seconds
+}
+
+// signStatement returns the statement as a compact JWS.
+func signStatement(statement pointsStatement) (string, error) {
+	header, err := json.Marshal(gin.H{"alg": "EdDSA", "kid": signingKeyID, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(signingKey, []byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// getCertificate serves GET /receipts/:id/certificate for accepted
+// receipts. Points are the receipt's current net points.
+func getCertificate(c *gin.Context) {
+	stored, err := store.Get(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	if stored.Status != receiptAccepted {
+		c.JSON(http.StatusConflict, gin.H{"error": "Receipt has not been accepted", "status": stored.Status})
+		return
+	}
+	statement := pointsStatement{
+		ReceiptID:    stored.ID,
+		Points:       stored.netPoints(),
+		RulesVersion: stored.RulesVersion,
+		Timestamp:    clock.Now().Unix(),
+	}
+	certificate, err := signStatement(statement)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not sign certificate"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"statement": statement, "certificate": certificate, "kid": signingKeyID})
+}
+
+// getJWKS serves GET /.well-known/jwks.json.
+func getJWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=3600")
+	c.JSON(http.StatusOK, gin.H{"keys": []gin.H{{
+		"kty": "OKP",
+		"crv": "Ed25519",
+		"x":   base64.RawURLEncoding.EncodeToString(signingKey.Public().(ed25519.PublicKey)),
+		"kid": signingKeyID,
+		"use": "sig",
+		"alg": "EdDSA",
+	}}})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Every receipt records the channel it came in through: api for plain
+// submissions, batch for batch and backfill imports, ocr-upload for
+// submissions with a receipt image, email for receipts forwarded by the
+// mail gateway, and file-drop for files ingested from the drop folder.
+// Integrations name their channel in X-Submission-Channel; otherwise it
+// follows from the endpoint. file-drop is internal and cannot be named.
+//
+// CHANNEL_RULES_FILE adjusts scoring per channel, e.g.
+//
+//	{"ocr-upload": {"maxPoints": 100}}
+//
+// caps OCR-sourced receipts at 100 points until an admin verifies them with
+// POST /admin/receipts/:id/verify. The cap is a "channel_cap" ledger entry,
+// so the earned points and breakdown stay as scored; verifying adds a
+// "channel_cap_release" entry that gives the difference back.
+
+const (
+	channelAPI       = "api"
+	channelBatch     = "batch"
+	channelOCRUpload = "ocr-upload"
+	channelEmail     = "email"
+	channelFileDrop  = "file-drop"
+)
+
+// submissionChannels are those clients may name; internalChannels are
+// only set by the service itself.
+var (
+	submissionChannels = []string{channelAPI, channelBatch, channelOCRUpload, channelEmail}
+	internalChannels   = []string{channelFileDrop}
+)
+
+type channelRule struct {
+	MaxPoints int `json:"maxPoints"`
+}
+
+var channelRules = map[string]channelRule{}
+
+func loadChannelRules(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	rules := make(map[string]channelRule)
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	for channel, rule := range rules {
+		if !slices.Contains(submissionChannels, channel) && !slices.Contains(internalChannels, channel) {
+			return fmt.Errorf("unknown channel %q", channel)
+		}
+		if rule.MaxPoints < 0 {
+			return fmt.Errorf("maxPoints for %q must not be negative", channel)
+		}
+	}
+	channelRules = rules
+	return nil
+}
+
+// submissionChannel returns the channel named in X-Submission-Channel, or
+// fallback, the endpoint's channel, when there is none. A named channel
+// may not be capped more loosely than fallback, so naming one never lifts
+// a cap. It answers 400 and returns false for an unknown or looser channel.
+func submissionChannel(c *gin.Context, fallback string) (string, bool) {
+	channel := c.GetHeader("X-Submission-Channel")
+	if channel == "" {
+		return fallback, true
+	}
+	if !slices.Contains(submissionChannels, channel) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown submission channel", "channels": submissionChannels})
+		return "", false
+	}
+	if channelCap(channel) > channelCap(fallback) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Submission channel is less restricted than this endpoint allows", "channel": fallback})
+		return "", false
+	}
+	return channel, true
+}
+
+// channelCap is the most points a channel's receipts keep until verified.
+func channelCap(channel string) int {
+	if rule := channelRules[channel]; rule.MaxPoints > 0 {
+		return rule.MaxPoints
+	}
+	return math.MaxInt
+}
+
+// applyChannelCap caps a newly accepted receipt's points under its
+// channel's rule, unless it has been verified.
+func applyChannelCap(s *storedReceipt) []outboxEvent {
+	rule, ok := channelRules[s.Channel]
+	if !ok || rule.MaxPoints == 0 || s.VerifiedAt != nil {
+		return nil
+	}
+	excess := s.netPoints() - rule.MaxPoints
+	if excess <= 0 {
+		return nil
+	}
+	entry := ledgerEntry{
+		ID:        uuid.New().String(),
+		Kind:      "channel_cap",
+		Points:    -excess,
+		Reason:    fmt.Sprintf("%s receipts are capped at %d points until verified", s.Channel, rule.MaxPoints),
+		CreatedAt: clock.Now().UTC(),
+	}
+	s.Ledger = append(s.Ledger, entry)
+	return pointsAdjustedEvents(s, entry)
+}
+
+// verifyReceipt serves POST /admin/receipts/:id/verify, lifting any channel
+// cap on the receipt. Verifying twice changes nothing.
+func verifyReceipt(c *gin.Context) {
+	stored, err := store.Apply(c.Request.Context(), c.Param("id"), func(s *storedReceipt) ([]outboxEvent, error) {
+		if s.VerifiedAt != nil {
+			return nil, nil
+		}
+		now := clock.Now().UTC()
+		s.VerifiedAt = &now
+		capped := 0
+		for _, entry := range s.Ledger {
+			if entry.Kind == "channel_cap" || entry.Kind == "channel_cap_release" {
+				capped += entry.Points
+			}
+		}
+		if capped >= 0 {
+			return nil, nil
+		}
+		entry := ledgerEntry{ID: uuid.New().String(), Kind: "channel_cap_release", Points: -capped, Reason: "verified", CreatedAt: now}
+		s.Ledger = append(s.Ledger, entry)
+		return pointsAdjustedEvents(s, entry), nil
+	})
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": stored.ID, "channel": stored.Channel, "verifiedAt": stored.VerifiedAt, "points": stored.netPoints()})
+}
+
+var channelDaily = make(map[int64]map[string]*seriesBucket)
+
+func recordChannelRollup(day int64, stored *storedReceipt) {
+	channel := stored.Channel
+	if channel == "" {
+		channel = "unknown"
+	}
+	byChannel, ok := channelDaily[day]
+	if !ok {
+		byChannel = make(map[string]*seriesBucket)
+		channelDaily[day] = byChannel
+	}
+	bucket, ok := byChannel[channel]
+	if !ok {
+		bucket = &seriesBucket{}
+		byChannel[channel] = bucket
+	}
+	bucket.Receipts++
+	bucket.Points += int64(stored.Points)
+}
+
+// getChannelAnalytics serves GET /analytics/channels: receipts and points
+// per submission channel between from and to.
+func getChannelAnalytics(c *gin.Context) {
+	from, to, err := timeRange(c, 30*24*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid time range: use RFC 3339 timestamps or YYYY-MM-DD dates with from before to"})
+		return
+	}
+	from = startOfDay(from)
+	if to.Sub(from)/(24*time.Hour) > maxSeriesBuckets {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Requested range has too many buckets"})
+		return
+	}
+
+	totals := make(map[string]*seriesBucket)
+	analyticsMu.RLock()
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		for channel, bucket := range channelDaily[day.Unix()] {
+			sum, ok := totals[channel]
+			if !ok {
+				sum = &seriesBucket{}
+				totals[channel] = sum
+			}
+			sum.Receipts += bucket.Receipts
+			sum.Points += bucket.Points
+		}
+	}
+	analyticsMu.RUnlock()
+
+	type channelBucket struct {
+		Channel     string `json:"channel"`
+		Receipts    int    `json:"receipts"`
+		TotalPoints int64  `json:"totalPoints"`
+	}
+	buckets := make([]channelBucket, 0, len(totals))
+	for channel, sum := range totals {
+		buckets = append(buckets, channelBucket{channel, sum.Receipts, sum.Points})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Receipts > buckets[j].Receipts })
+	c.JSON(http.StatusOK, gin.H{"from": from, "to": to, "channels": buckets})
+}
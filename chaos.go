@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// chaosRule is one entry of the CHAOS_CONFIG_FILE JSON array. Route is a
+// registered path such as "/receipts/process" and Method an HTTP method;
+// either may be "*". Rates are probabilities between 0 and 1.
+type chaosRule struct {
+	Route         string  `json:"route"`
+	Method        string  `json:"method"`
+	Latency       string  `json:"latency"`
+	LatencyJitter string  `json:"latencyJitter"`
+	LatencyRate   float64 `json:"latencyRate"`
+	ErrorRate     float64 `json:"errorRate"`
+	ErrorStatus   int     `json:"errorStatus"`
+	PartialRate   float64 `json:"partialRate"`
+
+	latency, jitter time.Duration
+}
+
+// chaosRules are the rules loadChaos installed, for drift detection.
+var chaosRules []chaosRule
+
+// loadChaos returns fault-injection middleware when CHAOS_ENABLED=true,
+// for validating client retry logic in staging. It must never be enabled
+// in production: injected errors are indistinguishable from real ones
+// except for the X-Chaos-Injected header.
+func loadChaos() (gin.HandlerFunc, error) {
+	if os.Getenv("CHAOS_ENABLED") != "true" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(os.Getenv("CHAOS_CONFIG_FILE"))
+	if err != nil {
+		return nil, err
+	}
+	var rules []chaosRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse chaos config: %w", err)
+	}
+	for i := range rules {
+		r := &rules[i]
+		if r.Route == "" || r.Method == "" {
+			return nil, fmt.Errorf("chaos rule %d: route and method are required", i)
+		}
+		if r.Latency != "" {
+			if r.latency, err = time.ParseDuration(r.Latency); err != nil {
+				return nil, fmt.Errorf("chaos rule %d: latency: %w", i, err)
+			}
+		}
+		if r.LatencyJitter != "" {
+			if r.jitter, err = time.ParseDuration(r.LatencyJitter); err != nil {
+				return nil, fmt.Errorf("chaos rule %d: latencyJitter: %w", i, err)
+			}
+		}
+		if r.ErrorStatus == 0 {
+			r.ErrorStatus = http.StatusServiceUnavailable
+		}
+	}
+	chaosRules = rules
+	log.Printf("CHAOS MODE ENABLED: injecting faults on %d rules", len(rules))
+	return func(c *gin.Context) { injectChaos(c, rules) }, nil
+}
+
+func injectChaos(c *gin.Context, rules []chaosRule) {
+	var rule *chaosRule
+	for i := range rules {
+		r := &rules[i]
+		if (r.Route == "*" || r.Route == c.FullPath()) && (r.Method == "*" || r.Method == c.Request.Method) {
+			rule = r
+			break
+		}
+	}
+	if rule == nil {
+		c.Next()
+		return
+	}
+
+	if rule.latency > 0 && rand.Float64() < rule.LatencyRate {
+		delay := rule.latency
+		if rule.jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(rule.jitter)))
+		}
+		c.Header("X-Chaos-Injected", "latency")
+		select {
+		case <-time.After(delay):
+		case <-c.Request.Context().Done():
+		}
+	}
+	if rand.Float64() < rule.ErrorRate {
+		c.Header("X-Chaos-Injected", "error")
+		errorResponse(c, rule.ErrorStatus, "chaos_injected", "Injected failure")
+		return
+	}
+	if rand.Float64() < rule.PartialRate {
+		// The request is fully processed but its response is replaced, as
+		// if the connection broke after the work was committed.
+		w := &discardWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+		c.Header("X-Chaos-Injected", "partial")
+		c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": "Injected partial failure", "code": "chaos_injected"})
+		return
+	}
+	c.Next()
+}
+
+// discardWriter swallows the handler's response.
+type discardWriter struct {
+	gin.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *discardWriter) WriteHeader(code int)              { w.status = code }
+func (w *discardWriter) WriteHeaderNow()                   {}
+func (w *discardWriter) Write(data []byte) (int, error)    { return w.body.Write(data) }
+func (w *discardWriter) WriteString(s string) (int, error) { return w.body.WriteString(s) }
+func (w *discardWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+func (w *discardWriter) Written() bool { return w.status != 0 || w.body.Len() > 0 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const anonymousClient = "anonymous"
+
+// clientID identifies the integration behind a request by a fingerprint of
+// its X-API-Key header, so stats can be shared without exposing keys.
+func clientID(c *gin.Context) string {
+	key := strings.TrimSpace(c.GetHeader("X-API-Key"))
+	if key == "" {
+		return anonymousClient
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "key_" + hex.EncodeToString(sum[:6])
+}
+
+type clientCounters struct {
+	Submissions int
+	Accepted    int
+	Rejected    int
+	Duplicates  int
+	LastSeen    time.Time
+}
+
+var (
+	clientMu    sync.Mutex
+	clientStats = make(map[string]*clientCounters)
+)
+
+// trackSubmission is middleware for receipt submission routes. Handlers
+// mark duplicates with c.Set("duplicate", true); 4xx responses count as
+// rejections.
+func trackSubmission(c *gin.Context) {
+	c.Next()
+
+	status := c.Writer.Status()
+	outcome := ""
+	switch {
+	case status >= 200 && status < 300:
+		outcome = "accepted"
+		if c.GetBool("duplicate") {
+			outcome = "duplicate"
+		}
+	case status >= 400 && status < 500:
+		outcome = "rejected"
+	default:
+		return
+	}
+	submissionsTotal.WithLabelValues(outcome).Inc()
+	recordTenantSubmission(context.WithoutCancel(c.Request.Context()), tenantID(c), outcome)
+
+	id := clientID(c)
+	clientMu.Lock()
+	stats, ok := clientStats[id]
+	if !ok {
+		stats = &clientCounters{}
+		clientStats[id] = stats
+	}
+	stats.Submissions++
+	switch outcome {
+	case "accepted":
+		stats.Accepted++
+	case "duplicate":
+		stats.Accepted++
+		stats.Duplicates++
+	case "rejected":
+		stats.Rejected++
+	}
+	stats.LastSeen = clock.Now().UTC()
+	clientMu.Unlock()
+}
+
+// getClientStats serves GET /admin/clients, worst rejection rate first.
+func getClientStats(c *gin.Context) {
+	type clientReport struct {
+		Client        string    `json:"client"`
+		Submissions   int       `json:"submissions"`
+		Accepted      int       `json:"accepted"`
+		Rejected      int       `json:"rejected"`
+		Duplicates    int       `json:"duplicates"`
+		RejectionRate float64   `json:"rejectionRate"`
+		DuplicateRate float64   `json:"duplicateRate"`
+		LastSeen      time.Time `json:"lastSeen"`
+	}
+
+	clientMu.Lock()
+	reports := make([]clientReport, 0, len(clientStats))
+	for id, stats := range clientStats {
+		report := clientReport{
+			Client:      id,
+			Submissions: stats.Submissions,
+			Accepted:    stats.Accepted,
+			Rejected:    stats.Rejected,
+			Duplicates:  stats.Duplicates,
+			LastSeen:    stats.LastSeen,
+		}
+		report.RejectionRate = float64(stats.Rejected) / float64(stats.Submissions)
+		if stats.Accepted > 0 {
+			report.DuplicateRate = float64(stats.Duplicates) / float64(stats.Accepted)
+		}
+		reports = append(reports, report)
+	}
+	clientMu.Unlock()
+
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].RejectionRate != reports[j].RejectionRate {
+			return reports[i].RejectionRate > reports[j].RejectionRate
+		}
+		return reports[i].Client < reports[j].Client
+	})
+	c.JSON(http.StatusOK, gin.H{"clients": reports})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Cohorts group customers by the month (UTC, by processing time) of their
+// first receipt. For every later month we record how many of the cohort's
+// customers came back and how many receipts they submitted.
+
+type cohortMonth struct {
+	Receipts  int
+	Customers map[string]struct{}
+}
+
+var (
+	customerFirstMonth = make(map[string]int)
+	cohortSizes        = make(map[int]int)
+	cohortActivity     = make(map[int]map[int]*cohortMonth)
+)
+
+func monthIndex(t time.Time) int {
+	return t.Year()*12 + int(t.Month()) - 1
+}
+
+func monthLabel(index int) string {
+	return fmt.Sprintf("%04d-%02d", index/12, index%12+1)
+}
+
+func recordCohortActivity(stored *storedReceipt) {
+	customer := stored.Receipt.CustomerID
+	if customer == "" {
+		return
+	}
+	month := monthIndex(stored.CreatedAt.UTC())
+	first, seen := customerFirstMonth[customer]
+	if !seen {
+		first = month
+		customerFirstMonth[customer] = month
+		cohortSizes[month]++
+	}
+
+	byOffset, ok := cohortActivity[first]
+	if !ok {
+		byOffset = make(map[int]*cohortMonth)
+		cohortActivity[first] = byOffset
+	}
+	activity, ok := byOffset[month-first]
+	if !ok {
+		activity = &cohortMonth{Customers: make(map[string]struct{})}
+		byOffset[month-first] = activity
+	}
+	activity.Receipts++
+	activity.Customers[customer] = struct{}{}
+}
+
+// getCohorts serves GET /analytics/cohorts. from and to are YYYY-MM months
+// (inclusive) selecting cohorts; the default is the last twelve months.
+func getCohorts(c *gin.Context) {
+	now := monthIndex(clock.Now().UTC())
+	from, to := now-11, now
+	for param, target := range map[string]*int{"from": &from, "to": &to} {
+		if raw := c.Query(param); raw != "" {
+			t, err := time.Parse("2006-01", raw)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "From and to must be YYYY-MM months"})
+				return
+			}
+			*target = monthIndex(t)
+		}
+	}
+	if from > to {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "From must not be after to"})
+		return
+	}
+
+	type retention struct {
+		Offset              int     `json:"monthsSinceFirst"`
+		ActiveCustomers     int     `json:"activeCustomers"`
+		Receipts            int     `json:"receipts"`
+		Retention           float64 `json:"retention"`
+		ReceiptsPerCustomer float64 `json:"receiptsPerCustomer"`
+	}
+	type cohort struct {
+		Cohort    string      `json:"cohort"`
+		Customers int         `json:"customers"`
+		Months    []retention `json:"months"`
+	}
+
+	// Under privacy the minimum count applies to customers, and months
+	// with too few active ones are left out of their cohort.
+	privacy := privacyFor(c)
+	cohorts := make([]cohort, 0)
+	analyticsMu.RLock()
+	for month := from; month <= to; month++ {
+		figure := "cohorts/" + monthLabel(month)
+		size, ok := privacy.count(figure, cohortSizes[month])
+		if size == 0 || !ok {
+			continue
+		}
+		entry := cohort{Cohort: monthLabel(month), Customers: size, Months: make([]retention, 0)}
+		for offset, activity := range cohortActivity[month] {
+			active, ok := privacy.count(figure+"/"+strconv.Itoa(offset), len(activity.Customers))
+			if !ok {
+				continue
+			}
+			receipts, _ := privacy.count(figure+"/"+strconv.Itoa(offset)+"/receipts", activity.Receipts)
+			entry.Months = append(entry.Months, retention{
+				Offset:              offset,
+				ActiveCustomers:     active,
+				Receipts:            receipts,
+				Retention:           min(1, float64(active)/float64(size)),
+				ReceiptsPerCustomer: float64(receipts) / float64(active),
+			})
+		}
+		sort.Slice(entry.Months, func(i, j int) bool { return entry.Months[i].Offset < entry.Months[j].Offset })
+		cohorts = append(cohorts, entry)
+	}
+	analyticsMu.RUnlock()
+
+	resp := gin.H{"cohorts": cohorts}
+	privacy.describe(resp)
+	c.JSON(http.StatusOK, resp)
+}
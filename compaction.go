@@ -0,0 +1,355 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bolt never gives pages back to the file system: a long-running store
+// grows to its high-water mark and keeps the free pages that updated
+// receipts and delivered events leave behind. Compaction copies the live
+// data into a fresh file and swaps it in while the store keeps serving.
+// The bulk copy reads a snapshot; writes committed meanwhile are journaled
+// by key and copied over in catch-up rounds, and only the last round and
+// the swap itself hold operations back, normally for milliseconds. POST
+// /admin/store/compact starts it and GET /admin/store/compact reports its
+// progress. The memory backend has nothing to compact.
+
+const (
+	compactionBatch     = 1000 // keys per write transaction on the new file
+	compactionCatchUps  = 5    // catch-up rounds before pausing regardless
+	compactionPauseKeys = 256  // journal size small enough to finish paused
+)
+
+var errCompactionRunning = errors.New("compaction is already running")
+
+type boltKey struct{ bucket, key string }
+
+// compactionJournal is the set of keys written since the snapshot.
+type compactionJournal struct {
+	mu   sync.Mutex
+	keys map[boltKey]struct{}
+}
+
+func newCompactionJournal() *compactionJournal {
+	return &compactionJournal{keys: make(map[boltKey]struct{})}
+}
+
+func (j *compactionJournal) add(keys []boltKey) {
+	j.mu.Lock()
+	for _, k := range keys {
+		j.keys[k] = struct{}{}
+	}
+	j.mu.Unlock()
+}
+
+// take empties the journal and returns what it held.
+func (j *compactionJournal) take() []boltKey {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	keys := make([]boltKey, 0, len(j.keys))
+	for k := range j.keys {
+		keys = append(keys, k)
+	}
+	clear(j.keys)
+	return keys
+}
+
+type compactionStatus struct {
+	// State is idle, running, done or failed; Phase, while running, is
+	// copying, catching_up or swapping.
+	State        string     `json:"state"`
+	Phase        string     `json:"phase,omitempty"`
+	TotalKeys    int64      `json:"totalKeys"`
+	CopiedKeys   int64      `json:"copiedKeys"`
+	CaughtUpKeys int64      `json:"caughtUpKeys"`
+	SizeBefore   int64      `json:"sizeBefore,omitempty"`
+	SizeAfter    int64      `json:"sizeAfter,omitempty"`
+	Paused       string     `json:"paused,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	StartedAt    *time.Time `json:"startedAt,omitempty"`
+	FinishedAt   *time.Time `json:"finishedAt,omitempty"`
+}
+
+// boltCompaction runs one compaction at a time and tracks its progress.
+type boltCompaction struct {
+	s *boltStore
+
+	mu     sync.Mutex
+	status compactionStatus
+	copied atomic.Int64
+	caught atomic.Int64
+}
+
+// compactableStore is implemented by backends that can compact their
+// files, and passed through by the wrappers around them.
+type compactableStore interface {
+	compaction() *boltCompaction
+}
+
+func storeCompaction() *boltCompaction {
+	if c, ok := store.(compactableStore); ok {
+		return c.compaction()
+	}
+	return nil
+}
+
+func (c *boltCompaction) current() compactionStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := c.status
+	if status.State == "" {
+		status.State = "idle"
+	}
+	status.CopiedKeys, status.CaughtUpKeys = c.copied.Load(), c.caught.Load()
+	return status
+}
+
+func (c *boltCompaction) update(fn func(*compactionStatus)) {
+	c.mu.Lock()
+	fn(&c.status)
+	c.mu.Unlock()
+}
+
+// start begins a compaction in the background.
+func (c *boltCompaction) start() (compactionStatus, error) {
+	c.mu.Lock()
+	if c.status.State == "running" {
+		c.mu.Unlock()
+		return c.current(), errCompactionRunning
+	}
+	now := clock.Now().UTC()
+	c.status = compactionStatus{State: "running", Phase: "copying", StartedAt: &now}
+	c.copied.Store(0)
+	c.caught.Store(0)
+	c.mu.Unlock()
+
+	go func() {
+		err := c.run()
+		finished := clock.Now().UTC()
+		c.update(func(status *compactionStatus) {
+			status.State, status.Phase, status.FinishedAt = "done", "", &finished
+			if err != nil {
+				status.State, status.Error = "failed", err.Error()
+			}
+		})
+		if err != nil {
+			log.Printf("compacting %s: %v", c.s.path, err)
+		}
+	}()
+	return c.current(), nil
+}
+
+func (c *boltCompaction) run() error {
+	s := c.s
+	tmp := s.path + ".compact"
+	os.Remove(tmp)
+	dst, err := bolt.Open(tmp, 0o600, &bolt.Options{Timeout: 5 * time.Second, NoSync: true})
+	if err != nil {
+		return err
+	}
+	swapped := false
+	defer func() {
+		if !swapped {
+			dst.Close()
+			os.Remove(tmp)
+			s.swapMu.Lock()
+			s.journal = nil
+			s.swapMu.Unlock()
+		}
+	}()
+
+	// Journaling starts with operations held back, so every write is either
+	// in the snapshot or in the journal.
+	s.swapMu.Lock()
+	s.journal = newCompactionJournal()
+	src, err := s.db.Begin(false)
+	s.swapMu.Unlock()
+	if err != nil {
+		return err
+	}
+	err = c.copySnapshot(src, dst)
+	src.Rollback()
+	if err != nil {
+		return err
+	}
+
+	c.update(func(status *compactionStatus) { status.Phase = "catching_up" })
+	var keys []boltKey
+	for range compactionCatchUps {
+		if keys = s.journal.take(); len(keys) <= compactionPauseKeys {
+			break
+		}
+		if err := s.view(func(tx *bolt.Tx) error { return c.copyKeys(tx, dst, keys) }); err != nil {
+			return err
+		}
+		keys = nil
+	}
+
+	c.update(func(status *compactionStatus) { status.Phase = "swapping" })
+	s.swapMu.Lock()
+	defer s.swapMu.Unlock()
+	paused := time.Now()
+	keys = append(keys, s.journal.take()...)
+	if err := s.db.View(func(tx *bolt.Tx) error { return c.copyKeys(tx, dst, keys) }); err != nil {
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	swapped = true
+	s.journal = nil
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	old := s.path + ".old"
+	if err := os.Rename(s.path, old); err != nil {
+		s.reopen(s.path)
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Rename(old, s.path)
+		s.reopen(s.path)
+		return err
+	}
+	if err := s.reopen(s.path); err != nil {
+		os.Rename(s.path, tmp)
+		os.Rename(old, s.path)
+		if reopenErr := s.reopen(s.path); reopenErr != nil {
+			log.Fatalf("reopening %s after failed compaction: %v", s.path, reopenErr)
+		}
+		return err
+	}
+	os.Remove(old)
+	c.update(func(status *compactionStatus) {
+		status.SizeAfter, status.Paused = fileSize(s.path), time.Since(paused).Round(time.Microsecond).String()
+	})
+	return nil
+}
+
+func (s *boltStore) reopen(path string) error {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	s.db = db
+	return nil
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// copySnapshot copies every bucket of src into dst, in batches.
+func (c *boltCompaction) copySnapshot(src *bolt.Tx, dst *bolt.DB) error {
+	var total int64
+	src.ForEach(func(_ []byte, b *bolt.Bucket) error {
+		total += int64(b.Stats().KeyN)
+		return nil
+	})
+	c.update(func(status *compactionStatus) { status.TotalKeys, status.SizeBefore = total, fileSize(c.s.path) })
+
+	return src.ForEach(func(name []byte, b *bolt.Bucket) error {
+		cursor := b.Cursor()
+		key, value := cursor.First()
+		for first := true; first || key != nil; first = false {
+			err := dst.Update(func(tx *bolt.Tx) error {
+				out, err := tx.CreateBucketIfNotExists(name)
+				if err != nil {
+					return err
+				}
+				if err := out.SetSequence(b.Sequence()); err != nil {
+					return err
+				}
+				out.FillPercent = 1 // keys arrive in order, so pages can be packed full
+				for n := 0; key != nil && n < compactionBatch; n++ {
+					if err := out.Put(key, value); err != nil {
+						return err
+					}
+					key, value = cursor.Next()
+					c.copied.Add(1)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// copyKeys brings the given keys, and each bucket's sequence, in dst up to
+// date with src.
+func (c *boltCompaction) copyKeys(src *bolt.Tx, dst *bolt.DB, keys []boltKey) error {
+	return dst.Update(func(tx *bolt.Tx) error {
+		err := src.ForEach(func(name []byte, b *bolt.Bucket) error {
+			out, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+			return out.SetSequence(b.Sequence())
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			in, out := src.Bucket([]byte(k.bucket)), tx.Bucket([]byte(k.bucket))
+			if in == nil || out == nil {
+				continue
+			}
+			if value := in.Get([]byte(k.key)); value != nil {
+				err = out.Put([]byte(k.key), value)
+			} else {
+				err = out.Delete([]byte(k.key))
+			}
+			if err != nil {
+				return err
+			}
+			c.caught.Add(1)
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) compaction() *boltCompaction { return &s.compactor }
+
+// startCompaction serves POST /admin/store/compact.
+func startCompaction(c *gin.Context) {
+	compaction := storeCompaction()
+	if compaction == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Store backend does not support compaction"})
+		return
+	}
+	status, err := compaction.start()
+	if errors.Is(err, errCompactionRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Compaction is already running", "compaction": status})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"compaction": status})
+}
+
+// getCompaction serves GET /admin/store/compact.
+func getCompaction(c *gin.Context) {
+	compaction := storeCompaction()
+	if compaction == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Store backend does not support compaction"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"compaction": compaction.current()})
+}
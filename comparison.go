@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// externalComparer forwards accepted receipts to a second scoring service,
+// such as the legacy system being migrated off, and records where its
+// points disagree with ours. The service receives the receipt JSON and
+// must answer {"points": n}. Comparisons run on their own workers from a
+// bounded queue; when the queue is full receipts are skipped, so a slow
+// external service never holds up ingestion.
+type externalComparer struct {
+	url      string
+	sample   float64
+	receipts chan *storedReceipt
+	http     *http.Client
+
+	mu         sync.Mutex
+	compared   int
+	matched    int
+	failed     int
+	skipped    int
+	byRule     map[string]int
+	mismatches []comparisonMismatch
+}
+
+type comparisonMismatch struct {
+	ReceiptID string       `json:"receiptId"`
+	Retailer  string       `json:"retailer"`
+	Points    int          `json:"points"`
+	External  int          `json:"external"`
+	Diff      int          `json:"diff"`
+	Breakdown []ruleResult `json:"breakdown"`
+	At        time.Time    `json:"at"`
+}
+
+const comparisonMismatchLimit = 500
+
+var (
+	comparisonsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "receipt_external_comparisons_total",
+		Help: "Receipts scored by the external comparison service, by result (match, mismatch, error or skipped).",
+	}, []string{"result"})
+	comparisonDiff = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "receipt_external_comparison_diff_points",
+		Help:    "Absolute points difference between this service and the external one, for mismatches.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	})
+)
+
+var comparer *externalComparer
+
+// newExternalComparerFromEnv returns nil unless COMPARE_SCORING_URL is set.
+// COMPARE_SCORING_SAMPLE is the fraction of receipts compared (default 1),
+// COMPARE_SCORING_QUEUE the queue length and COMPARE_SCORING_TIMEOUT the
+// per-request timeout.
+func newExternalComparerFromEnv() *externalComparer {
+	url := os.Getenv("COMPARE_SCORING_URL")
+	if url == "" {
+		return nil
+	}
+	return &externalComparer{
+		url:      url,
+		sample:   envFloat("COMPARE_SCORING_SAMPLE", 1),
+		receipts: make(chan *storedReceipt, envInt("COMPARE_SCORING_QUEUE", 1000)),
+		http:     &http.Client{Timeout: envDuration("COMPARE_SCORING_TIMEOUT", 5*time.Second)},
+		byRule:   make(map[string]int),
+	}
+}
+
+// compareScore queues a newly accepted receipt for comparison.
+func compareScore(stored *storedReceipt) {
+	if comparer == nil || rand.Float64() >= comparer.sample {
+		return
+	}
+	select {
+	case comparer.receipts <- stored.clone():
+	default:
+		comparer.mu.Lock()
+		comparer.skipped++
+		comparer.mu.Unlock()
+		comparisonsTotal.WithLabelValues("skipped").Inc()
+	}
+}
+
+// run compares queued receipts with the given number of workers until ctx
+// is done.
+func (e *externalComparer) run(ctx context.Context, workers int) {
+	for range workers {
+		go func() {
+			for {
+				select {
+				case stored := <-e.receipts:
+					e.compare(ctx, stored)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (e *externalComparer) compare(ctx context.Context, stored *storedReceipt) {
+	external, err := e.score(ctx, stored.Receipt)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err != nil {
+		e.failed++
+		comparisonsTotal.WithLabelValues("error").Inc()
+		if e.failed%100 == 1 {
+			log.Printf("external comparison: %v", err)
+		}
+		return
+	}
+	e.compared++
+	if external == stored.Points {
+		e.matched++
+		comparisonsTotal.WithLabelValues("match").Inc()
+		return
+	}
+	comparisonsTotal.WithLabelValues("mismatch").Inc()
+	diff := external - stored.Points
+	comparisonDiff.Observe(float64(max(diff, -diff)))
+	for _, result := range stored.Breakdown {
+		e.byRule[result.Rule]++
+	}
+	e.mismatches = append(e.mismatches, comparisonMismatch{
+		ReceiptID: stored.ID,
+		Retailer:  stored.Retailer,
+		Points:    stored.Points,
+		External:  external,
+		Diff:      diff,
+		Breakdown: stored.Breakdown,
+		At:        clock.Now().UTC(),
+	})
+	if len(e.mismatches) > comparisonMismatchLimit {
+		e.mismatches = e.mismatches[len(e.mismatches)-comparisonMismatchLimit:]
+	}
+}
+
+func (e *externalComparer) score(ctx context.Context, receipt Receipt) (int, error) {
+	body, err := json.Marshal(receipt)
+	if err != nil {
+		return 0, err
+	}
+	var result struct {
+		Points *int `json:"points"`
+	}
+	err = breakerFor("external-scoring").Do(func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := e.http.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("external scoring: %s", resp.Status)
+		}
+		return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if result.Points == nil {
+		return 0, fmt.Errorf("external scoring: response has no points")
+	}
+	return *result.Points, nil
+}
+
+// getComparisonReport serves GET /admin/comparison: match rates, the rules
+// that fired most often on mismatching receipts, and the latest mismatches.
+func getComparisonReport(c *gin.Context) {
+	if comparer == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "External comparison is not configured"})
+		return
+	}
+	comparer.mu.Lock()
+	defer comparer.mu.Unlock()
+	type ruleCount struct {
+		Rule       string `json:"rule"`
+		Mismatches int    `json:"mismatches"`
+	}
+	rules := make([]ruleCount, 0, len(comparer.byRule))
+	for rule, n := range comparer.byRule {
+		rules = append(rules, ruleCount{rule, n})
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Mismatches != rules[j].Mismatches {
+			return rules[i].Mismatches > rules[j].Mismatches
+		}
+		return rules[i].Rule < rules[j].Rule
+	})
+	var matchRate float64
+	if comparer.compared > 0 {
+		matchRate = float64(comparer.matched) / float64(comparer.compared)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"url":        comparer.url,
+		"compared":   comparer.compared,
+		"matched":    comparer.matched,
+		"mismatched": comparer.compared - comparer.matched,
+		"errors":     comparer.failed,
+		"skipped":    comparer.skipped,
+		"matchRate":  matchRate,
+		"rules":      rules,
+		"mismatches": append([]comparisonMismatch{}, comparer.mismatches...),
+	})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The service in proto/receipts/v1/receipts.proto is served with the
+// Connect protocol, so internal callers can use generated Connect clients:
+// a unary call is POST /receipts.v1.ReceiptService/<Method> with the
+// request message as JSON. Each method runs the same handler chain as its
+// REST route, with the message's fields moved to where that chain reads
+// them, and the REST response becomes the response message, or a Connect
+// error whose code follows the HTTP status. Only the JSON codec is served:
+// binary protobuf and the gRPC and gRPC-Web protocols need generated code
+// this service does not carry, and are refused with 415.
+
+const connectServicePath = "/receipts.v1.ReceiptService/"
+
+// connectMethod binds an RPC to a REST handler chain. params maps message
+// fields to path parameters and query to query parameters; body names the
+// field sent as the request body.
+type connectMethod struct {
+	name     string
+	params   map[string]string
+	query    []string
+	body     string
+	handlers []gin.HandlerFunc
+}
+
+func registerConnect(r *gin.Engine) {
+	methods := []connectMethod{
+		{name: "ProcessReceipt", body: "receipt", handlers: []gin.HandlerFunc{trackSubmission, idempotentReplay, processReceipt}},
+		{name: "GetReceipt", params: map[string]string{"id": "id"}, handlers: []gin.HandlerFunc{requireReceiptTenant, getReceipt}},
+		{name: "GetPoints", params: map[string]string{"id": "id"}, handlers: []gin.HandlerFunc{requireReceiptTenant, getPoints}},
+		{name: "GetBalance", params: map[string]string{"customerId": "id"}, query: []string{"asOf"}, handlers: []gin.HandlerFunc{getBalance}},
+	}
+	for _, m := range methods {
+		r.POST(connectServicePath+m.name, append([]gin.HandlerFunc{m.serve}, m.handlers...)...)
+	}
+}
+
+// connectCodes maps the REST handlers' statuses to Connect error codes.
+var connectCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_argument",
+	http.StatusUnauthorized:          "unauthenticated",
+	http.StatusForbidden:             "permission_denied",
+	http.StatusNotFound:              "not_found",
+	http.StatusConflict:              "failed_precondition",
+	http.StatusPreconditionFailed:    "failed_precondition",
+	http.StatusRequestEntityTooLarge: "resource_exhausted",
+	http.StatusUnsupportedMediaType:  "invalid_argument",
+	http.StatusUnprocessableEntity:   "invalid_argument",
+	http.StatusTooManyRequests:       "resource_exhausted",
+	http.StatusNotImplemented:        "unimplemented",
+	http.StatusServiceUnavailable:    "unavailable",
+	http.StatusGatewayTimeout:        "deadline_exceeded",
+}
+
+// connectStatuses is the HTTP status the Connect protocol gives each code.
+var connectStatuses = map[string]int{
+	"invalid_argument":    http.StatusBadRequest,
+	"unauthenticated":     http.StatusUnauthorized,
+	"permission_denied":   http.StatusForbidden,
+	"not_found":           http.StatusNotFound,
+	"failed_precondition": http.StatusBadRequest,
+	"resource_exhausted":  http.StatusTooManyRequests,
+	"unimplemented":       http.StatusNotImplemented,
+	"unavailable":         http.StatusServiceUnavailable,
+	"deadline_exceeded":   http.StatusGatewayTimeout,
+	"internal":            http.StatusInternalServerError,
+	"unknown":             http.StatusInternalServerError,
+}
+
+func connectCode(status int) string {
+	if code, ok := connectCodes[status]; ok {
+		return code
+	}
+	if status >= 500 {
+		return "internal"
+	}
+	return "unknown"
+}
+
+func connectError(c *gin.Context, code, message string) {
+	c.AbortWithStatusJSON(connectStatuses[code], gin.H{"code": code, "message": message})
+}
+
+// serve turns the Connect request into the REST one, runs the chain and
+// turns its response into a Connect response.
+func (m connectMethod) serve(c *gin.Context) {
+	mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	if mediaType != gin.MIMEJSON {
+		c.Header("Accept-Post", gin.MIMEJSON)
+		c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{"code": "unimplemented", "message": "Only the JSON codec is supported"})
+		return
+	}
+	if v := c.GetHeader("Connect-Protocol-Version"); v != "" && v != "1" {
+		connectError(c, "invalid_argument", "Unsupported Connect protocol version")
+		return
+	}
+	if raw := c.GetHeader("Connect-Timeout-Ms"); raw != "" {
+		ms, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || ms <= 0 {
+			connectError(c, "invalid_argument", "Connect-Timeout-Ms must be a positive integer")
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Duration(ms)*time.Millisecond)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+	}
+
+	msg := map[string]json.RawMessage{}
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, maxImageBytes))
+	if err == nil && len(bytes.TrimSpace(data)) > 0 {
+		err = json.Unmarshal(data, &msg)
+	}
+	if err != nil {
+		connectError(c, "invalid_argument", "Request message is not valid JSON")
+		return
+	}
+	for field, param := range m.params {
+		var value string
+		if raw, ok := msg[field]; !ok || json.Unmarshal(raw, &value) != nil || value == "" {
+			connectError(c, "invalid_argument", "Request message needs "+field)
+			return
+		}
+		c.Params = append(c.Params, gin.Param{Key: param, Value: value})
+	}
+	query := url.Values{}
+	for _, field := range m.query {
+		raw, ok := msg[field]
+		if !ok {
+			continue
+		}
+		var value string
+		if json.Unmarshal(raw, &value) != nil {
+			value = string(raw)
+		}
+		if value != "" {
+			query.Set(field, value)
+		}
+	}
+	c.Request.URL.RawQuery = query.Encode()
+	body := []byte("{}")
+	if m.body != "" && msg[m.body] != nil {
+		body = msg[m.body]
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	c.Request.ContentLength = int64(len(body))
+
+	w := &heldWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	c.Next()
+	c.Writer = w.ResponseWriter
+
+	status := w.Status()
+	if status >= 200 && status < 300 {
+		w.ResponseWriter.WriteHeader(http.StatusOK)
+		w.ResponseWriter.Write(w.held.Bytes())
+		return
+	}
+	var resp struct {
+		Error string `json:"error"`
+	}
+	json.Unmarshal(w.held.Bytes(), &resp)
+	if resp.Error == "" {
+		resp.Error = http.StatusText(status)
+	}
+	code := connectCode(status)
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(connectStatuses[code])
+	body, _ = json.Marshal(gin.H{"code": code, "message": resp.Error})
+	w.Header().Set("Content-Type", "application/json")
+	w.ResponseWriter.Write(body)
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const clockThreadCPUTime = 3 // CLOCK_THREAD_CPUTIME_ID
+
+// threadCPU returns the CPU time used by the calling thread.
+func threadCPU() (time.Duration, bool) {
+	var ts syscall.Timespec
+	if _, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockThreadCPUTime, uintptr(unsafe.Pointer(&ts)), 0); errno != 0 {
+		return 0, false
+	}
+	return time.Duration(ts.Nano()), true
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "time"
+
+// threadCPU reports that thread CPU time is not measured on this platform.
+func threadCPU() (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SUBMISSION_DEADLINE_DAYS limits how long after the purchase date a
+// receipt may be submitted; 0 (the default) disables the limit. A receipt
+// is on time through the whole cutoff day, purchaseDate plus N days in UTC.
+// SUBMISSION_DEADLINE_ACTION decides what happens to late receipts:
+// "reject" (the default) refuses them and "zero" stores them with no points.
+var (
+	submissionDeadlineDays   = envInt("SUBMISSION_DEADLINE_DAYS", 0)
+	submissionDeadlineAction = deadlineActionFromEnv()
+)
+
+const (
+	deadlineReject = "reject"
+	deadlineZero   = "zero"
+)
+
+func deadlineActionFromEnv() string {
+	switch action := os.Getenv("SUBMISSION_DEADLINE_ACTION"); action {
+	case "", deadlineReject:
+		return deadlineReject
+	case deadlineZero:
+		return deadlineZero
+	default:
+		log.Fatalf("SUBMISSION_DEADLINE_ACTION: must be reject or zero, got %q", action)
+		return ""
+	}
+}
+
+// submissionWindow is the deadline a receipt was submitted against.
+// DaysRemaining counts whole days left after the submission day and is
+// negative once the cutoff has passed.
+type submissionWindow struct {
+	Cutoff        string `json:"cutoff"`
+	DaysRemaining int    `json:"daysRemaining"`
+}
+
+func (w *submissionWindow) late() bool {
+	return w != nil && w.DaysRemaining < 0
+}
+
+// deadlineFor returns the receipt's submission window, or nil when no
+// deadline is configured or the purchase date does not parse.
+func deadlineFor(receipt Receipt, submittedAt time.Time) *submissionWindow {
+	if submissionDeadlineDays <= 0 {
+		return nil
+	}
+	purchased, err := time.Parse("2006-01-02", receipt.PurchaseDate)
+	if err != nil {
+		return nil
+	}
+	cutoff := purchased.AddDate(0, 0, submissionDeadlineDays)
+	return &submissionWindow{
+		Cutoff:        cutoff.Format("2006-01-02"),
+		DaysRemaining: int(cutoff.Sub(startOfDay(submittedAt.UTC())).Hours() / 24),
+	}
+}
+
+// zeroScoredLate reports whether a late receipt keeps its place but earns
+// nothing.
+func zeroScoredLate(w *submissionWindow) bool {
+	return w.late() && submissionDeadlineAction == deadlineZero
+}
+
+func deadlineResponse(resp gin.H, w *submissionWindow) {
+	if w == nil {
+		return
+	}
+	resp["submissionDeadline"] = w
+	if w.late() {
+		resp["zeroScored"] = true
+	}
+}
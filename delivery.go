@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+var webhookClient = &http.Client{Timeout: 15 * time.Second}
+
+var errSMTPNotConfigured = errors.New("SMTP_ADDR and SMTP_FROM must be set")
+
+func postWebhook(ctx context.Context, url, contentType string, body []byte) error {
+	return webhookBreaker(url).Do(func() error { return postWebhookOnce(ctx, url, contentType, body) })
+}
+
+func postWebhookOnce(ctx context.Context, url, contentType string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "receipt-processor")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// sendEmail sends a text message with one attachment through SMTP_ADDR
+// (host:port) from SMTP_FROM, authenticating when SMTP_USERNAME is set.
+func sendEmail(to []string, subject, text, filename, contentType string, attachment []byte) error {
+	addr, from := os.Getenv("SMTP_ADDR"), os.Getenv("SMTP_FROM")
+	if addr == "" || from == "" {
+		return errSMTPNotConfigured
+	}
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USERNAME"); user != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+
+	var msg bytes.Buffer
+	parts := multipart.NewWriter(&msg)
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\n", from, strings.Join(to, ", "), subject)
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", parts.Boundary())
+
+	body, err := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return err
+	}
+	io.WriteString(body, text)
+
+	if attachment != nil {
+		file, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {fmt.Sprintf(`attachment; filename="%s"`, filename)},
+		})
+		if err != nil {
+			return err
+		}
+		encoded := base64.StdEncoding.EncodeToString(attachment)
+		for len(encoded) > 76 {
+			io.WriteString(file, encoded[:76]+"\r\n")
+			encoded = encoded[76:]
+		}
+		io.WriteString(file, encoded+"\r\n")
+	}
+	if err := parts.Close(); err != nil {
+		return err
+	}
+
+	return breakerFor("smtp").Do(func() error { return smtp.SendMail(addr, auth, from, to, msg.Bytes()) })
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /admin/diagnose runs live checks against this replica and its
+// dependencies and reports each as pass, warn or fail, with what was
+// observed and, for anything short of pass, what to do about it, so whoever
+// is paged starts from a short list rather than the dashboards. The checks
+// run together under DIAGNOSE_TIMEOUT; one that runs out of time fails.
+// The overall status is the worst of them, and the answer is 200 whatever
+// it is.
+//
+// Clock skew is measured against Redis when leader election uses it, or
+// else against the Date header of DIAGNOSE_TIME_URL; with neither, the
+// check is skipped. Memory headroom is measured against GOMEMLIMIT, or the
+// container's cgroup limit.
+
+const (
+	diagnosePass    = "pass"
+	diagnoseWarn    = "warn"
+	diagnoseFail    = "fail"
+	diagnoseSkipped = "skipped"
+)
+
+var (
+	diagnoseTimeout = envDuration("DIAGNOSE_TIMEOUT", 5*time.Second)
+	diagnoseTimeURL = os.Getenv("DIAGNOSE_TIME_URL")
+
+	diagnoseStoreWarn = envDuration("DIAGNOSE_STORE_WARN", 100*time.Millisecond)
+	diagnoseStoreFail = envDuration("DIAGNOSE_STORE_FAIL", time.Second)
+	diagnoseOutboxAge = envDuration("DIAGNOSE_OUTBOX_MAX_AGE", time.Minute)
+	diagnoseClockWarn = envDuration("DIAGNOSE_CLOCK_WARN", 500*time.Millisecond)
+	diagnoseClockFail = envDuration("DIAGNOSE_CLOCK_FAIL", 5*time.Second)
+)
+
+type diagnosis struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Observed string `json:"observed"`
+	Action   string `json:"action,omitempty"`
+}
+
+type diagnosticCheck struct {
+	name string
+	run  func(ctx context.Context) diagnosis
+}
+
+var diagnosticChecks = []diagnosticCheck{
+	{"store latency", diagnoseStore},
+	{"async queue depth", diagnoseAsyncQueue},
+	{"webhook backlog", diagnoseWebhookBacklog},
+	{"memory headroom", diagnoseMemory},
+	{"clock skew", diagnoseClock},
+	{"circuit breakers", diagnoseBreakers},
+}
+
+func diagnoseStatusRank(status string) int {
+	switch status {
+	case diagnoseFail:
+		return 2
+	case diagnoseWarn:
+		return 1
+	}
+	return 0
+}
+
+func runDiagnostics(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), diagnoseTimeout)
+	defer cancel()
+	results := make([]diagnosis, len(diagnosticChecks))
+	var wg sync.WaitGroup
+	for i, check := range diagnosticChecks {
+		results[i] = diagnosis{Name: check.name, Status: diagnoseFail, Observed: "did not finish within " + diagnoseTimeout.String(),
+			Action: "The check itself is stuck; its dependency is probably unreachable."}
+		wg.Add(1)
+		done := make(chan diagnosis, 1)
+		go func() { done <- check.run(ctx) }()
+		go func() {
+			defer wg.Done()
+			select {
+			case d := <-done:
+				d.Name = check.name
+				results[i] = d
+			case <-ctx.Done():
+			}
+		}()
+	}
+	wg.Wait()
+
+	overall := diagnosePass
+	for _, d := range results {
+		if diagnoseStatusRank(d.Status) > diagnoseStatusRank(overall) {
+			overall = d.Status
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":    overall,
+		"checkedAt": time.Now().UTC(),
+		"checks":    results,
+	})
+}
+
+func diagnoseStore(ctx context.Context) diagnosis {
+	// Three lookups of an ID that cannot exist; the median is reported.
+	latencies := make([]time.Duration, 0, 3)
+	for range 3 {
+		start := time.Now()
+		_, err := store.Get(ctx, "diagnose-probe")
+		if err != nil && !errors.Is(err, errReceiptNotFound) {
+			return diagnosis{Status: diagnoseFail, Observed: "lookup failed: " + err.Error(),
+				Action: "Check the store backend (STORE_BACKEND, STORE_DSN) and the store circuit breaker; writes are being refused with 503."}
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	median := latencies[1]
+	d := diagnosis{Status: diagnosePass, Observed: "median lookup " + median.Round(time.Microsecond).String()}
+	switch {
+	case median >= diagnoseStoreFail:
+		d.Status = diagnoseFail
+		d.Action = "The store is too slow to serve requests in time; look for a long compaction, disk saturation or lock contention."
+	case median >= diagnoseStoreWarn:
+		d.Status = diagnoseWarn
+		d.Action = "Store lookups are slow; check disk latency and whether a compaction or large export is running."
+	}
+	return d
+}
+
+func diagnoseAsyncQueue(context.Context) diagnosis {
+	if asyncWorkers <= 0 || async.backend == nil {
+		return diagnosis{Status: diagnoseSkipped, Observed: "async processing is off"}
+	}
+	var parts []string
+	worst := 0.0
+	for _, priority := range []string{priorityInteractive, priorityBulk} {
+		queued := async.backend.queued(priority)
+		parts = append(parts, fmt.Sprintf("%s %d", priority, queued))
+		if async.limit > 0 {
+			worst = math.Max(worst, float64(queued)/float64(async.limit))
+		}
+	}
+	d := diagnosis{Status: diagnosePass, Observed: strings.Join(parts, ", ") + " queued"}
+	if async.limit > 0 {
+		d.Observed += fmt.Sprintf(" of %d", async.limit)
+	}
+	switch {
+	case worst >= 1:
+		d.Status = diagnoseFail
+		d.Action = "The queue is full and new async submissions get 503; add workers (ASYNC_WORKERS) or replicas, or find what slows processing."
+	case worst >= 0.8:
+		d.Status = diagnoseWarn
+		d.Action = "The queue is filling up; add workers (ASYNC_WORKERS) before it refuses submissions."
+	}
+	return d
+}
+
+func diagnoseWebhookBacklog(ctx context.Context) diagnosis {
+	if !eventsEnabled() {
+		return diagnosis{Status: diagnoseSkipped, Observed: "events are off"}
+	}
+	pending, err := store.PendingEvents(ctx, outboxBatchSize)
+	if err != nil {
+		return diagnosis{Status: diagnoseFail, Observed: "reading the outbox failed: " + err.Error(),
+			Action: "The outbox lives in the store; fix the store first."}
+	}
+	count := strconv.Itoa(len(pending))
+	if len(pending) == outboxBatchSize {
+		count = "at least " + count
+	}
+	d := diagnosis{Status: diagnosePass, Observed: count + " events pending"}
+	if len(pending) > 0 {
+		age := clock.Now().Sub(pending[0].CreatedAt).Round(time.Second)
+		d.Observed += ", oldest " + age.String() + " old"
+		if age > diagnoseOutboxAge {
+			d.Status = diagnoseFail
+			d.Action = "The outbox relay is not keeping up or EVENTS_WEBHOOK_URL is failing; check the relay log lines and the receiver, and that this deployment has a leader."
+		}
+	}
+	if subscriptionsEnabled {
+		live, bulk := len(subscriptionQueue), len(subscriptionBulkQueue)
+		batched, most := batchBacklog()
+		d.Observed += fmt.Sprintf("; %d of %d subscription deliveries queued, %d of %d bulk, %d events waiting in batches", live, cap(subscriptionQueue), bulk, cap(subscriptionBulkQueue), batched)
+		full := live >= cap(subscriptionQueue)*8/10 || bulk >= cap(subscriptionBulkQueue)*8/10 || most >= webhookBatchQueue*8/10
+		if full && d.Status == diagnosePass {
+			d.Status = diagnoseWarn
+			d.Action = "Subscription deliveries are backing up; a subscriber is slow or down. Deliveries beyond the queue, or beyond WEBHOOK_BATCH_QUEUE for a batched subscription, are dropped."
+		}
+	}
+	return d
+}
+
+func diagnoseMemory(context.Context) diagnosis {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	used := stats.Sys - stats.HeapReleased
+	limit, source := uint64(math.MaxInt64), "GOMEMLIMIT"
+	if l := debug.SetMemoryLimit(-1); l != math.MaxInt64 {
+		limit = uint64(l)
+	} else if l, ok := cgroupMemoryLimit(); ok {
+		limit, source = l, "cgroup limit"
+	} else {
+		return diagnosis{Status: diagnosePass, Observed: fmt.Sprintf("%d MiB in use, no memory limit set", used>>20)}
+	}
+	headroom := 1 - float64(used)/float64(limit)
+	d := diagnosis{Status: diagnosePass, Observed: fmt.Sprintf("%d MiB in use of %d MiB (%s), %.0f%% headroom", used>>20, limit>>20, source, headroom*100)}
+	switch {
+	case headroom < 0.1:
+		d.Status = diagnoseFail
+		d.Action = "The process is close to its memory limit and will be killed or thrash in GC; look for large exports or lists in flight, and raise the limit."
+	case headroom < 0.2:
+		d.Status = diagnoseWarn
+		d.Action = "Memory is running low; watch for growth and check for large responses or queues building up."
+	}
+	return d
+}
+
+// cgroupMemoryLimit reads the cgroup v2 memory limit, if there is one.
+func cgroupMemoryLimit() (uint64, bool) {
+	data, err := os.ReadFile("/sys/fs/cgroup/memory.max")
+	if err != nil {
+		return 0, false
+	}
+	limit, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	return limit, err == nil
+}
+
+func diagnoseClock(ctx context.Context) diagnosis {
+	var skew time.Duration
+	var against string
+	switch l := leader.(type) {
+	case *redisLeader:
+		start := time.Now()
+		remote, err := l.client.Time(ctx).Result()
+		if err != nil {
+			return diagnosis{Status: diagnoseFail, Observed: "reading Redis time failed: " + err.Error(),
+				Action: "Redis is unreachable, so leader election is failing too; check LEADER_REDIS_URL."}
+		}
+		skew = start.Add(time.Since(start) / 2).Sub(remote)
+		against = "Redis"
+	default:
+		if diagnoseTimeURL == "" {
+			return diagnosis{Status: diagnoseSkipped, Observed: "no time reference; set DIAGNOSE_TIME_URL or use Redis leader election"}
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, diagnoseTimeURL, nil)
+		if err != nil {
+			return diagnosis{Status: diagnoseFail, Observed: err.Error(), Action: "Fix DIAGNOSE_TIME_URL."}
+		}
+		start := time.Now()
+		resp, err := webhookClient.Do(req)
+		if err != nil {
+			return diagnosis{Status: diagnoseFail, Observed: "reaching " + diagnoseTimeURL + " failed: " + err.Error(),
+				Action: "Check DIAGNOSE_TIME_URL and outbound connectivity."}
+		}
+		resp.Body.Close()
+		remote, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			return diagnosis{Status: diagnoseFail, Observed: "no Date header from " + diagnoseTimeURL, Action: "Point DIAGNOSE_TIME_URL at a server that sends Date."}
+		}
+		// Date has whole seconds; compare the midpoint of the request.
+		skew = start.Add(time.Since(start) / 2).Truncate(time.Second).Sub(remote)
+		against = diagnoseTimeURL
+	}
+	d := diagnosis{Status: diagnosePass, Observed: fmt.Sprintf("%s off from %s", skew.Round(time.Millisecond), against)}
+	if sandboxMode {
+		d.Observed += fmt.Sprintf("; the sandbox clock runs %s ahead", clock.Now().Sub(time.Now()).Round(time.Second))
+	}
+	switch abs := max(skew, -skew); {
+	case abs >= diagnoseClockFail:
+		d.Status = diagnoseFail
+		d.Action = "The host clock is badly off, which breaks leader leases, token expiry and receipt timestamps; fix NTP on the host."
+	case abs >= diagnoseClockWarn:
+		d.Status = diagnoseWarn
+		d.Action = "The host clock is drifting; check NTP synchronisation."
+	}
+	return d
+}
+
+func diagnoseBreakers(context.Context) diagnosis {
+	breakersMu.Lock()
+	names := make([]string, 0, len(breakers))
+	states := make(map[string]breakerState, len(breakers))
+	for name, b := range breakers {
+		b.mu.Lock()
+		states[name] = b.state
+		b.mu.Unlock()
+		names = append(names, name)
+	}
+	breakersMu.Unlock()
+	sort.Strings(names)
+	var open, halfOpen []string
+	for _, name := range names {
+		switch states[name] {
+		case breakerOpen:
+			open = append(open, name)
+		case breakerHalfOpen:
+			halfOpen = append(halfOpen, name)
+		}
+	}
+	switch {
+	case len(open) > 0:
+		return diagnosis{Status: diagnoseFail, Observed: "open: " + strings.Join(open, ", "),
+			Action: "Calls to these dependencies are being refused; check each one's health, and the breaker closes by itself once a probe succeeds."}
+	case len(halfOpen) > 0:
+		return diagnosis{Status: diagnoseWarn, Observed: "half-open: " + strings.Join(halfOpen, ", "),
+			Action: "These dependencies failed recently and are being probed; watch whether they recover."}
+	}
+	return diagnosis{Status: diagnosePass, Observed: fmt.Sprintf("%d closed", len(names))}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// A subscription created with a "digest" object receives a digest.weekly
+// event once a week: the tenant's accepted receipts, points, quarantined
+// receipts, busiest retailers and submission rejection rate over the week
+// before. The digest object picks when the week turns over and how many
+// retailers to list:
+//
+//	"digest": {"weekday": "monday", "hour": 9, "timeZone": "America/Chicago", "topRetailers": 5}
+//
+// Every field is optional: the week turns over on Monday at midnight in
+// the program time zone and five retailers are listed by default. The
+// first digest covers the first full week after the subscription was
+// created, and digests are not caught up after downtime beyond the latest
+// week.
+//
+// Rejected submissions are not stored as receipts, so each tenant's daily
+// submission and rejection counts are kept as submission_counts records
+// for the digests to read. The digests due in a run are built together in
+// one pass over the store.
+
+type digestSchedule struct {
+	Weekday      string `json:"weekday"`
+	Hour         int    `json:"hour"`
+	TimeZone     string `json:"timeZone"`
+	TopRetailers int    `json:"topRetailers"`
+
+	loc *time.Location
+}
+
+// normalize fills in defaults and checks the schedule, returning a message
+// for the client when it is invalid.
+func (d *digestSchedule) normalize() string {
+	d.Weekday = strings.ToLower(d.Weekday)
+	if d.Weekday == "" {
+		d.Weekday = "monday"
+	}
+	if _, ok := weekdays[d.Weekday]; !ok {
+		return "Digest weekday must be a day name such as monday"
+	}
+	if d.Hour < 0 || d.Hour > 23 {
+		return "Digest hour must be between 0 and 23"
+	}
+	d.loc = programZone
+	if d.TimeZone != "" {
+		loc, err := loadZone(d.TimeZone)
+		if err != nil {
+			return "Digest timeZone is not a known IANA time zone"
+		}
+		d.loc = loc
+	} else {
+		d.TimeZone = programZone.String()
+	}
+	if d.TopRetailers == 0 {
+		d.TopRetailers = 5
+	}
+	if d.TopRetailers < 1 || d.TopRetailers > 50 {
+		return "Digest topRetailers must be between 1 and 50"
+	}
+	return ""
+}
+
+// weekEnd returns the latest turn of the week at or before t.
+func (d *digestSchedule) weekEnd(t time.Time) time.Time {
+	local := t.In(d.loc)
+	end := time.Date(local.Year(), local.Month(), local.Day(), d.Hour, 0, 0, 0, d.loc)
+	end = end.AddDate(0, 0, -((int(local.Weekday()) - int(weekdays[d.Weekday]) + 7) % 7))
+	if end.After(t) {
+		end = end.AddDate(0, 0, -7)
+	}
+	return end
+}
+
+type submissionCounts struct {
+	Submissions int `json:"submissions"`
+	Rejected    int `json:"rejected"`
+}
+
+// submissionCountsKey is the submission_counts key of tenant's counts for
+// the UTC day containing t.
+func submissionCountsKey(t time.Time, tenant string) string {
+	return t.UTC().Format(time.DateOnly) + "/" + tenant
+}
+
+func recordTenantSubmission(ctx context.Context, tenant, outcome string) {
+	key := submissionCountsKey(clock.Now(), tenant)
+	err := store.Transact(ctx, func(tx storeTx) error {
+		var counts submissionCounts
+		if _, err := getTxRecordJSON(tx, recordSubmissionCounts, key, &counts); err != nil {
+			return err
+		}
+		counts.Submissions++
+		if outcome == "rejected" {
+			counts.Rejected++
+		}
+		return putTxRecordJSON(tx, recordSubmissionCounts, key, counts)
+	})
+	if err != nil {
+		log.Printf("submission counts for tenant %s: %v", tenant, err)
+	}
+}
+
+type digestRetailer struct {
+	Retailer string `json:"retailer"`
+	Receipts int    `json:"receipts"`
+	Points   int    `json:"points"`
+}
+
+type weeklyDigest struct {
+	Tenant        string           `json:"tenant"`
+	From          time.Time        `json:"from"`
+	To            time.Time        `json:"to"`
+	Receipts      int              `json:"receipts"`
+	Points        int              `json:"points"`
+	Quarantined   int              `json:"quarantined"`
+	Submissions   int              `json:"submissions"`
+	Rejected      int              `json:"rejected"`
+	RejectionRate float64          `json:"rejectionRate"`
+	TopRetailers  []digestRetailer `json:"topRetailers"`
+}
+
+// digestRequest asks for the digest of tenant's receipts created in
+// [from, to), listing top retailers.
+type digestRequest struct {
+	tenant   string
+	from, to time.Time
+	top      int
+}
+
+// buildDigests builds the digest of each request, reading the store once
+// for all of them. The submission counts go by whole UTC days, the
+// granularity they are kept at.
+func buildDigests(ctx context.Context, requests []digestRequest) ([]weeklyDigest, error) {
+	digests := make([]weeklyDigest, len(requests))
+	byRetailer := make([]map[string]*digestRetailer, len(requests))
+	byTenant := make(map[string][]int)
+	var from, to time.Time
+	for i, r := range requests {
+		digests[i] = weeklyDigest{Tenant: r.tenant, From: r.from.UTC(), To: r.to.UTC(), TopRetailers: make([]digestRetailer, 0)}
+		byRetailer[i] = make(map[string]*digestRetailer)
+		byTenant[r.tenant] = append(byTenant[r.tenant], i)
+		if from.IsZero() || r.from.Before(from) {
+			from = r.from
+		}
+		if r.to.After(to) {
+			to = r.to
+		}
+	}
+	_, err := store.List(ctx, func(s *storedReceipt) bool {
+		if s.CreatedAt.Before(from) || !s.CreatedAt.Before(to) {
+			return false
+		}
+		for _, i := range byTenant[s.Tenant] {
+			r, digest := requests[i], &digests[i]
+			if s.CreatedAt.Before(r.from) || !s.CreatedAt.Before(r.to) {
+				continue
+			}
+			switch s.Status {
+			case receiptAccepted:
+				digest.Receipts++
+				digest.Points += s.netPoints()
+				retailer, ok := byRetailer[i][s.Retailer]
+				if !ok {
+					retailer = &digestRetailer{Retailer: s.Retailer}
+					byRetailer[i][s.Retailer] = retailer
+				}
+				retailer.Receipts++
+				retailer.Points += s.netPoints()
+			case receiptQuarantined:
+				digest.Quarantined++
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	counts, err := listRecordsJSON[submissionCounts](ctx, recordSubmissionCounts)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, r := range requests {
+		digest := &digests[i]
+		for _, retailer := range byRetailer[i] {
+			digest.TopRetailers = append(digest.TopRetailers, *retailer)
+		}
+		sort.Slice(digest.TopRetailers, func(i, j int) bool {
+			a, b := digest.TopRetailers[i], digest.TopRetailers[j]
+			if a.Receipts != b.Receipts {
+				return a.Receipts > b.Receipts
+			}
+			return a.Retailer < b.Retailer
+		})
+		if len(digest.TopRetailers) > r.top {
+			digest.TopRetailers = digest.TopRetailers[:r.top]
+		}
+		for day := startOfDay(r.from.UTC()); day.Before(r.to); day = day.AddDate(0, 0, 1) {
+			c := counts[submissionCountsKey(day, r.tenant)]
+			digest.Submissions += c.Submissions
+			digest.Rejected += c.Rejected
+		}
+		if digest.Submissions > 0 {
+			digest.RejectionRate = float64(digest.Rejected) / float64(digest.Submissions)
+		}
+	}
+	return digests, nil
+}
+
+func digestEvent(tenant string, digest weeklyDigest) outboxEvent {
+	payload, _ := json.Marshal(digest)
+	return outboxEvent{
+		ID:        uuid.New().String(),
+		Type:      "digest.weekly",
+		Tenant:    tenant,
+		Payload:   payload,
+		CreatedAt: clock.Now().UTC(),
+	}
+}
+
+// sendDueDigests queues a digest for every subscription whose week has
+// turned over since its last one.
+func sendDueDigests(now time.Time) {
+	ctx := context.Background()
+	if err := syncSubscriptions(ctx); err != nil {
+		log.Printf("weekly digests: %v", err)
+		return
+	}
+	var due []*webhookSubscription
+	var requests []digestRequest
+	subscriptionsMu.Lock()
+	for _, sub := range subscriptions {
+		if sub.Digest == nil {
+			continue
+		}
+		if end := sub.Digest.weekEnd(now); end.After(sub.digestThrough) {
+			due = append(due, sub)
+			requests = append(requests, digestRequest{sub.tenant, end.AddDate(0, 0, -7), end, sub.Digest.TopRetailers})
+		}
+	}
+	subscriptionsMu.Unlock()
+
+	if len(due) > 0 {
+		digests, err := buildDigests(ctx, requests)
+		if err != nil {
+			log.Printf("weekly digests for %d subscriptions: %v", len(due), err)
+			return
+		}
+		for i, sub := range due {
+			if err := saveDigestThrough(ctx, sub.ID, requests[i].to); err != nil {
+				log.Printf("weekly digest for subscription %s: %v", sub.ID, err)
+				continue
+			}
+			subscriptionsMu.Lock()
+			if _, active := subscriptions[sub.ID]; active {
+				sub.digestThrough = requests[i].to
+				sub.queue(digestEvent(sub.tenant, digests[i]))
+			}
+			subscriptionsMu.Unlock()
+		}
+	}
+
+	// Submission counts are only needed for the week a digest covers.
+	counts, err := store.ListRecords(ctx, recordSubmissionCounts)
+	if err != nil {
+		log.Printf("submission counts: %v", err)
+		return
+	}
+	cutoff := submissionCountsKey(now.AddDate(0, 0, -9), "")
+	for key := range counts {
+		if key < cutoff {
+			if err := store.DeleteRecord(ctx, recordSubmissionCounts, key); err != nil {
+				log.Printf("submission counts: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// saveDigestThrough records in the store that the subscription's digests
+// are sent up to through, so no replica sends that week's again.
+func saveDigestThrough(ctx context.Context, id string, through time.Time) error {
+	return store.Transact(ctx, func(tx storeTx) error {
+		var record storedSubscription
+		found, err := getTxRecordJSON(tx, recordSubscriptions, id, &record)
+		if err != nil || !found {
+			return err
+		}
+		record.DigestThrough = through
+		return putTxRecordJSON(tx, recordSubscriptions, id, record)
+	})
+}
+
+// sendDigestNow serves POST /webhooks/subscriptions/:id/digest: it queues
+// the digest of the latest full week straight away, for trying out a
+// consumer, and answers with it. The weekly schedule is unaffected.
+func sendDigestNow(c *gin.Context) {
+	subscriptionsMu.Lock()
+	sub, ok := ownSubscription(c)
+	subscriptionsMu.Unlock()
+	if !ok {
+		return
+	}
+	if sub.Digest == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Subscription has no digest schedule"})
+		return
+	}
+	end := sub.Digest.weekEnd(clock.Now())
+	digests, err := buildDigests(c.Request.Context(), []digestRequest{{sub.tenant, end.AddDate(0, 0, -7), end, sub.Digest.TopRetailers}})
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	digest := digests[0]
+	event := digestEvent(sub.tenant, digest)
+	subscriptionsMu.Lock()
+	sub.queue(event)
+	subscriptionsMu.Unlock()
+	c.JSON(http.StatusAccepted, gin.H{"eventId": event.ID, "digest": digest})
+}
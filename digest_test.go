@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// listCountingStore counts the scans of the receipts.
+type listCountingStore struct {
+	receiptStore
+	lists int
+}
+
+func (s *listCountingStore) List(ctx context.Context, match func(*storedReceipt) bool) ([]*storedReceipt, error) {
+	s.lists++
+	return s.receiptStore.List(ctx, match)
+}
+
+func TestDigestsBuiltInOnePass(t *testing.T) {
+	saved := store
+	defer func() { store = saved }()
+	counting := &listCountingStore{receiptStore: newMemoryStore()}
+	store = counting
+
+	ctx := context.Background()
+	week := time.Date(2026, 10, 5, 0, 0, 0, 0, time.UTC)
+	for i, r := range []struct {
+		tenant, retailer string
+		at               time.Time
+	}{
+		{defaultTenant, "Target", week.AddDate(0, 0, 1)},
+		{defaultTenant, "Walgreens", week.AddDate(0, 0, 8)},
+		{"acme", "Target", week.AddDate(0, 0, 2)},
+	} {
+		stored := &storedReceipt{ID: receiptID(r.tenant, testUUID(i)), Tenant: r.tenant, Retailer: r.retailer, Hash: string(rune('a' + i)), Status: receiptAccepted, Points: 10, CreatedAt: r.at, AcceptedAt: r.at}
+		if _, err := store.Create(ctx, stored, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Counts are kept in the store, so these stand for submissions seen by
+	// any replica before a restart.
+	savedClock := clock
+	defer func() { clock = savedClock }()
+	clock = newManualClock(week.AddDate(0, 0, 3))
+	recordTenantSubmission(ctx, defaultTenant, "accepted")
+	recordTenantSubmission(ctx, defaultTenant, "rejected")
+
+	digests, err := buildDigests(ctx, []digestRequest{
+		{defaultTenant, week, week.AddDate(0, 0, 7), 5},
+		{defaultTenant, week.AddDate(0, 0, 7), week.AddDate(0, 0, 14), 5},
+		{"acme", week, week.AddDate(0, 0, 7), 5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counting.lists != 1 {
+		t.Errorf("three digests scanned the store %d times", counting.lists)
+	}
+	if d := digests[0]; d.Receipts != 1 || d.TopRetailers[0].Retailer != "Target" || d.Submissions != 2 || d.Rejected != 1 {
+		t.Errorf("first week: %+v", d)
+	}
+	if d := digests[1]; d.Receipts != 1 || d.TopRetailers[0].Retailer != "Walgreens" || d.Submissions != 0 {
+		t.Errorf("second week: %+v", d)
+	}
+	if d := digests[2]; d.Tenant != "acme" || d.Receipts != 1 || d.Submissions != 0 {
+		t.Errorf("other tenant: %+v", d)
+	}
+}
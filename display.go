@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// pointsDisplay is how a tenant presents points to its customers: Label
+// names the unit ("stars", "coins") and RoundTo rounds shown amounts to the
+// nearest multiple, so with 10 a receipt worth 37 points shows as 40.
+// Responses keep the raw "points" and add a "display" object next to them;
+// stored points and balances are never rounded.
+type pointsDisplay struct {
+	Label   string `json:"label"`
+	RoundTo int    `json:"roundTo"`
+}
+
+var (
+	displaysMu sync.Mutex
+	displays   = make(map[string]pointsDisplay)
+)
+
+func displayFor(tenant string) (pointsDisplay, bool) {
+	displaysMu.Lock()
+	defer displaysMu.Unlock()
+	d, ok := displays[tenant]
+	return d, ok
+}
+
+func (d pointsDisplay) round(points int) int {
+	if d.RoundTo <= 1 {
+		return points
+	}
+	half := d.RoundTo / 2
+	if points < 0 {
+		return -((-points + half) / d.RoundTo * d.RoundTo)
+	}
+	return (points + half) / d.RoundTo * d.RoundTo
+}
+
+func (d pointsDisplay) render(points int) gin.H {
+	shown := d.round(points)
+	return gin.H{"value": shown, "label": d.Label, "text": fmt.Sprintf("%d %s", shown, d.Label)}
+}
+
+// displayPoints adds the tenant's display of each named points field of
+// resp under "display", when the tenant has configured one.
+func displayPoints(resp gin.H, tenant string, fields ...string) {
+	d, ok := displayFor(tenant)
+	if !ok {
+		return
+	}
+	shown := gin.H{}
+	for _, field := range fields {
+		if points, ok := resp[field].(int); ok {
+			shown[field] = d.render(points)
+		}
+	}
+	resp["display"] = shown
+}
+
+func getPointsDisplay(c *gin.Context) {
+	d, ok := displayFor(tenantID(c))
+	if !ok {
+		d = pointsDisplay{Label: "points", RoundTo: 1}
+	}
+	c.JSON(http.StatusOK, gin.H{"display": d, "configured": ok})
+}
+
+// putPointsDisplay serves PUT /settings/points-display for the request's
+// tenant.
+func putPointsDisplay(c *gin.Context) {
+	var d pointsDisplay
+	if err := c.ShouldBindJSON(&d); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+	d.Label = strings.TrimSpace(d.Label)
+	if d.Label == "" || len(d.Label) > 32 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Label must be 1 to 32 characters"})
+		return
+	}
+	if d.RoundTo == 0 {
+		d.RoundTo = 1
+	}
+	if d.RoundTo < 1 || d.RoundTo > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "roundTo must be between 1 and 1000"})
+		return
+	}
+	displaysMu.Lock()
+	displays[tenantID(c)] = d
+	displaysMu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"display": d, "configured": true})
+}
+
+func deletePointsDisplay(c *gin.Context) {
+	displaysMu.Lock()
+	delete(displays, tenantID(c))
+	displaysMu.Unlock()
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// A dispute is a customer's challenge to a receipt's score. It stays open
+// until an admin resolves it, either adjusting the points through a ledger
+// entry or rejecting it. A receipt has at most one open dispute at a time.
+type dispute struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	Reason     string     `json:"reason"`
+	Expected   *int       `json:"expectedPoints,omitempty"`
+	Adjustment int        `json:"adjustment,omitempty"`
+	Resolution string     `json:"resolution,omitempty"`
+	OpenedAt   time.Time  `json:"openedAt"`
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty"`
+}
+
+const (
+	disputeOpen     = "open"
+	disputeAdjusted = "adjusted"
+	disputeRejected = "rejected"
+)
+
+var (
+	errDisputeOpen     = errors.New("receipt already has an open dispute")
+	errDisputeNotFound = errors.New("dispute not found")
+	errDisputeClosed   = errors.New("dispute is already resolved")
+)
+
+func (s *storedReceipt) openDispute() *dispute {
+	for i := range s.Disputes {
+		if s.Disputes[i].Status == disputeOpen {
+			return &s.Disputes[i]
+		}
+	}
+	return nil
+}
+
+// disputeEvents emits dispute.opened for a new dispute and dispute.resolved
+// once it is adjusted or rejected.
+func disputeEvents(s *storedReceipt, d dispute, at time.Time) []outboxEvent {
+	typ := eventDisputeResolved
+	if d.Status == disputeOpen {
+		typ = eventDisputeOpened
+	}
+	return newEvents(s, typ, at, disputePayload{
+		ReceiptID: s.ID,
+		Dispute:   d,
+		Points:    s.netPoints(),
+		Metadata:  s.Receipt.Metadata,
+	})
+}
+
+// createDispute serves POST /receipts/:id/disputes with {"reason": "...",
+// "expectedPoints": 40}.
+func createDispute(c *gin.Context) {
+	var req struct {
+		Reason   string `json:"reason"`
+		Expected *int   `json:"expectedPoints"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+	if req.Reason = strings.TrimSpace(req.Reason); req.Reason == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A reason is required"})
+		return
+	}
+
+	var opened dispute
+	_, err := store.Apply(c.Request.Context(), c.Param("id"), func(s *storedReceipt) ([]outboxEvent, error) {
+		if s.Status != receiptAccepted {
+			return nil, errNotAccepted
+		}
+		if s.openDispute() != nil {
+			return nil, errDisputeOpen
+		}
+		now := clock.Now()
+		opened = dispute{ID: uuid.New().String(), Status: disputeOpen, Reason: req.Reason, Expected: req.Expected, OpenedAt: now.UTC()}
+		s.Disputes = append(s.Disputes, opened)
+		return disputeEvents(s, opened, now), nil
+	})
+	switch {
+	case errors.Is(err, errNotAccepted):
+		c.JSON(http.StatusConflict, gin.H{"error": "Receipt has not been accepted"})
+	case errors.Is(err, errDisputeOpen):
+		c.JSON(http.StatusConflict, gin.H{"error": "Receipt already has an open dispute"})
+	case err != nil:
+		storeFailure(c, err)
+	default:
+		c.JSON(http.StatusCreated, opened)
+	}
+}
+
+func listReceiptDisputes(c *gin.Context) {
+	stored, err := store.Get(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": stored.ID, "disputes": append([]dispute{}, stored.Disputes...)})
+}
+
+// listOpenDisputes serves GET /admin/disputes, oldest first.
+func listOpenDisputes(c *gin.Context) {
+	held, err := store.List(c.Request.Context(), func(s *storedReceipt) bool { return s.openDispute() != nil })
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	type entry struct {
+		ReceiptID string  `json:"receiptId"`
+		Tenant    string  `json:"tenant"`
+		Points    int     `json:"points"`
+		Dispute   dispute `json:"dispute"`
+	}
+	entries := make([]entry, 0, len(held))
+	for _, s := range held {
+		entries = append(entries, entry{s.ID, s.Tenant, s.netPoints(), *s.openDispute()})
+	}
+	c.JSON(http.StatusOK, gin.H{"disputes": entries})
+}
+
+// resolveDispute serves POST /admin/receipts/:id/disputes/:dispute/resolve
+// with {"adjustment": 7, "resolution": "..."}. A non-zero adjustment is
+// added to the receipt's ledger; zero rejects the dispute.
+func resolveDispute(c *gin.Context) {
+	var req struct {
+		Adjustment int    `json:"adjustment"`
+		Resolution string `json:"resolution"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+
+	var resolved dispute
+	stored, err := store.Apply(c.Request.Context(), c.Param("id"), func(s *storedReceipt) ([]outboxEvent, error) {
+		var d *dispute
+		for i := range s.Disputes {
+			if s.Disputes[i].ID == c.Param("dispute") {
+				d = &s.Disputes[i]
+			}
+		}
+		if d == nil {
+			return nil, errDisputeNotFound
+		}
+		if d.Status != disputeOpen {
+			return nil, errDisputeClosed
+		}
+		now := clock.Now()
+		at := now.UTC()
+		d.Status, d.Resolution, d.ResolvedAt = disputeRejected, strings.TrimSpace(req.Resolution), &at
+		var adjusted []outboxEvent
+		if req.Adjustment != 0 {
+			d.Status, d.Adjustment = disputeAdjusted, req.Adjustment
+			entry := ledgerEntry{
+				ID:        uuid.New().String(),
+				Kind:      "dispute",
+				Points:    req.Adjustment,
+				Reason:    d.Resolution,
+				CreatedAt: at,
+			}
+			s.Ledger = append(s.Ledger, entry)
+			adjusted = pointsAdjustedEvents(s, entry)
+		}
+		resolved = *d
+		return append(disputeEvents(s, resolved, now), adjusted...), nil
+	})
+	switch {
+	case errors.Is(err, errDisputeNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dispute not found"})
+	case errors.Is(err, errDisputeClosed):
+		c.JSON(http.StatusConflict, gin.H{"error": "Dispute is already resolved"})
+	case err != nil:
+		storeFailure(c, err)
+	default:
+		c.JSON(http.StatusOK, gin.H{"receiptId": stored.ID, "points": stored.netPoints(), "dispute": resolved})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var defaultPointBuckets = []int{0, 25, 50, 75, 100, 150, 200}
+
+// pointsFrequency counts receipts per exact points value, so any bucket
+// layout can be answered without rescanning receipts.
+var pointsFrequency = make(map[int]int)
+
+func recordPointsFrequency(points int) {
+	pointsFrequency[points]++
+}
+
+type histogramBucket struct {
+	Min        *int `json:"min,omitempty"`
+	Max        *int `json:"max,omitempty"`
+	Count      int  `json:"count"`
+	Suppressed bool `json:"suppressed,omitempty"`
+}
+
+// getPointsDistribution serves GET /analytics/points/distribution. The
+// optional buckets parameter lists ascending lower bounds, e.g.
+// ?buckets=0,50,100 yields [0,50), [50,100) and [100,∞).
+func getPointsDistribution(c *gin.Context) {
+	bounds := defaultPointBuckets
+	if raw := c.Query("buckets"); raw != "" {
+		parsed, ok := parseBucketBounds(raw)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Buckets must be ascending integers separated by commas"})
+			return
+		}
+		bounds = parsed
+	}
+
+	buckets := make([]histogramBucket, len(bounds)+1)
+	for i := range bounds {
+		buckets[i+1].Min = &bounds[i]
+		buckets[i].Max = &bounds[i]
+	}
+	total := 0
+	analyticsMu.RLock()
+	for points, count := range pointsFrequency {
+		i := sort.Search(len(bounds), func(i int) bool { return bounds[i] > points })
+		buckets[i].Count += count
+		total += count
+	}
+	analyticsMu.RUnlock()
+
+	privacy := privacyFor(c)
+	if privacy != nil {
+		total = 0
+		for i := range buckets {
+			figure := "distribution/" + bucketBound(buckets[i].Min) + "-" + bucketBound(buckets[i].Max)
+			n, ok := privacy.count(figure, buckets[i].Count)
+			if !ok {
+				n, buckets[i].Suppressed = 0, true
+			}
+			buckets[i].Count = n
+			total += n
+		}
+	}
+	if buckets[0].Count == 0 && !buckets[0].Suppressed {
+		buckets = buckets[1:]
+	}
+	resp := gin.H{"receipts": total, "buckets": buckets}
+	privacy.describe(resp)
+	c.JSON(http.StatusOK, resp)
+}
+
+func bucketBound(bound *int) string {
+	if bound == nil {
+		return ""
+	}
+	return strconv.Itoa(*bound)
+}
+
+func parseBucketBounds(raw string) ([]int, bool) {
+	parts := strings.Split(raw, ",")
+	if len(parts) > 100 {
+		return nil, false
+	}
+	bounds := make([]int, 0, len(parts))
+	for _, part := range parts {
+		value, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || (len(bounds) > 0 && value <= bounds[len(bounds)-1]) {
+			return nil, false
+		}
+		bounds = append(bounds, value)
+	}
+	return bounds, true
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// drainTracker counts in-flight requests and, once draining for shutdown
+// or maintenance, turns new requests away with 503 so load balancers move
+// traffic elsewhere while the rest finish. The drain status, metrics,
+// diagnostics and maintenance endpoints keep answering, so maintenance can
+// be switched off again without a restart.
+type drainTracker struct {
+	mu          sync.Mutex
+	next        uint64
+	inFlight    map[uint64]time.Time
+	shutdown    bool
+	maintenance bool
+	since       time.Time
+}
+
+var drain = &drainTracker{inFlight: make(map[uint64]time.Time)}
+
+const drainStatusPath = "/drain"
+
+// drainExempt are the routes served while draining.
+var drainExempt = map[string]bool{
+	drainStatusPath:      true,
+	"/metrics":           true,
+	"/admin/diagnose":    true,
+	"/admin/maintenance": true,
+}
+
+// track is middleware registering each request while it runs.
+func (d *drainTracker) track(c *gin.Context) {
+	if c.FullPath() == drainStatusPath {
+		c.Next()
+		return
+	}
+	d.mu.Lock()
+	if d.draining() && !drainExempt[c.FullPath()] {
+		d.mu.Unlock()
+		c.Header("Connection", "close")
+		c.Header("Retry-After", "5")
+		errorResponse(c, http.StatusServiceUnavailable, "draining", "Server is draining; retry against another instance")
+		return
+	}
+	d.next++
+	id := d.next
+	d.inFlight[id] = time.Now()
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.inFlight, id)
+		d.mu.Unlock()
+	}()
+	c.Next()
+}
+
+// draining reports whether new requests are turned away. The caller holds
+// d.mu.
+func (d *drainTracker) draining() bool {
+	return d.shutdown || d.maintenance
+}
+
+// reason is why the server is draining. The caller holds d.mu.
+func (d *drainTracker) reason() string {
+	if d.shutdown {
+		return "shutdown"
+	}
+	return "maintenance"
+}
+
+// beginShutdown starts the drain for shutdown, which nothing ends.
+func (d *drainTracker) beginShutdown() {
+	d.mu.Lock()
+	if !d.draining() {
+		d.since = time.Now()
+	}
+	d.shutdown = true
+	d.mu.Unlock()
+}
+
+// setMaintenance turns maintenance on or off. Turning it off leaves a
+// shutdown drain running.
+func (d *drainTracker) setMaintenance(on bool) {
+	d.mu.Lock()
+	if on && !d.draining() {
+		d.since = time.Now()
+	}
+	d.maintenance = on
+	d.mu.Unlock()
+}
+
+// wait blocks until no requests are in flight or timeout passes, and
+// reports whether the server drained completely.
+func (d *drainTracker) wait(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		d.mu.Lock()
+		n := len(d.inFlight)
+		d.mu.Unlock()
+		if n == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// getDrainStatus serves GET /drain for deployment tooling: whether the
+// server is draining and how much work is still running.
+func getDrainStatus(c *gin.Context) {
+	d := drain
+	d.mu.Lock()
+	resp := gin.H{"draining": d.draining(), "inFlight": len(d.inFlight), "oldestInFlightSeconds": 0.0}
+	var oldest time.Time
+	for _, started := range d.inFlight {
+		if oldest.IsZero() || started.Before(oldest) {
+			oldest = started
+		}
+	}
+	if !oldest.IsZero() {
+		resp["oldestInFlightSeconds"] = time.Since(oldest).Seconds()
+	}
+	if d.draining() {
+		resp["reason"] = d.reason()
+		resp["since"] = d.since.UTC()
+	}
+	d.mu.Unlock()
+	c.JSON(http.StatusOK, resp)
+}
+
+// setMaintenance serves POST /admin/maintenance with {"enabled": bool}.
+func setMaintenance(c *gin.Context) {
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Enabled == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Body must be {\"enabled\": true|false}"})
+		return
+	}
+	drain.setMaintenance(*req.Enabled)
+	c.JSON(http.StatusOK, gin.H{"maintenance": *req.Enabled})
+}
+
+// serveUntilSignal runs the HTTP server until SIGTERM or SIGINT, then
+// drains: new requests get 503 while in-flight ones finish, for at most
+// DRAIN_TIMEOUT, before the listener closes.
+func serveUntilSignal(addr string, handler http.Handler) {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	errs := make(chan error, 1)
+	go func() { errs <- srv.ListenAndServe() }()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-errs:
+		log.Fatal(err)
+	case sig := <-signals:
+		log.Printf("received %v, draining", sig)
+	}
+
+	drain.beginShutdown()
+	if !drain.wait(envDuration("DRAIN_TIMEOUT", 30*time.Second)) {
+		log.Printf("drain timeout reached with requests still in flight")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMaintenanceCanBeSwitchedOff(t *testing.T) {
+	saved := drain
+	defer func() { drain = saved }()
+	drain = &drainTracker{inFlight: make(map[uint64]time.Time)}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { drain.track(c) })
+	r.POST("/admin/maintenance", setMaintenance)
+	r.GET("/metrics", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/rules", func(c *gin.Context) { c.Status(http.StatusOK) })
+	do := func(method, path, body string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w.Code
+	}
+
+	if code := do(http.MethodPost, "/admin/maintenance", `{"enabled": true}`); code != http.StatusOK {
+		t.Fatalf("enabling maintenance: %d", code)
+	}
+	if code := do(http.MethodGet, "/rules", ""); code != http.StatusServiceUnavailable {
+		t.Errorf("request during maintenance: %d", code)
+	}
+	if code := do(http.MethodGet, "/metrics", ""); code != http.StatusOK {
+		t.Errorf("metrics during maintenance: %d", code)
+	}
+	if code := do(http.MethodPost, "/admin/maintenance", `{"enabled": false}`); code != http.StatusOK {
+		t.Fatalf("disabling maintenance: %d", code)
+	}
+	if code := do(http.MethodGet, "/rules", ""); code != http.StatusOK {
+		t.Errorf("request after maintenance: %d", code)
+	}
+
+	// Ending maintenance leaves a shutdown drain in place.
+	drain.setMaintenance(true)
+	drain.beginShutdown()
+	do(http.MethodPost, "/admin/maintenance", `{"enabled": false}`)
+	if code := do(http.MethodGet, "/rules", ""); code != http.StatusServiceUnavailable {
+		t.Errorf("request while shutting down: %d", code)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Config drift detection compares the running configuration with a
+// baseline the deploy pipeline declares, to catch hand edits in
+// production. The configuration is checksummed in components, each taken
+// from what this replica has loaded rather than from the files it came
+// from, so runtime changes count too: "rules", the scoring rules;
+// "retailers", the retailer profiles with the admin API's changes;
+// "tenant-keys", the tenant key assignments, PUT ones included; one
+// component for each other config file's loaded contents; and "env", the
+// variables listed in CONFIG_DRIFT_ENV, when set. The overall checksum
+// covers every component.
+//
+// CONFIG_BASELINE declares the expected overall checksum at startup; PUT
+// /admin/config/baseline replaces it, with {"checksum": ...}, per-component
+// {"components": {...}} so a report names what drifted, or {"current":
+// true} to adopt the running configuration. GET /admin/config/drift
+// reports the comparison, checked every CONFIG_DRIFT_INTERVAL and exported
+// as receipt_config_drift.
+
+// driftComponents describes each component's loaded state; maps marshal
+// with sorted keys, so equal state gives equal bytes.
+var driftComponents = []struct {
+	name  string
+	state func() any
+}{
+	{"rules", rulesState},
+	{"retailers", retailerState},
+	{"tenant-keys", tenantKeyState},
+	{"channels", func() any { return channelRules }},
+	{"chaos", func() any { return chaosRules }},
+	{"exporters", exporterState},
+	{"text-templates", func() any { return textTemplates }},
+	{"tenant-concurrency", func() any { return tenantLimits }},
+}
+
+var configDriftInterval = envDuration("CONFIG_DRIFT_INTERVAL", time.Minute)
+
+var (
+	configDrifted = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "receipt_config_drift",
+		Help: "1 when the running configuration differs from the declared baseline.",
+	})
+	configComponentDrifted = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "receipt_config_component_drift",
+		Help: "1 for each configuration component differing from its declared baseline checksum.",
+	}, []string{"component"})
+)
+
+type configBaseline struct {
+	Checksum   string            `json:"checksum,omitempty"`
+	Components map[string]string `json:"components,omitempty"`
+	DeclaredAt time.Time         `json:"declaredAt"`
+}
+
+type componentDrift struct {
+	Component string `json:"component"`
+	Checksum  string `json:"checksum"`
+	Expected  string `json:"expected,omitempty"`
+	Drifted   bool   `json:"drifted"`
+	Error     string `json:"error,omitempty"`
+}
+
+type driftReport struct {
+	Checksum   string           `json:"checksum"`
+	Baseline   *configBaseline  `json:"baseline"`
+	Drifted    bool             `json:"drifted"`
+	Components []componentDrift `json:"components"`
+	CheckedAt  time.Time        `json:"checkedAt"`
+}
+
+var configDrift = struct {
+	sync.Mutex
+	baseline *configBaseline
+	last     *driftReport
+}{}
+
+func init() {
+	if checksum := os.Getenv("CONFIG_BASELINE"); checksum != "" {
+		configDrift.baseline = &configBaseline{Checksum: checksum, DeclaredAt: time.Now().UTC()}
+	}
+}
+
+func configChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// configComponents checksums each component of the running configuration.
+func configComponents() []componentDrift {
+	components := make([]componentDrift, 0, len(driftComponents)+1)
+	for _, dc := range driftComponents {
+		component := componentDrift{Component: dc.name}
+		if data, err := json.Marshal(dc.state()); err != nil {
+			component.Error = err.Error()
+		} else {
+			component.Checksum = configChecksum(data)
+		}
+		components = append(components, component)
+	}
+	if raw := os.Getenv("CONFIG_DRIFT_ENV"); raw != "" {
+		var lines []string
+		for _, name := range strings.Split(raw, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				lines = append(lines, name+"="+os.Getenv(name))
+			}
+		}
+		sort.Strings(lines)
+		components = append(components, componentDrift{Component: "env", Checksum: configChecksum([]byte(strings.Join(lines, "\n")))})
+	}
+	return components
+}
+
+// rulesState describes the stable and candidate rulesets as they score.
+func rulesState() any {
+	type ruleFingerprint struct {
+		Name     string         `json:"name"`
+		Points   int            `json:"points"`
+		Params   map[string]any `json:"params"`
+		Disabled bool           `json:"disabled"`
+		Scale    float64        `json:"scale"`
+		Rounding roundingPolicy `json:"rounding"`
+	}
+	describe := func(rs *ruleset) any {
+		if rs == nil {
+			return nil
+		}
+		rules := make([]ruleFingerprint, 0, len(pointsRules))
+		for _, rule := range pointsRules {
+			rules = append(rules, ruleFingerprint{rule.name, rule.points, rule.params, rs.disabled[rule.name], rs.scale[rule.name], rs.policyFor(rule)})
+		}
+		return gin.H{"version": rs.version, "rules": rules}
+	}
+	return gin.H{"stable": describe(stableRuleset), "candidate": describe(candidateRuleset)}
+}
+
+func retailerState() any {
+	retailerMu.RLock()
+	defer retailerMu.RUnlock()
+	return retailerRecords
+}
+
+func tenantKeyState() any {
+	tenantKeysMu.RLock()
+	defer tenantKeysMu.RUnlock()
+	return gin.H{"keys": tenantKeys, "locked": lockedTenants}
+}
+
+func exporterState() any {
+	configs := make(map[string]exporterConfig, len(exportJobs))
+	for name, job := range exportJobs {
+		configs[name] = job.config
+	}
+	return configs
+}
+
+// checkConfigDrift compares the running configuration with the baseline
+// and records the result.
+func checkConfigDrift(now time.Time) {
+	components := configComponents()
+	lines := make([]string, 0, len(components))
+	for _, component := range components {
+		lines = append(lines, component.Component+"="+component.Checksum)
+	}
+	report := &driftReport{Checksum: configChecksum([]byte(strings.Join(lines, "\n"))), Components: components, CheckedAt: now.UTC()}
+
+	configDrift.Lock()
+	defer configDrift.Unlock()
+	report.Baseline = configDrift.baseline
+	if baseline := report.Baseline; baseline != nil {
+		report.Drifted = baseline.Checksum != "" && baseline.Checksum != report.Checksum
+		for i := range components {
+			expected, ok := baseline.Components[components[i].Component]
+			if ok {
+				components[i].Expected = expected
+			}
+			components[i].Drifted = ok && expected != components[i].Checksum
+			report.Drifted = report.Drifted || components[i].Drifted
+		}
+		// A component the baseline expects but the configuration no longer
+		// has has drifted too.
+		for name, expected := range baseline.Components {
+			if !slices.ContainsFunc(components, func(c componentDrift) bool { return c.Component == name }) {
+				components = append(components, componentDrift{Component: name, Expected: expected, Drifted: true})
+				report.Drifted = true
+			}
+		}
+		report.Components = components
+	}
+	configComponentDrifted.Reset()
+	for _, component := range components {
+		if component.Expected != "" {
+			configComponentDrifted.WithLabelValues(component.Component).Set(boolGauge(component.Drifted))
+		}
+	}
+	configDrifted.Set(boolGauge(report.Drifted))
+	if report.Drifted && (configDrift.last == nil || !configDrift.last.Drifted) {
+		log.Printf("config drift: running configuration %s differs from the declared baseline", report.Checksum)
+	}
+	configDrift.last = report
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// getConfigDrift serves GET /admin/config/drift, checking afresh.
+func getConfigDrift(c *gin.Context) {
+	checkConfigDrift(clock.Now())
+	configDrift.Lock()
+	report := configDrift.last
+	configDrift.Unlock()
+	c.JSON(http.StatusOK, report)
+}
+
+// putConfigBaseline serves PUT /admin/config/baseline.
+func putConfigBaseline(c *gin.Context) {
+	var req struct {
+		Checksum   string            `json:"checksum"`
+		Components map[string]string `json:"components"`
+		Current    bool              `json:"current"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+	baseline := &configBaseline{Checksum: req.Checksum, Components: req.Components, DeclaredAt: clock.Now().UTC()}
+	if req.Current {
+		checkConfigDrift(clock.Now())
+		configDrift.Lock()
+		baseline.Checksum, baseline.Components = configDrift.last.Checksum, make(map[string]string)
+		for _, component := range configDrift.last.Components {
+			baseline.Components[component.Component] = component.Checksum
+		}
+		configDrift.Unlock()
+	}
+	if baseline.Checksum == "" && len(baseline.Components) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Baseline needs a checksum, components or current"})
+		return
+	}
+	configDrift.Lock()
+	configDrift.baseline = baseline
+	configDrift.Unlock()
+	getConfigDrift(c)
+}
+
+// deleteConfigBaseline serves DELETE /admin/config/baseline.
+func deleteConfigBaseline(c *gin.Context) {
+	configDrift.Lock()
+	configDrift.baseline = nil
+	configDrift.Unlock()
+	checkConfigDrift(clock.Now())
+	c.Status(http.StatusNoContent)
+}
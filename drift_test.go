@@ -0,0 +1,61 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func componentChecksum(t *testing.T, name string) string {
+	t.Helper()
+	for _, component := range configComponents() {
+		if component.Component == name {
+			if component.Error != "" {
+				t.Fatalf("%s: %s", name, component.Error)
+			}
+			return component.Checksum
+		}
+	}
+	t.Fatalf("no %s component", name)
+	return ""
+}
+
+func TestDriftFingerprintsRuntimeRetailerChanges(t *testing.T) {
+	retailerMu.Lock()
+	saved := retailerRecords
+	records := maps.Clone(saved)
+	retailerMu.Unlock()
+	defer func() {
+		retailerMu.Lock()
+		installRetailers(saved)
+		retailerMu.Unlock()
+	}()
+
+	before := componentChecksum(t, "retailers")
+	records[retailerKey("Corner Deli")] = &retailerProfile{Canonical: "Corner Deli"}
+	retailerMu.Lock()
+	installRetailers(records)
+	retailerMu.Unlock()
+	if after := componentChecksum(t, "retailers"); after == before {
+		t.Error("adding a retailer at runtime left the retailers checksum unchanged")
+	}
+}
+
+func TestDriftFingerprintsAssignedTenantKeys(t *testing.T) {
+	tenantKeysMu.Lock()
+	saved := tenantKeys
+	tenantKeys = maps.Clone(saved)
+	tenantKeysMu.Unlock()
+	defer func() {
+		tenantKeysMu.Lock()
+		tenantKeys = saved
+		tenantKeysMu.Unlock()
+	}()
+
+	before := componentChecksum(t, "tenant-keys")
+	tenantKeysMu.Lock()
+	tenantKeys["acme"] = "local:acme"
+	tenantKeysMu.Unlock()
+	if after := componentChecksum(t, "tenant-keys"); after == before {
+		t.Error("assigning a tenant key left the tenant-keys checksum unchanged")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// For partners that can only drop files, DROP_DIR names a directory, such
+// as an SFTP-mounted drop folder, that is scanned every DROP_INTERVAL for
+// receipt files: .json holding one receipt or an array of them, .ndjson or
+// .jsonl with one receipt per line, or .csv in the backfill layout (see
+// backfill.go). Files land in DROP_TENANT (default) when dropped at the top
+// level, or in the tenant a subdirectory is named after. A file is picked
+// up once it has not been modified for DROP_SETTLE, so one still being
+// uploaded is left alone; dotfiles and .part, .filepart and .tmp files are
+// never read.
+//
+// Each receipt is submitted through the file-drop channel. The file is then
+// moved to processed/, or to failed/ if it could not be read or any of its
+// receipts was rejected, beside a <file>.results.json listing the outcome
+// of every receipt as the batch endpoint reports it. Accepted receipts stay
+// stored either way. Receipt IDs follow from the file's content and the
+// receipt's position, so a file interrupted by a restart or store outage,
+// which is left where it is and retried, or dropped again unchanged, is
+// not stored twice. Only the cluster leader scans.
+
+var (
+	dropDir      = os.Getenv("DROP_DIR")
+	dropInterval = envDuration("DROP_INTERVAL", 10*time.Second)
+	dropSettle   = envDuration("DROP_SETTLE", 30*time.Second)
+	dropTenant   = envString("DROP_TENANT", defaultTenant)
+
+	dropNamespace = uuid.MustParse("0b6f8f5e-3c2d-4a8e-9d71-5e4c3b2a1f60")
+)
+
+const (
+	dropProcessed = "processed"
+	dropFailed    = "failed"
+)
+
+var dropFiles = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "receipt_drop_files_total",
+	Help: "Files ingested from the drop folder, by outcome: processed or failed.",
+}, []string{"outcome"})
+
+// dropReport is written beside an ingested file.
+type dropReport struct {
+	File            string        `json:"file"`
+	Tenant          string        `json:"tenant"`
+	SHA256          string        `json:"sha256"`
+	IngestedAt      time.Time     `json:"ingestedAt"`
+	Accepted        int           `json:"accepted"`
+	Quarantined     int           `json:"quarantined"`
+	Rejected        int           `json:"rejected"`
+	AlreadyImported int           `json:"alreadyImported"`
+	Error           string        `json:"error,omitempty"`
+	Results         []batchResult `json:"results"`
+}
+
+// scanDropDir ingests the settled files in the drop folder and in its
+// tenant subdirectories.
+func scanDropDir(time.Time) {
+	ctx := context.Background()
+	dirs := map[string]string{dropDir: dropTenant}
+	entries, err := os.ReadDir(dropDir)
+	if err != nil {
+		log.Printf("drop: reading %s: %v", dropDir, err)
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() && name != dropProcessed && name != dropFailed && tenantPattern.MatchString(name) && !isSandboxTenant(name) {
+			dirs[filepath.Join(dropDir, name)] = name
+		}
+	}
+	for dir, tenant := range dirs {
+		if err := scanDropTenant(ctx, dir, tenant); err != nil {
+			log.Printf("drop: %s: %v", dir, err)
+		}
+	}
+}
+
+func scanDropTenant(ctx context.Context, dir, tenant string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || dropFormat(name) == "" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < dropSettle {
+			continue
+		}
+		// A store outage leaves the file for the next scan.
+		if err := ingestDropFile(ctx, dir, name, tenant); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func dropFormat(name string) string {
+	lower := strings.ToLower(name)
+	if strings.HasPrefix(name, ".") {
+		return ""
+	}
+	switch filepath.Ext(lower) {
+	case ".json":
+		return "json"
+	case ".ndjson", ".jsonl":
+		return "ndjson"
+	case ".csv":
+		return "csv"
+	}
+	return ""
+}
+
+// ingestDropFile submits a file's receipts and moves it out of the way. It
+// returns an error, leaving the file in place, only when the store failed.
+func ingestDropFile(ctx context.Context, dir, name, tenant string) error {
+	path := filepath.Join(dir, name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	report := &dropReport{File: name, Tenant: tenant, SHA256: hex.EncodeToString(sum[:]), Results: []batchResult{}}
+
+	var next backfillReader
+	switch dropFormat(name) {
+	case "json":
+		next = jsonRecords(data)
+	case "ndjson":
+		next = ndjsonRecords(bytes.NewReader(data))
+	case "csv":
+		next = csvRecords(bytes.NewReader(data))
+	}
+	for n := 0; ; n++ {
+		receipt, recordErr, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			report.Error = err.Error()
+			break
+		}
+		result := batchResult{Index: n, Status: receiptRejected}
+		if recordErr != nil {
+			result.Error = decodeFailure(recordErr)
+		} else {
+			id := receiptID(tenant, uuid.NewSHA1(dropNamespace, []byte(fmt.Sprintf("%s#%d", report.SHA256, n))))
+			if existing, err := store.Get(ctx, id); err == nil {
+				report.AlreadyImported++
+				result.Status, result.ID = existing.Status, existing.ID
+				report.Results = append(report.Results, result)
+				continue
+			} else if !errors.Is(err, errReceiptNotFound) {
+				return err
+			} else {
+				submitted, err := submitReceipt(ctx, submission{id: id, tenant: tenant, receipt: receipt, channel: channelFileDrop})
+				if err != nil && !errors.As(err, new(*submissionError)) {
+					return err
+				}
+				result = result.outcome(submitted, err)
+			}
+		}
+		switch result.Status {
+		case receiptAccepted:
+			report.Accepted++
+		case receiptQuarantined:
+			report.Quarantined++
+		default:
+			report.Rejected++
+		}
+		report.Results = append(report.Results, result)
+	}
+
+	outcome := dropProcessed
+	if report.Error != "" || report.Rejected > 0 {
+		outcome = dropFailed
+	}
+	report.IngestedAt = clock.Now().UTC()
+	if err := moveDropFile(dir, name, outcome, report); err != nil {
+		log.Printf("drop: moving %s to %s: %v", path, outcome, err)
+		return nil
+	}
+	dropFiles.WithLabelValues(outcome).Inc()
+	log.Printf("drop: %s for tenant %s: %d accepted, %d quarantined, %d rejected, %d already imported; moved to %s",
+		name, tenant, report.Accepted, report.Quarantined, report.Rejected, report.AlreadyImported, outcome)
+	return nil
+}
+
+// moveDropFile moves a file to dir/outcome under a timestamped name, so
+// files dropped again under the same name do not collide, with its report
+// beside it.
+func moveDropFile(dir, name, outcome string, report *dropReport) error {
+	target := filepath.Join(dir, outcome)
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return err
+	}
+	stamped := filepath.Join(target, report.IngestedAt.Format("20060102T150405Z")+"-"+name)
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(stamped+".results.json", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(dir, name), stamped)
+}
+
+// jsonRecords reads a JSON file holding one receipt or an array of them.
+func jsonRecords(data []byte) backfillReader {
+	var docs []json.RawMessage
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		if err := json.Unmarshal(trimmed, &docs); err != nil {
+			return func() (Receipt, error, error) {
+				return Receipt{}, nil, errors.New("file is not a JSON array of receipts")
+			}
+		}
+	} else {
+		docs = []json.RawMessage{trimmed}
+	}
+	return func() (Receipt, error, error) {
+		if len(docs) == 0 {
+			return Receipt{}, nil, io.EOF
+		}
+		doc := docs[0]
+		docs = docs[1:]
+		receipt, decodeErr := decodeReceipt(bytes.NewReader(doc))
+		return receipt, decodeErr, nil
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ruleRollup struct {
+	Receipts int
+	Points   int64
+}
+
+// ruleDaily maps UTC day -> rule name -> receipts the rule fired on and the
+// points it awarded.
+var ruleDaily = make(map[int64]map[string]*ruleRollup)
+
+func recordRuleRollup(daily map[int64]map[string]*ruleRollup, day int64, stored *storedReceipt) {
+	byRule, ok := daily[day]
+	if !ok {
+		byRule = make(map[string]*ruleRollup)
+		daily[day] = byRule
+	}
+	seen := make(map[string]bool)
+	for _, result := range stored.Breakdown {
+		rollup, ok := byRule[result.Rule]
+		if !ok {
+			rollup = &ruleRollup{}
+			byRule[result.Rule] = rollup
+		}
+		if !seen[result.Rule] {
+			rollup.Receipts++
+			seen[result.Rule] = true
+		}
+		rollup.Points += int64(result.Points)
+	}
+}
+
+type ruleDay struct {
+	Day      time.Time `json:"day"`
+	Receipts int       `json:"receiptsFired"`
+	Points   int64     `json:"points"`
+}
+
+type ruleEffectiveness struct {
+	Rule          string    `json:"rule"`
+	Description   string    `json:"description"`
+	ReceiptsFired int       `json:"receiptsFired"`
+	FireRate      float64   `json:"fireRate"`
+	PointsAwarded int64     `json:"pointsAwarded"`
+	ShareOfPoints float64   `json:"shareOfPoints"`
+	NeverFired    bool      `json:"neverFired"`
+	Daily         []ruleDay `json:"daily"`
+}
+
+type rulesReport struct {
+	From       time.Time           `json:"from"`
+	To         time.Time           `json:"to"`
+	Receipts   int                 `json:"receipts"`
+	Points     int64               `json:"points"`
+	Rules      []ruleEffectiveness `json:"rules"`
+	NeverFired []string            `json:"neverFired"`
+}
+
+// buildRulesReport compares the points each active rule awarded per day in
+// [from, to) and lists the rules that never fired.
+func buildRulesReport(from, to time.Time) rulesReport {
+	analyticsMu.RLock()
+	defer analyticsMu.RUnlock()
+	return rulesReportIn(dailySeries, ruleDaily, from, to)
+}
+
+func rulesReportIn(series map[int64]*seriesBucket, daily map[int64]map[string]*ruleRollup, from, to time.Time) rulesReport {
+	from = startOfDay(from.UTC())
+	report := rulesReport{From: from, To: to, NeverFired: make([]string, 0)}
+	byRule := make(map[string]*ruleEffectiveness, len(pointsRules))
+	for _, rule := range pointsRules {
+		report.Rules = append(report.Rules, ruleEffectiveness{Rule: rule.name, Description: rule.description, Daily: make([]ruleDay, 0)})
+	}
+	for i := range report.Rules {
+		byRule[report.Rules[i].Rule] = &report.Rules[i]
+	}
+
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		if bucket, ok := series[day.Unix()]; ok {
+			report.Receipts += bucket.Receipts
+			report.Points += bucket.Points
+		}
+		for name, rollup := range daily[day.Unix()] {
+			entry, ok := byRule[name]
+			if !ok {
+				continue
+			}
+			entry.ReceiptsFired += rollup.Receipts
+			entry.PointsAwarded += rollup.Points
+			entry.Daily = append(entry.Daily, ruleDay{Day: day, Receipts: rollup.Receipts, Points: rollup.Points})
+		}
+	}
+
+	for i := range report.Rules {
+		entry := &report.Rules[i]
+		if report.Receipts > 0 {
+			entry.FireRate = float64(entry.ReceiptsFired) / float64(report.Receipts)
+		}
+		if report.Points > 0 {
+			entry.ShareOfPoints = float64(entry.PointsAwarded) / float64(report.Points)
+		}
+		if entry.ReceiptsFired == 0 {
+			entry.NeverFired = true
+			report.NeverFired = append(report.NeverFired, entry.Rule)
+		}
+	}
+	return report
+}
+
+func encodeRulesReport(report rulesReport, format string) ([]byte, string, error) {
+	if format == "json" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		return data, "application/json", err
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"rule", "receipts_fired", "fire_rate", "points_awarded", "share_of_points", "never_fired"})
+	for _, rule := range report.Rules {
+		w.Write([]string{
+			rule.Rule,
+			strconv.Itoa(rule.ReceiptsFired),
+			strconv.FormatFloat(rule.FireRate, 'f', 4, 64),
+			strconv.FormatInt(rule.PointsAwarded, 10),
+			strconv.FormatFloat(rule.ShareOfPoints, 'f', 4, 64),
+			strconv.FormatBool(rule.NeverFired),
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), "text/csv", w.Error()
+}
+
+// getRulesEffectiveness serves GET /analytics/rules (default: last 30 days).
+func getRulesEffectiveness(c *gin.Context) {
+	from, to, err := timeRange(c, 30*24*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid time range: use RFC 3339 timestamps or YYYY-MM-DD dates with from before to"})
+		return
+	}
+	if to.Sub(from)/(24*time.Hour) > maxSeriesBuckets {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Requested range has too many buckets"})
+		return
+	}
+	c.JSON(http.StatusOK, buildRulesReport(from, to))
+}
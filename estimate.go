@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// POST /points/estimate scores a cart before it is bought. The body is a
+// receipt in which total, purchaseDate and purchaseTime may be left out:
+// the total defaults to the item sum, and a missing date or time is not
+// known yet, so the estimate is the range of points over the times it
+// could be. While a candidate ruleset is rolling out, the range also covers
+// a receipt landing in it.
+//
+// For the planned purchase (now, where the cart leaves date or time out),
+// "opportunities" lists the time-based rules it misses with the points
+// buying at another time would add, e.g. 10 for afternoon_purchase between
+// 14:00 and 16:00. Nothing is stored.
+
+// timingBonus is a rule a purchase can earn by its timing, and how to move
+// a receipt to earn it.
+type timingBonus struct {
+	rule  string
+	shift func(Receipt) Receipt
+	hint  string
+}
+
+var timingBonuses = []timingBonus{
+	{"afternoon_purchase", func(r Receipt) Receipt {
+		return atProgramHour(r, afternoonFromHour)
+	}, fmt.Sprintf("Buy between %02d:00 and %02d:00 %s time", afternoonFromHour, afternoonToHour, programZone)},
+	{"odd_purchase_day", func(r Receipt) Receipt {
+		if date, err := time.Parse(time.DateOnly, r.PurchaseDate); err == nil {
+			r.PurchaseDate = date.AddDate(0, 0, 1).Format(time.DateOnly)
+		}
+		return r
+	}, "Buy on an odd day of the month"},
+}
+
+// atProgramHour moves a receipt's purchase to the given hour on the program
+// clock, the clock the timing rules read, on the same program day.
+func atProgramHour(r Receipt, hour int) Receipt {
+	at, ok := programPurchaseTime(r)
+	if !ok {
+		return r
+	}
+	loc := programZone
+	if r.TimeZone != "" {
+		loc, _ = loadZone(r.TimeZone)
+	}
+	local := time.Date(at.Year(), at.Month(), at.Day(), hour, 0, 0, 0, programZone).In(loc)
+	r.PurchaseDate, r.PurchaseTime = local.Format(time.DateOnly), local.Format("15:04")
+	return r
+}
+
+type opportunity struct {
+	Rule   string `json:"rule"`
+	Points int    `json:"points"`
+	Hint   string `json:"hint"`
+}
+
+// estimatePoints serves POST /points/estimate.
+func estimatePoints(c *gin.Context) {
+	cart, err := decodeReceipt(c.Request.Body)
+	if errors.Is(err, errUnsupportedSchema) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported schemaVersion"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+	loc := programZone
+	if cart.TimeZone != "" {
+		if loc, err = loadZone(cart.TimeZone); err != nil {
+			loc = programZone // validateReceipt reports it
+		}
+	}
+	now := clock.Now().In(loc)
+	planned := cart
+	if planned.Total == "" {
+		var sum int64
+		for _, item := range planned.Items {
+			cents, _ := parseCents(item.Price)
+			sum += cents
+		}
+		planned.Total = formatCents(sum)
+	}
+	if planned.PurchaseDate == "" {
+		planned.PurchaseDate = now.Format(time.DateOnly)
+	}
+	if planned.PurchaseTime == "" {
+		planned.PurchaseTime = now.Format("15:04")
+	}
+	if errs := validateReceipt(planned); errs != nil {
+		refused := invalidReceipt(errs)
+		c.JSON(refused.status, refused.body)
+		return
+	}
+
+	// The unknowns take values on either side of each timing rule: three
+	// consecutive days cover both parities, and two hours fall inside and
+	// just outside the afternoon window.
+	scenarios := []Receipt{planned}
+	if cart.PurchaseDate == "" {
+		for d := 1; d <= 2; d++ {
+			scenario := planned
+			scenario.PurchaseDate = now.AddDate(0, 0, d).Format(time.DateOnly)
+			scenarios = append(scenarios, scenario)
+		}
+	}
+	if cart.PurchaseTime == "" {
+		for _, scenario := range scenarios {
+			scenarios = append(scenarios, atProgramHour(scenario, afternoonFromHour), atProgramHour(scenario, afternoonToHour))
+		}
+	}
+	rulesets := []*ruleset{stableRuleset}
+	if candidateRuleset != nil {
+		rulesets = append(rulesets, candidateRuleset)
+	}
+
+	plannedPoints, err := estimateScore(c, stableRuleset, planned)
+	if err != nil {
+		return
+	}
+	low, high := plannedPoints, plannedPoints
+	for _, rs := range rulesets {
+		for _, scenario := range scenarios {
+			points, err := estimateScore(c, rs, scenario)
+			if err != nil {
+				return
+			}
+			low, high = min(low, points), max(high, points)
+		}
+	}
+
+	opportunities := make([]opportunity, 0)
+	for _, bonus := range timingBonuses {
+		if stableRuleset.disabled[bonus.rule] {
+			continue
+		}
+		points, err := estimateScore(c, stableRuleset, bonus.shift(planned))
+		if err != nil {
+			return
+		}
+		if gain := points - plannedPoints; gain > 0 {
+			opportunities = append(opportunities, opportunity{Rule: bonus.rule, Points: gain, Hint: bonus.hint})
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"min":          low,
+		"max":          high,
+		"planned":      gin.H{"points": plannedPoints, "total": planned.Total, "purchaseDate": planned.PurchaseDate, "purchaseTime": planned.PurchaseTime, "timeZone": loc.String()},
+		"rulesVersion": stableRuleset.scoredVersion(),
+
+		"opportunities": opportunities,
+	})
+}
+
+// estimateScore scores receipt with rs, answering for the request when
+// scoring is cut short.
+func estimateScore(c *gin.Context, rs *ruleset, receipt Receipt) (int, error) {
+	results, err := rs.score(c.Request.Context(), receipt)
+	if err != nil {
+		requestExpired(c, err)
+		return 0, err
+	}
+	return totalPoints(results), nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"embed"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Domain events are the one model of what happened to a receipt that every
+// event consumer is given: the outbox writes them, and EVENTS_WEBHOOK_URL
+// and webhook subscriptions, history and replay included, deliver them as
+// written, so no consumer sees its own shape of an event. Each event has a
+// type and the version of that type's payload. A change that would break
+// consumers, such as removing or retyping a field, gets a new version
+// rather than changing the old one; new fields may be added to a version.
+//
+// Each type's JSON Schema, envelope and payload, is served at
+// GET /events/schemas/:type, from api/events, and GET /events/schemas lists
+// them.
+//
+// points.redeemed is emitted instead of points.adjusted for ledger entries
+// of kind redemption. This service writes none of its own yet; the type is
+// defined for the systems that will.
+//
+// The API-key audit trail is recorded the same way: each entry appended to
+// a key is also an api_key.changed event, written with the key in one
+// transaction. This service has no Kafka producer or SSE stream; when one
+// is added it should publish from the outbox like the webhooks do.
+
+const (
+	eventReceiptProcessed = "receipt.processed"
+	eventReceiptReturned  = "receipt.returned"
+	eventReceiptDeleted   = "receipt.deleted"
+	eventPointsAdjusted   = "points.adjusted"
+	eventPointsRedeemed   = "points.redeemed"
+	eventDisputeOpened    = "dispute.opened"
+	eventDisputeResolved  = "dispute.resolved"
+	eventAPIKeyChanged    = "api_key.changed"
+
+	redemptionKind = "redemption"
+)
+
+// eventVersions is the current payload version of each event type.
+var eventVersions = map[string]int{
+	eventReceiptProcessed: 1,
+	eventReceiptReturned:  1,
+	eventReceiptDeleted:   1,
+	eventPointsAdjusted:   1,
+	eventPointsRedeemed:   1,
+	eventDisputeOpened:    1,
+	eventDisputeResolved:  1,
+	eventAPIKeyChanged:    1,
+}
+
+//go:embed api/events
+var eventSchemas embed.FS
+
+type receiptProcessedPayload struct {
+	ID          string            `json:"id"`
+	Retailer    string            `json:"retailer"`
+	Points      int               `json:"points"`
+	Hash        string            `json:"hash"`
+	ProcessedAt time.Time         `json:"processedAt"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+type receiptReturnedPayload struct {
+	ID            string            `json:"id"`
+	Items         []int             `json:"items"`
+	PointsClawed  int               `json:"pointsClawed"`
+	Points        int               `json:"points"`
+	FullyReturned bool              `json:"fullyReturned"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+}
+
+type receiptDeletedPayload struct {
+	ID        string            `json:"id"`
+	Retailer  string            `json:"retailer"`
+	Points    int               `json:"points"`
+	Reason    string            `json:"reason"`
+	DeletedAt time.Time         `json:"deletedAt"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// pointsChangedPayload is the payload of points.adjusted and
+// points.redeemed; Points is the receipt's net points after the entry.
+type pointsChangedPayload struct {
+	ReceiptID string            `json:"receiptId"`
+	Entry     ledgerEntry       `json:"entry"`
+	Points    int               `json:"points"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+type disputePayload struct {
+	ReceiptID string            `json:"receiptId"`
+	Dispute   dispute           `json:"dispute"`
+	Points    int               `json:"points"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// apiKeyChangedPayload is one entry of an API key's audit trail.
+type apiKeyChangedPayload struct {
+	KeyID string `json:"keyId"`
+	apiKeyAuditEntry
+}
+
+// receiptDeletedEvents emits receipt.deleted for a receipt being deleted.
+// A purge erases the receipt, so its metadata is not passed on.
+func receiptDeletedEvents(s *storedReceipt, reason string, at time.Time) []outboxEvent {
+	metadata := s.Receipt.Metadata
+	if reason == "purge" {
+		metadata = nil
+	}
+	return newEvents(s, eventReceiptDeleted, at, receiptDeletedPayload{
+		ID:        s.ID,
+		Retailer:  s.Retailer,
+		Points:    s.netPoints(),
+		Reason:    reason,
+		DeletedAt: at.UTC(),
+		Metadata:  metadata,
+	})
+}
+
+// apiKeyEvents emits api_key.changed for each audit entry k has gained
+// since previous, which is nil for a new key.
+func apiKeyEvents(k, previous *apiKey) []outboxEvent {
+	seen := 0
+	if previous != nil {
+		seen = len(previous.Audit)
+	}
+	var events []outboxEvent
+	for _, entry := range k.Audit[min(seen, len(k.Audit)):] {
+		events = append(events, tenantEvents(k.Tenant, "", eventAPIKeyChanged, entry.At, apiKeyChangedPayload{KeyID: k.ID, apiKeyAuditEntry: entry})...)
+	}
+	return events
+}
+
+func listEventSchemas(c *gin.Context) {
+	types := make([]gin.H, 0, len(eventVersions))
+	for typ, version := range eventVersions {
+		types = append(types, gin.H{"type": typ, "version": version, "schema": "/events/schemas/" + typ})
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i]["type"].(string) < types[j]["type"].(string) })
+	c.JSON(http.StatusOK, gin.H{"events": types})
+}
+
+func getEventSchema(c *gin.Context) {
+	typ := c.Param("type")
+	if _, ok := eventVersions[typ]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown event type"})
+		return
+	}
+	data, err := eventSchemas.ReadFile("api/events/" + typ + ".json")
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown event type"})
+		return
+	}
+	c.Data(http.StatusOK, "application/schema+json", data)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestReceiptDeletedEventMetadata(t *testing.T) {
+	saved := eventsWebhookURL
+	defer func() { eventsWebhookURL = saved }()
+	eventsWebhookURL = "https://events.example.com"
+
+	s := &storedReceipt{ID: "r1", Tenant: defaultTenant, Receipt: Receipt{Metadata: map[string]string{"orderId": "42"}}}
+	for reason, want := range map[string]bool{"purge": false, "sandbox_purge": true} {
+		events := receiptDeletedEvents(s, reason, time.Now())
+		if len(events) != 1 {
+			t.Fatalf("%s: %d events", reason, len(events))
+		}
+		var payload receiptDeletedPayload
+		if err := json.Unmarshal(events[0].Payload, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if got := payload.Metadata != nil; got != want {
+			t.Errorf("%s: metadata sent = %v, want %v", reason, got, want)
+		}
+	}
+}
+
+func TestAPIKeyEventsEmitNewAuditEntries(t *testing.T) {
+	saved := eventsWebhookURL
+	defer func() { eventsWebhookURL = saved }()
+	eventsWebhookURL = "https://events.example.com"
+
+	now := time.Now().UTC()
+	created := &apiKey{ID: "k1", Tenant: "acme", Audit: []apiKeyAuditEntry{{Action: "created", At: now}}}
+	if events := apiKeyEvents(created, nil); len(events) != 1 || events[0].Type != eventAPIKeyChanged || events[0].Tenant != "acme" {
+		t.Errorf("new key emitted %+v", events)
+	}
+	revoked := *created
+	revoked.Audit = append(append([]apiKeyAuditEntry(nil), created.Audit...), apiKeyAuditEntry{Action: "revoked", At: now})
+	events := apiKeyEvents(&revoked, created)
+	if len(events) != 1 {
+		t.Fatalf("revocation emitted %d events, want 1", len(events))
+	}
+	var payload apiKeyChangedPayload
+	if err := json.Unmarshal(events[0].Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.KeyID != "k1" || payload.Action != "revoked" {
+		t.Errorf("revocation payload %+v", payload)
+	}
+}
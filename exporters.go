@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// exportRecord is the flattened view of a stored receipt handed to
+// exporters.
+type exportRecord struct {
+	ID           string    `json:"id"`
+	Tenant       string    `json:"tenant"`
+	Retailer     string    `json:"retailer"`
+	RetailerRaw  string    `json:"retailerRaw"`
+	CustomerID   string    `json:"customerId,omitempty"`
+	PurchaseDate string    `json:"purchaseDate"`
+	PurchaseTime string    `json:"purchaseTime"`
+	Total        string    `json:"total"`
+	ItemCount    int       `json:"itemCount"`
+	Points       int       `json:"points"`
+	Tags         []string  `json:"tags"`
+	ProcessedAt  time.Time `json:"processedAt"`
+	CPUMicros    int64     `json:"cpuMicros"`
+	StoreOps     int       `json:"storeOps"`
+	BlobOps      int       `json:"blobOps"`
+
+	// Items is only filled in by anonymized exports; see anonymize.go.
+	Items      []exportItem `json:"items,omitempty"`
+	items      []Item
+	anonymized bool
+}
+
+// exporter delivers batches of receipts to one destination. When Export
+// fails the same records are offered again on the next run, so delivery is
+// at least once and destinations should key on the receipt ID.
+type exporter interface {
+	Export(ctx context.Context, records []exportRecord) error
+}
+
+// exporterConfig is one entry of the EXPORTERS_FILE JSON array.
+type exporterConfig struct {
+	Name     string            `json:"name"`
+	Type     string            `json:"type"`
+	Interval string            `json:"interval"`
+	Settings map[string]string `json:"settings"`
+	// Anonymize pseudonymizes the records before they are exported.
+	Anonymize bool `json:"anonymize"`
+}
+
+// exporterFactories maps a config type to its constructor. New destinations
+// register here; processing code never needs to know about them.
+var exporterFactories = map[string]func(settings map[string]string) (exporter, error){
+	"s3-csv":        newS3CSVExporter,
+	"bigquery":      newBigQueryExporter,
+	"webhook-batch": newWebhookBatchExporter,
+}
+
+type exportJob struct {
+	name      string
+	kind      string
+	interval  time.Duration
+	exporter  exporter
+	anonymize bool
+	config    exporterConfig // as loaded, for drift detection
+
+	mu        sync.Mutex
+	lastRun   time.Time
+	lastError string
+}
+
+// exportProgress is kept in the store per exporter, so a new leader carries
+// on from where the last one stopped instead of exporting everything again.
+type exportProgress struct {
+	Cursor   time.Time `json:"cursor"`
+	Exported int       `json:"exported"`
+}
+
+var exportJobs = map[string]*exportJob{}
+
+// loadExporters reads exporter definitions from path and registers one
+// scheduled job per exporter.
+func loadExporters(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var configs []exporterConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, cfg := range configs {
+		factory, ok := exporterFactories[cfg.Type]
+		if !ok {
+			return fmt.Errorf("exporter %q: unknown type %q", cfg.Name, cfg.Type)
+		}
+		if cfg.Name == "" || exportJobs[cfg.Name] != nil {
+			return fmt.Errorf("exporter names must be unique and non-empty (%q)", cfg.Name)
+		}
+		interval, err := time.ParseDuration(cfg.Interval)
+		if err != nil || interval < time.Minute {
+			return fmt.Errorf("exporter %q: interval must be a duration of at least 1m", cfg.Name)
+		}
+		if cfg.Anonymize && len(exportPseudonymKey) == 0 {
+			return fmt.Errorf("exporter %q: anonymize requires EXPORT_PSEUDONYM_KEY", cfg.Name)
+		}
+		exp, err := factory(cfg.Settings)
+		if err != nil {
+			return fmt.Errorf("exporter %q: %w", cfg.Name, err)
+		}
+		job := &exportJob{name: cfg.Name, kind: cfg.Type, interval: interval, exporter: exp, anonymize: cfg.Anonymize, config: cfg}
+		exportJobs[cfg.Name] = job
+		registerClusterJob("export:"+cfg.Name, interval, func(now time.Time) { job.run(now) })
+	}
+	return nil
+}
+
+// run exports every receipt accepted after the job's cursor and up to now.
+func (j *exportJob) run(now time.Time) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	var progress exportProgress
+	_, err := getRecordJSON(ctx, recordExportProgress, j.name, &progress)
+	var records []exportRecord
+	if err == nil {
+		records, err = exportRecordsBetween(ctx, progress.Cursor, now)
+	}
+	if err == nil && j.anonymize {
+		records = anonymizeRecords(records)
+	}
+	if err == nil && len(records) > 0 {
+		err = j.exporter.Export(ctx, records)
+	}
+	if err == nil {
+		progress.Cursor, progress.Exported = now, progress.Exported+len(records)
+		err = putRecordJSON(ctx, recordExportProgress, j.name, progress)
+	}
+	j.lastRun = now
+	j.lastError = ""
+	if err != nil {
+		j.lastError = err.Error()
+		log.Printf("export %s: %v", j.name, err)
+		return err
+	}
+	return nil
+}
+
+func exportRecordsBetween(ctx context.Context, after, upTo time.Time) ([]exportRecord, error) {
+	matched, err := store.List(ctx, func(stored *storedReceipt) bool {
+		return stored.Status == receiptAccepted && !isSandboxTenant(stored.Tenant) && stored.AcceptedAt.After(after) && !stored.AcceptedAt.After(upTo)
+	})
+	if err != nil {
+		return nil, err
+	}
+	records := make([]exportRecord, 0, len(matched))
+	for _, stored := range matched {
+		records = append(records, toExportRecord(stored))
+	}
+	return records, nil
+}
+
+func toExportRecord(stored *storedReceipt) exportRecord {
+	record := exportRecord{
+		ID:           stored.ID,
+		Tenant:       stored.Tenant,
+		Retailer:     stored.Retailer,
+		RetailerRaw:  stored.Receipt.Retailer,
+		CustomerID:   stored.Receipt.CustomerID,
+		PurchaseDate: stored.Receipt.PurchaseDate,
+		PurchaseTime: stored.Receipt.PurchaseTime,
+		Total:        stored.Receipt.Total,
+		ItemCount:    len(stored.Receipt.Items),
+		Points:       stored.Points,
+		Tags:         append([]string{}, stored.Tags...),
+		ProcessedAt:  stored.CreatedAt.UTC(),
+		items:        stored.Receipt.Items,
+	}
+	if stored.Cost != nil {
+		record.CPUMicros, record.StoreOps, record.BlobOps = stored.Cost.CPUMicros, stored.Cost.StoreOps, stored.Cost.BlobOps
+	}
+	return record
+}
+
+func listExports(c *gin.Context) {
+	type exportStatus struct {
+		Name       string     `json:"name"`
+		Type       string     `json:"type"`
+		Interval   string     `json:"interval"`
+		Anonymized bool       `json:"anonymized,omitempty"`
+		Cursor     time.Time  `json:"cursor"`
+		Exported   int        `json:"exported"`
+		LastRun    *time.Time `json:"lastRun,omitempty"`
+		LastError  string     `json:"lastError,omitempty"`
+	}
+	progress, err := listRecordsJSON[exportProgress](c.Request.Context(), recordExportProgress)
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	statuses := make([]exportStatus, 0, len(exportJobs))
+	for _, job := range exportJobs {
+		job.mu.Lock()
+		status := exportStatus{
+			Name:       job.name,
+			Type:       job.kind,
+			Interval:   job.interval.String(),
+			Anonymized: job.anonymize,
+			Cursor:     progress[job.name].Cursor,
+			Exported:   progress[job.name].Exported,
+			LastError:  job.lastError,
+		}
+		if !job.lastRun.IsZero() {
+			lastRun := job.lastRun
+			status.LastRun = &lastRun
+		}
+		job.mu.Unlock()
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	c.JSON(http.StatusOK, gin.H{"exporters": statuses})
+}
+
+func runExportNow(c *gin.Context) {
+	job, ok := exportJobs[c.Param("name")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Exporter not found"})
+		return
+	}
+	if err := job.run(clock.Now()); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Export failed: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"name": job.name, "exported": true})
+}
+
+// s3CSVExporter writes each batch as one CSV object under bucket/prefix.
+type s3CSVExporter struct {
+	bucket string
+	prefix string
+	client *s3Client
+}
+
+func newS3CSVExporter(settings map[string]string) (exporter, error) {
+	if settings["bucket"] == "" {
+		return nil, fmt.Errorf("bucket is required")
+	}
+	client, err := s3FromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return &s3CSVExporter{bucket: settings["bucket"], prefix: settings["prefix"], client: client}, nil
+}
+
+func (e *s3CSVExporter) Export(ctx context.Context, records []exportRecord) error {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	// Anonymized exports add the items column.
+	anonymized := records[0].anonymized
+	header := []string{"id", "tenant", "retailer", "retailer_raw", "customer_id", "purchase_date", "purchase_time", "total", "item_count", "points", "tags", "processed_at", "cpu_micros", "store_ops", "blob_ops"}
+	if anonymized {
+		header = append(header, "items")
+	}
+	w.Write(header)
+	for _, r := range records {
+		row := []string{
+			r.ID, r.Tenant, r.Retailer, r.RetailerRaw, r.CustomerID, r.PurchaseDate, r.PurchaseTime, r.Total,
+			strconv.Itoa(r.ItemCount), strconv.Itoa(r.Points), strings.Join(r.Tags, ";"), r.ProcessedAt.Format(time.RFC3339Nano),
+			strconv.FormatInt(r.CPUMicros, 10), strconv.Itoa(r.StoreOps), strconv.Itoa(r.BlobOps),
+		}
+		if anonymized {
+			row = append(row, csvItems(r.Items))
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	last := records[len(records)-1]
+	name := fmt.Sprintf("receipts-%s.csv", last.ProcessedAt.Format("20060102T150405.000000000Z"))
+	if anonymized {
+		// Processing times are only kept to the day, so the last pseudonym
+		// tells batches apart.
+		name = fmt.Sprintf("receipts-%s-%s.csv", last.ProcessedAt.Format("20060102"), last.ID)
+	}
+	key := path.Join(e.prefix, last.ProcessedAt.Format("2006/01/02"), name)
+	return e.client.PutObject(ctx, e.bucket, key, "text/csv", buf.Bytes())
+}
+
+// bigQueryExporter streams rows with the tabledata.insertAll REST call,
+// authenticating with the OAuth access token in BIGQUERY_ACCESS_TOKEN.
+// Receipt IDs are used as insert IDs so retried batches are deduplicated.
+type bigQueryExporter struct {
+	project string
+	dataset string
+	table   string
+}
+
+func newBigQueryExporter(settings map[string]string) (exporter, error) {
+	e := &bigQueryExporter{project: settings["project"], dataset: settings["dataset"], table: settings["table"]}
+	if e.project == "" || e.dataset == "" || e.table == "" {
+		return nil, fmt.Errorf("project, dataset and table are required")
+	}
+	return e, nil
+}
+
+func (e *bigQueryExporter) Export(ctx context.Context, records []exportRecord) error {
+	token := os.Getenv("BIGQUERY_ACCESS_TOKEN")
+	if token == "" {
+		return fmt.Errorf("BIGQUERY_ACCESS_TOKEN is not set")
+	}
+	type row struct {
+		InsertID string       `json:"insertId"`
+		JSON     exportRecord `json:"json"`
+	}
+	rows := make([]row, 0, len(records))
+	for _, r := range records {
+		rows = append(rows, row{InsertID: r.ID, JSON: r})
+	}
+	// Tables created before a field was added to exportRecord drop it
+	// rather than reject the row.
+	body, err := json.Marshal(gin.H{"rows": rows, "ignoreUnknownValues": true})
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("https://bigquery.googleapis.com/bigquery/v2/projects/%s/datasets/%s/tables/%s/insertAll", e.project, e.dataset, e.table)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	var result struct {
+		InsertErrors []json.RawMessage `json:"insertErrors"`
+	}
+	err = breakerFor("bigquery").Do(func() error {
+		resp, err := webhookClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("bigquery insertAll: %s", resp.Status)
+		}
+		return json.NewDecoder(resp.Body).Decode(&result)
+	})
+	if err != nil {
+		return err
+	}
+	if len(result.InsertErrors) > 0 {
+		return fmt.Errorf("bigquery insertAll: %d rows rejected", len(result.InsertErrors))
+	}
+	return nil
+}
+
+// webhookBatchExporter posts records as JSON arrays of at most batchSize.
+type webhookBatchExporter struct {
+	url       string
+	batchSize int
+}
+
+func newWebhookBatchExporter(settings map[string]string) (exporter, error) {
+	e := &webhookBatchExporter{url: settings["url"], batchSize: 500}
+	if !strings.HasPrefix(e.url, "http://") && !strings.HasPrefix(e.url, "https://") {
+		return nil, fmt.Errorf("url must be http(s)")
+	}
+	if raw := settings["batchSize"]; raw != "" {
+		size, err := strconv.Atoi(raw)
+		if err != nil || size < 1 {
+			return nil, fmt.Errorf("batchSize must be a positive integer")
+		}
+		e.batchSize = size
+	}
+	return e, nil
+}
+
+func (e *webhookBatchExporter) Export(ctx context.Context, records []exportRecord) error {
+	for start := 0; start < len(records); start += e.batchSize {
+		end := min(start+e.batchSize, len(records))
+		body, err := json.Marshal(gin.H{"records": records[start:end]})
+		if err != nil {
+			return err
+		}
+		if err := postWebhook(ctx, e.url, "application/json", body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
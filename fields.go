@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sparseFields trims successful JSON responses to the members named in
+// ?fields=, JSON:API style, so GET /receipts/:id?fields=id,points returns
+// just those two. With collection set, the filter applies to each object in
+// that member of the response instead, leaving the rest (such as
+// nextCursor) alone. Unknown names are ignored.
+func sparseFields(collection string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		fields := requestedFields(c.Query("fields"))
+		if fields == nil {
+			c.Next()
+			return
+		}
+		w := &heldWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+
+		body := w.held.Bytes()
+		if w.Status() != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), gin.MIMEJSON) {
+			w.ResponseWriter.Write(body)
+			return
+		}
+		trimmed, err := trimFields(body, collection, fields)
+		if err != nil {
+			w.ResponseWriter.Write(body)
+			return
+		}
+		w.Header().Del("Content-Length")
+		w.ResponseWriter.Write(trimmed)
+	}
+}
+
+func requestedFields(query string) map[string]bool {
+	if query == "" {
+		return nil
+	}
+	fields := make(map[string]bool)
+	for _, name := range strings.Split(query, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+func trimFields(body []byte, collection string, fields map[string]bool) ([]byte, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	if collection == "" {
+		return json.Marshal(keepFields(doc, fields))
+	}
+	var items []map[string]json.RawMessage
+	if err := json.Unmarshal(doc[collection], &items); err != nil {
+		return nil, err
+	}
+	for i, item := range items {
+		items[i] = keepFields(item, fields)
+	}
+	trimmed, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	doc[collection] = trimmed
+	return json.Marshal(doc)
+}
+
+func keepFields(doc map[string]json.RawMessage, fields map[string]bool) map[string]json.RawMessage {
+	kept := make(map[string]json.RawMessage, len(fields))
+	for name, value := range doc {
+		if fields[name] {
+			kept[name] = value
+		}
+	}
+	return kept
+}
+
+// heldWriter holds back the response body so middleware can rewrite it.
+type heldWriter struct {
+	gin.ResponseWriter
+	held bytes.Buffer
+}
+
+func (w *heldWriter) Write(data []byte) (int, error) {
+	return w.held.Write(data)
+}
+
+func (w *heldWriter) WriteString(s string) (int, error) {
+	return w.held.WriteString(s)
+}
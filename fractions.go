@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+
+	"github.com/google/uuid"
+)
+
+// Rules whose rounding mode is "accrue" award the whole part of their
+// points and report the rest as the result's fraction, so many small
+// receipts lose no precision. A receipt's fractions are added to its
+// customer's carry, per tenant, and whenever the carry reaches a whole
+// point those points are awarded on that receipt as a fraction_rollover
+// ledger entry. A receipt without a customer ID carries nothing over: its
+// own fractions are awarded as far as they make whole points and the rest
+// is dropped.
+//
+// The carry is a store record per customer, so every replica sees the same
+// one. It always equals what the customer's accepted receipts add to it,
+// the fractions their kept items score less the points already rolled over
+// on them (see receiptCarry), and each change to a receipt's points moves
+// it by the change in that receipt's part, in the same transaction:
+// approving a quarantined receipt, returns, integrity repairs and
+// deletions. A submission's carry is updated in its own transaction just
+// before the receipt is created, and given back if that fails.
+// Reprocessing only writes shadow scores, so it leaves the carry alone. The
+// first start that finds no carry records rebuilds them from the receipts.
+
+const (
+	microPoints           = 1_000_000
+	fractionRolloverKind  = "fraction_rollover"
+	fractionRolloverCause = "accrued fractional points"
+)
+
+// fractionCarry is the record kept per tenant and customer.
+type fractionCarry struct {
+	Micros int64 `json:"micros"` // unawarded micropoints
+}
+
+func carryKey(tenant, customer string) string {
+	return tenant + "/" + customer
+}
+
+// fractionMicros sums the fractions in a breakdown.
+func fractionMicros(breakdown []ruleResult) int64 {
+	var micros int64
+	for _, result := range breakdown {
+		micros += int64(math.Round(result.Fraction * microPoints))
+	}
+	return micros
+}
+
+// rolledOver sums the points rolled over on a receipt, in micropoints.
+func rolledOver(s *storedReceipt) int64 {
+	var micros int64
+	for _, entry := range s.Ledger {
+		if entry.Kind == fractionRolloverKind {
+			micros += int64(entry.Points) * microPoints
+		}
+	}
+	return micros
+}
+
+// receiptCarry is what s adds to its customer's carry.
+func receiptCarry(ctx context.Context, s *storedReceipt) (int64, error) {
+	if s.Status != receiptAccepted || s.Receipt.CustomerID == "" {
+		return 0, nil
+	}
+	micros := fractionMicros(s.Breakdown)
+	if len(s.ReturnedItems) > 0 {
+		kept, err := keptBreakdown(ctx, s, s.ReturnedItems)
+		if err != nil {
+			return 0, err
+		}
+		micros = fractionMicros(kept)
+	}
+	return micros - rolledOver(s), nil
+}
+
+// adjustCarry moves a customer's carry by delta.
+func adjustCarry(tx recordTx, tenant, customer string, delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+	key := carryKey(tenant, customer)
+	var carry fractionCarry
+	if _, err := getTxRecordJSON(tx, recordFractionCarry, key, &carry); err != nil {
+		return err
+	}
+	carry.Micros += delta
+	if carry.Micros == 0 {
+		return tx.DeleteRecord(recordFractionCarry, key)
+	}
+	return putTxRecordJSON(tx, recordFractionCarry, key, carry)
+}
+
+// moveCarry updates the carry for a change to a receipt, given its part
+// before the change.
+func moveCarry(ctx context.Context, tx recordTx, s *storedReceipt, before int64) error {
+	after, err := receiptCarry(ctx, s)
+	if err != nil {
+		return err
+	}
+	return adjustCarry(tx, s.Tenant, s.Receipt.CustomerID, after-before)
+}
+
+// awardFractions adds a newly accepted receipt's fractions to its
+// customer's carry, appending any points that roll over to its ledger, and
+// returns the events for them.
+func awardFractions(tx recordTx, s *storedReceipt) ([]outboxEvent, error) {
+	micros := fractionMicros(s.Breakdown)
+	if micros == 0 {
+		return nil, nil
+	}
+	customer := s.Receipt.CustomerID
+	carry := micros
+	if customer != "" {
+		var stored fractionCarry
+		if _, err := getTxRecordJSON(tx, recordFractionCarry, carryKey(s.Tenant, customer), &stored); err != nil {
+			return nil, err
+		}
+		carry += stored.Micros
+	}
+	whole := max(0, carry/microPoints)
+	if customer != "" {
+		if err := adjustCarry(tx, s.Tenant, customer, micros-whole*microPoints); err != nil {
+			return nil, err
+		}
+	}
+	if whole == 0 {
+		return nil, nil
+	}
+	entry := ledgerEntry{
+		ID:        uuid.New().String(),
+		Kind:      fractionRolloverKind,
+		Points:    int(whole),
+		Reason:    fractionRolloverCause,
+		CreatedAt: s.AcceptedAt.UTC(),
+	}
+	s.Ledger = append(s.Ledger, entry)
+	return pointsAdjustedEvents(s, entry), nil
+}
+
+// awardSubmittedFractions is awardFractions for a receipt about to be
+// created, in a transaction of its own. The undo func gives the carry back
+// when the receipt is then not stored.
+func awardSubmittedFractions(ctx context.Context, s *storedReceipt) ([]outboxEvent, func(), error) {
+	if fractionMicros(s.Breakdown) == 0 {
+		return nil, func() {}, nil
+	}
+	var events []outboxEvent
+	err := store.Transact(ctx, func(tx storeTx) error {
+		var err error
+		events, err = awardFractions(tx, s)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	undo := func() {
+		part, _ := receiptCarry(ctx, s)
+		err := store.Transact(context.WithoutCancel(ctx), func(tx storeTx) error {
+			return adjustCarry(tx, s.Tenant, s.Receipt.CustomerID, -part)
+		})
+		if err != nil {
+			log.Printf("fractions: giving back the carry of unstored receipt %s: %v", s.ID, err)
+		}
+	}
+	if s.Receipt.CustomerID == "" {
+		undo = func() {}
+	}
+	return events, undo, nil
+}
+
+// usesAccrual reports whether any ruleset rounds a rule with accrue.
+func usesAccrual() bool {
+	for _, rs := range []*ruleset{stableRuleset, candidateRuleset} {
+		if rs == nil {
+			continue
+		}
+		for _, policy := range rs.rounding {
+			if policy.Mode == roundAccrue {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// seedFractionCarry rebuilds the carry records from the stored receipts
+// when there are none, as on the first start after they moved into the
+// store.
+func seedFractionCarry(ctx context.Context) error {
+	if !usesAccrual() {
+		return nil
+	}
+	existing, err := store.ListRecords(ctx, recordFractionCarry)
+	if err != nil || len(existing) > 0 {
+		return err
+	}
+	return store.Transact(ctx, func(tx storeTx) error {
+		receipts, err := tx.List(func(s *storedReceipt) bool {
+			return s.Status == receiptAccepted && s.Receipt.CustomerID != ""
+		})
+		if err != nil {
+			return err
+		}
+		for _, s := range receipts {
+			part, err := receiptCarry(ctx, s)
+			if err != nil {
+				return err
+			}
+			if err := adjustCarry(tx, s.Tenant, s.Receipt.CustomerID, part); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func storedCarry(t *testing.T, tenant, customer string) int64 {
+	t.Helper()
+	var carry fractionCarry
+	if _, err := getRecordJSON(context.Background(), recordFractionCarry, carryKey(tenant, customer), &carry); err != nil {
+		t.Fatal(err)
+	}
+	return carry.Micros
+}
+
+// acceptWithFraction stores an accepted receipt for customer c1 whose
+// breakdown kept fraction back, accruing it as a submission would.
+func acceptWithFraction(t *testing.T, i int, fraction float64) *storedReceipt {
+	t.Helper()
+	ctx := context.Background()
+	now := time.Now()
+	s := &storedReceipt{
+		ID:         receiptID(defaultTenant, testUUID(i)),
+		Tenant:     defaultTenant,
+		Receipt:    Receipt{CustomerID: "c1", Total: "1.00", Items: []Item{{ShortDescription: "Gum", Price: "1.00", Quantity: 1}}},
+		Hash:       string(rune('a' + i)),
+		Status:     receiptAccepted,
+		Breakdown:  []ruleResult{{Rule: "accrued", Fraction: fraction}},
+		CreatedAt:  now,
+		AcceptedAt: now,
+	}
+	events, undo, err := awardSubmittedFractions(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Create(ctx, s, events); err != nil {
+		undo()
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestFractionCarryFollowsPointChanges(t *testing.T) {
+	saved := store
+	defer func() { store = saved }()
+	store = newMemoryStore()
+
+	first := acceptWithFraction(t, 1, 0.6)
+	if got := storedCarry(t, defaultTenant, "c1"); got != 600_000 {
+		t.Fatalf("carry after 0.6 = %d", got)
+	}
+	second := acceptWithFraction(t, 2, 0.7)
+	if len(second.Ledger) != 1 || second.Ledger[0].Points != 1 {
+		t.Fatalf("second receipt's ledger %+v, want one rolled-over point", second.Ledger)
+	}
+	if got := storedCarry(t, defaultTenant, "c1"); got != 300_000 {
+		t.Fatalf("carry after rolling over = %d, want 300000", got)
+	}
+
+	// Returning the first receipt's only item takes its 0.6 back out.
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/receipts/:id/return", returnItems)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/receipts/"+first.ID+"/return", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("return: %d %s", w.Code, w.Body)
+	}
+	if got := storedCarry(t, defaultTenant, "c1"); got != -300_000 {
+		t.Fatalf("carry after the return = %d, want -300000", got)
+	}
+
+	// Purging the second receipt takes out its 0.7 less the point it
+	// rolled over, and then nothing is carried.
+	if _, err := deleteReceipts(context.Background(), "purge", func(s *storedReceipt) bool { return s.ID == second.ID }); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedCarry(t, defaultTenant, "c1"); got != 0 {
+		t.Fatalf("carry after the purge = %d, want 0", got)
+	}
+	if records, err := store.ListRecords(context.Background(), recordFractionCarry); err != nil || len(records) != 0 {
+		t.Errorf("empty carries are kept: %v, %v", records, err)
+	}
+}
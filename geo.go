@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Location is the optional store location on a receipt.
+type Location struct {
+	City       string `json:"city,omitempty"`
+	State      string `json:"state,omitempty"`
+	Region     string `json:"region,omitempty"`
+	PostalCode string `json:"postalCode,omitempty"`
+	Country    string `json:"country,omitempty"`
+}
+
+// censusRegions maps US state codes to Census Bureau regions, used when a
+// receipt gives a state but no region.
+var censusRegions = map[string]string{}
+
+func init() {
+	for region, states := range map[string]string{
+		"Northeast": "CT ME MA NH RI VT NJ NY PA",
+		"Midwest":   "IL IN MI OH WI IA KS MN MO NE ND SD",
+		"South":     "DE DC FL GA MD NC SC VA WV AL KY MS TN AR LA OK TX",
+		"West":      "AZ CO ID MT NV NM UT WY AK CA HI OR WA",
+	} {
+		for _, state := range strings.Fields(states) {
+			censusRegions[state] = region
+		}
+	}
+}
+
+type geoKey struct {
+	Country string
+	State   string
+	Region  string
+}
+
+type geoRollup struct {
+	Receipts   int
+	Points     int64
+	SpendCents int64
+}
+
+var geoDaily = make(map[int64]map[geoKey]*geoRollup)
+
+func locationKey(loc *Location) (geoKey, bool) {
+	if loc == nil {
+		return geoKey{}, false
+	}
+	key := geoKey{
+		Country: strings.ToUpper(strings.TrimSpace(loc.Country)),
+		State:   strings.ToUpper(strings.TrimSpace(loc.State)),
+		Region:  canonicalText(loc.Region),
+	}
+	if key.Country == "" {
+		key.Country = "US"
+	}
+	if key.Region == "" && key.Country == "US" {
+		key.Region = censusRegions[key.State]
+	}
+	if key.State == "" && key.Region == "" {
+		return geoKey{}, false
+	}
+	return key, true
+}
+
+func recordGeoRollup(day int64, stored *storedReceipt) {
+	key, ok := locationKey(stored.Receipt.Location)
+	if !ok {
+		return
+	}
+	byKey, ok := geoDaily[day]
+	if !ok {
+		byKey = make(map[geoKey]*geoRollup)
+		geoDaily[day] = byKey
+	}
+	rollup, ok := byKey[key]
+	if !ok {
+		rollup = &geoRollup{}
+		byKey[key] = rollup
+	}
+	rollup.Receipts++
+	rollup.Points += int64(stored.Points)
+	if cents, err := parseCents(stored.Receipt.Total); err == nil {
+		rollup.SpendCents += cents
+	}
+}
+
+// getGeoAnalytics serves GET /analytics/geo?level=state|region, summing
+// receipts, points and spend per location bucket between from and to.
+func getGeoAnalytics(c *gin.Context) {
+	level := c.DefaultQuery("level", "state")
+	if level != "state" && level != "region" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Level must be state or region"})
+		return
+	}
+	from, to, err := timeRange(c, 30*24*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid time range: use RFC 3339 timestamps or YYYY-MM-DD dates with from before to"})
+		return
+	}
+	from = startOfDay(from)
+	if to.Sub(from)/(24*time.Hour) > maxSeriesBuckets {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Requested range has too many buckets"})
+		return
+	}
+
+	type bucketKey struct{ country, name string }
+	totals := make(map[bucketKey]*geoRollup)
+	analyticsMu.RLock()
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		for key, rollup := range geoDaily[day.Unix()] {
+			name := key.State
+			if level == "region" {
+				name = key.Region
+			}
+			if name == "" {
+				name = "unknown"
+			}
+			bk := bucketKey{key.Country, name}
+			sum, ok := totals[bk]
+			if !ok {
+				sum = &geoRollup{}
+				totals[bk] = sum
+			}
+			sum.Receipts += rollup.Receipts
+			sum.Points += rollup.Points
+			sum.SpendCents += rollup.SpendCents
+		}
+	}
+	analyticsMu.RUnlock()
+
+	type geoBucket struct {
+		Country     string `json:"country"`
+		Name        string `json:"name"`
+		Receipts    int    `json:"receipts"`
+		TotalPoints int64  `json:"totalPoints"`
+		TotalSpend  string `json:"totalSpend"`
+	}
+	privacy := privacyFor(c)
+	buckets := make([]geoBucket, 0, len(totals))
+	for key, sum := range totals {
+		figure := "geo/" + level + "/" + key.country + "/" + key.name
+		receipts, ok := privacy.count(figure, sum.Receipts)
+		if !ok {
+			continue
+		}
+		buckets = append(buckets, geoBucket{
+			Country:     key.country,
+			Name:        key.name,
+			Receipts:    receipts,
+			TotalPoints: privacy.points(figure, sum.Points),
+			TotalSpend:  formatCents(privacy.spend(figure, sum.SpendCents)),
+		})
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		if buckets[i].Country != buckets[j].Country {
+			return buckets[i].Country < buckets[j].Country
+		}
+		return buckets[i].Name < buckets[j].Name
+	})
+
+	resp := gin.H{"level": level, "from": from, "to": to, "buckets": buckets}
+	privacy.describe(resp)
+	c.JSON(http.StatusOK, resp)
+}
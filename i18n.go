@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/language"
+)
+
+// Error messages are written in English throughout the handlers. The
+// localizeErrors middleware translates the "error" field of error responses
+// into the language the client prefers by Accept-Language, using message
+// catalogs keyed by the English text. A key ending in ": " matches messages
+// that continue with a detail, such as "Invalid retailer: ...", and the
+// detail is kept as is, and a key with %d or %s verbs, such as "may have at
+// most %d keys", matches messages made from that format. The messages of a
+// validation response's field errors are translated the same way. Messages
+// missing from a catalog stay in English.
+//
+// Spanish is built in. I18N_CATALOG_DIR may hold more catalogs named after
+// their language tag (fr.json, pt-BR.json) as JSON objects; a file for a
+// built-in language adds to and overrides its entries.
+
+var builtinCatalogs = map[string]map[string]string{
+	"es": {
+		"Invalid JSON format":                                                     "Formato JSON no válido",
+		"Unsupported schemaVersion":                                               "schemaVersion no admitida",
+		"Receipt ID not found":                                                    "No se encontró el ID del recibo",
+		"Receipt has not been accepted":                                           "El recibo no ha sido aceptado",
+		"Receipt has no image":                                                    "El recibo no tiene imagen",
+		"Receipt has no thumbnail":                                                "El recibo no tiene miniatura",
+		"Receipt purging is disabled":                                             "La purga de recibos está desactivada",
+		"Purging needs a retailer or before filter":                               "La purga requiere un filtro retailer o before",
+		"Invalid before: use an RFC 3339 timestamp or a YYYY-MM-DD date":          "before no es válido: use una marca de tiempo RFC 3339 o una fecha AAAA-MM-DD",
+		"Repeat the request with X-Confirm-Token to delete the matching receipts": "Repita la solicitud con X-Confirm-Token para eliminar los recibos coincidentes",
+		"Confirmation token is invalid or expired":                                "El token de confirmación no es válido o ha caducado",
+		"Unknown job status":                                                      "Estado de trabajo desconocido",
+		"Limit must be between 1 and 1000":                                        "El límite debe estar entre 1 y 1000",
+		"Could not list jobs":                                                     "No se pudieron listar los trabajos",
+		"Only failed or dead jobs can be retried":                                 "Solo se pueden reintentar los trabajos fallidos o descartados",
+		"Could not store image":                                                   "No se pudo guardar la imagen",
+		"Could not load image":                                                    "No se pudo cargar la imagen",
+		"Could not hash receipt":                                                  "No se pudo calcular el hash del recibo",
+		"Could not read request body":                                             "No se pudo leer el cuerpo de la solicitud",
+		"Request body exceeds the size limit":                                     "El cuerpo de la solicitud supera el tamaño máximo",
+		"Invalid multipart body":                                                  "Cuerpo multipart no válido",
+		"Multipart body must include a receipt part":                              "El cuerpo multipart debe incluir una parte receipt",
+		"Image must be JPEG, PNG, GIF or WebP":                                    "La imagen debe ser JPEG, PNG, GIF o WebP",
+		"Image exceeds the size limit":                                            "La imagen supera el tamaño máximo",
+		"Webhook subscriptions are not enabled":                                   "Las suscripciones a webhooks no están habilitadas",
+		"A managed API key is required":                                           "Se requiere una clave de API gestionada",
+		"Subscription not found":                                                  "No se encontró la suscripción",
+		"URL must be an absolute http(s) URL":                                     "La URL debe ser una URL http(s) absoluta",
+		"Unknown event type: ":                                                    "Tipo de evento desconocido: ",
+		"Invalid cursor":                                                          "Cursor no válido",
+		"Invalid adjustments CSV: ":                                               "CSV de ajustes no válido: ",
+		"This file was already applied":                                           "Este archivo ya se aplicó",
+		"Adjustment import not found":                                             "No se encontró la importación de ajustes",
+		"Wait must be a duration such as 30s":                                     "La espera debe ser una duración como 30s",
+		"Receipt processing failed":                                               "El procesamiento del recibo falló",
+		"Could not sign certificate":                                              "No se pudo firmar el certificado",
+		"Unknown submission channel":                                              "Canal de envío desconocido",
+		"Submission channel is less restricted than this endpoint allows":         "El canal de envío está menos restringido de lo que permite este endpoint",
+		"Invalid YAML format":                                                     "Formato YAML no válido",
+		"YAML body exceeds the size limit":                                        "El cuerpo YAML supera el tamaño máximo",
+		"YAML anchors and aliases are not supported":                              "No se admiten anclas ni alias de YAML",
+		"Receipt text is required":                                                "Se requiere el texto del recibo",
+		"Unknown text template":                                                   "Plantilla de texto desconocida",
+		"is required":                                                             "es obligatorio",
+		"may only contain letters, digits, spaces, - and &":                       "solo puede contener letras, dígitos, espacios, - y &",
+		"must be a calendar date as YYYY-MM-DD":                                   "debe ser una fecha del calendario con formato AAAA-MM-DD",
+		"must be a 24-hour time as HH:MM":                                         "debe ser una hora de 24 horas con formato HH:MM",
+		"must be an IANA time zone such as America/Chicago":                       "debe ser una zona horaria IANA, como America/Chicago",
+		"must be an amount with two decimals, such as 6.49":                       "debe ser un importe con dos decimales, como 6.49",
+		"must include at least one item":                                          "debe incluir al menos un artículo",
+		"must be at least 1":                                                      "debe ser al menos 1",
+		"may have at most %d keys":                                                "puede tener como máximo %d claves",
+		"keys must not be empty":                                                  "las claves no pueden estar vacías",
+		"keys and values may total at most %d bytes":                              "las claves y los valores pueden sumar como máximo %d bytes",
+		"items sum to %s, not %s":                                                 "los artículos suman %s, no %s",
+		"was submitted after the deadline":                                        "se envió después de la fecha límite",
+		"Receipt failed validation":                                               "El recibo no superó la validación",
+		"Receipt was submitted after the deadline":                                "El recibo se envió después de la fecha límite",
+		"Items must be indexes into the receipt's items":                          "Los artículos deben ser índices de los artículos del recibo",
+		"Items have already been returned":                                        "Los artículos ya fueron devueltos",
+		"Receipt already has an open dispute":                                     "El recibo ya tiene una disputa abierta",
+		"A reason is required":                                                    "Se requiere un motivo",
+		"Tags must not be empty":                                                  "Las etiquetas no pueden estar vacías",
+		"At least one tag or a note is required":                                  "Se requiere al menos una etiqueta o una nota",
+		"Template not found":                                                      "No se encontró la plantilla",
+		"Template names are lowercase letters, digits, - and _":                   "Los nombres de plantilla usan minúsculas, dígitos, - y _",
+		"Template fields do not match the receipt format":                         "Los campos de la plantilla no coinciden con el formato del recibo",
+		"The template and request do not make a valid receipt":                    "La plantilla y la solicitud no forman un recibo válido",
+		"Priority must be interactive or bulk":                                    "La prioridad debe ser interactive o bulk",
+		"Job not found":                                                           "No se encontró el trabajo",
+		"Metric must be receipts or points":                                       "La métrica debe ser receipts o points",
+		"Interval must be hour or day":                                            "El intervalo debe ser hour o day",
+		"Level must be state or region":                                           "El nivel debe ser state o region",
+		"Requested range has too many buckets":                                    "El rango solicitado tiene demasiados intervalos",
+		"Invalid time range: use RFC 3339 timestamps or YYYY-MM-DD dates with from before to": "Rango de tiempo no válido: use marcas RFC 3339 o fechas AAAA-MM-DD con from antes de to",
+		"Idempotency-Key must be at most 255 characters":                                      "Idempotency-Key debe tener como máximo 255 caracteres",
+		"A request with this Idempotency-Key is still in progress":                            "Una solicitud con esta Idempotency-Key sigue en curso",
+		"Idempotency-Key was already used with a different request body":                      "Idempotency-Key ya se usó con otro cuerpo de solicitud",
+		"Idempotency store is temporarily unavailable":                                        "El almacén de idempotencia no está disponible temporalmente",
+		"Receipt store is temporarily unavailable":                                            "El almacén de recibos no está disponible temporalmente",
+		"Receipt store error": "Error del almacén de recibos",
+		"Receipt is encrypted under a tenant key that cannot be used": "El recibo está cifrado con una clave del inquilino que no se puede usar",
+		"Encryption key is not usable: ":                              "La clave de cifrado no se puede usar: ",
+		"Rules version is not deployed":                               "La versión de las reglas no está desplegada",
+		"Tenant has no encryption key":                                "El inquilino no tiene clave de cifrado",
+		"A managed API key or admin credentials are required":         "Se requiere una clave de API gestionada o credenciales de administrador",
+		"An API key is required for image uploads":                    "Se requiere una clave de API para subir imágenes",
+		"Image could not be read":                                     "No se pudo leer la imagen",
+		"Only an active API key can be rotated":                       "Solo se puede rotar una clave de API activa",
+		"API key not found":                                           "Clave de API no encontrada",
+		"Overlap must be a duration such as 24h":                      "El solapamiento debe ser una duración como 24h",
+		"Could not save the API key":                                  "No se pudo guardar la clave de API",
+		"expiresAt must be in the future":                             "expiresAt debe estar en el futuro",
+		"Tenant must be a valid tenant ID outside the sandbox":        "El inquilino debe ser un ID de inquilino válido fuera del entorno de pruebas",
+		"Invalid, expired or revoked API key":                         "Clave de API no válida, caducada o revocada",
+		"An API key is required":                                      "Se requiere una clave de API",
+		"Limit must be between 1 and 100":                             "El límite debe estar entre 1 y 100",
+		"minScore must be between 0 and 1":                            "minScore debe estar entre 0 y 1",
+		"Unknown event type":                                          "Tipo de evento desconocido",
+		"Could not save notification settings":                        "No se pudieron guardar los ajustes de notificación",
+		"Email must be a plain email address":                         "El correo debe ser una dirección de correo simple",
+		"Invalid notification settings":                               "Ajustes de notificación no válidos",
+		"No notification settings for this customer":                  "No hay ajustes de notificación para este cliente",
+		"Request does not match the API specification":                "La solicitud no se ajusta a la especificación de la API",
+		"Could not read the request body":                             "No se pudo leer el cuerpo de la solicitud",
+		"Invalid sandbox API key":                                     "Clave de API de sandbox no válida",
+		"Sandbox keys need SANDBOX_KEY_SECRET":                        "Las claves de sandbox requieren SANDBOX_KEY_SECRET",
+		"Partner must be 1-40 lowercase letters, digits or hyphens":   "El socio debe tener de 1 a 40 letras minúsculas, dígitos o guiones",
+		"Unsupported Content-Encoding: use gzip":                      "Content-Encoding no admitido: use gzip",
+		"Invalid gzip body":                                           "Cuerpo gzip no válido",
+		"asOf must be an RFC 3339 timestamp or a YYYY-MM-DD date":     "asOf debe ser una marca de tiempo RFC 3339 o una fecha AAAA-MM-DD",
+		"asOf must not be in the future":                              "asOf no puede estar en el futuro",
+		"Baseline needs a checksum, components or current":            "La referencia necesita checksum, components o current",
+		"Digest weekday must be a day name such as monday":            "El día del resumen debe ser un nombre de día como monday",
+		"Digest hour must be between 0 and 23":                        "La hora del resumen debe estar entre 0 y 23",
+		"Digest timeZone is not a known IANA time zone":               "La zona horaria del resumen no es una zona IANA conocida",
+		"Digest topRetailers must be between 1 and 50":                "topRetailers del resumen debe estar entre 1 y 50",
+		"Subscription has no digest schedule":                         "La suscripción no tiene programado un resumen",
+		"Too many requests in flight for this tenant":                 "Demasiadas solicitudes en curso para este inquilino",
+		"Analytics privacy budget exhausted":                          "Presupuesto de privacidad de analítica agotado",
+		"Store backend does not support compaction":                   "El backend de almacenamiento no admite compactación",
+		"Compaction is already running":                               "La compactación ya está en curso",
+		"Request timed out":                                           "Se agotó el tiempo de la solicitud",
+		"Server is draining; retry against another instance":          "El servidor se está vaciando; reintente en otra instancia",
+		"Async queue is full":                                         "La cola asíncrona está llena",
+		"Admin credentials required":                                  "Se requieren credenciales de administrador",
+		"Admin access is not configured":                              "El acceso de administrador no está configurado",
+		"Label must be 1 to 32 characters":                            "La etiqueta debe tener entre 1 y 32 caracteres",
+		"roundTo must be between 1 and 1000":                          "roundTo debe estar entre 1 y 1000",
+		"Advance must be a duration such as 36h":                      "advance debe ser una duración como 36h",
+		"Give exactly one of now and advance":                         "Indique solo uno de now y advance",
+	},
+}
+
+type messageCatalog struct {
+	exact    map[string]string
+	prefixes []string // keys ending in ": ", longest first
+	formats  []catalogFormat
+}
+
+// catalogFormat matches messages made from a key with verbs.
+type catalogFormat struct {
+	pattern *regexp.Regexp
+	key     string
+}
+
+var formatVerb = regexp.MustCompile(`%[ds]`)
+
+func newCatalogFormat(key string) catalogFormat {
+	parts := formatVerb.Split(key, -1)
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	return catalogFormat{regexp.MustCompile("^" + strings.Join(parts, "(.+?)") + "$"), key}
+}
+
+// supportedLanguages lists English and then the catalog languages, in the
+// order languageMatcher was built with.
+var (
+	supportedLanguages = []language.Tag{language.English}
+	catalogs           = []*messageCatalog{nil}
+	languageMatcher    = language.NewMatcher(supportedLanguages)
+)
+
+// loadCatalogs installs the built-in catalogs and those in dir, if given.
+func loadCatalogs(dir string) error {
+	merged := make(map[string]map[string]string)
+	for lang, messages := range builtinCatalogs {
+		merged[lang] = make(map[string]string, len(messages))
+		for k, v := range messages {
+			merged[lang][k] = v
+		}
+	}
+	if dir != "" {
+		files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			return err
+		}
+		for _, path := range files {
+			lang := strings.TrimSuffix(filepath.Base(path), ".json")
+			if _, err := language.Parse(lang); err != nil {
+				return fmt.Errorf("%s: file name is not a language tag", path)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			var messages map[string]string
+			if err := json.Unmarshal(data, &messages); err != nil {
+				return fmt.Errorf("parse %s: %w", path, err)
+			}
+			if merged[lang] == nil {
+				merged[lang] = make(map[string]string)
+			}
+			for k, v := range messages {
+				merged[lang][k] = v
+			}
+		}
+	}
+
+	langs := make([]string, 0, len(merged))
+	for lang := range merged {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	tags := []language.Tag{language.English}
+	cats := []*messageCatalog{nil}
+	for _, lang := range langs {
+		messages := merged[lang]
+		cat := &messageCatalog{exact: messages}
+		for key := range messages {
+			if strings.HasSuffix(key, ": ") {
+				cat.prefixes = append(cat.prefixes, key)
+			}
+			if formatVerb.MatchString(key) {
+				cat.formats = append(cat.formats, newCatalogFormat(key))
+			}
+		}
+		sort.Slice(cat.prefixes, func(i, j int) bool { return len(cat.prefixes[i]) > len(cat.prefixes[j]) })
+		tags = append(tags, language.MustParse(lang))
+		cats = append(cats, cat)
+	}
+	supportedLanguages, catalogs, languageMatcher = tags, cats, language.NewMatcher(tags)
+	return nil
+}
+
+func (cat *messageCatalog) translate(msg string) (string, bool) {
+	if translated, ok := cat.exact[msg]; ok {
+		return translated, true
+	}
+	for _, prefix := range cat.prefixes {
+		if detail, ok := strings.CutPrefix(msg, prefix); ok {
+			return cat.exact[prefix] + detail, true
+		}
+	}
+	for _, format := range cat.formats {
+		match := format.pattern.FindStringSubmatch(msg)
+		if match == nil {
+			continue
+		}
+		args := match[1:]
+		return formatVerb.ReplaceAllStringFunc(cat.exact[format.key], func(string) string {
+			if len(args) == 0 {
+				return ""
+			}
+			arg := args[0]
+			args = args[1:]
+			return arg
+		}), true
+	}
+	return "", false
+}
+
+// translateFieldErrors translates the messages in a response's "errors"
+// list, reporting whether any was.
+func (cat *messageCatalog) translateFieldErrors(resp map[string]any) bool {
+	list, _ := resp["errors"].([]any)
+	translatedAny := false
+	for _, entry := range list {
+		fields, _ := entry.(map[string]any)
+		msg, _ := fields["message"].(string)
+		if translated, ok := cat.translate(msg); ok {
+			fields["message"] = translated
+			translatedAny = true
+		}
+	}
+	return translatedAny
+}
+
+// catalogFor picks the catalog for an Accept-Language header; nil means
+// English.
+func catalogFor(header string) (language.Tag, *messageCatalog) {
+	if header == "" {
+		return language.English, nil
+	}
+	prefs, _, err := language.ParseAcceptLanguage(header)
+	if err != nil || len(prefs) == 0 {
+		return language.English, nil
+	}
+	_, index, confidence := languageMatcher.Match(prefs...)
+	if confidence == language.No {
+		return language.English, nil
+	}
+	return supportedLanguages[index], catalogs[index]
+}
+
+// localizedWriter holds back error response bodies so their message can be
+// translated.
+type localizedWriter struct {
+	gin.ResponseWriter
+	held bytes.Buffer
+}
+
+func (w *localizedWriter) Write(data []byte) (int, error) {
+	if w.Status() >= http.StatusBadRequest {
+		return w.held.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *localizedWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *localizedWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// localizeErrors is middleware translating error messages; see above.
+func localizeErrors(c *gin.Context) {
+	c.Writer.Header().Add("Vary", "Accept-Language")
+	tag, cat := catalogFor(c.GetHeader("Accept-Language"))
+	if cat == nil {
+		c.Next()
+		return
+	}
+	w := &localizedWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	c.Next()
+	c.Writer = w.ResponseWriter
+	if w.held.Len() == 0 {
+		return
+	}
+
+	var resp map[string]any
+	var msg string
+	if json.Unmarshal(w.held.Bytes(), &resp) == nil {
+		msg, _ = resp["error"].(string)
+	}
+	translated, ok := cat.translate(msg)
+	if ok {
+		resp["error"] = translated
+	}
+	if !cat.translateFieldErrors(resp) && !ok {
+		w.ResponseWriter.Write(w.held.Bytes())
+		return
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		w.ResponseWriter.Write(w.held.Bytes())
+		return
+	}
+	w.Header().Set("Content-Language", tag.String())
+	w.ResponseWriter.Write(body)
+}
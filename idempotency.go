@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Idempotency-Key support: the first request with a given key runs and its
+// response is saved for IDEMPOTENCY_TTL; retries with the same key and body
+// get that response replayed instead of creating another receipt. With
+// IDEMPOTENCY_REDIS_URL set, records live in Redis and are shared by every
+// replica; otherwise they are kept in process memory.
+type idempotencyRecord struct {
+	State       string `json:"state"`
+	Fingerprint string `json:"fingerprint"`
+	Status      int    `json:"status,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+const (
+	idempotencyPending  = "pending"
+	idempotencyComplete = "complete"
+)
+
+// idempotencyStore persists idempotency records. Reserve atomically claims
+// key for a new request; when the key is already taken it returns the
+// existing record (nil if it vanished in between) and false.
+type idempotencyStore interface {
+	Reserve(ctx context.Context, key string, rec idempotencyRecord, ttl time.Duration) (*idempotencyRecord, bool, error)
+	Complete(ctx context.Context, key string, rec idempotencyRecord, ttl time.Duration) error
+	Release(ctx context.Context, key string) error
+}
+
+var (
+	idempotencyTTL     = envDuration("IDEMPOTENCY_TTL", 24*time.Hour)
+	idempotencyLockTTL = envDuration("IDEMPOTENCY_LOCK_TTL", 30*time.Second)
+	idempotencyBackend = newIdempotencyStore(os.Getenv("IDEMPOTENCY_REDIS_URL"))
+)
+
+func newIdempotencyStore(redisURL string) idempotencyStore {
+	if redisURL == "" {
+		records := newCache[string, idempotencyRecord]("idempotency", envInt("IDEMPOTENCY_MEMORY_MAX", 100000), 0)
+		records.pinned = func(rec idempotencyRecord) bool { return rec.State == idempotencyPending }
+		return &memoryIdempotencyStore{records: records}
+	}
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		log.Fatalf("IDEMPOTENCY_REDIS_URL: %v", err)
+	}
+	return &redisIdempotencyStore{client: redis.NewClient(opts)}
+}
+
+// idempotentReplay is middleware for create endpoints.
+func idempotentReplay(c *gin.Context) {
+	key := strings.TrimSpace(c.GetHeader("Idempotency-Key"))
+	if key == "" {
+		c.Next()
+		return
+	}
+	if len(key) > 255 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key must be at most 255 characters"})
+		c.Abort()
+		return
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read request body"})
+		c.Abort()
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+	fingerprint := hex.EncodeToString(sum[:])
+	scoped := "idem:" + tenantID(c) + ":" + clientID(c) + ":" + key
+
+	ctx := c.Request.Context()
+	existing, reserved, err := idempotencyBackend.Reserve(ctx, scoped, idempotencyRecord{State: idempotencyPending, Fingerprint: fingerprint}, idempotencyLockTTL)
+	if err != nil {
+		log.Printf("idempotency: %v", err)
+		c.Header("Retry-After", "1")
+		errorResponse(c, http.StatusServiceUnavailable, "idempotency_unavailable", "Idempotency store is temporarily unavailable")
+		return
+	}
+	if !reserved {
+		switch {
+		case existing == nil || existing.State != idempotencyComplete:
+			errorResponse(c, http.StatusConflict, "idempotency_in_progress", "A request with this Idempotency-Key is still in progress")
+		case existing.Fingerprint != fingerprint:
+			errorResponse(c, http.StatusUnprocessableEntity, "idempotency_mismatch", "Idempotency-Key was already used with a different request body")
+		default:
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(existing.Status, existing.ContentType, existing.Body)
+			c.Abort()
+		}
+		return
+	}
+
+	w := &teeWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	c.Next()
+	c.Writer = w.ResponseWriter
+
+	// Server errors are not final; let the client retry for real.
+	if w.Status() >= 500 {
+		if err := idempotencyBackend.Release(context.Background(), scoped); err != nil {
+			log.Printf("idempotency: %v", err)
+		}
+		return
+	}
+	rec := idempotencyRecord{
+		State:       idempotencyComplete,
+		Fingerprint: fingerprint,
+		Status:      w.Status(),
+		ContentType: w.Header().Get("Content-Type"),
+		Body:        w.body.Bytes(),
+	}
+	if err := idempotencyBackend.Complete(context.Background(), scoped, rec, idempotencyTTL); err != nil {
+		log.Printf("idempotency: %v", err)
+	}
+}
+
+// teeWriter copies the response body as it is written.
+type teeWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *teeWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *teeWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// memoryIdempotencyStore keeps up to IDEMPOTENCY_MEMORY_MAX records; past
+// that the least recently used completed ones are forgotten early. Records
+// of requests still running are kept until they complete or their lock
+// expires, so a retry never runs alongside the original.
+type memoryIdempotencyStore struct {
+	records *cache[string, idempotencyRecord]
+}
+
+func (s *memoryIdempotencyStore) Reserve(ctx context.Context, key string, rec idempotencyRecord, ttl time.Duration) (*idempotencyRecord, bool, error) {
+	if existing, loaded := s.records.getOrSet(key, rec, ttl); loaded {
+		return &existing, false, nil
+	}
+	return nil, true, nil
+}
+
+func (s *memoryIdempotencyStore) Complete(ctx context.Context, key string, rec idempotencyRecord, ttl time.Duration) error {
+	s.records.set(key, rec, ttl)
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	s.records.delete(key)
+	return nil
+}
+
+type redisIdempotencyStore struct {
+	client *redis.Client
+}
+
+func (s *redisIdempotencyStore) Reserve(ctx context.Context, key string, rec idempotencyRecord, ttl time.Duration) (*idempotencyRecord, bool, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, false, err
+	}
+	ok, err := s.client.SetNX(ctx, key, data, ttl).Result()
+	if err != nil || ok {
+		return nil, ok, err
+	}
+	raw, err := s.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	var existing idempotencyRecord
+	if err := json.Unmarshal(raw, &existing); err != nil {
+		return nil, false, err
+	}
+	return &existing, false, nil
+}
+
+func (s *redisIdempotencyStore) Complete(ctx context.Context, key string, rec idempotencyRecord, ttl time.Duration) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, key, data, ttl).Err()
+}
+
+func (s *redisIdempotencyStore) Release(ctx context.Context, key string) error {
+	return s.client.Del(ctx, key).Err()
+}
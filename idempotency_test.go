@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMemoryIdempotencyKeepsReservations(t *testing.T) {
+	records := newCache[string, idempotencyRecord]("idempotency_test", 2, 0)
+	records.pinned = func(rec idempotencyRecord) bool { return rec.State == idempotencyPending }
+	s := &memoryIdempotencyStore{records: records}
+	ctx := context.Background()
+
+	if _, reserved, _ := s.Reserve(ctx, "in-flight", idempotencyRecord{State: idempotencyPending}, time.Minute); !reserved {
+		t.Fatal("first reservation refused")
+	}
+	// Fill the cache well past its size with completed requests.
+	for i := range 5 {
+		key := fmt.Sprint("done-", i)
+		s.Reserve(ctx, key, idempotencyRecord{State: idempotencyPending}, time.Minute)
+		s.Complete(ctx, key, idempotencyRecord{State: idempotencyComplete}, time.Hour)
+	}
+	if _, reserved, _ := s.Reserve(ctx, "in-flight", idempotencyRecord{State: idempotencyPending}, time.Minute); reserved {
+		t.Error("a retry reserved a key whose request is still running")
+	}
+	if n := records.len(); n > 3 {
+		t.Errorf("cache holds %d records, want its 2 plus the reservation", n)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif" // registered for thumbnail decoding
+	"image/jpeg"
+	_ "image/png" // registered for thumbnail decoding
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Uploaded receipt images are cleaned before they are stored: EXIF, XMP and
+// text metadata, which commonly carry the GPS position and device of the
+// phone that took the picture, are cut from JPEG, PNG and WebP files
+// without re-encoding the pixels. EXIF orientation goes with the rest, so a
+// rotated photo is stored as the camera captured it. A file whose structure
+// we cannot walk is refused rather than stored with its metadata.
+// IMAGE_KEEP_METADATA turns this off.
+//
+// JPEG, PNG and GIF images declaring more than IMAGE_MAX_PIXELS pixels are
+// refused from their header alone, before anything decodes them.
+//
+// A JPEG thumbnail no larger than IMAGE_THUMBNAIL_SIZE pixels on its long
+// side is stored next to each image for the admin UI; 0 disables them.
+// WebP images, which the standard library cannot decode, get none.
+
+var (
+	stripImageMetadata = os.Getenv("IMAGE_KEEP_METADATA") != "true"
+	thumbnailSize      = envInt("IMAGE_THUMBNAIL_SIZE", 256)
+	// maxImagePixels bounds the decoded size of an image, so a small file
+	// declaring huge dimensions cannot exhaust memory.
+	maxImagePixels = envInt("IMAGE_MAX_PIXELS", 16_000_000)
+
+	errImageUnreadable = errors.New("image could not be read")
+)
+
+func thumbnailKey(id string) string { return id + ".thumb" }
+
+// checkImageDimensions reads the header of a decodable image and refuses
+// it when it cannot be parsed or declares more than maxImagePixels.
+func checkImageDimensions(img blob) error {
+	if img.ContentType == "image/webp" {
+		return nil
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(img.Data))
+	if err != nil || config.Width <= 0 || config.Height <= 0 {
+		return errImageUnreadable
+	}
+	if int64(config.Width)*int64(config.Height) > int64(maxImagePixels) {
+		return errImageTooLarge
+	}
+	return nil
+}
+
+// cleanImage returns img with its metadata removed, or unchanged when
+// stripping is off. GIF files carry no EXIF and are kept as they are.
+func cleanImage(img blob) (blob, error) {
+	if !stripImageMetadata {
+		return img, nil
+	}
+	var cleaned []byte
+	var err error
+	switch img.ContentType {
+	case "image/jpeg":
+		cleaned, err = stripJPEG(img.Data)
+	case "image/png":
+		cleaned, err = stripPNG(img.Data)
+	case "image/webp":
+		cleaned, err = stripWebP(img.Data)
+	default:
+		return img, nil
+	}
+	if err != nil {
+		return blob{}, errImageUnreadable
+	}
+	return blob{ContentType: img.ContentType, Data: cleaned}, nil
+}
+
+var errImageStructure = errors.New("unexpected image structure")
+
+// stripJPEG drops APP1 (EXIF, XMP), APP13 (IPTC) and comment segments. The
+// entropy-coded data from the start of scan on is copied as is.
+func stripJPEG(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errImageStructure
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	for i := 2; ; {
+		if i+4 > len(data) || data[i] != 0xFF {
+			return nil, errImageStructure
+		}
+		marker := data[i+1]
+		if marker == 0xDA { // start of scan
+			out.Write(data[i:])
+			return out.Bytes(), nil
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, errImageStructure
+		}
+		if marker != 0xE1 && marker != 0xED && marker != 0xFE {
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// stripPNG drops eXIf, text and timestamp chunks. Each chunk carries its
+// own CRC, so the rest need no rewriting.
+func stripPNG(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errImageStructure
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+	for i := len(pngSignature); i < len(data); {
+		if i+12 > len(data) {
+			return nil, errImageStructure
+		}
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, errImageStructure
+		}
+		switch string(data[i+4 : i+8]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+	return out.Bytes(), nil
+}
+
+// stripWebP drops the EXIF and XMP chunks of an extended WebP file and
+// clears their flags in the VP8X header.
+func stripWebP(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errImageStructure
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, errImageStructure
+		}
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + size + size&1
+		if size < 0 || end > len(data) {
+			return nil, errImageStructure
+		}
+		switch string(data[i : i+4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			start := out.Len()
+			out.Write(data[i:end])
+			if size > 0 {
+				out.Bytes()[start+8] &^= 0x08 | 0x04 // EXIF and XMP present
+			}
+		default:
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+	cleaned := out.Bytes()
+	binary.LittleEndian.PutUint32(cleaned[4:], uint32(len(cleaned)-8))
+	return cleaned, nil
+}
+
+// makeThumbnail scales img down to fit thumbnailSize and encodes it as
+// JPEG. It returns false when thumbnails are off or the image cannot be
+// decoded.
+func makeThumbnail(img blob) (blob, bool) {
+	if thumbnailSize <= 0 {
+		return blob{}, false
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(img.Data))
+	if err != nil || config.Width <= 0 || config.Height <= 0 || int64(config.Width)*int64(config.Height) > int64(maxImagePixels) {
+		return blob{}, false
+	}
+	src, _, err := image.Decode(bytes.NewReader(img.Data))
+	if err != nil {
+		return blob{}, false
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleDown(src, thumbnailSize), &jpeg.Options{Quality: 80}); err != nil {
+		return blob{}, false
+	}
+	return blob{ContentType: "image/jpeg", Data: buf.Bytes()}, true
+}
+
+// scaleDown fits src within size×size by averaging each block of source
+// pixels. Images already small enough are only copied. The decoders'
+// concrete image types are read directly; anything else goes through At.
+func scaleDown(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, max(1, h*size/b.Dx())
+		} else {
+			w, h = max(1, w*size/b.Dy()), size
+		}
+	}
+	pixel := pixelReader(src)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		for x := range w {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			var r, g, bl, a, n uint32
+			for sy := y0; sy < max(y1, y0+1); sy++ {
+				for sx := x0; sx < max(x1, x0+1); sx++ {
+					pr, pg, pb, pa := pixel(sx, sy)
+					r, g, bl, a, n = r+pr, g+pg, bl+pb, a+pa, n+1
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = uint8(r/n), uint8(g/n), uint8(bl/n), uint8(a/n)
+		}
+	}
+	return dst
+}
+
+// pixelReader returns a function reading the premultiplied 8-bit RGBA
+// value at (x, y) without boxing a color.Color per pixel.
+func pixelReader(src image.Image) func(x, y int) (r, g, b, a uint32) {
+	switch img := src.(type) {
+	case *image.YCbCr:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			yi, ci := img.YOffset(x, y), img.COffset(x, y)
+			r, g, b := color.YCbCrToRGB(img.Y[yi], img.Cb[ci], img.Cr[ci])
+			return uint32(r), uint32(g), uint32(b), 0xff
+		}
+	case *image.Gray:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			v := uint32(img.Pix[img.PixOffset(x, y)])
+			return v, v, v, 0xff
+		}
+	case *image.RGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			p := img.Pix[img.PixOffset(x, y):]
+			return uint32(p[0]), uint32(p[1]), uint32(p[2]), uint32(p[3])
+		}
+	case *image.NRGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			p := img.Pix[img.PixOffset(x, y):]
+			a := uint32(p[3])
+			return uint32(p[0]) * a / 0xff, uint32(p[1]) * a / 0xff, uint32(p[2]) * a / 0xff, a
+		}
+	case *image.Paletted:
+		palette := make([][4]uint32, len(img.Palette))
+		for i, c := range img.Palette {
+			r, g, b, a := c.RGBA()
+			palette[i] = [4]uint32{r >> 8, g >> 8, b >> 8, a >> 8}
+		}
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			i := int(img.Pix[img.PixOffset(x, y)])
+			if i >= len(palette) {
+				return 0, 0, 0, 0
+			}
+			p := palette[i]
+			return p[0], p[1], p[2], p[3]
+		}
+	}
+	return func(x, y int) (uint32, uint32, uint32, uint32) {
+		r, g, b, a := src.At(x, y).RGBA()
+		return r >> 8, g >> 8, b >> 8, a >> 8
+	}
+}
+
+// storeImage puts a receipt image, and its thumbnail when one can be made.
+// It reports whether a thumbnail was stored; failing to store one only
+// logs.
+func storeImage(ctx context.Context, id string, img blob) (bool, error) {
+	blobOp(ctx)
+	if err := attachments.Put(ctx, id, img); err != nil {
+		return false, err
+	}
+	thumb, ok := makeThumbnail(img)
+	if !ok {
+		return false, nil
+	}
+	blobOp(ctx)
+	if err := attachments.Put(ctx, thumbnailKey(id), thumb); err != nil {
+		log.Printf("storing thumbnail for %s: %v", id, err)
+		return false, nil
+	}
+	return true, nil
+}
+
+// getThumbnail serves GET /admin/receipts/:id/thumbnail.
+func getThumbnail(c *gin.Context) {
+	id := c.Param("id")
+	stored, err := store.Get(c.Request.Context(), id)
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	if !stored.HasThumbnail {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Receipt has no thumbnail"})
+		return
+	}
+	thumb, err := attachments.Get(c.Request.Context(), thumbnailKey(id))
+	if errors.Is(err, errBlobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Receipt has no thumbnail"})
+		return
+	}
+	if requestExpired(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not load image"})
+		return
+	}
+	c.Header("Cache-Control", "private, no-store")
+	c.Data(http.StatusOK, thumb.ContentType, thumb.Data)
+}
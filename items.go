@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type itemRollup struct {
+	Count      int
+	SpendCents int64
+}
+
+// itemDaily maps UTC day -> canonical retailer -> normalized description.
+var itemDaily = make(map[int64]map[string]map[string]*itemRollup)
+
+func recordItemRollup(day int64, stored *storedReceipt) {
+	byRetailer, ok := itemDaily[day]
+	if !ok {
+		byRetailer = make(map[string]map[string]*itemRollup)
+		itemDaily[day] = byRetailer
+	}
+	byItem, ok := byRetailer[stored.Retailer]
+	if !ok {
+		byItem = make(map[string]*itemRollup)
+		byRetailer[stored.Retailer] = byItem
+	}
+	for _, item := range stored.Receipt.Items {
+		desc := normalizeDescription(stored.Receipt.Retailer, item.ShortDescription)
+		if desc == "" {
+			continue
+		}
+		rollup, ok := byItem[desc]
+		if !ok {
+			rollup = &itemRollup{}
+			byItem[desc] = rollup
+		}
+		rollup.Count++
+		if cents, err := parseCents(item.Price); err == nil {
+			rollup.SpendCents += cents
+		}
+	}
+}
+
+// getTopItems serves GET /analytics/items/top: the most frequent normalized
+// item descriptions between from and to, optionally for one retailer.
+func getTopItems(c *gin.Context) {
+	from, to, err := timeRange(c, 30*24*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid time range: use RFC 3339 timestamps or YYYY-MM-DD dates with from before to"})
+		return
+	}
+	from = startOfDay(from)
+	if to.Sub(from)/(24*time.Hour) > maxSeriesBuckets {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Requested range has too many buckets"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if err != nil || limit < 1 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Limit must be between 1 and 1000"})
+		return
+	}
+	retailer := ""
+	if name := c.Query("retailer"); name != "" {
+		retailer = normalizeRetailer(name)
+	}
+
+	totals := make(map[string]*itemRollup)
+	analyticsMu.RLock()
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		for r, byItem := range itemDaily[day.Unix()] {
+			if retailer != "" && r != retailer {
+				continue
+			}
+			for desc, rollup := range byItem {
+				sum, ok := totals[desc]
+				if !ok {
+					sum = &itemRollup{}
+					totals[desc] = sum
+				}
+				sum.Count += rollup.Count
+				sum.SpendCents += rollup.SpendCents
+			}
+		}
+	}
+	analyticsMu.RUnlock()
+
+	type itemStats struct {
+		Description string `json:"description"`
+		Count       int    `json:"count"`
+		TotalSpend  string `json:"totalSpend"`
+		spendCents  int64
+	}
+	// Under privacy an item is known by how many lines name it, so the
+	// minimum count applies to those.
+	privacy := privacyFor(c)
+	items := make([]itemStats, 0, len(totals))
+	for desc, sum := range totals {
+		figure := "items/" + retailer + "/" + desc
+		count, spend := privacy.items(figure, sum.Count), privacy.spend(figure, sum.SpendCents)
+		if privacy != nil && count < max(privacy.minCount, 1) {
+			continue
+		}
+		items = append(items, itemStats{Description: desc, Count: count, TotalSpend: formatCents(spend), spendCents: spend})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Count != items[j].Count {
+			return items[i].Count > items[j].Count
+		}
+		if items[i].spendCents != items[j].spendCents {
+			return items[i].spendCents > items[j].spendCents
+		}
+		return items[i].Description < items[j].Description
+	})
+	if len(items) > limit {
+		items = items[:limit]
+	}
+
+	resp := gin.H{"from": from, "to": to, "items": items}
+	if retailer != "" {
+		resp["retailer"] = retailer
+	}
+	privacy.describe(resp)
+	c.JSON(http.StatusOK, resp)
+}
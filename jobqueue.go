@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The async queue keeps its jobs in a jobBackend: in memory by default, or
+// in the BoltDB file at ASYNC_QUEUE_FILE so queued work survives a restart.
+// A worker claims a job by leasing it for ASYNC_VISIBILITY_TIMEOUT; a job
+// whose worker died mid-lease becomes visible again when the lease runs
+// out and is claimed as if it were queued.
+//
+// Webhook subscription deliveries keep their in-memory queue: the
+// subscriptions themselves are not persisted, and the outbox events they
+// are made from already are.
+
+var errJobNotFound = errors.New("job not found")
+
+// storedJob is a job as the backend keeps it: the public view plus what
+// the worker needs to run it.
+type storedJob struct {
+	asyncJob
+	Tenant  string  `json:"tenant"`
+	Channel string  `json:"channel"`
+	Receipt Receipt `json:"receipt"`
+	// VisibleAt is when a queued job may next be claimed, or when a
+	// processing job's lease runs out.
+	VisibleAt time.Time `json:"visibleAt"`
+	// TraceID is the submitting request's trace, for exemplars.
+	TraceID string `json:"traceId,omitempty"`
+}
+
+func (j *storedJob) active() bool {
+	return j.Status == asyncQueued || j.Status == asyncProcessing
+}
+
+func (j *storedJob) clone() *storedJob {
+	copied := *j
+	return &copied
+}
+
+type jobBackend interface {
+	// add saves a new job unless priority already has limit queued jobs.
+	add(job *storedJob, limit int) error
+	save(job *storedJob) error
+	get(id string) (*storedJob, error)
+	byReceipt(receiptID string) (*storedJob, error)
+	// claim leases the next visible job until now+lease, interactive jobs
+	// first and then the longest waiting. It returns nil when none is
+	// visible.
+	claim(now time.Time, lease time.Duration) (*storedJob, error)
+	// list returns up to limit jobs with status (any when empty), newest
+	// first.
+	list(status string, limit int) ([]*storedJob, error)
+	// queued counts the jobs of priority waiting to be claimed.
+	queued(priority string) int
+	// prune forgets the oldest finished jobs beyond retain.
+	prune(retain int) error
+}
+
+func openJobBackend(path string) (jobBackend, error) {
+	if path == "" {
+		return newMemoryJobs(), nil
+	}
+	return openBoltJobs(path)
+}
+
+func priorityRank(priority string) byte {
+	if priority == priorityBulk {
+		return 1
+	}
+	return 0
+}
+
+type memoryJobs struct {
+	mu        sync.Mutex
+	jobs      map[string]*storedJob
+	receipts  map[string]string
+	finished  []string // oldest first
+	queuedFor map[string]int
+}
+
+func newMemoryJobs() *memoryJobs {
+	return &memoryJobs{jobs: make(map[string]*storedJob), receipts: make(map[string]string), queuedFor: make(map[string]int)}
+}
+
+func (m *memoryJobs) add(job *storedJob, limit int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.queuedFor[job.Priority] >= limit {
+		return errQueueFull
+	}
+	m.put(job)
+	return nil
+}
+
+func (m *memoryJobs) save(job *storedJob) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.put(job)
+	return nil
+}
+
+// put stores job, keeping the counts and finished list in step; the
+// caller holds mu.
+func (m *memoryJobs) put(job *storedJob) {
+	old, existed := m.jobs[job.ID]
+	if existed && old.Status == asyncQueued {
+		m.queuedFor[old.Priority]--
+	}
+	if job.Status == asyncQueued {
+		m.queuedFor[job.Priority]++
+	}
+	if !job.active() && (!existed || old.active()) {
+		m.finished = append(m.finished, job.ID)
+	}
+	m.jobs[job.ID] = job.clone()
+	m.receipts[job.ReceiptID] = job.ID
+}
+
+func (m *memoryJobs) get(id string) (*storedJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, errJobNotFound
+	}
+	return job.clone(), nil
+}
+
+func (m *memoryJobs) byReceipt(receiptID string) (*storedJob, error) {
+	m.mu.Lock()
+	id, ok := m.receipts[receiptID]
+	m.mu.Unlock()
+	if !ok {
+		return nil, errJobNotFound
+	}
+	return m.get(id)
+}
+
+func (m *memoryJobs) claim(now time.Time, lease time.Duration) (*storedJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var next *storedJob
+	for _, job := range m.jobs {
+		if !job.active() || job.VisibleAt.After(now) {
+			continue
+		}
+		if next == nil || priorityRank(job.Priority) < priorityRank(next.Priority) ||
+			priorityRank(job.Priority) == priorityRank(next.Priority) && job.VisibleAt.Before(next.VisibleAt) {
+			next = job
+		}
+	}
+	if next == nil {
+		return nil, nil
+	}
+	claimed := next.clone()
+	claimed.Status, claimed.Attempts, claimed.VisibleAt, claimed.NextAttemptAt = asyncProcessing, next.Attempts+1, now.Add(lease), nil
+	m.put(claimed)
+	return claimed, nil
+}
+
+func (m *memoryJobs) list(status string, limit int) ([]*storedJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	matched := make([]*storedJob, 0)
+	for _, job := range m.jobs {
+		if status == "" || job.Status == status {
+			matched = append(matched, job.clone())
+		}
+	}
+	sortNewestFirst(matched)
+	if len(matched) > limit {
+		matched = matched[:limit]
+	}
+	return matched, nil
+}
+
+func (m *memoryJobs) queued(priority string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.queuedFor[priority]
+}
+
+func (m *memoryJobs) prune(retain int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(m.finished) > retain {
+		id := m.finished[0]
+		m.finished = m.finished[1:]
+		// A finished job sent back to the queue is no longer a candidate.
+		if job, ok := m.jobs[id]; ok && !job.active() {
+			delete(m.receipts, job.ReceiptID)
+			delete(m.jobs, id)
+		}
+	}
+	return nil
+}
+
+func sortNewestFirst(jobs []*storedJob) {
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].EnqueuedAt.After(jobs[j].EnqueuedAt) })
+}
+
+var (
+	boltJobs         = []byte("jobs")
+	boltJobsReady    = []byte("jobs_ready")    // rank, VisibleAt, ID → status of active jobs
+	boltJobsFinished = []byte("jobs_finished") // FinishedAt, ID → nil
+	boltJobsReceipts = []byte("jobs_receipts") // receipt ID → job ID
+)
+
+// boltJobQueue keeps each job as JSON, with an index of active jobs
+// ordered by priority and visibility so a claim reads one key per
+// priority, and an index of finished jobs by age for pruning.
+type boltJobQueue struct {
+	db *bolt.DB
+
+	mu     sync.Mutex
+	counts jobCounts
+}
+
+// jobCounts tracks the bolt indexes' sizes so limits and pruning need not
+// scan them.
+type jobCounts struct {
+	queued   [2]int // by priority rank
+	finished int
+}
+
+func (c *jobCounts) add(d jobCounts) {
+	c.queued[0] += d.queued[0]
+	c.queued[1] += d.queued[1]
+	c.finished += d.finished
+}
+
+func openBoltJobs(path string) (*boltJobQueue, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	q := &boltJobQueue{db: db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltJobs, boltJobsReady, boltJobsFinished, boltJobsReceipts} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		q.counts.finished = tx.Bucket(boltJobsFinished).Stats().KeyN
+		return tx.Bucket(boltJobsReady).ForEach(func(k, v []byte) error {
+			if string(v) == asyncQueued {
+				q.counts.queued[k[0]]++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	return q, nil
+}
+
+func readyKey(job *storedJob) []byte {
+	key := make([]byte, 9, 9+len(job.ID))
+	key[0] = priorityRank(job.Priority)
+	binary.BigEndian.PutUint64(key[1:], uint64(job.VisibleAt.UnixNano()))
+	return append(key, job.ID...)
+}
+
+func finishedKey(job *storedJob) []byte {
+	key := make([]byte, 8, 8+len(job.ID))
+	if job.FinishedAt != nil {
+		binary.BigEndian.PutUint64(key, uint64(job.FinishedAt.UnixNano()))
+	}
+	return append(key, job.ID...)
+}
+
+func boltGetJob(tx *bolt.Tx, id string) (*storedJob, error) {
+	data := tx.Bucket(boltJobs).Get([]byte(id))
+	if data == nil {
+		return nil, errJobNotFound
+	}
+	job := new(storedJob)
+	if err := json.Unmarshal(data, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// put writes job and moves it between the indexes, returning the change
+// to the counts.
+func (q *boltJobQueue) put(tx *bolt.Tx, job *storedJob) (jobCounts, error) {
+	var d jobCounts
+	old, err := boltGetJob(tx, job.ID)
+	if err != nil && !errors.Is(err, errJobNotFound) {
+		return d, err
+	}
+	ready, finished := tx.Bucket(boltJobsReady), tx.Bucket(boltJobsFinished)
+	if old != nil {
+		if old.active() {
+			err = ready.Delete(readyKey(old))
+		} else {
+			err = finished.Delete(finishedKey(old))
+			d.finished--
+		}
+		if err != nil {
+			return d, err
+		}
+		if old.Status == asyncQueued {
+			d.queued[priorityRank(old.Priority)]--
+		}
+	}
+	if job.active() {
+		err = ready.Put(readyKey(job), []byte(job.Status))
+	} else {
+		err = finished.Put(finishedKey(job), nil)
+		d.finished++
+	}
+	if err != nil {
+		return d, err
+	}
+	if job.Status == asyncQueued {
+		d.queued[priorityRank(job.Priority)]++
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return d, err
+	}
+	if err := tx.Bucket(boltJobs).Put([]byte(job.ID), data); err != nil {
+		return d, err
+	}
+	return d, tx.Bucket(boltJobsReceipts).Put([]byte(job.ReceiptID), []byte(job.ID))
+}
+
+// write runs fn in a read-write transaction and applies its change to the
+// counts once it commits.
+func (q *boltJobQueue) write(fn func(tx *bolt.Tx) (jobCounts, error)) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var d jobCounts
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		d, err = fn(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	q.counts.add(d)
+	return nil
+}
+
+func (q *boltJobQueue) add(job *storedJob, limit int) error {
+	return q.write(func(tx *bolt.Tx) (jobCounts, error) {
+		if q.counts.queued[priorityRank(job.Priority)] >= limit {
+			return jobCounts{}, errQueueFull
+		}
+		return q.put(tx, job)
+	})
+}
+
+func (q *boltJobQueue) save(job *storedJob) error {
+	return q.write(func(tx *bolt.Tx) (jobCounts, error) { return q.put(tx, job) })
+}
+
+func (q *boltJobQueue) get(id string) (*storedJob, error) {
+	var job *storedJob
+	err := q.db.View(func(tx *bolt.Tx) error {
+		var err error
+		job, err = boltGetJob(tx, id)
+		return err
+	})
+	return job, err
+}
+
+func (q *boltJobQueue) byReceipt(receiptID string) (*storedJob, error) {
+	var job *storedJob
+	err := q.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(boltJobsReceipts).Get([]byte(receiptID))
+		if id == nil {
+			return errJobNotFound
+		}
+		var err error
+		job, err = boltGetJob(tx, string(id))
+		return err
+	})
+	return job, err
+}
+
+func (q *boltJobQueue) claim(now time.Time, lease time.Duration) (*storedJob, error) {
+	var claimed *storedJob
+	err := q.write(func(tx *bolt.Tx) (jobCounts, error) {
+		c := tx.Bucket(boltJobsReady).Cursor()
+		for _, rank := range []byte{0, 1} {
+			k, _ := c.Seek([]byte{rank})
+			if k == nil || k[0] != rank || int64(binary.BigEndian.Uint64(k[1:9])) > now.UnixNano() {
+				continue
+			}
+			job, err := boltGetJob(tx, string(k[9:]))
+			if err != nil {
+				return jobCounts{}, err
+			}
+			job.Status, job.Attempts, job.VisibleAt, job.NextAttemptAt = asyncProcessing, job.Attempts+1, now.Add(lease), nil
+			claimed = job
+			return q.put(tx, job)
+		}
+		return jobCounts{}, nil
+	})
+	return claimed, err
+}
+
+func (q *boltJobQueue) list(status string, limit int) ([]*storedJob, error) {
+	matched := make([]*storedJob, 0)
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltJobs).ForEach(func(_, data []byte) error {
+			job := new(storedJob)
+			if err := json.Unmarshal(data, job); err != nil {
+				return err
+			}
+			if status == "" || job.Status == status {
+				matched = append(matched, job)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortNewestFirst(matched)
+	if len(matched) > limit {
+		matched = matched[:limit]
+	}
+	return matched, nil
+}
+
+func (q *boltJobQueue) queued(priority string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.counts.queued[priorityRank(priority)]
+}
+
+func (q *boltJobQueue) prune(retain int) error {
+	return q.write(func(tx *bolt.Tx) (jobCounts, error) {
+		var d jobCounts
+		excess := q.counts.finished - retain
+		if excess <= 0 {
+			return d, nil
+		}
+		// Collect first: deleting under a bolt cursor can skip keys.
+		var keys [][]byte
+		c := tx.Bucket(boltJobsFinished).Cursor()
+		for k, _ := c.First(); k != nil && len(keys) < excess; k, _ = c.Next() {
+			keys = append(keys, bytes.Clone(k))
+		}
+		for _, k := range keys {
+			id := k[8:]
+			if job, err := boltGetJob(tx, string(id)); err == nil {
+				if err := tx.Bucket(boltJobsReceipts).Delete([]byte(job.ReceiptID)); err != nil {
+					return d, err
+				}
+			}
+			if err := tx.Bucket(boltJobs).Delete(id); err != nil {
+				return d, err
+			}
+			if err := tx.Bucket(boltJobsFinished).Delete(k); err != nil {
+				return d, err
+			}
+			d.finished--
+		}
+		return d, nil
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+var schedulerLeader = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "scheduler_leader",
+	Help: "1 while this replica holds the background job lease.",
+})
+
+// leaderElector decides whether this replica runs cluster-wide jobs.
+type leaderElector interface {
+	IsLeader() bool
+	run(ctx context.Context)
+}
+
+// soloLeader is used when no election backend is configured: a single
+// replica is always the leader.
+type soloLeader struct{}
+
+func (soloLeader) IsLeader() bool          { return true }
+func (soloLeader) run(ctx context.Context) { schedulerLeader.Set(1) }
+
+// redisLeader holds a lease key in Redis. The holder renews it every third
+// of LEADER_LEASE_TTL; other replicas try to take it over once it lapses.
+type redisLeader struct {
+	client   *redis.Client
+	key      string
+	identity string
+	ttl      time.Duration
+	leader   atomic.Bool
+}
+
+// renewLease extends the lease only if this replica still holds it.
+var renewLease = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+var leader = newLeaderElectorFromEnv()
+
+// newLeaderElectorFromEnv reads LEADER_REDIS_URL, LEADER_LEASE_KEY and
+// LEADER_LEASE_TTL.
+func newLeaderElectorFromEnv() leaderElector {
+	raw := os.Getenv("LEADER_REDIS_URL")
+	if raw == "" {
+		return soloLeader{}
+	}
+	opts, err := redis.ParseURL(raw)
+	if err != nil {
+		log.Fatalf("LEADER_REDIS_URL: %v", err)
+	}
+	host, _ := os.Hostname()
+	key := os.Getenv("LEADER_LEASE_KEY")
+	if key == "" {
+		key = "receipt-processor:scheduler-leader"
+	}
+	return &redisLeader{
+		client:   redis.NewClient(opts),
+		key:      key,
+		identity: host + "/" + uuid.New().String(),
+		ttl:      envDuration("LEADER_LEASE_TTL", 15*time.Second),
+	}
+}
+
+func (l *redisLeader) IsLeader() bool { return l.leader.Load() }
+
+func (l *redisLeader) run(ctx context.Context) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		l.campaign(ctx)
+		select {
+		case <-ctx.Done():
+			if l.leader.Load() {
+				l.client.Del(context.Background(), l.key)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *redisLeader) campaign(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, l.ttl/3)
+	defer cancel()
+	var held bool
+	var err error
+	if l.leader.Load() {
+		var renewed int64
+		renewed, err = renewLease.Run(ctx, l.client, []string{l.key}, l.identity, l.ttl.Milliseconds()).Int64()
+		held = renewed == 1
+	} else {
+		held, err = l.client.SetNX(ctx, l.key, l.identity, l.ttl).Result()
+	}
+	if err != nil {
+		// Without Redis we cannot prove the lease is still ours.
+		log.Printf("leader election: %v", err)
+		held = false
+	}
+	if held != l.leader.Load() {
+		log.Printf("leader election: leader=%v (%s)", held, l.identity)
+	}
+	l.leader.Store(held)
+	if held {
+		schedulerLeader.Set(1)
+	} else {
+		schedulerLeader.Set(0)
+	}
+}
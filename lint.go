@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// POST /receipts/lint checks a receipt without storing it. Besides the
+// validation errors that would make /receipts/process refuse it, it lists
+// warnings about data that is accepted but probably not what the partner
+// meant: inconsistent casing, suspicious prices, and descriptions whose
+// stray whitespace costs them the description length points.
+
+type lintWarning struct {
+	Code    string `json:"code"`
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func lintReceipt(c *gin.Context) {
+	receipt, err := decodeReceipt(c.Request.Body)
+	if errors.Is(err, errUnsupportedSchema) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported schemaVersion"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+	errs := validateReceipt(receipt)
+	warnings := receiptWarnings(receipt)
+	c.JSON(http.StatusOK, gin.H{
+		"valid":    len(errs) == 0,
+		"errors":   append([]fieldError{}, errs...),
+		"warnings": append([]lintWarning{}, warnings...),
+	})
+}
+
+func receiptWarnings(receipt Receipt) []lintWarning {
+	var warnings []lintWarning
+	warn := func(code, field, format string, args ...any) {
+		warnings = append(warnings, lintWarning{Code: code, Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if profile := lookupRetailer(receipt.Retailer); profile != nil {
+		name := strings.TrimSpace(storeNumberPattern.ReplaceAllString(receipt.Retailer, ""))
+		if name != profile.Canonical && strings.EqualFold(name, profile.Canonical) {
+			warn("retailer_casing", "retailer", "is usually written %q", profile.Canonical)
+		}
+	}
+
+	var upper, mixed []int
+	for i, item := range receipt.Items {
+		switch letterCase(item.ShortDescription) {
+		case "upper":
+			upper = append(upper, i)
+		case "mixed":
+			mixed = append(mixed, i)
+		}
+	}
+	if len(upper) > 0 && len(mixed) > 0 {
+		minority := upper
+		if len(upper) > len(mixed) {
+			minority = mixed
+		}
+		for _, i := range minority {
+			warn("inconsistent_casing", fmt.Sprintf("items[%d].shortDescription", i), "is cased differently from the other items")
+		}
+	}
+
+	total, totalErr := parseCents(receipt.Total)
+	var sum int64
+	pricesValid := totalErr == nil
+	for i, item := range receipt.Items {
+		field := fmt.Sprintf("items[%d].price", i)
+		price, err := parseCents(item.Price)
+		if err != nil {
+			pricesValid = false
+			continue
+		}
+		sum += price
+		switch {
+		case price == 0:
+			warn("zero_price", field, "is 0.00")
+		case totalErr == nil && price > total:
+			warn("price_exceeds_total", field, "is more than the receipt total %s", receipt.Total)
+		}
+	}
+	if pricesValid && len(receipt.Items) > 0 && sum != total {
+		warn("total_mismatch", "total", "items sum to %s, not %s", formatCents(sum), receipt.Total)
+	}
+
+	for i, item := range receipt.Items {
+		if lost := whitespacePointsLost(item); lost > 0 {
+			warn("description_whitespace", fmt.Sprintf("items[%d].shortDescription", i),
+				"loses %d points to repeated or unusual whitespace; %q would earn them", lost, canonicalText(item.ShortDescription))
+		}
+	}
+	return warnings
+}
+
+// letterCase reports whether s's letters are all "upper", all "lower" or
+// "mixed"; it is "" when s has no letters.
+func letterCase(s string) string {
+	var hasUpper, hasLower bool
+	for _, r := range s {
+		hasUpper = hasUpper || unicode.IsUpper(r)
+		hasLower = hasLower || unicode.IsLower(r)
+	}
+	switch {
+	case hasUpper && hasLower:
+		return "mixed"
+	case hasUpper:
+		return "upper"
+	case hasLower:
+		return "lower"
+	}
+	return ""
+}
+
+// whitespacePointsLost is what the description length rule would award an
+// item if runs of whitespace in its description were single spaces, when
+// it awards nothing as written.
+func whitespacePointsLost(item Item) int {
+	desc := strings.TrimSpace(item.ShortDescription)
+	cleaned := canonicalText(desc)
+	if cleaned == desc || len(desc)%3 == 0 || len(cleaned)%3 != 0 {
+		return 0
+	}
+	price, err := strconv.ParseFloat(item.Price, 64)
+	if err != nil {
+		return 0
+	}
+	for _, rule := range pointsRules {
+		if rule.name == "item_description_length" && !stableRuleset.disabled[rule.name] {
+			policy := stableRuleset.policyFor(rule)
+			return policy.round(price * policy.Multiplier)
+		}
+	}
+	return 0
+}
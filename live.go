@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	liveSeconds = 15 * 60
+	liveMinutes = 15
+)
+
+type liveSecond struct {
+	at           int64
+	requests     int
+	clientErrors int
+	serverErrors int
+	receipts     int
+}
+
+type liveMinute struct {
+	at        int64
+	retailers map[string]int
+}
+
+// liveWindow keeps the last fifteen minutes of traffic in fixed rings:
+// per-second counters for rates, per-minute retailer counts for the top
+// list. Slots are reused in place, so memory stays constant.
+type liveWindow struct {
+	mu      sync.Mutex
+	seconds [liveSeconds]liveSecond
+	minutes [liveMinutes]liveMinute
+}
+
+var live = &liveWindow{}
+
+func (w *liveWindow) second(now time.Time) *liveSecond {
+	at := now.Unix()
+	slot := &w.seconds[at%liveSeconds]
+	if slot.at != at {
+		*slot = liveSecond{at: at}
+	}
+	return slot
+}
+
+// observe is middleware counting every request and its outcome.
+func (w *liveWindow) observe(c *gin.Context) {
+	c.Next()
+	status := c.Writer.Status()
+	w.mu.Lock()
+	slot := w.second(time.Now())
+	slot.requests++
+	if status >= 500 {
+		slot.serverErrors++
+	} else if status >= 400 {
+		slot.clientErrors++
+	}
+	w.mu.Unlock()
+}
+
+func (w *liveWindow) recordReceipt(retailer string) {
+	now := time.Now()
+	w.mu.Lock()
+	w.second(now).receipts++
+	at := now.Unix() / 60
+	slot := &w.minutes[at%liveMinutes]
+	if slot.at != at || slot.retailers == nil {
+		*slot = liveMinute{at: at, retailers: make(map[string]int)}
+	}
+	slot.retailers[retailer]++
+	w.mu.Unlock()
+}
+
+type liveRates struct {
+	ReceiptsPerMinute float64 `json:"receiptsPerMinute"`
+	RequestsPerMinute float64 `json:"requestsPerMinute"`
+	ErrorRate         float64 `json:"errorRate"`
+	RejectionRate     float64 `json:"rejectionRate"`
+}
+
+func (w *liveWindow) rates(now int64, minutes int) liveRates {
+	var sum liveSecond
+	for _, slot := range w.seconds {
+		if slot.at > now-int64(minutes*60) && slot.at <= now {
+			sum.requests += slot.requests
+			sum.clientErrors += slot.clientErrors
+			sum.serverErrors += slot.serverErrors
+			sum.receipts += slot.receipts
+		}
+	}
+	rates := liveRates{
+		ReceiptsPerMinute: float64(sum.receipts) / float64(minutes),
+		RequestsPerMinute: float64(sum.requests) / float64(minutes),
+	}
+	if sum.requests > 0 {
+		rates.ErrorRate = float64(sum.serverErrors) / float64(sum.requests)
+		rates.RejectionRate = float64(sum.clientErrors) / float64(sum.requests)
+	}
+	return rates
+}
+
+// getLive serves GET /analytics/live: request and receipt rates over the
+// last 1, 5 and 15 minutes and the busiest retailers in the last 5.
+func getLive(c *gin.Context) {
+	now := time.Now()
+	type retailerCount struct {
+		Retailer string `json:"retailer"`
+		Receipts int    `json:"receipts"`
+	}
+
+	live.mu.Lock()
+	windows := gin.H{
+		"1m":  live.rates(now.Unix(), 1),
+		"5m":  live.rates(now.Unix(), 5),
+		"15m": live.rates(now.Unix(), 15),
+	}
+	counts := make(map[string]int)
+	minute := now.Unix() / 60
+	for _, slot := range live.minutes {
+		if slot.at > minute-5 && slot.at <= minute {
+			for retailer, n := range slot.retailers {
+				counts[retailer] += n
+			}
+		}
+	}
+	live.mu.Unlock()
+
+	top := make([]retailerCount, 0, len(counts))
+	for retailer, n := range counts {
+		top = append(top, retailerCount{Retailer: retailer, Receipts: n})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Receipts != top[j].Receipts {
+			return top[i].Receipts > top[j].Receipts
+		}
+		return top[i].Retailer < top[j].Retailer
+	})
+	if len(top) > 5 {
+		top = top[:5]
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{"at": now.UTC(), "windows": windows, "topRetailers": top})
+}
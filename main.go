@@ -1,28 +1,42 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"math"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log"
 	"net/http"
-	"regexp"
-	"strconv"
-	"strings"
-	"sync"
+	"os"
 	"time"
 )
 
 type Receipt struct {
-	Retailer     string `json:"retailer"`
-	PurchaseDate string `json:"purchaseDate"`
-	PurchaseTime string `json:"purchaseTime"`
-	Items        []Item `json:"items"`
-	Total        string `json:"total"`
+	SchemaVersion int    `json:"schemaVersion"`
+	Retailer      string `json:"retailer"`
+	PurchaseDate  string `json:"purchaseDate"`
+	PurchaseTime  string `json:"purchaseTime"`
+	// TimeZone is the IANA zone of the purchase date and time; see
+	// timezone.go.
+	TimeZone   string    `json:"timeZone,omitempty"`
+	Items      []Item    `json:"items"`
+	Total      string    `json:"total"`
+	Currency   string    `json:"currency"`
+	CustomerID string    `json:"customerId,omitempty"`
+	Location   *Location `json:"location,omitempty"`
+	// Metadata is the submitter's own reference data, such as an order ID.
+	// It is stored and echoed back but plays no part in scoring or hashing.
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
 type Item struct {
 	ShortDescription string `json:"shortDescription"`
 	Price            string `json:"price"`
+	Quantity         int    `json:"quantity"`
+	Category         string `json:"category"`
 }
 
 type ReceiptPoints struct {
@@ -30,96 +44,658 @@ type ReceiptPoints struct {
 	Points int    `json:"points"`
 }
 
-var (
-	receipts = make(map[string]int)
-	mutex    = &sync.Mutex{}
-)
+type storedReceipt struct {
+	ID      string
+	Tenant  string
+	Receipt Receipt
+	// Sealed holds Receipt encrypted under the tenant's key while it is
+	// stored; see tenantkeys.go.
+	Sealed *sealedReceipt
+	// Corrections lists fields the service changed on submission, with
+	// their original values; see autocorrect.go.
+	Corrections  []receiptCorrection
+	Retailer     string
+	Points       int
+	RulesVersion string
+	Breakdown    []ruleResult
+	Hash         string
+	HasImage     bool
+	HasThumbnail bool
+	Tags         []string
+	Notes        []receiptNote
+	Shadow       *shadowScore
+	// Ledger adjusts Points after scoring, e.g. clawbacks for returns.
+	Ledger        []ledgerEntry
+	ReturnedItems []int
+	Disputes      []dispute
+	// Channel is how the receipt was submitted; see channels.go.
+	Channel    string
+	VerifiedAt *time.Time
+	// Deadline is the submission window the receipt was checked against.
+	Deadline *submissionWindow
+	// Backfill is the source a historical import read the receipt from.
+	Backfill string
+	// Cost is what processing the submission took; see costs.go.
+	Cost *processingCost
+	// Status is receiptAccepted, receiptQuarantined or receiptRejected.
+	Status            string
+	QuarantineReasons []string
+	Review            *receiptReview
+	CreatedAt         time.Time
+	// AcceptedAt is when the receipt was scored: CreatedAt, or the approval
+	// time for receipts released from quarantine.
+	AcceptedAt time.Time
+	// SettlesAt is when the points leave their hold; SettledAt, when set,
+	// is an earlier explicit settlement.
+	SettlesAt time.Time
+	SettledAt time.Time
+	// ExpiresAt, when set, is when the points expire unredeemed.
+	ExpiresAt time.Time
+}
 
 func main() {
+	if err := loadRetailerProfiles(os.Getenv("RETAILER_PROFILES_FILE")); err != nil {
+		log.Fatalf("loading retailer profiles: %v", err)
+	}
+	if err := loadTextTemplates(os.Getenv("RECEIPT_TEXT_TEMPLATES_FILE")); err != nil {
+		log.Fatalf("loading receipt text templates: %v", err)
+	}
+	if err := loadCatalogs(os.Getenv("I18N_CATALOG_DIR")); err != nil {
+		log.Fatalf("loading message catalogs: %v", err)
+	}
+	if err := loadSigningKey(os.Getenv("POINTS_SIGNING_KEY_FILE")); err != nil {
+		log.Fatalf("loading points signing key: %v", err)
+	}
+	if err := loadRoundingPolicies(os.Getenv("RULES_ROUNDING_FILE")); err != nil {
+		log.Fatalf("loading rounding policies: %v", err)
+	}
+	if err := loadChannelRules(os.Getenv("CHANNEL_RULES_FILE")); err != nil {
+		log.Fatalf("loading channel rules: %v", err)
+	}
+	if err := loadCandidateRules(os.Getenv("RULES_CANDIDATE_FILE")); err != nil {
+		log.Fatalf("loading candidate rules: %v", err)
+	}
+	if err := loadTenantKeys(os.Getenv("TENANT_KEYS_FILE")); err != nil {
+		log.Fatalf("loading tenant keys: %v", err)
+	}
+	if err := loadTenantLimits(os.Getenv("TENANT_CONCURRENCY_FILE")); err != nil {
+		log.Fatalf("loading tenant concurrency limits: %v", err)
+	}
+	if err := loadSimilarityConfig(os.Getenv("SIMILARITY_FILE")); err != nil {
+		log.Fatalf("loading similarity config: %v", err)
+	}
+	if err := loadEmailTemplates(os.Getenv("CUSTOMER_EMAIL_TEMPLATES")); err != nil {
+		log.Fatalf("loading customer email templates: %v", err)
+	}
+	if err := loadScoringCorpus(os.Getenv("SELFTEST_CORPUS_FILE")); err != nil {
+		log.Fatalf("loading scoring corpus: %v", err)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		os.Exit(runSelftestCommand(os.Args[2:]))
+	}
+	var err error
+	if store, err = openStoreFromEnv(); err != nil {
+		log.Fatalf("opening receipt store: %v", err)
+	}
+	if attachments, err = newBlobStore(os.Getenv("BLOB_STORE_DIR")); err != nil {
+		log.Fatalf("opening blob store: %v", err)
+	}
+	if async.backend, err = openJobBackend(os.Getenv("ASYNC_QUEUE_FILE")); err != nil {
+		log.Fatalf("opening async queue: %v", err)
+	}
+	if err := loadStoredRetailers(context.Background()); err != nil {
+		log.Fatalf("loading stored retailers: %v", err)
+	}
+	if err := loadStoredTenantKeys(context.Background()); err != nil {
+		log.Fatalf("loading stored tenant keys: %v", err)
+	}
+	if err := loadStoredAPIKeys(context.Background()); err != nil {
+		log.Fatalf("loading API keys: %v", err)
+	}
+	if err := seedFractionCarry(context.Background()); err != nil {
+		log.Fatalf("loading fractional points: %v", err)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		os.Exit(runBackfillCommand(os.Args[2:]))
+	}
+
+	configureGinMode()
 	r := gin.Default()
-	r.POST("/receipts/process", processReceipt)
-	r.GET("/receipts/:id/points", getPoints)
+	r.Use(traceContext, drain.track, live.observe, observeTenant, withRequestTimeout, decompressRequest, captureRejected, negotiateYAML, localizeErrors, authenticateSandbox, authenticateAPIKey, limitTenantConcurrency, checkReceiptTenant)
+	if chaos, err := loadChaos(); err != nil {
+		log.Fatalf("loading chaos config: %v", err)
+	} else if chaos != nil {
+		r.Use(chaos)
+	}
+	if validate, err := loadSpecValidation(); err != nil {
+		log.Fatalf("loading OpenAPI spec: %v", err)
+	} else if validate != nil {
+		r.Use(validate)
+	}
+	r.POST("/receipts/process", yamlReceiptBody, trackSubmission, idempotentReplay, processReceipt)
+	r.POST("/receipts/process/batch", processBatch)
+	r.POST(streamPath, processBatchStream)
+	r.POST("/receipts/parse-text", parseReceiptText)
+	r.POST("/receipts/lint", yamlReceiptBody, lintReceipt)
+	r.POST("/receipts/process/async", processReceiptAsync)
+	r.GET("/receipts/jobs/:id", getAsyncJob)
+	r.POST("/receipts/process/from-template/:name", processFromTemplate)
+	r.GET("/receipts/templates", listTemplates)
+	r.GET("/receipts/templates/:name", getTemplate)
+	r.PUT("/receipts/templates/:name", putTemplate)
+	r.DELETE("/receipts/templates/:name", deleteTemplate)
+	r.GET("/receipts/:id", sparseFields(""), getReceipt)
+	r.GET("/receipts/:id/points", sparseFields(""), getPoints)
+	r.GET("/receipts/:id/breakdown", sparseFields(""), getBreakdown)
+	r.GET("/receipts/:id/certificate", getCertificate)
+	r.GET("/.well-known/jwks.json", getJWKS)
+	r.GET("/receipts", sparseFields("receipts"), listReceipts)
+	r.POST("/receipts/:id/return", returnItems)
+	r.POST("/receipts/:id/disputes", createDispute)
+	r.GET("/receipts/:id/disputes", listReceiptDisputes)
+	r.GET("/customers/:id/balance", getBalance)
+	r.GET("/customers/:id/notifications", requireTenantKey, getNotificationSettings)
+	r.PUT("/customers/:id/notifications", requireTenantKey, putNotificationSettings)
+	r.DELETE("/customers/:id/notifications", requireTenantKey, deleteNotificationSettings)
+	registerConnect(r)
+	hooks := r.Group("/webhooks/subscriptions", requireSubscriptions)
+	hooks.GET("", listSubscriptions)
+	hooks.POST("", createSubscription)
+	hooks.DELETE("/:id", deleteSubscription)
+	hooks.POST("/:id/test", testSubscription)
+	hooks.POST("/:id/replay", replaySubscription)
+	hooks.POST("/:id/digest", sendDigestNow)
+	r.GET("/settings/points-display", getPointsDisplay)
+	r.PUT("/settings/points-display", putPointsDisplay)
+	r.DELETE("/settings/points-display", deletePointsDisplay)
+	r.GET("/settings/encryption-key", getEncryptionKey)
+	r.PUT("/settings/encryption-key", requireTenantKey, putEncryptionKey)
+	r.DELETE("/settings/encryption-key", requireTenantKey, deleteEncryptionKey)
+	r.POST("/settings/encryption-key/reseal", requireTenantKey, resealReceipts)
+	r.GET("/receipts/:id/tags", getTags)
+	r.POST("/receipts/:id/tags", addTags)
+	r.DELETE("/receipts/:id/tags/:tag", removeTag)
+	r.POST("/receipts/:id/image", uploadImage)
+	r.GET("/receipts/:id/image", requireAdmin, getImage)
+	r.GET("/analytics/timeseries", spendPrivacyBudget, getTimeSeries)
+	r.GET("/analytics/retailers", spendPrivacyBudget, getRetailerAnalytics)
+	r.GET("/analytics/points/distribution", spendPrivacyBudget, getPointsDistribution)
+	r.GET("/analytics/cohorts", spendPrivacyBudget, getCohorts)
+	r.GET("/analytics/anomalies", getAnomalies)
+	r.GET("/analytics/items/top", spendPrivacyBudget, getTopItems)
+	r.GET("/analytics/pipeline", getPipelineAnalytics)
+	r.GET("/capabilities", getCapabilities)
+	r.GET("/openapi.yaml", getOpenAPISpec)
+	r.GET("/events/schemas", listEventSchemas)
+	r.GET("/events/schemas/:type", getEventSchema)
+	r.GET("/rules", getRules)
+	r.POST("/points/estimate", estimatePoints)
+	r.GET("/analytics/rules", getRulesEffectiveness)
+	r.GET("/analytics/live", getLive)
+	r.GET("/analytics/geo", spendPrivacyBudget, getGeoAnalytics)
+	r.GET("/analytics/channels", getChannelAnalytics)
+	r.GET("/metrics", gin.WrapH(promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}))))
+	r.GET(drainStatusPath, getDrainStatus)
 
-	r.Run(":8080")
+	registerSandbox(r)
+	registerUI(r)
+
+	r.GET("/partners/me/quality", getPartnerQuality)
+	admin := r.Group("/admin", requireAdmin)
+	admin.DELETE("/receipts", purgeReceipts)
+	admin.POST("/sandbox/keys", issueSandboxKey)
+	admin.GET("/api-keys", listAPIKeys)
+	admin.POST("/api-keys", createAPIKey)
+	admin.POST("/api-keys/:id/rotate", rotateAPIKey)
+	admin.DELETE("/api-keys/:id", revokeAPIKey)
+	admin.GET("/receipts/:id", getAdminReceipt)
+	admin.GET("/receipts/:id/thumbnail", getThumbnail)
+	admin.GET("/receipts/:id/similar", findSimilarReceipts)
+	admin.GET("/reports", listReportSchedules)
+	admin.POST("/reports", createReportSchedule)
+	admin.GET("/reports/:id", getReportSchedule)
+	admin.PUT("/reports/:id", updateReportSchedule)
+	admin.DELETE("/reports/:id", deleteReportSchedule)
+	admin.GET("/reports/:id/preview", previewReport)
+	admin.POST("/reports/:id/run", runReportNow)
+	admin.GET("/clients", getClientStats)
+	admin.GET("/retailers", listRetailers)
+	admin.POST("/retailers", createRetailer)
+	admin.GET("/retailers/:name", getRetailer)
+	admin.PUT("/retailers/:name", updateRetailer)
+	admin.DELETE("/retailers/:name", deleteRetailer)
+	admin.GET("/rejections/:ref", getRejectedCapture)
+	admin.POST("/maintenance", setMaintenance)
+	admin.GET("/rules/rollout", getRulesRollout)
+	admin.GET("/reprocess", getReprocessing)
+	admin.POST("/reprocess", startReprocessing)
+	admin.POST("/reprocess/pause", pauseReprocessing)
+	admin.POST("/reprocess/resume", resumeReprocessing)
+	admin.GET("/reprocess/diff", getReprocessingDiff)
+	admin.POST("/receipts/:id/settle", settleReceipt)
+	admin.POST("/receipts/:id/verify", verifyReceipt)
+	admin.GET("/adjustments", listAdjustmentImports)
+	admin.POST("/adjustments", importAdjustments)
+	admin.GET("/adjustments/:id", getAdjustmentImport)
+	admin.GET("/jobs", listJobs)
+	admin.POST("/jobs/:id/retry", retryJob)
+	admin.GET("/disputes", listOpenDisputes)
+	admin.POST("/receipts/:id/disputes/:dispute/resolve", resolveDispute)
+	admin.GET("/backfill", listBackfills)
+	admin.POST("/backfill", startBackfill)
+	admin.GET("/backfill/:id", getBackfill)
+	admin.GET("/quarantine", listQuarantine)
+	admin.POST("/quarantine/:id/approve", approveQuarantined)
+	admin.POST("/quarantine/:id/reject", rejectQuarantined)
+	admin.GET("/comparison", getComparisonReport)
+	admin.GET("/integrity", getIntegrityReport)
+	admin.POST("/integrity/verify", runIntegrityCheck)
+	admin.GET("/exports", listExports)
+	admin.POST("/exports/:name/run", runExportNow)
+	admin.GET("/store/compact", getCompaction)
+	admin.POST("/store/compact", startCompaction)
+	admin.GET("/config/drift", getConfigDrift)
+	admin.PUT("/config/baseline", putConfigBaseline)
+	admin.DELETE("/config/baseline", deleteConfigBaseline)
+	admin.GET("/usage", getUsage)
+	admin.GET("/diagnose", runDiagnostics)
+	admin.POST("/selftest", runSelftest)
+	admin.GET("/selftest/corpus", getScoringCorpus)
+
+	registerClusterJob("reports", time.Minute, runDueReports)
+	registerClusterJob("reprocess-adopt", reprocessStale, adoptReprocessing)
+	registerJob("volume-anomalies", time.Minute, volume.evaluate)
+	registerJob("config-drift", configDriftInterval, checkConfigDrift)
+	registerJob("api-key-usage", time.Minute, flushAPIKeyUsage)
+	registerJob("api-keys", apiKeysRefresh, refreshAPIKeys)
+	registerJob("tenant-keys", tenantKeysRefresh, refreshTenantKeys)
+	registerJob("retailers", retailerRefresh, refreshRetailers)
+	if dropDir != "" {
+		registerClusterJob("file-drop", dropInterval, scanDropDir)
+	}
+	if customerEmails && pointsExpireAfter > 0 {
+		registerClusterJob("points-expiry-notices", time.Hour, sendExpiryNotices)
+	}
+	if sandboxKeySecret != "" {
+		registerClusterJob("sandbox-purge", time.Hour, purgeSandboxReceipts)
+	}
+	if eventsEnabled() {
+		registerClusterJob("outbox-relay", envDuration("OUTBOX_RELAY_INTERVAL", 5*time.Second), relayOutbox)
+	}
+	if subscriptionsEnabled {
+		registerClusterJob("weekly-digests", time.Minute, sendDueDigests)
+	}
+	if rejectedCaptureTTL > 0 {
+		registerJob("rejected-capture-expiry", time.Minute, expireCaptures)
+	}
+	if err := loadExporters(os.Getenv("EXPORTERS_FILE")); err != nil {
+		log.Fatalf("loading exporters: %v", err)
+	}
+	runScheduler(context.Background())
+	async.start(context.Background(), asyncWorkers)
+	if customerEmails {
+		runCustomerEmails(context.Background())
+	}
+	if subscriptionsEnabled {
+		runSubscriptionDeliveries(context.Background(), envInt("WEBHOOK_SUBSCRIPTION_WORKERS", 4))
+	}
+	go verifyIntegrityOnBoot()
+	go runStoreMetrics(context.Background())
+	if comparer = newExternalComparerFromEnv(); comparer != nil {
+		comparer.run(context.Background(), envInt("COMPARE_SCORING_WORKERS", 2))
+	}
+	if warehouse = newClickHouseSinkFromEnv(); warehouse != nil {
+		go warehouse.run(context.Background())
+	}
+	if seedDemo {
+		if err := seedDemoReceipts(context.Background()); err != nil {
+			log.Fatalf("seeding demo receipts: %v", err)
+		}
+	}
+
+	serveUntilSignal(":8080", newTolerantRouter(r))
 }
 
 func processReceipt(c *gin.Context) {
-	var receipt Receipt
-	if err := c.ShouldBindJSON(&receipt); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+	ctx, _, stop := measureCost(c.Request.Context())
+	defer stop()
+	c.Request = c.Request.WithContext(ctx)
+	multipart := c.ContentType() == "multipart/form-data"
+	if multipart && !requireUploadKey(c) {
+		return
+	}
+	var done func(error)
+	if multipart {
+		done = beginStage(c.Request.Context(), stageUpload)
+	}
+	body, image, err := readSubmission(c)
+	if multipart {
+		done(err)
+	}
+	if err != nil {
+		imageErrorResponse(c, err)
 		return
 	}
 
-	id := uuid.New().String()
-	points := calculatePoints(receipt)
-
-	mutex.Lock()
-	receipts[id] = points
-	mutex.Unlock()
+	done = beginStage(c.Request.Context(), stageDecode)
+	receipt, err := decodeReceipt(body)
+	done(err)
+	if err != nil {
+		recordDecodeQuality(tenantID(c), err)
+	}
+	if errors.Is(err, errUnsupportedSchema) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported schemaVersion"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
 
-	c.JSON(http.StatusOK, gin.H{"id": id})
+	fallback := channelAPI
+	if image != nil {
+		fallback = channelOCRUpload
+	}
+	channel, ok := submissionChannel(c, fallback)
+	if !ok {
+		return
+	}
+	result, err := submitReceipt(c.Request.Context(), submission{tenant: tenantID(c), receipt: receipt, image: image, channel: channel})
+	if err != nil {
+		submissionFailure(c, err)
+		return
+	}
+	respondSubmitted(c, result)
 }
 
-func getPoints(c *gin.Context) {
-	id := c.Param("id")
-	mutex.Lock()
-	points, exists := receipts[id]
-	mutex.Unlock()
-
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Receipt ID not found"})
+// respondSubmitted writes the response for a stored submission: 202 for
+// quarantined receipts, otherwise 200, or 201 with a Location for API v2.
+func respondSubmitted(c *gin.Context, result *submissionResult) {
+	stored := result.stored
+	resp := result.response()
+	if result.duplicateOf != "" {
+		c.Set("duplicate", true)
+	}
+	if stored.Status == receiptQuarantined {
+		c.JSON(http.StatusAccepted, resp)
+		return
+	}
+	if apiVersion(c) >= apiVersion2 {
+		c.Header("Location", "/receipts/"+stored.ID+"/points")
+		c.JSON(http.StatusCreated, resp)
 		return
 	}
+	c.JSON(http.StatusOK, resp)
+}
 
-	c.JSON(http.StatusOK, gin.H{"points": points})
+// submissionError is a receipt refused by policy, with the response that
+// explains why.
+type submissionError struct {
+	status int
+	body   gin.H
 }
 
-func calculatePoints(receipt Receipt) int {
-	points := 0
+func (e *submissionError) Error() string {
+	return fmt.Sprint(e.body["error"])
+}
 
-	alphanumeric := regexp.MustCompile("[a-zA-Z0-9]")
-	points += len(alphanumeric.FindAllString(receipt.Retailer, -1))
+type submissionResult struct {
+	stored      *storedReceipt
+	duplicateOf string
+}
 
-	
-	if total, err := strconv.ParseFloat(receipt.Total, 64); err == nil {
-		if total == math.Floor(total) {
-			points += 50
-		}
-		if math.Mod(total, 0.25) == 0 {
-			points += 25
-		}
-		if total > 10.00 {
-			points += 5
-		}
+func (r *submissionResult) response() gin.H {
+	resp := gin.H{"id": r.stored.ID, "hash": r.stored.Hash}
+	deadlineResponse(resp, r.stored.Deadline)
+	if r.duplicateOf != "" {
+		resp["duplicateOf"] = r.duplicateOf
 	}
+	if len(r.stored.Corrections) > 0 {
+		resp["corrections"] = r.stored.Corrections
+	}
+	if r.stored.Status == receiptQuarantined {
+		resp["status"] = r.stored.Status
+		resp["reasons"] = r.stored.QuarantineReasons
+	}
+	return resp
+}
 
-	points += (len(receipt.Items) / 2) * 5
+// submission is a decoded receipt ready to be scored and stored.
+type submission struct {
+	id      string // generated when empty
+	tenant  string
+	receipt Receipt
+	image   *blob
+	// backfill marks historical imports, which skip the submission deadline.
+	backfill string
+	channel  string
+}
+
+// submitReceipt validates, scores and stores a submission. Errors are a
+// *submissionError, a context error or a store error; see
+// submissionFailure.
+func submitReceipt(ctx context.Context, sub submission) (*submissionResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ctx, cost, stop := measureCost(ctx)
+	defer stop()
+	receipt, image := sub.receipt, sub.image
+	var corrections []receiptCorrection
+	correction, err := correctTotal(ctx, &receipt)
+	if err != nil {
+		return nil, err
+	}
+	if correction != nil {
+		corrections = append(corrections, *correction)
+	}
+	if errs := validateReceipt(receipt); errs != nil {
+		if sub.backfill == "" {
+			recordSubmissionQuality(sub.tenant, errs)
+		}
+		return nil, invalidReceipt(errs)
+	}
+	submittedAt := clock.Now()
+	var deadline *submissionWindow
+	if sub.backfill == "" {
+		deadline = deadlineFor(receipt, submittedAt)
+	}
+	if deadline.late() && submissionDeadlineAction == deadlineReject {
+		recordSubmissionQuality(sub.tenant, []fieldError{{Field: "purchaseDate", Message: "was submitted after the deadline"}})
+		return nil, &submissionError{http.StatusUnprocessableEntity, gin.H{
+			"error":              "Receipt was submitted after the deadline",
+			"code":               "submission_deadline_passed",
+			"submissionDeadline": deadline,
+		}}
+	}
 
+	done := beginStage(ctx, stageScore)
+	hash, err := receiptHash(ctx, receipt)
+	if ctx.Err() != nil {
+		done(err)
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		done(err)
+		return nil, &submissionError{http.StatusInternalServerError, gin.H{"error": "Could not hash receipt"}}
+	}
+	// Quarantined receipts are scored only once approved; late receipts
+	// under the zero action are never scored.
+	reasons := quarantineReasons(receipt)
+	status := receiptAccepted
+	var breakdown []ruleResult
+	var points int
+	var version string
+	if len(reasons) > 0 {
+		status = receiptQuarantined
+	} else if !zeroScoredLate(deadline) {
+		rules := rulesetForReceipt(hash)
+		breakdown, err = rules.score(ctx, receipt)
+		if err != nil {
+			done(err)
+			return nil, err
+		}
+		points, version = totalPoints(breakdown), rules.scoredVersion()
+		observeScoring(version, points)
+	}
+	done(nil)
 
-	for _, item := range receipt.Items {
-		desc := strings.TrimSpace(item.ShortDescription)
-		if len(desc)%3 == 0 {
-			if price, err := strconv.ParseFloat(item.Price, 64); err == nil {
-				points += int(math.Ceil(price * 0.2))
+	id := sub.id
+	if id == "" {
+		id = receiptID(sub.tenant, uuid.New())
+	}
+	done = beginStage(ctx, stageStore)
+	var thumbnail bool
+	if image != nil {
+		if thumbnail, err = storeImage(ctx, id, *image); err != nil {
+			done(err)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
 			}
+			return nil, &submissionError{http.StatusInternalServerError, gin.H{"error": "Could not store image"}}
 		}
 	}
 
-	
-	if date, err := time.Parse("2006-01-02", receipt.PurchaseDate); err == nil {
-		if date.Day()%2 != 0 {
-			points += 6
+	stored := &storedReceipt{
+		ID:           id,
+		Tenant:       sub.tenant,
+		Receipt:      receipt,
+		Retailer:     normalizeRetailer(receipt.Retailer),
+		Points:       points,
+		RulesVersion: version,
+		Breakdown:    breakdown,
+		Hash:         hash,
+		HasImage:     image != nil,
+		HasThumbnail: thumbnail,
+		CreatedAt:    submittedAt,
+		Deadline:     deadline,
+		Backfill:     sub.backfill,
+		Channel:      sub.channel,
+		Corrections:  corrections,
+
+		Status:            status,
+		QuarantineReasons: reasons,
+	}
+	var events []outboxEvent
+	undoAccrual := func() {}
+	if status == receiptAccepted {
+		stored.AcceptedAt = stored.CreatedAt
+		startHold(stored)
+		events = receiptEvents(stored)
+		var rolledOver []outboxEvent
+		rolledOver, undoAccrual, err = awardSubmittedFractions(ctx, stored)
+		if err != nil {
+			done(err)
+			return nil, err
 		}
+		events = append(append(events, rolledOver...), applyChannelCap(stored)...)
+	}
+	stored.Cost = cost.record()
+	duplicateOf, err := store.Create(ctx, stored, events)
+	done(err)
+	if err != nil {
+		undoAccrual()
+		return nil, err
+	}
+	observeCost(stored)
+	if sub.backfill == "" {
+		recordSubmissionQuality(sub.tenant, nil)
+	}
+	if status == receiptAccepted {
+		recordAccepted(stored)
+	}
+	return &submissionResult{stored: stored, duplicateOf: duplicateOf}, nil
+}
+
+// submissionFailure writes the response for an error from submitReceipt.
+func submissionFailure(c *gin.Context, err error) {
+	var refused *submissionError
+	switch {
+	case errors.As(err, &refused):
+		c.JSON(refused.status, refused.body)
+	case requestExpired(c, err):
+	default:
+		storeFailure(c, err)
+	}
+}
+
+// recordAccepted feeds a newly accepted receipt to analytics, the warehouse
+// sink, live metrics and the external score comparison. Sandbox receipts
+// are fed to none of them.
+func recordAccepted(stored *storedReceipt) {
+	if isSandboxTenant(stored.Tenant) {
+		return
 	}
+	recordIngest(stored)
+	publishFact(stored)
+	volume.record(stored)
+	live.recordReceipt(stored.Retailer)
+	compareScore(stored)
+	notifyReceiptProcessed(stored)
+	receiptsProcessed.Inc()
+}
 
-	
-	if t, err := time.Parse("15:04", receipt.PurchaseTime); err == nil {
-		if t.Hour() == 14 || (t.Hour() == 15 && t.Minute() < 60) {
-			points += 10
+// pointsMaxWait caps the ?wait= long poll on GET /receipts/:id/points.
+var pointsMaxWait = envDuration("POINTS_MAX_WAIT", time.Minute)
+
+// getPoints serves GET /receipts/:id/points. With ?wait=30s, a receipt
+// still queued for async processing is waited for up to that long; if it
+// is not done by then the answer is 202 with the job's status.
+func getPoints(c *gin.Context) {
+	var wait time.Duration
+	if raw := c.Query("wait"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Wait must be a duration such as 30s"})
+			return
+		}
+		wait = min(d, pointsMaxWait)
+	}
+	id := c.Param("id")
+	stored, err := store.Get(c.Request.Context(), id)
+	if errors.Is(err, errReceiptNotFound) && wait > 0 {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), wait)
+		job, pending := async.waitForReceipt(ctx, id)
+		cancel()
+		switch {
+		case pending && (job.Status == asyncFailed || job.Status == asyncDead):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Receipt processing failed", "job": job})
+			return
+		case pending && job.Status != asyncDone:
+			c.Header("Location", "/receipts/jobs/"+job.ID)
+			c.Header("Retry-After", "1")
+			c.JSON(http.StatusAccepted, job)
+			return
+		case pending:
+			stored, err = store.Get(c.Request.Context(), id)
 		}
 	}
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	if stored.Status != receiptAccepted {
+		c.JSON(http.StatusConflict, gin.H{"error": "Receipt has not been accepted", "status": stored.Status})
+		return
+	}
 
-	return points
+	now := clock.Now()
+	resp := gin.H{
+		"points":      stored.netPoints(),
+		"hash":        stored.Hash,
+		"state":       stored.pointsState(now),
+		"availableAt": stored.availableAt().UTC(),
+	}
+	if !stored.ExpiresAt.IsZero() {
+		resp["expiresAt"] = stored.ExpiresAt.UTC()
+	}
+	if len(stored.Ledger) > 0 {
+		resp["earned"] = stored.Points
+		resp["ledger"] = stored.Ledger
+	}
+	displayPoints(resp, stored.Tenant, "points", "earned")
+	c.JSON(http.StatusOK, resp)
 }
 
 // Dockerfile
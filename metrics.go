@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	receiptsProcessed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "receipts_processed_total",
+		Help: "Receipts accepted and scored.",
+	})
+	volumeAnomalies = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "receipt_volume_anomalies_total",
+		Help: "Ingestion volume anomalies detected, by dimension (tenant or retailer) and direction (spike or drop).",
+	}, []string{"dimension", "direction"})
+)
+
+var pipelineStageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "receipt_pipeline_stage_duration_seconds",
+	Help:    "Time spent in each submission pipeline stage, by outcome.",
+	Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+}, []string{"stage", "outcome"})
+
+var submissionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "receipt_submissions_total",
+	Help: "Receipt submissions by outcome (accepted, duplicate or rejected).",
+}, []string{"outcome"})
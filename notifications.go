@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// With CUSTOMER_EMAILS=true, customers with an email address on file are
+// emailed through the SMTP settings (see delivery.go) when a receipt of
+// theirs is accepted and, with POINTS_EXPIRE_AFTER set, when points of
+// theirs expire within POINTS_EXPIRY_NOTICE. A customer's address and
+// opt-out are set with PUT /customers/:id/notifications
+// {"email": "…", "optOut": false} in the request's tenant; DELETE forgets
+// them. An opted-out customer is not emailed, and keeps the opt-out until
+// it is changed through the API.
+//
+// The settings endpoints need the tenant's managed API key or admin
+// credentials. Contacts are kept in the receipt store, so every replica
+// sees the same ones and they last as long as the receipts.
+//
+// Messages are text/template templates, receipt_processed.tmpl and
+// points_expiring.tmpl in CUSTOMER_EMAIL_TEMPLATES, whose first line is
+// "Subject: …"; a missing file falls back to a built-in template. See
+// emailData for what they are given. Receipt emails are sent in the
+// background and dropped, and counted, when the queue is full; expiry
+// notices are sent by the cluster leader's hourly job, once per expiring
+// receipt.
+
+const (
+	emailReceiptProcessed = "receipt_processed"
+	emailPointsExpiring   = "points_expiring"
+)
+
+var (
+	customerEmails     = os.Getenv("CUSTOMER_EMAILS") == "true"
+	pointsExpiryNotice = envDuration("POINTS_EXPIRY_NOTICE", 7*24*time.Hour)
+
+	emailTemplates = map[string]*template.Template{
+		emailReceiptProcessed: template.Must(template.New(emailReceiptProcessed).Parse(
+			"Subject: You earned {{.Points}} {{.Label}} at {{.Retailer}}\n" +
+				"Your receipt from {{.Retailer}} on {{.PurchaseDate}} earned {{.Points}} {{.Label}}.\n" +
+				"{{if .AvailableAt}}They can be used from {{.AvailableAt}}.\n{{end}}")),
+		emailPointsExpiring: template.Must(template.New(emailPointsExpiring).Parse(
+			"Subject: {{.Points}} {{.Label}} expire on {{.ExpiresAt}}\n" +
+				"{{.Points}} of your {{.Label}} expire on {{.ExpiresAt}}. Use them before then to keep them.\n")),
+	}
+
+	customerEmailQueue = make(chan customerEmail, envInt("CUSTOMER_EMAIL_QUEUE", 1000))
+)
+
+var customerEmailsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "receipt_customer_emails_total",
+	Help: "Customer emails by kind and outcome: sent, failed or dropped.",
+}, []string{"kind", "outcome"})
+
+// customerContact is a customer's email address and opt-out.
+type customerContact struct {
+	Tenant     string     `json:"tenant"`
+	CustomerID string     `json:"customerId"`
+	Email      string     `json:"email,omitempty"`
+	OptOut     bool       `json:"optOut"`
+	OptedOutAt *time.Time `json:"optedOutAt,omitempty"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	// NoticedThrough is the latest expiry already noticed, so the next
+	// notice covers only points expiring after it.
+	NoticedThrough *time.Time `json:"noticedThrough,omitempty"`
+}
+
+func (ct *customerContact) reachable() bool {
+	return ct != nil && ct.Email != "" && !ct.OptOut
+}
+
+// contactFor returns the customer's contact, reporting false when there is
+// none.
+func contactFor(ctx context.Context, tenant, customer string) (customerContact, bool, error) {
+	var ct customerContact
+	ok, err := getRecordJSON(ctx, recordCustomerContacts, carryKey(tenant, customer), &ct)
+	return ct, ok, err
+}
+
+func getNotificationSettings(c *gin.Context) {
+	ct, ok, err := contactFor(c.Request.Context(), tenantID(c), c.Param("id"))
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No notification settings for this customer"})
+		return
+	}
+	c.JSON(http.StatusOK, ct)
+}
+
+func putNotificationSettings(c *gin.Context) {
+	var req struct {
+		Email  string `json:"email"`
+		OptOut bool   `json:"optOut"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification settings"})
+		return
+	}
+	if req.Email != "" {
+		addr, err := mail.ParseAddress(req.Email)
+		if err != nil || addr.Address != req.Email {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Email must be a plain email address"})
+			return
+		}
+	}
+	tenant, customer := tenantID(c), c.Param("id")
+	now := clock.Now().UTC()
+	var ct customerContact
+	err := store.Transact(c.Request.Context(), func(tx storeTx) error {
+		ct = customerContact{}
+		key := carryKey(tenant, customer)
+		if data, err := tx.GetRecord(recordCustomerContacts, key); err == nil {
+			if err := json.Unmarshal(data, &ct); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, errRecordNotFound) {
+			return err
+		}
+		ct.Tenant, ct.CustomerID, ct.Email, ct.UpdatedAt = tenant, customer, req.Email, now
+		if req.OptOut && !ct.OptOut {
+			ct.OptedOutAt = &now
+		} else if !req.OptOut {
+			ct.OptedOutAt = nil
+		}
+		ct.OptOut = req.OptOut
+		data, err := json.Marshal(ct)
+		if err != nil {
+			return err
+		}
+		return tx.PutRecord(recordCustomerContacts, key, data)
+	})
+	if err != nil {
+		log.Printf("notifications: saving contact: %v", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Could not save notification settings"})
+		return
+	}
+	c.JSON(http.StatusOK, ct)
+}
+
+func deleteNotificationSettings(c *gin.Context) {
+	ctx := c.Request.Context()
+	tenant, customer := tenantID(c), c.Param("id")
+	if _, ok, err := contactFor(ctx, tenant, customer); err != nil {
+		storeFailure(c, err)
+		return
+	} else if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No notification settings for this customer"})
+		return
+	}
+	if err := store.DeleteRecord(ctx, recordCustomerContacts, carryKey(tenant, customer)); err != nil {
+		log.Printf("notifications: deleting contact: %v", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Could not save notification settings"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// loadEmailTemplates replaces the built-in templates with those in dir.
+func loadEmailTemplates(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	for name := range emailTemplates {
+		data, err := os.ReadFile(filepath.Join(dir, name+".tmpl"))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(string(data), "Subject:") {
+			return fmt.Errorf("%s.tmpl: first line must be Subject: …", name)
+		}
+		tmpl, err := template.New(name).Parse(string(data))
+		if err != nil {
+			return err
+		}
+		emailTemplates[name] = tmpl
+	}
+	return nil
+}
+
+// emailData is what a template is given. Points are shown as the tenant
+// displays them, with its label, or "points"; dates are in the program's
+// time zone.
+type emailData struct {
+	Tenant       string
+	CustomerID   string
+	ReceiptID    string
+	Retailer     string
+	PurchaseDate string
+	Points       int
+	Label        string
+	AvailableAt  string
+	ExpiresAt    string
+}
+
+type customerEmail struct {
+	kind string
+	to   string
+	data emailData
+}
+
+func newEmailData(tenant, customer string, points int) emailData {
+	data := emailData{Tenant: tenant, CustomerID: customer, Points: points, Label: "points"}
+	if d, ok := displayFor(tenant); ok {
+		data.Points = d.round(points)
+		if d.Label != "" {
+			data.Label = d.Label
+		}
+	}
+	return data
+}
+
+func emailDate(t time.Time) string {
+	return t.In(programZone).Format("January 2, 2006")
+}
+
+// render returns the message's subject and body.
+func (m customerEmail) render() (string, string, error) {
+	var buf bytes.Buffer
+	if err := emailTemplates[m.kind].Execute(&buf, m.data); err != nil {
+		return "", "", err
+	}
+	first, body, _ := strings.Cut(buf.String(), "\n")
+	return strings.TrimSpace(strings.TrimPrefix(first, "Subject:")), body, nil
+}
+
+func (m customerEmail) send() error {
+	subject, body, err := m.render()
+	if err == nil {
+		err = sendEmail([]string{m.to}, subject, body, "", "", nil)
+	}
+	if err != nil {
+		customerEmailsSent.WithLabelValues(m.kind, "failed").Inc()
+		return err
+	}
+	customerEmailsSent.WithLabelValues(m.kind, "sent").Inc()
+	return nil
+}
+
+// notifyReceiptProcessed queues the email for an accepted receipt, if its
+// customer wants one. Backfilled receipts are history, and emailed about
+// to no one.
+func notifyReceiptProcessed(s *storedReceipt) {
+	if !customerEmails || s.Receipt.CustomerID == "" || s.Backfill != "" {
+		return
+	}
+	ct, ok, err := contactFor(context.Background(), s.Tenant, s.Receipt.CustomerID)
+	if err != nil {
+		log.Printf("notifications: looking up customer %s of tenant %s: %v", s.Receipt.CustomerID, s.Tenant, err)
+		return
+	}
+	if !ok || !ct.reachable() {
+		return
+	}
+	data := newEmailData(s.Tenant, s.Receipt.CustomerID, s.Points)
+	data.ReceiptID, data.Retailer, data.PurchaseDate = s.ID, s.Retailer, s.Receipt.PurchaseDate
+	if s.pointsState(s.AcceptedAt) == pointsPending {
+		data.AvailableAt = emailDate(s.availableAt())
+	}
+	select {
+	case customerEmailQueue <- customerEmail{kind: emailReceiptProcessed, to: ct.Email, data: data}:
+	default:
+		customerEmailsSent.WithLabelValues(emailReceiptProcessed, "dropped").Inc()
+	}
+}
+
+func runCustomerEmails(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case m := <-customerEmailQueue:
+				// The opt-out may have changed while the email was queued.
+				if ct, ok, err := contactFor(ctx, m.data.Tenant, m.data.CustomerID); err != nil || !ok || !ct.reachable() {
+					continue
+				}
+				if err := m.send(); err != nil {
+					log.Printf("notifications: emailing customer %s of tenant %s: %v", m.data.CustomerID, m.data.Tenant, err)
+				}
+			}
+		}
+	}()
+}
+
+// sendExpiryNotices emails each reachable customer the points of theirs
+// that expire within the notice period and have not been noticed yet.
+func sendExpiryNotices(now time.Time) {
+	type expiring struct {
+		points  int
+		first   time.Time
+		through time.Time
+	}
+	due := make(map[string]*expiring)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	all, err := listRecordsJSON[customerContact](ctx, recordCustomerContacts)
+	if err != nil {
+		log.Printf("notifications: listing contacts: %v", err)
+		return
+	}
+	reachable := make(map[string]customerContact)
+	for key, ct := range all {
+		if ct.reachable() {
+			reachable[key] = ct
+		}
+	}
+	if len(reachable) == 0 {
+		return
+	}
+
+	horizon := now.Add(pointsExpiryNotice)
+	_, err = store.List(ctx, func(s *storedReceipt) bool {
+		if s.Status != receiptAccepted || s.Receipt.CustomerID == "" || s.ExpiresAt.IsZero() ||
+			!s.ExpiresAt.After(now) || s.ExpiresAt.After(horizon) {
+			return false
+		}
+		key := carryKey(s.Tenant, s.Receipt.CustomerID)
+		ct, ok := reachable[key]
+		if !ok || (ct.NoticedThrough != nil && !s.ExpiresAt.After(*ct.NoticedThrough)) {
+			return false
+		}
+		e := due[key]
+		if e == nil {
+			e = &expiring{first: s.ExpiresAt}
+			due[key] = e
+		}
+		e.points += s.pointsAt(now)
+		if s.ExpiresAt.Before(e.first) {
+			e.first = s.ExpiresAt
+		}
+		if s.ExpiresAt.After(e.through) {
+			e.through = s.ExpiresAt
+		}
+		return false
+	})
+	if err != nil {
+		log.Printf("notifications: finding expiring points: %v", err)
+		return
+	}
+
+	for key, e := range due {
+		ct := reachable[key]
+		if e.points > 0 {
+			data := newEmailData(ct.Tenant, ct.CustomerID, e.points)
+			data.ExpiresAt = emailDate(e.first)
+			if err := (customerEmail{kind: emailPointsExpiring, to: ct.Email, data: data}).send(); err != nil {
+				// Left unnoticed, so the next run tries again.
+				log.Printf("notifications: emailing customer %s of tenant %s: %v", ct.CustomerID, ct.Tenant, err)
+				continue
+			}
+		}
+		err := store.Transact(ctx, func(tx storeTx) error {
+			data, err := tx.GetRecord(recordCustomerContacts, key)
+			if errors.Is(err, errRecordNotFound) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			var current customerContact
+			if err := json.Unmarshal(data, &current); err != nil {
+				return err
+			}
+			current.NoticedThrough = &e.through
+			if data, err = json.Marshal(current); err != nil {
+				return err
+			}
+			return tx.PutRecord(recordCustomerContacts, key, data)
+		})
+		if err != nil {
+			log.Printf("notifications: saving contact: %v", err)
+		}
+	}
+}
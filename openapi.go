@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/gin-gonic/gin"
+)
+
+// api/openapi.yaml describes the public receipt API and is served at
+// GET /openapi.yaml. With OPENAPI_VALIDATION=true, every request to an
+// operation it lists is validated against it before the handler runs, so
+// the document, not handler code, decides what a well-formed request is;
+// a request that does not match is refused with 400 invalid_request and
+// its errors by field. Routes it does not list pass unchecked. Handlers
+// keep their own checks, which also cover what the document cannot know,
+// such as limits set by the environment.
+//
+// Receipt bodies sent without a content type the document names are
+// validated as JSON, as the handlers read them. Bodies are read within the
+// limit the handler would apply to their type, and refused with 413 beyond
+// it.
+
+//go:embed api/openapi.yaml
+var openAPISpec []byte
+
+type specValidator struct {
+	router routers.Router
+}
+
+func loadSpecValidation() (gin.HandlerFunc, error) {
+	if os.Getenv("OPENAPI_VALIDATION") != "true" {
+		return nil, nil
+	}
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(openAPISpec)
+	if err != nil {
+		return nil, err
+	}
+	if err := doc.Validate(loader.Context); err != nil {
+		return nil, fmt.Errorf("invalid spec: %w", err)
+	}
+	// Requests are matched on path alone, whatever host they were sent to.
+	doc.Servers = nil
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, err
+	}
+	return specValidator{router}.validate, nil
+}
+
+func getOpenAPISpec(c *gin.Context) {
+	c.Data(http.StatusOK, yamlContentType, openAPISpec)
+}
+
+func (v specValidator) validate(c *gin.Context) {
+	route, params, err := v.router.FindRoute(c.Request)
+	if err != nil {
+		c.Next()
+		return
+	}
+	req := c.Request
+	var body []byte
+	if route.Operation.RequestBody != nil {
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if body, err = io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, specBodyLimit(mediaType))); err != nil {
+			if errors.As(err, new(*http.MaxBytesError)) {
+				c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body exceeds the size limit"})
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Could not read the request body"})
+			return
+		}
+		if route.Operation.RequestBody.Value.Content.Get(mediaType) == nil {
+			req = req.Clone(req.Context())
+			req.Header.Set("Content-Type", gin.MIMEJSON)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	err = openapi3filter.ValidateRequest(req.Context(), &openapi3filter.RequestValidationInput{
+		Request:    req,
+		PathParams: params,
+		Route:      route,
+		Options: &openapi3filter.Options{
+			MultiError:          true,
+			SkipSettingDefaults: true,
+			AuthenticationFunc:  openapi3filter.NoopAuthenticationFunc,
+		},
+	})
+	if body != nil {
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error":  "Request does not match the API specification",
+			"code":   "invalid_request",
+			"errors": specErrors(err),
+		})
+		return
+	}
+	c.Next()
+}
+
+// specBodyLimit is the most the handlers read of a body of mediaType.
+func specBodyLimit(mediaType string) int64 {
+	switch {
+	case mediaType == "multipart/form-data":
+		return maxMultipartBytes
+	case isYAML(mediaType):
+		return yamlMaxBytes
+	}
+	return maxDecompressedBytes
+}
+
+// specErrors flattens a validation error into field errors.
+func specErrors(err error) []fieldError {
+	switch e := err.(type) {
+	case openapi3.MultiError:
+		var errs []fieldError
+		for _, inner := range e {
+			errs = append(errs, specErrors(inner)...)
+		}
+		return errs
+	case *openapi3filter.RequestError:
+		errs := []fieldError{{Field: "body", Message: e.Reason}}
+		if e.Err != nil {
+			errs = specErrors(e.Err)
+		}
+		if e.Parameter != nil {
+			for i := range errs {
+				errs[i].Field = e.Parameter.Name
+			}
+		}
+		return errs
+	case *openapi3.SchemaError:
+		field := specField(e.JSONPointer())
+		if field == "" {
+			field = "body"
+		}
+		return []fieldError{{Field: field, Message: e.Reason}}
+	}
+	return []fieldError{{Field: "body", Message: err.Error()}}
+}
+
+// specField writes a JSON pointer the way validateReceipt names fields, as
+// in items[0].price.
+func specField(pointer []string) string {
+	var b strings.Builder
+	for _, part := range pointer {
+		if _, err := strconv.Atoi(part); err == nil {
+			b.WriteString("[" + part + "]")
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(part)
+	}
+	return b.String()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Receipt events go through a transactional outbox: they are written by
+// receiptStore.Create together with the receipt, and a relay job delivers
+// them to EVENTS_WEBHOOK_URL and to webhook subscriptions afterwards. An
+// event therefore exists exactly when its receipt does, and delivery is
+// retried until acknowledged, so receivers get each event at least once and
+// should dedupe on its ID.
+type outboxEvent struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// Version is the version of Type's payload; see events.go.
+	Version   int             `json:"version"`
+	ReceiptID string          `json:"receiptId"`
+	Tenant    string          `json:"tenant"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"createdAt"`
+	// Priority is priorityBulk for events about backfilled receipts, which
+	// subscriptions deliver after live ones; see webhookbatches.go.
+	Priority string `json:"priority,omitempty"`
+}
+
+var (
+	eventsWebhookURL = os.Getenv("EVENTS_WEBHOOK_URL")
+	outboxBatchSize  = envInt("OUTBOX_BATCH_SIZE", 100)
+)
+
+func eventsEnabled() bool {
+	return eventsWebhookURL != "" || subscriptionsEnabled
+}
+
+// receiptEvents returns the outbox events for a newly processed receipt.
+func receiptEvents(stored *storedReceipt) []outboxEvent {
+	return newEvents(stored, eventReceiptProcessed, stored.CreatedAt, receiptProcessedPayload{
+		ID:          stored.ID,
+		Retailer:    stored.Retailer,
+		Points:      stored.Points,
+		Hash:        stored.Hash,
+		ProcessedAt: stored.CreatedAt.UTC(),
+		Metadata:    stored.Receipt.Metadata,
+	})
+}
+
+// newEvents returns a single event of type typ about stored, or nothing
+// when events are disabled.
+func newEvents(stored *storedReceipt, typ string, at time.Time, payload any) []outboxEvent {
+	events := tenantEvents(stored.Tenant, stored.ID, typ, at, payload)
+	if stored.Backfill != "" {
+		for i := range events {
+			events[i].Priority = priorityBulk
+		}
+	}
+	return events
+}
+
+// tenantEvents is newEvents for events that may not concern a receipt, in
+// which case receiptID is empty.
+func tenantEvents(tenant, receiptID, typ string, at time.Time, payload any) []outboxEvent {
+	if !eventsEnabled() {
+		return nil
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil
+	}
+	return []outboxEvent{{
+		ID:        uuid.New().String(),
+		Type:      typ,
+		Version:   eventVersions[typ],
+		ReceiptID: receiptID,
+		Tenant:    tenant,
+		Payload:   body,
+		CreatedAt: at.UTC(),
+	}}
+}
+
+// relayOutbox delivers pending events in batches until the outbox is empty
+// or a delivery fails; failed batches stay pending for the next run.
+func relayOutbox(now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for {
+		events, err := store.PendingEvents(ctx, outboxBatchSize)
+		if err != nil {
+			log.Printf("outbox relay: %v", err)
+			return
+		}
+		if len(events) == 0 {
+			return
+		}
+		if eventsWebhookURL != "" {
+			body, err := json.Marshal(gin.H{"events": events})
+			if err != nil {
+				log.Printf("outbox relay: %v", err)
+				return
+			}
+			if err := postWebhook(ctx, eventsWebhookURL, "application/json", body); err != nil {
+				log.Printf("outbox relay: %d events pending: %v", len(events), err)
+				return
+			}
+		}
+		dispatchSubscriptions(ctx, events)
+		ids := make([]string, len(events))
+		for i, event := range events {
+			ids[i] = event.ID
+		}
+		if err := store.AckEvents(ctx, ids); err != nil {
+			log.Printf("outbox relay: %v", err)
+			return
+		}
+	}
+}
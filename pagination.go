@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// pageCursor marks the last receipt of a page in list order: by CreatedAt,
+// then ID.
+type pageCursor struct {
+	createdAt time.Time
+	id        string
+}
+
+func (p pageCursor) String() string {
+	raw := strconv.FormatInt(p.createdAt.UnixNano(), 10) + "|" + p.id
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parsePageCursor(s string) (pageCursor, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return pageCursor{}, false
+	}
+	nanos, id, ok := strings.Cut(string(raw), "|")
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if !ok || err != nil || id == "" {
+		return pageCursor{}, false
+	}
+	return pageCursor{time.Unix(0, n), id}, true
+}
+
+func (p pageCursor) before(s *storedReceipt) bool {
+	if !s.CreatedAt.Equal(p.createdAt) {
+		return p.createdAt.Before(s.CreatedAt)
+	}
+	return p.id < s.ID
+}
+
+// paginate reads ?limit= and ?cursor= and returns the page of receipts
+// after the cursor, with the cursor for the next page or "" on the last
+// one. It writes a 400 and returns false for bad parameters.
+func paginate(c *gin.Context, receipts []*storedReceipt) ([]*storedReceipt, string, bool) {
+	limit := defaultPageLimit
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxPageLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Limit must be between 1 and " + strconv.Itoa(maxPageLimit)})
+			return nil, "", false
+		}
+		limit = n
+	}
+	sort.SliceStable(receipts, func(i, j int) bool {
+		return pageCursor{receipts[i].CreatedAt, receipts[i].ID}.before(receipts[j])
+	})
+	if raw := c.Query("cursor"); raw != "" {
+		after, ok := parsePageCursor(raw)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return nil, "", false
+		}
+		start := sort.Search(len(receipts), func(i int) bool { return after.before(receipts[i]) })
+		receipts = receipts[start:]
+	}
+	if len(receipts) <= limit {
+		return receipts, "", true
+	}
+	last := receipts[limit-1]
+	return receipts[:limit], pageCursor{last.CreatedAt, last.ID}.String(), true
+}
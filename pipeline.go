@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Submission pipeline stages in the order a receipt passes through them.
+// Upload only applies to multipart submissions and image attachments.
+const (
+	stageUpload = "upload"
+	stageDecode = "decode"
+	stageScore  = "score"
+	stageStore  = "store"
+)
+
+var pipelineStages = []string{stageUpload, stageDecode, stageScore, stageStore}
+
+type stageStats struct {
+	Succeeded int
+	Failed    int
+	Total     time.Duration
+	Max       time.Duration
+}
+
+var (
+	pipelineMu    sync.Mutex
+	pipelineStats = make(map[string]*stageStats)
+)
+
+// beginStage starts timing a pipeline stage; call the returned function
+// with the stage's error (nil on success) when it finishes. The duration
+// histogram gets the trace in ctx as its exemplar.
+func beginStage(ctx context.Context, stage string) func(err error) {
+	start := time.Now()
+	return func(err error) {
+		elapsed := time.Since(start)
+		outcome := "success"
+		if err != nil {
+			outcome = "failure"
+		}
+		observeTraced(ctx, pipelineStageDuration.WithLabelValues(stage, outcome), elapsed.Seconds())
+
+		pipelineMu.Lock()
+		stats, ok := pipelineStats[stage]
+		if !ok {
+			stats = &stageStats{}
+			pipelineStats[stage] = stats
+		}
+		if err != nil {
+			stats.Failed++
+		} else {
+			stats.Succeeded++
+		}
+		stats.Total += elapsed
+		stats.Max = max(stats.Max, elapsed)
+		pipelineMu.Unlock()
+	}
+}
+
+// getPipelineAnalytics serves GET /analytics/pipeline with per-stage counts
+// and durations since startup.
+func getPipelineAnalytics(c *gin.Context) {
+	type stageReport struct {
+		Stage         string  `json:"stage"`
+		Attempts      int     `json:"attempts"`
+		Succeeded     int     `json:"succeeded"`
+		Failed        int     `json:"failed"`
+		SuccessRate   float64 `json:"successRate"`
+		AvgDurationMs float64 `json:"avgDurationMs"`
+		MaxDurationMs float64 `json:"maxDurationMs"`
+	}
+
+	pipelineMu.Lock()
+	stages := make([]stageReport, 0, len(pipelineStages))
+	for _, stage := range pipelineStages {
+		report := stageReport{Stage: stage}
+		if stats, ok := pipelineStats[stage]; ok {
+			report.Succeeded, report.Failed = stats.Succeeded, stats.Failed
+			report.Attempts = stats.Succeeded + stats.Failed
+			report.SuccessRate = float64(stats.Succeeded) / float64(report.Attempts)
+			report.AvgDurationMs = float64(stats.Total.Microseconds()) / 1000 / float64(report.Attempts)
+			report.MaxDurationMs = float64(stats.Max.Microseconds()) / 1000
+		}
+		stages = append(stages, report)
+	}
+	submitted, completed := 0, 0
+	if stats, ok := pipelineStats[stageDecode]; ok {
+		submitted = stats.Succeeded + stats.Failed
+	}
+	if stats, ok := pipelineStats[stageStore]; ok {
+		completed = stats.Succeeded
+	}
+	pipelineMu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{"submitted": submitted, "completed": completed, "stages": stages})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/binary"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Everyone but admins gets the aggregate analytics (time series,
+// retailers, points distribution, top items, geo and cohorts) with
+// differential privacy applied, so that no figure gives away what one
+// customer bought. Every count gets Laplace
+// noise of scale 1/ANALYTICS_DP_EPSILON, and every sum noise scaled to the
+// most one receipt is taken to add to it: ANALYTICS_DP_POINTS_CAP points,
+// ANALYTICS_DP_SPEND_CAP spend (500.00 by default) and
+// ANALYTICS_DP_ITEMS_CAP items. Groups whose noisy count is under
+// ANALYTICS_MIN_COUNT receipts (customers, for cohorts) are left out of
+// lists and reported as suppressed zeros in series. Only admins see exact
+// figures.
+//
+// Noise is drawn afresh for every answer, so what stops a requester
+// averaging it away, or differencing overlapping ranges, is a budget: each
+// answer spends ANALYTICS_DP_EPSILON of ANALYTICS_DP_BUDGET per
+// ANALYTICS_DP_BUDGET_WINDOW (24h), after which analytics answer 429 until
+// the next window. The budget belongs to the tenant of the request's
+// managed API key, or, without one, to its client address; X-Tenant-ID
+// alone does not open a fresh budget.
+
+type analyticsPrivacy struct {
+	epsilon   float64
+	minCount  int
+	pointsCap float64
+	spendCap  float64 // cents
+	itemsCap  float64
+	// remaining is the requester's budget left after this answer.
+	remaining float64
+}
+
+var (
+	privatePolicy = &analyticsPrivacy{
+		epsilon:   envFloat("ANALYTICS_DP_EPSILON", 1),
+		minCount:  envInt("ANALYTICS_MIN_COUNT", 10),
+		pointsCap: float64(envInt("ANALYTICS_DP_POINTS_CAP", 500)),
+		spendCap:  float64(cmp.Or(max(envCents("ANALYTICS_DP_SPEND_CAP"), 0), 50000)),
+		itemsCap:  float64(envInt("ANALYTICS_DP_ITEMS_CAP", 50)),
+	}
+	privacyBudget       = envFloat("ANALYTICS_DP_BUDGET", 20)
+	privacyBudgetWindow = envDuration("ANALYTICS_DP_BUDGET_WINDOW", 24*time.Hour)
+)
+
+const privacyRemainingKey = "privacyRemaining"
+
+func init() {
+	if privatePolicy.epsilon <= 0 {
+		log.Fatalf("ANALYTICS_DP_EPSILON must be positive")
+	}
+}
+
+// privacyBudgets holds what each requester has spent in the current
+// window.
+var privacyBudgets = struct {
+	sync.Mutex
+	window int64
+	spent  map[string]float64
+}{spent: make(map[string]float64)}
+
+// privacyAccount is who a request's answers are charged to.
+func privacyAccount(c *gin.Context) string {
+	if tenant := c.GetString(apiKeyTenantKey); tenant != "" {
+		return "tenant:" + tenant
+	}
+	return "addr:" + c.ClientIP()
+}
+
+// spendPrivacyBudget is middleware charging a noisy analytics answer to
+// the requester's budget, refusing it once the budget is spent. Admins,
+// who see exact figures, are not charged.
+func spendPrivacyBudget(c *gin.Context) {
+	if adminCredentials(c) {
+		c.Next()
+		return
+	}
+	account := privacyAccount(c)
+	window := clock.Now().UnixNano() / int64(max(privacyBudgetWindow, time.Second))
+	privacyBudgets.Lock()
+	if privacyBudgets.window != window {
+		privacyBudgets.window, privacyBudgets.spent = window, make(map[string]float64)
+	}
+	spent := privacyBudgets.spent[account] + privatePolicy.epsilon
+	ok := spent <= privacyBudget
+	if ok {
+		privacyBudgets.spent[account] = spent
+	}
+	privacyBudgets.Unlock()
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Analytics privacy budget exhausted"})
+		return
+	}
+	c.Set(privacyRemainingKey, privacyBudget-spent)
+	c.Next()
+}
+
+// privacyFor returns the policy for the request, or nil for admins, who
+// see exact figures. A nil policy passes every figure through unchanged.
+func privacyFor(c *gin.Context) *analyticsPrivacy {
+	if adminCredentials(c) {
+		return nil
+	}
+	p := *privatePolicy
+	p.remaining = c.GetFloat64(privacyRemainingKey)
+	return &p
+}
+
+// noise draws fresh Laplace noise of the given scale.
+func (p *analyticsPrivacy) noise(scale float64) float64 {
+	var b [8]byte
+	rand.Read(b[:])
+	u := float64(binary.BigEndian.Uint64(b[:])>>11)/(1<<53) - 0.5
+	if u == -0.5 {
+		u = 0
+	}
+	return -scale * math.Copysign(math.Log(1-2*math.Abs(u)), u)
+}
+
+// count releases a count, reporting false when it is under the minimum.
+func (p *analyticsPrivacy) count(figure string, n int) (int, bool) {
+	if p == nil {
+		return n, true
+	}
+	noisy := max(0, int(math.Round(float64(n)+p.noise(1/p.epsilon))))
+	return noisy, noisy >= max(p.minCount, 1)
+}
+
+// points, spend and items release sums of what receipts contributed.
+func (p *analyticsPrivacy) points(figure string, v int64) int64 {
+	if p == nil {
+		return v
+	}
+	return p.sum("points:"+figure, v, p.pointsCap)
+}
+
+func (p *analyticsPrivacy) spend(figure string, cents int64) int64 {
+	if p == nil {
+		return cents
+	}
+	return p.sum("spend:"+figure, cents, p.spendCap)
+}
+
+func (p *analyticsPrivacy) items(figure string, n int) int {
+	if p == nil {
+		return n
+	}
+	return int(p.sum("items:"+figure, int64(n), p.itemsCap))
+}
+
+func (p *analyticsPrivacy) sum(figure string, v int64, perReceipt float64) int64 {
+	return max(0, int64(math.Round(float64(v)+p.noise(perReceipt/p.epsilon))))
+}
+
+// describe tells the client its figures are noisy, and how.
+func (p *analyticsPrivacy) describe(resp gin.H) {
+	if p != nil {
+		resp["privacy"] = gin.H{"epsilon": p.epsilon, "minCount": p.minCount, "budgetRemaining": p.remaining}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DELETE /admin/receipts?retailer=&before= purges receipts from shared
+// staging environments, e.g. load-test data, while the service keeps
+// running. It is off unless ALLOW_RECEIPT_PURGE is "true" and takes two
+// calls: the first answers 428 with the number of matching receipts and a
+// confirmation token, and the second, repeating the same filter with the
+// token in X-Confirm-Token, deletes them and their images in one store
+// transaction. Tokens are bound to the filter and expire after
+// PURGE_CONFIRM_TTL. Each deleted receipt emits receipt.deleted; outbox
+// events already written and analytics rollups are left as they are.
+
+var (
+	purgeEnabled    = os.Getenv("ALLOW_RECEIPT_PURGE") == "true"
+	purgeConfirmTTL = envDuration("PURGE_CONFIRM_TTL", 5*time.Minute)
+	purgeKey        = purgeTokenKey()
+)
+
+// purgeTokenKey derives the HMAC key from ADMIN_TOKEN, so every replica
+// accepts the others' tokens; without one the key is random.
+func purgeTokenKey() []byte {
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		sum := sha256.Sum256([]byte("receipt-purge:" + token))
+		return sum[:]
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+func purgeToken(filter string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, purgeKey)
+	mac.Write([]byte(filter + "\n" + exp))
+	return exp + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func validPurgeToken(token, filter string) bool {
+	exp, _, ok := strings.Cut(token, ".")
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if !ok || err != nil || clock.Now().Unix() > unix {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(purgeToken(filter, time.Unix(unix, 0))))
+}
+
+func purgeReceipts(c *gin.Context) {
+	if !purgeEnabled {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Receipt purging is disabled"})
+		return
+	}
+	retailer, rawBefore := c.Query("retailer"), c.Query("before")
+	if retailer == "" && rawBefore == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Purging needs a retailer or before filter"})
+		return
+	}
+	if retailer != "" {
+		retailer = normalizeRetailer(retailer)
+	}
+	var before time.Time
+	if rawBefore != "" {
+		var err error
+		if before, err = parseTimeParam(rawBefore); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid before: use an RFC 3339 timestamp or a YYYY-MM-DD date"})
+			return
+		}
+	}
+	match := func(s *storedReceipt) bool {
+		return (retailer == "" || s.Retailer == retailer) && (before.IsZero() || s.CreatedAt.Before(before))
+	}
+	filter := retailer + "\n" + rawBefore
+
+	token := c.GetHeader("X-Confirm-Token")
+	if token == "" {
+		matched, err := store.List(c.Request.Context(), match)
+		if err != nil {
+			storeFailure(c, err)
+			return
+		}
+		expires := clock.Now().Add(purgeConfirmTTL).UTC()
+		c.JSON(http.StatusPreconditionRequired, gin.H{
+			"error":             "Repeat the request with X-Confirm-Token to delete the matching receipts",
+			"matched":           len(matched),
+			"confirmationToken": purgeToken(filter, expires),
+			"expiresAt":         expires,
+		})
+		return
+	}
+	if !validPurgeToken(token, filter) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Confirmation token is invalid or expired"})
+		return
+	}
+
+	purged, err := deleteReceipts(c.Request.Context(), "purge", match)
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	log.Printf("purge: deleted %d receipts (retailer=%q before=%q)", len(purged), retailer, rawBefore)
+	c.JSON(http.StatusOK, gin.H{"deleted": len(purged)})
+}
+
+// deleteReceipts deletes the matching receipts in one store transaction,
+// emitting receipt.deleted with reason for each, then their images, and
+// returns the receipts deleted.
+func deleteReceipts(ctx context.Context, reason string, match func(*storedReceipt) bool) ([]*storedReceipt, error) {
+	var deleted []*storedReceipt
+	now := clock.Now()
+	err := store.Transact(ctx, func(tx storeTx) error {
+		matched, err := tx.List(match)
+		if err != nil {
+			return err
+		}
+		for _, s := range matched {
+			part, err := receiptCarry(ctx, s)
+			if err != nil {
+				return err
+			}
+			if err := adjustCarry(tx, s.Tenant, s.Receipt.CustomerID, -part); err != nil {
+				return err
+			}
+			if err := tx.Delete(s.ID); err != nil && !errors.Is(err, errReceiptNotFound) {
+				return err
+			}
+			tx.Emit(receiptDeletedEvents(s, reason, now)...)
+		}
+		deleted = matched
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range deleted {
+		if !s.HasImage {
+			continue
+		}
+		for _, key := range []string{s.ID, thumbnailKey(s.ID)} {
+			if err := attachments.Delete(ctx, key); err != nil {
+				log.Printf("purge: deleting image %s: %v", key, err)
+			}
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /partners/me/quality reports the calling partner's (tenant's) most
+// common reasons for rejected submissions over the last
+// PARTNER_QUALITY_WINDOW (7 days by default), so integrators can find and
+// fix their data-quality problems themselves. Every submission counts,
+// through any channel but backfill imports: field validation errors,
+// bodies that are not a receipt and submissions after the deadline. Field
+// errors are grouped by field and message, with item indexes and the
+// amounts of item sum mismatches taken out, so "items[3].price" and
+// "items[7].price" failing the same way are one entry, counted once per
+// submission; each entry keeps its latest instance as an example.
+// Counts are held in memory per hour, by the replica that served the
+// submission. Tenants are named by the client, so each hour counts at most
+// PARTNER_QUALITY_MAX_TENANTS tenants, later ones going uncounted, and at
+// most PARTNER_QUALITY_MAX_REASONS reasons per tenant, later ones counted
+// together as other reasons.
+
+var (
+	partnerQualityWindow = envDuration("PARTNER_QUALITY_WINDOW", 7*24*time.Hour)
+	qualityMaxTenants    = envInt("PARTNER_QUALITY_MAX_TENANTS", 1000)
+	qualityMaxReasons    = envInt("PARTNER_QUALITY_MAX_REASONS", 50)
+)
+
+// otherQualityReasons stands for reasons past the per-tenant limit.
+var otherQualityReasons = fieldError{Message: "other reasons"}
+
+var (
+	itemIndexPattern = regexp.MustCompile(`\[\d+\]`)
+	itemSumMessage   = regexp.MustCompile(`^items sum to \S+, not \S+$`)
+)
+
+type qualityFailure struct {
+	count    int
+	example  fieldError
+	lastSeen time.Time
+}
+
+type qualityBucket struct {
+	submissions int
+	rejected    int
+	failures    map[fieldError]*qualityFailure // by normalized field error
+}
+
+var (
+	qualityMu      sync.Mutex
+	qualityBuckets = make(map[int64]map[string]*qualityBucket) // hour -> tenant
+)
+
+// recordSubmissionQuality counts one submission by tenant, rejected for
+// errs when there are any.
+func recordSubmissionQuality(tenant string, errs []fieldError) {
+	now := clock.Now().UTC()
+	hour := now.Truncate(time.Hour).Unix()
+	qualityMu.Lock()
+	defer qualityMu.Unlock()
+	for h := range qualityBuckets {
+		if h < now.Add(-partnerQualityWindow).Truncate(time.Hour).Unix() {
+			delete(qualityBuckets, h)
+		}
+	}
+	byTenant, ok := qualityBuckets[hour]
+	if !ok {
+		byTenant = make(map[string]*qualityBucket)
+		qualityBuckets[hour] = byTenant
+	}
+	bucket, ok := byTenant[tenant]
+	if !ok {
+		if len(byTenant) >= qualityMaxTenants {
+			return
+		}
+		bucket = &qualityBucket{failures: make(map[fieldError]*qualityFailure)}
+		byTenant[tenant] = bucket
+	}
+	bucket.submissions++
+	if len(errs) == 0 {
+		return
+	}
+	bucket.rejected++
+	seen := make(map[fieldError]bool, len(errs))
+	for _, e := range errs {
+		key := fieldError{
+			Field:   itemIndexPattern.ReplaceAllString(e.Field, "[]"),
+			Message: itemSumMessage.ReplaceAllString(e.Message, "items do not sum to the total"),
+		}
+		failure, ok := bucket.failures[key]
+		if !ok && len(bucket.failures) >= qualityMaxReasons {
+			key = otherQualityReasons
+			failure, ok = bucket.failures[key]
+		}
+		if !ok {
+			failure = &qualityFailure{}
+			bucket.failures[key] = failure
+		}
+		if !seen[key] {
+			seen[key] = true
+			failure.count++
+		}
+		failure.example, failure.lastSeen = e, now
+	}
+}
+
+// recordDecodeQuality counts a submission whose body decodeReceipt refused.
+func recordDecodeQuality(tenant string, err error) {
+	recordSubmissionQuality(tenant, []fieldError{{Message: decodeFailure(err)}})
+}
+
+func getPartnerQuality(c *gin.Context) {
+	limit := 10
+	if raw := c.Query("limit"); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 1 || v > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Limit must be between 1 and 100"})
+			return
+		}
+		limit = v
+	}
+	type failureReport struct {
+		Field      string     `json:"field,omitempty"`
+		Message    string     `json:"message"`
+		Count      int        `json:"count"`
+		Share      float64    `json:"share"` // of rejected submissions
+		Example    fieldError `json:"example"`
+		LastSeenAt time.Time  `json:"lastSeenAt"`
+	}
+
+	tenant := tenantID(c)
+	to := clock.Now().UTC()
+	from := to.Add(-partnerQualityWindow)
+	submissions, rejected := 0, 0
+	merged := make(map[fieldError]*qualityFailure)
+	qualityMu.Lock()
+	for hour, byTenant := range qualityBuckets {
+		bucket, ok := byTenant[tenant]
+		if !ok || hour < from.Truncate(time.Hour).Unix() {
+			continue
+		}
+		submissions += bucket.submissions
+		rejected += bucket.rejected
+		for key, f := range bucket.failures {
+			m, ok := merged[key]
+			if !ok {
+				m = &qualityFailure{}
+				merged[key] = m
+			}
+			m.count += f.count
+			if f.lastSeen.After(m.lastSeen) {
+				m.example, m.lastSeen = f.example, f.lastSeen
+			}
+		}
+	}
+	qualityMu.Unlock()
+
+	failures := make([]failureReport, 0, len(merged))
+	for key, f := range merged {
+		failures = append(failures, failureReport{
+			Field:      key.Field,
+			Message:    key.Message,
+			Count:      f.count,
+			Share:      roundScore(float64(f.count) / float64(rejected)),
+			Example:    f.example,
+			LastSeenAt: f.lastSeen,
+		})
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		if failures[i].Count != failures[j].Count {
+			return failures[i].Count > failures[j].Count
+		}
+		return failures[i].LastSeenAt.After(failures[j].LastSeenAt)
+	})
+	if len(failures) > limit {
+		failures = failures[:limit]
+	}
+	rate := 0.0
+	if submissions > 0 {
+		rate = roundScore(float64(rejected) / float64(submissions))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"partner":       tenant,
+		"from":          from,
+		"to":            to,
+		"submissions":   submissions,
+		"rejected":      rejected,
+		"rejectionRate": rate,
+		"failures":      failures,
+	})
+}
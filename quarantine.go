@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Receipt review states. Accepted receipts are scored; quarantined ones
+// wait for an admin decision and carry no points until approved.
+const (
+	receiptAccepted    = "accepted"
+	receiptQuarantined = "quarantined"
+	receiptRejected    = "rejected"
+)
+
+var errNotQuarantined = errors.New("receipt is not in quarantine")
+
+type receiptReview struct {
+	Decision  string    `json:"decision"`
+	Reason    string    `json:"reason,omitempty"`
+	DecidedAt time.Time `json:"decidedAt"`
+}
+
+// Quarantine checks are all off by default:
+//
+//	QUARANTINE_TOTAL_TOLERANCE   quarantine when item prices and the total
+//	                             differ by more than this amount, e.g. "0.05"
+//	QUARANTINE_MAX_TOTAL         quarantine totals above this amount
+//	QUARANTINE_MAX_ITEMS         quarantine receipts with more items
+//	QUARANTINE_FUTURE_PURCHASES  "true" quarantines purchases dated after now
+var (
+	quarantineTolerance = envCents("QUARANTINE_TOTAL_TOLERANCE")
+	quarantineMaxTotal  = envCents("QUARANTINE_MAX_TOTAL")
+	quarantineMaxItems  = envInt("QUARANTINE_MAX_ITEMS", 0)
+	quarantineFuture    = os.Getenv("QUARANTINE_FUTURE_PURCHASES") == "true"
+)
+
+// envCents reads a money amount, returning -1 when the variable is unset.
+func envCents(key string) int64 {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return -1
+	}
+	cents, err := parseCents(raw)
+	if err != nil || cents < 0 {
+		log.Fatalf("%s: invalid amount %q", key, raw)
+	}
+	return cents
+}
+
+// quarantineReasons lists why a receipt looks suspicious enough to hold
+// for review; nil means it can be scored straight away.
+func quarantineReasons(receipt Receipt) []string {
+	var reasons []string
+	total, totalErr := parseCents(receipt.Total)
+	if quarantineTolerance >= 0 && totalErr == nil {
+		var sum int64
+		valid := true
+		for _, item := range receipt.Items {
+			cents, err := parseCents(item.Price)
+			if err != nil {
+				valid = false
+				break
+			}
+			sum += cents
+		}
+		if valid && abs64(sum-total) > quarantineTolerance {
+			reasons = append(reasons, fmt.Sprintf("total_mismatch: items sum to %s but total is %s", formatCents(sum), formatCents(total)))
+		}
+	}
+	if quarantineMaxTotal >= 0 && totalErr == nil && total > quarantineMaxTotal {
+		reasons = append(reasons, "total_above_limit")
+	}
+	if quarantineMaxItems > 0 && len(receipt.Items) > quarantineMaxItems {
+		reasons = append(reasons, "too_many_items")
+	}
+	if quarantineFuture {
+		if purchased, err := time.Parse("2006-01-02 15:04", receipt.PurchaseDate+" "+receipt.PurchaseTime); err == nil && purchased.After(clock.Now().Add(24*time.Hour)) {
+			// A day of slack covers purchases made ahead of us in other time zones.
+			reasons = append(reasons, "purchase_in_future")
+		}
+	}
+	return reasons
+}
+
+func abs64(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// listQuarantine serves GET /admin/quarantine, oldest first.
+func listQuarantine(c *gin.Context) {
+	held, err := store.List(c.Request.Context(), func(s *storedReceipt) bool { return s.Status == receiptQuarantined })
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	type entry struct {
+		ID        string    `json:"id"`
+		Tenant    string    `json:"tenant"`
+		Reasons   []string  `json:"reasons"`
+		Receipt   Receipt   `json:"receipt"`
+		CreatedAt time.Time `json:"createdAt"`
+	}
+	entries := make([]entry, 0, len(held))
+	for _, s := range held {
+		entries = append(entries, entry{s.ID, s.Tenant, s.QuarantineReasons, s.Receipt, s.CreatedAt.UTC()})
+	}
+	c.JSON(http.StatusOK, gin.H{"receipts": entries})
+}
+
+// approveQuarantined serves POST /admin/quarantine/:id/approve: the receipt
+// is scored as if it had just been accepted.
+func approveQuarantined(c *gin.Context) {
+	ctx := c.Request.Context()
+	var version string
+	stored, err := applyTx(ctx, c.Param("id"), func(tx storeTx, s *storedReceipt) error {
+		if s.Status != receiptQuarantined {
+			return errNotQuarantined
+		}
+		s.Status = receiptAccepted
+		if !zeroScoredLate(s.Deadline) {
+			rules := rulesetForReceipt(s.Hash)
+			breakdown, err := rules.score(ctx, s.Receipt)
+			if err != nil {
+				return err
+			}
+			s.Points, s.Breakdown, s.RulesVersion = totalPoints(breakdown), breakdown, rules.scoredVersion()
+		}
+		s.AcceptedAt = clock.Now()
+		startHold(s)
+		s.Review = &receiptReview{Decision: "approved", DecidedAt: s.AcceptedAt.UTC()}
+		version = s.RulesVersion
+		tx.Emit(receiptEvents(s)...)
+		rolledOver, err := awardFractions(tx, s)
+		if err != nil {
+			return err
+		}
+		tx.Emit(rolledOver...)
+		tx.Emit(applyChannelCap(s)...)
+		return nil
+	})
+	if errors.Is(err, errNotQuarantined) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Receipt is not in quarantine"})
+		return
+	}
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	if version != "" {
+		observeScoring(version, stored.Points)
+	}
+	recordAccepted(stored)
+	c.JSON(http.StatusOK, gin.H{"id": stored.ID, "status": stored.Status, "points": stored.Points})
+}
+
+// rejectQuarantined serves POST /admin/quarantine/:id/reject with an
+// optional {"reason": "..."}.
+func rejectQuarantined(c *gin.Context) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+			return
+		}
+	}
+	stored, err := store.Apply(c.Request.Context(), c.Param("id"), func(s *storedReceipt) ([]outboxEvent, error) {
+		if s.Status != receiptQuarantined {
+			return nil, errNotQuarantined
+		}
+		s.Status = receiptRejected
+		s.Review = &receiptReview{Decision: "rejected", Reason: strings.TrimSpace(req.Reason), DecidedAt: clock.Now().UTC()}
+		return nil, nil
+	})
+	if errors.Is(err, errNotQuarantined) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Receipt is not in quarantine"})
+		return
+	}
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": stored.ID, "status": stored.Status})
+}
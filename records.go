@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// Records kinds. Each feature that keeps settings or a registry in the
+// store names its own kind here, so kinds cannot collide.
+const (
+	recordTenantKeys       = "tenant_keys"
+	recordCustomerContacts = "customer_contacts"
+	recordRetailers        = "retailers"
+	recordReportSchedules  = "report_schedules"
+	recordExportProgress   = "export_progress"
+	recordReprocess        = "reprocess"
+	recordAPIKeys          = "api_keys"
+	recordFractionCarry    = "fraction_carry"
+	recordAdjustmentFiles  = "adjustment_files"
+	recordAdjustments      = "adjustment_imports"
+	recordSubmissionCounts = "submission_counts"
+	recordSubscriptions    = "webhook_subscriptions"
+)
+
+type recordKey struct {
+	kind, key string
+}
+
+// recordTx is the record half of storeTx.
+type recordTx interface {
+	GetRecord(kind, key string) ([]byte, error)
+	PutRecord(kind, key string, value []byte) error
+	DeleteRecord(kind, key string) error
+}
+
+// getRecordJSON decodes the record under kind and key into v, reporting
+// false when there is none.
+func getRecordJSON(ctx context.Context, kind, key string, v any) (bool, error) {
+	data, err := store.GetRecord(ctx, kind, key)
+	if errors.Is(err, errRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+func putRecordJSON(ctx context.Context, kind, key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return store.PutRecord(ctx, kind, key, data)
+}
+
+// getTxRecordJSON is getRecordJSON inside a transaction.
+func getTxRecordJSON(tx recordTx, kind, key string, v any) (bool, error) {
+	data, err := tx.GetRecord(kind, key)
+	if errors.Is(err, errRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+func putTxRecordJSON(tx recordTx, kind, key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.PutRecord(kind, key, data)
+}
+
+// listRecordsJSON decodes every record of a kind.
+func listRecordsJSON[T any](ctx context.Context, kind string) (map[string]T, error) {
+	raw, err := store.ListRecords(ctx, kind)
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[string]T, len(raw))
+	for key, data := range raw {
+		var v T
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		records[key] = v
+	}
+	return records, nil
+}
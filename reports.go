@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// reportDestination says where a generated report goes: a webhook URL, a
+// list of email recipients, or an S3 bucket and key prefix.
+type reportDestination struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url,omitempty"`
+	To     []string `json:"to,omitempty"`
+	Bucket string   `json:"bucket,omitempty"`
+	Prefix string   `json:"prefix,omitempty"`
+}
+
+// reportSchedule runs daily or weekly at Hour:00 UTC (weekly on Weekday)
+// and reports on the preceding day or seven days. Kind selects the report:
+// "summary" (receipts, points and spend per retailer) or "rules" (points
+// awarded per rule, flagging rules that never fired).
+type reportSchedule struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Kind        string            `json:"kind"`
+	Frequency   string            `json:"frequency"`
+	Format      string            `json:"format"`
+	Hour        int               `json:"hour"`
+	Weekday     string            `json:"weekday,omitempty"`
+	Destination reportDestination `json:"destination"`
+	NextRun     time.Time         `json:"nextRun"`
+	LastRun     *time.Time        `json:"lastRun,omitempty"`
+	LastError   string            `json:"lastError,omitempty"`
+}
+
+type summaryReport struct {
+	Name       string          `json:"name"`
+	Frequency  string          `json:"frequency"`
+	From       time.Time       `json:"from"`
+	To         time.Time       `json:"to"`
+	Receipts   int             `json:"receipts"`
+	Points     int64           `json:"points"`
+	TotalSpend string          `json:"totalSpend"`
+	Retailers  []retailerStats `json:"retailers"`
+}
+
+// Schedules are kept as store records, so whichever replica leads runs the
+// ones any replica created, and reports are built from the receipts in the
+// store rather than from this replica's rollups.
+
+var (
+	errReportScheduleNotFound = errors.New("report schedule not found")
+
+	weekdays = map[string]time.Weekday{
+		"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday,
+		"thursday": time.Thursday, "friday": time.Friday, "saturday": time.Saturday,
+	}
+)
+
+func (s *reportSchedule) validate() error {
+	s.Name = strings.TrimSpace(s.Name)
+	if s.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if s.Kind == "" {
+		s.Kind = "summary"
+	}
+	if s.Kind != "summary" && s.Kind != "rules" {
+		return fmt.Errorf("kind must be summary or rules")
+	}
+	if s.Frequency != "daily" && s.Frequency != "weekly" {
+		return fmt.Errorf("frequency must be daily or weekly")
+	}
+	if s.Format == "" {
+		s.Format = "json"
+	}
+	if s.Format != "json" && s.Format != "csv" {
+		return fmt.Errorf("format must be json or csv")
+	}
+	if s.Hour < 0 || s.Hour > 23 {
+		return fmt.Errorf("hour must be between 0 and 23")
+	}
+	s.Weekday = strings.ToLower(s.Weekday)
+	if s.Frequency == "weekly" {
+		if s.Weekday == "" {
+			s.Weekday = "monday"
+		}
+		if _, ok := weekdays[s.Weekday]; !ok {
+			return fmt.Errorf("weekday must be a day name such as monday")
+		}
+	} else {
+		s.Weekday = ""
+	}
+
+	d := s.Destination
+	switch d.Type {
+	case "webhook":
+		if !strings.HasPrefix(d.URL, "http://") && !strings.HasPrefix(d.URL, "https://") {
+			return fmt.Errorf("webhook destination needs an http(s) url")
+		}
+	case "email":
+		if len(d.To) == 0 {
+			return fmt.Errorf("email destination needs at least one recipient")
+		}
+	case "s3":
+		if d.Bucket == "" {
+			return fmt.Errorf("s3 destination needs a bucket")
+		}
+	default:
+		return fmt.Errorf("destination type must be webhook, email or s3")
+	}
+	return nil
+}
+
+// nextRunAfter returns the first scheduled time strictly after t.
+func (s *reportSchedule) nextRunAfter(t time.Time) time.Time {
+	t = t.UTC()
+	next := startOfDay(t).Add(time.Duration(s.Hour) * time.Hour)
+	if s.Frequency == "weekly" {
+		next = next.AddDate(0, 0, (int(weekdays[s.Weekday])-int(next.Weekday())+7)%7)
+		for !next.After(t) {
+			next = next.AddDate(0, 0, 7)
+		}
+		return next
+	}
+	for !next.After(t) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// reportPeriod covers the whole UTC days before runAt: one day for daily
+// schedules, seven for weekly ones.
+func reportPeriod(s reportSchedule, runAt time.Time) (time.Time, time.Time) {
+	to := startOfDay(runAt.UTC())
+	days := 1
+	if s.Frequency == "weekly" {
+		days = 7
+	}
+	return to.AddDate(0, 0, -days), to
+}
+
+// storedRollups holds the analytics rollups of the accepted receipts stored
+// in one report period.
+type storedRollups struct {
+	series    map[int64]*seriesBucket
+	retailers map[int64]map[string]*retailerRollup
+	rules     map[int64]map[string]*ruleRollup
+}
+
+func rollupsFromStore(ctx context.Context, from, to time.Time) (*storedRollups, error) {
+	r := &storedRollups{
+		series:    make(map[int64]*seriesBucket),
+		retailers: make(map[int64]map[string]*retailerRollup),
+		rules:     make(map[int64]map[string]*ruleRollup),
+	}
+	_, err := store.List(ctx, func(stored *storedReceipt) bool {
+		at := stored.CreatedAt.UTC()
+		if stored.Status != receiptAccepted || isSandboxTenant(stored.Tenant) || at.Before(from) || !at.Before(to) {
+			return false
+		}
+		day := startOfDay(at).Unix()
+		addToSeries(r.series, day, stored.Points)
+		recordRetailerRollup(r.retailers, day, stored)
+		recordRuleRollup(r.rules, day, stored)
+		return false
+	})
+	return r, err
+}
+
+func buildSummaryReport(s reportSchedule, rollups *storedRollups, runAt time.Time) summaryReport {
+	from, to := reportPeriod(s, runAt)
+
+	report := summaryReport{
+		Name:      s.Name,
+		Frequency: s.Frequency,
+		From:      from,
+		To:        to,
+		Retailers: retailerStatsIn(rollups.retailers, from, to),
+	}
+	var spend int64
+	for _, stats := range report.Retailers {
+		report.Receipts += stats.Receipts
+		report.Points += stats.TotalPoints
+		spend += stats.spendCents
+	}
+	report.TotalSpend = formatCents(spend)
+	return report
+}
+
+func encodeReport(report summaryReport, format string) ([]byte, string, error) {
+	if format == "json" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		return data, "application/json", err
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"retailer", "receipts", "total_spend", "total_points", "average_basket_size"})
+	for _, stats := range report.Retailers {
+		w.Write([]string{
+			stats.Retailer,
+			strconv.Itoa(stats.Receipts),
+			stats.TotalSpend,
+			strconv.FormatInt(stats.TotalPoints, 10),
+			strconv.FormatFloat(stats.AverageBasketSize, 'f', 2, 64),
+		})
+	}
+	w.Write([]string{"TOTAL", strconv.Itoa(report.Receipts), report.TotalSpend, strconv.FormatInt(report.Points, 10), ""})
+	w.Flush()
+	return buf.Bytes(), "text/csv", w.Error()
+}
+
+// renderReport builds and encodes the report a schedule produces at runAt,
+// along with a short plain-text summary for email bodies.
+func renderReport(ctx context.Context, s reportSchedule, runAt time.Time) ([]byte, string, string, error) {
+	from, to := reportPeriod(s, runAt)
+	rollups, err := rollupsFromStore(ctx, from, to)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if s.Kind == "rules" {
+		report := rulesReportIn(rollups.series, rollups.rules, from, to)
+		data, contentType, err := encodeRulesReport(report, s.Format)
+		text := fmt.Sprintf("%s report for %s to %s.\r\nReceipts: %d\r\nRules that never fired: %s\r\n",
+			s.Name, from.Format(time.RFC3339), to.Format(time.RFC3339), report.Receipts, strings.Join(report.NeverFired, ", "))
+		return data, contentType, text, err
+	}
+
+	report := buildSummaryReport(s, rollups, runAt)
+	data, contentType, err := encodeReport(report, s.Format)
+	text := fmt.Sprintf("%s report for %s to %s.\r\nReceipts: %d\r\nPoints: %d\r\nTotal spend: %s\r\n",
+		s.Name, from.Format(time.RFC3339), to.Format(time.RFC3339), report.Receipts, report.Points, report.TotalSpend)
+	return data, contentType, text, err
+}
+
+func deliverReport(ctx context.Context, s reportSchedule, runAt time.Time) error {
+	data, contentType, text, err := renderReport(ctx, s, runAt)
+	if err != nil {
+		return err
+	}
+	from, _ := reportPeriod(s, runAt)
+	filename := fmt.Sprintf("%s-%s-%s.%s", slugify(s.Name), s.Frequency, from.Format("2006-01-02"), s.Format)
+
+	d := s.Destination
+	switch d.Type {
+	case "webhook":
+		return postWebhook(ctx, d.URL, contentType, data)
+	case "email":
+		subject := fmt.Sprintf("%s (%s)", s.Name, from.Format("2006-01-02"))
+		return sendEmail(d.To, subject, text, filename, contentType, data)
+	case "s3":
+		client, err := s3FromEnv()
+		if err != nil {
+			return err
+		}
+		return client.PutObject(ctx, d.Bucket, path.Join(d.Prefix, filename), contentType, data)
+	}
+	return fmt.Errorf("unknown destination type %q", d.Type)
+}
+
+func runDueReports(now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	schedules, err := listRecordsJSON[reportSchedule](ctx, recordReportSchedules)
+	cancel()
+	if err != nil {
+		log.Printf("reports: listing schedules: %v", err)
+		return
+	}
+	for _, s := range schedules {
+		if !s.NextRun.After(now) {
+			runReport(s, now)
+		}
+	}
+}
+
+func runReport(s reportSchedule, now time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	err := deliverReport(ctx, s, now)
+	if err != nil {
+		log.Printf("report %s (%s): %v", s.ID, s.Name, err)
+	}
+
+	saveErr := store.Transact(ctx, func(tx storeTx) error {
+		var current reportSchedule
+		if ok, err := getTxRecordJSON(tx, recordReportSchedules, s.ID, &current); !ok || err != nil {
+			return err
+		}
+		ran := now.UTC()
+		current.LastRun = &ran
+		current.LastError = ""
+		if err != nil {
+			current.LastError = err.Error()
+		}
+		current.NextRun = current.nextRunAfter(now)
+		return putTxRecordJSON(tx, recordReportSchedules, s.ID, current)
+	})
+	if saveErr != nil {
+		log.Printf("report %s (%s): saving schedule: %v", s.ID, s.Name, saveErr)
+	}
+	return err
+}
+
+func slugify(name string) string {
+	return strings.Trim(nonAlnumPattern.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+func listReportSchedules(c *gin.Context) {
+	stored, err := listRecordsJSON[reportSchedule](c.Request.Context(), recordReportSchedules)
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	schedules := make([]reportSchedule, 0, len(stored))
+	for _, s := range stored {
+		schedules = append(schedules, s)
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].Name < schedules[j].Name })
+
+	c.JSON(http.StatusOK, gin.H{"schedules": schedules})
+}
+
+func createReportSchedule(c *gin.Context) {
+	var s reportSchedule
+	if err := c.ShouldBindJSON(&s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+	if err := s.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid report schedule: " + err.Error()})
+		return
+	}
+	s.ID = uuid.New().String()
+	s.NextRun = s.nextRunAfter(clock.Now())
+	s.LastRun, s.LastError = nil, ""
+
+	if err := putRecordJSON(c.Request.Context(), recordReportSchedules, s.ID, s); err != nil {
+		storeFailure(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, s)
+}
+
+// lookupReportSchedule loads the schedule named in the path, writing the
+// error response when there is none.
+func lookupReportSchedule(c *gin.Context) (reportSchedule, bool) {
+	var s reportSchedule
+	ok, err := getRecordJSON(c.Request.Context(), recordReportSchedules, c.Param("id"), &s)
+	if err != nil {
+		storeFailure(c, err)
+		return s, false
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Report schedule not found"})
+	}
+	return s, ok
+}
+
+func getReportSchedule(c *gin.Context) {
+	s, ok := lookupReportSchedule(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, s)
+}
+
+func updateReportSchedule(c *gin.Context) {
+	var s reportSchedule
+	if err := c.ShouldBindJSON(&s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+	if err := s.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid report schedule: " + err.Error()})
+		return
+	}
+
+	err := store.Transact(c.Request.Context(), func(tx storeTx) error {
+		var current reportSchedule
+		ok, err := getTxRecordJSON(tx, recordReportSchedules, c.Param("id"), &current)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errReportScheduleNotFound
+		}
+		s.ID, s.LastRun, s.LastError = current.ID, current.LastRun, current.LastError
+		s.NextRun = s.nextRunAfter(clock.Now())
+		return putTxRecordJSON(tx, recordReportSchedules, s.ID, s)
+	})
+	if errors.Is(err, errReportScheduleNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Report schedule not found"})
+		return
+	}
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, s)
+}
+
+func deleteReportSchedule(c *gin.Context) {
+	err := store.Transact(c.Request.Context(), func(tx storeTx) error {
+		if _, err := tx.GetRecord(recordReportSchedules, c.Param("id")); err != nil {
+			return err
+		}
+		return tx.DeleteRecord(recordReportSchedules, c.Param("id"))
+	})
+	if errors.Is(err, errRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Report schedule not found"})
+		return
+	}
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// previewReport renders the report a schedule would deliver now, without
+// delivering it.
+func previewReport(c *gin.Context) {
+	schedule, ok := lookupReportSchedule(c)
+	if !ok {
+		return
+	}
+
+	data, contentType, _, err := renderReport(c.Request.Context(), schedule, clock.Now())
+	if requestExpired(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not render report"})
+		return
+	}
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// runReportNow delivers a schedule's report immediately; the regular
+// schedule then continues from now.
+func runReportNow(c *gin.Context) {
+	schedule, ok := lookupReportSchedule(c)
+	if !ok {
+		return
+	}
+
+	if err := runReport(schedule, clock.Now()); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Report delivery failed: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": schedule.ID, "delivered": true})
+}
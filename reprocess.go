@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Reprocessing re-scores every stored receipt under another rules version
+// in the background and stores the outcome in the receipt's shadow fields,
+// leaving Points untouched, so the two versions can be compared before a
+// cutover. The job walks receipts oldest first behind a (CreatedAt, ID)
+// cursor. Its state is a store record written in the same transaction as
+// each shadow score, so a paused, failed or interrupted run resumes where
+// it stopped, and a running job whose replica went away is picked up by
+// the leader once its state has not moved for reprocessStale.
+type shadowScore struct {
+	RulesVersion string       `json:"rulesVersion"`
+	Points       int          `json:"points"`
+	Breakdown    []ruleResult `json:"breakdown"`
+	ScoredAt     time.Time    `json:"scoredAt"`
+}
+
+// reprocessState is the job as kept in the store.
+type reprocessState struct {
+	State         string        `json:"state"`
+	RulesVersion  string        `json:"rulesVersion"`
+	RatePerSecond int           `json:"ratePerSecond"`
+	Cursor        receiptCursor `json:"cursor"`
+	Processed     int           `json:"processed"`
+	Changed       int           `json:"changed"`
+	PointsDelta   int64         `json:"pointsDelta"`
+	StartedAt     time.Time     `json:"startedAt"`
+	FinishedAt    time.Time     `json:"finishedAt"`
+	LastError     string        `json:"lastError,omitempty"`
+	// Worker names the replica running the job; UpdatedAt moves with
+	// every receipt it scores.
+	Worker    string    `json:"worker,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ownedBy reports whether st is still the running job the worker started
+// from seen, rather than one paused, replaced or adopted since.
+func (st *reprocessState) ownedBy(seen reprocessState) bool {
+	return st.State == reprocessRunning && st.StartedAt.Equal(seen.StartedAt) && st.Worker == reprocessWorker
+}
+
+// reprocessJob is the worker on this replica, if it runs one.
+type reprocessJob struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+const (
+	reprocessRunning  = "running"
+	reprocessPaused   = "paused"
+	reprocessDone     = "done"
+	reprocessFailed   = "failed"
+	defaultReprocRate = 50
+	reprocessStale    = 5 * time.Minute
+
+	reprocessRecordKey = "current"
+)
+
+var (
+	reprocess       = &reprocessJob{}
+	reprocessWorker = uuid.New().String()
+
+	// errReprocessStopped ends a worker whose job was paused or replaced
+	// from another replica.
+	errReprocessStopped = errors.New("reprocessing job stopped")
+	errNoReprocessJob   = errors.New("no reprocessing job")
+)
+
+func loadReprocessState(ctx context.Context) (reprocessState, bool, error) {
+	var st reprocessState
+	ok, err := getRecordJSON(ctx, recordReprocess, reprocessRecordKey, &st)
+	return st, ok, err
+}
+
+// updateReprocessState applies fn to the stored job state in one
+// transaction. fn may refuse the change by returning an error.
+func updateReprocessState(ctx context.Context, fn func(st *reprocessState) error) (reprocessState, error) {
+	var st reprocessState
+	err := store.Transact(ctx, func(tx storeTx) error {
+		st = reprocessState{}
+		if _, err := getTxRecordJSON(tx, recordReprocess, reprocessRecordKey, &st); err != nil {
+			return err
+		}
+		if err := fn(&st); err != nil {
+			return err
+		}
+		st.UpdatedAt = clock.Now().UTC()
+		return putTxRecordJSON(tx, recordReprocess, reprocessRecordKey, st)
+	})
+	return st, err
+}
+
+// startReprocessing serves POST /admin/reprocess with
+// {"rulesVersion": "...", "ratePerSecond": 50}.
+func startReprocessing(c *gin.Context) {
+	var req struct {
+		RulesVersion  string `json:"rulesVersion"`
+		RatePerSecond int    `json:"ratePerSecond"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+	rules := rulesetByVersion(req.RulesVersion)
+	if rules == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown rulesVersion"})
+		return
+	}
+	if req.RatePerSecond == 0 {
+		req.RatePerSecond = defaultReprocRate
+	}
+	if req.RatePerSecond < 1 || req.RatePerSecond > 10000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ratePerSecond must be between 1 and 10000"})
+		return
+	}
+
+	j := reprocess
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	errRunning := errors.New("already running")
+	st, err := updateReprocessState(c.Request.Context(), func(st *reprocessState) error {
+		if st.State == reprocessRunning {
+			return errRunning
+		}
+		*st = reprocessState{State: reprocessRunning, RulesVersion: rules.version, RatePerSecond: req.RatePerSecond, StartedAt: clock.Now().UTC(), Worker: reprocessWorker}
+		return nil
+	})
+	if errors.Is(err, errRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A reprocessing job is already running"})
+		return
+	}
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	j.launch(st, rules)
+	c.JSON(http.StatusAccepted, reprocessStatus(st))
+}
+
+// pauseReprocessing serves POST /admin/reprocess/pause. A worker on another
+// replica stops at its next receipt.
+func pauseReprocessing(c *gin.Context) {
+	j := reprocess
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	st, err := updateReprocessState(c.Request.Context(), func(st *reprocessState) error {
+		if st.State != reprocessRunning {
+			return errNoReprocessJob
+		}
+		st.State = reprocessPaused
+		return nil
+	})
+	if errors.Is(err, errNoReprocessJob) {
+		c.JSON(http.StatusConflict, gin.H{"error": "No reprocessing job is running"})
+		return
+	}
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	if j.cancel != nil {
+		j.cancel()
+		j.cancel = nil
+	}
+	c.JSON(http.StatusOK, reprocessStatus(st))
+}
+
+// resumeReprocessing serves POST /admin/reprocess/resume, continuing a
+// paused or failed job from its cursor.
+func resumeReprocessing(c *gin.Context) {
+	j := reprocess
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var rules *ruleset
+	errUnknownRules := errors.New("unknown rules version")
+	st, err := updateReprocessState(c.Request.Context(), func(st *reprocessState) error {
+		if st.State != reprocessPaused && st.State != reprocessFailed {
+			return errNoReprocessJob
+		}
+		if rules = rulesetByVersion(st.RulesVersion); rules == nil {
+			return errUnknownRules
+		}
+		st.State, st.LastError, st.Worker = reprocessRunning, "", reprocessWorker
+		return nil
+	})
+	switch {
+	case errors.Is(err, errNoReprocessJob):
+		c.JSON(http.StatusConflict, gin.H{"error": "No paused or failed reprocessing job to resume"})
+	case errors.Is(err, errUnknownRules):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown rulesVersion"})
+	case err != nil:
+		storeFailure(c, err)
+	default:
+		j.launch(st, rules)
+		c.JSON(http.StatusOK, reprocessStatus(st))
+	}
+}
+
+// getReprocessing serves GET /admin/reprocess with the job's progress.
+func getReprocessing(c *gin.Context) {
+	st, ok, err := loadReprocessState(c.Request.Context())
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No reprocessing job has run"})
+		return
+	}
+	c.JSON(http.StatusOK, reprocessStatus(st))
+}
+
+// adoptReprocessing runs on the leader and takes over a running job whose
+// state has not moved for reprocessStale, such as one whose replica was
+// restarted.
+func adoptReprocessing(now time.Time) {
+	j := reprocess
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var rules *ruleset
+	st, err := updateReprocessState(ctx, func(st *reprocessState) error {
+		if st.State != reprocessRunning || now.Sub(st.UpdatedAt) < reprocessStale {
+			return errNoReprocessJob
+		}
+		if rules = rulesetByVersion(st.RulesVersion); rules == nil {
+			st.State, st.LastError = reprocessFailed, "rules version "+st.RulesVersion+" is no longer loaded"
+		}
+		st.Worker = reprocessWorker
+		return nil
+	})
+	if errors.Is(err, errNoReprocessJob) {
+		return
+	}
+	if err != nil {
+		log.Printf("reprocessing: adopting job: %v", err)
+		return
+	}
+	if rules == nil {
+		log.Printf("reprocessing: %s", st.LastError)
+		return
+	}
+	log.Printf("reprocessing: resuming after %s/%s", st.Cursor.CreatedAt.Format(time.RFC3339Nano), st.Cursor.ID)
+	j.launch(st, rules)
+}
+
+// launch starts the worker; j.mu must be held.
+func (j *reprocessJob) launch(st reprocessState, rules *ruleset) {
+	if j.cancel != nil {
+		j.cancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	j.cancel = cancel
+	go func() {
+		err := j.run(ctx, st, rules)
+		j.mu.Lock()
+		if ctx.Err() == nil {
+			j.cancel = nil
+		}
+		j.mu.Unlock()
+		cancel()
+		if err != nil && !errors.Is(err, errReprocessStopped) && ctx.Err() == nil {
+			log.Printf("reprocessing: %v", err)
+			_, saveErr := updateReprocessState(context.Background(), func(current *reprocessState) error {
+				if !current.ownedBy(st) {
+					return errReprocessStopped
+				}
+				current.State, current.LastError = reprocessFailed, err.Error()
+				return nil
+			})
+			if saveErr != nil && !errors.Is(saveErr, errReprocessStopped) {
+				log.Printf("reprocessing: saving failure: %v", saveErr)
+			}
+		}
+	}()
+}
+
+// run walks the receipts after the job's cursor. Each round lists the
+// remaining receipts' positions in one pass over the store and then
+// visits them in order; a further round picks up receipts stored
+// meanwhile, and the job is done when one finds none.
+func (j *reprocessJob) run(ctx context.Context, st reprocessState, rules *ruleset) error {
+	interval := time.Second / time.Duration(st.RatePerSecond)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	cursor := st.Cursor
+	for {
+		var pending []receiptCursor
+		_, err := store.List(ctx, func(s *storedReceipt) bool {
+			if s.Status == receiptAccepted && cursor.before(cursorOf(s)) {
+				pending = append(pending, cursorOf(s))
+			}
+			return false
+		})
+		if err != nil {
+			return err
+		}
+		sort.Slice(pending, func(a, b int) bool { return pending[a].before(pending[b]) })
+		if len(pending) == 0 {
+			_, err := updateReprocessState(ctx, func(current *reprocessState) error {
+				if !current.ownedBy(st) {
+					return errReprocessStopped
+				}
+				current.State, current.FinishedAt = reprocessDone, clock.Now().UTC()
+				return nil
+			})
+			return err
+		}
+		for _, next := range pending {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+			if err := j.rescore(ctx, st, rules, next); err != nil {
+				return err
+			}
+			cursor = next
+		}
+	}
+}
+
+// rescore stores the shadow score of the receipt at next and moves the
+// job's cursor past it in one transaction.
+func (j *reprocessJob) rescore(ctx context.Context, st reprocessState, rules *ruleset, next receiptCursor) error {
+	stored, err := store.Get(ctx, next.ID)
+	if err != nil && !errors.Is(err, errReceiptNotFound) {
+		return err
+	}
+	var shadow *shadowScore
+	if stored != nil && stored.Status == receiptAccepted {
+		breakdown, err := rules.score(ctx, stored.Receipt)
+		if err != nil {
+			return err
+		}
+		shadow = &shadowScore{RulesVersion: rules.scoredVersion(), Points: totalPoints(breakdown), Breakdown: breakdown, ScoredAt: clock.Now().UTC()}
+	}
+	return store.Transact(ctx, func(tx storeTx) error {
+		var current reprocessState
+		if _, err := getTxRecordJSON(tx, recordReprocess, reprocessRecordKey, &current); err != nil {
+			return err
+		}
+		if !current.ownedBy(st) {
+			return errReprocessStopped
+		}
+		current.Cursor, current.UpdatedAt = next, clock.Now().UTC()
+		if shadow != nil {
+			stored, err := tx.Get(next.ID)
+			if err != nil && !errors.Is(err, errReceiptNotFound) {
+				return err
+			}
+			if stored != nil {
+				stored.Shadow = shadow
+				if err := tx.Put(stored); err != nil {
+					return err
+				}
+				current.Processed++
+				if shadow.Points != stored.Points {
+					current.Changed++
+					current.PointsDelta += int64(shadow.Points - stored.Points)
+				}
+			}
+		}
+		return putTxRecordJSON(tx, recordReprocess, reprocessRecordKey, current)
+	})
+}
+
+func reprocessStatus(st reprocessState) gin.H {
+	status := gin.H{
+		"state":         st.State,
+		"rulesVersion":  st.RulesVersion,
+		"ratePerSecond": st.RatePerSecond,
+		"processed":     st.Processed,
+		"changed":       st.Changed,
+		"pointsDelta":   st.PointsDelta,
+		"startedAt":     st.StartedAt,
+	}
+	if !st.Cursor.CreatedAt.IsZero() {
+		status["cursor"] = gin.H{"createdAt": st.Cursor.CreatedAt.UTC(), "id": st.Cursor.ID}
+	}
+	if !st.FinishedAt.IsZero() {
+		status["finishedAt"] = st.FinishedAt
+	}
+	if st.LastError != "" {
+		status["lastError"] = st.LastError
+	}
+	return status
+}
+
+// getReprocessingDiff serves GET /admin/reprocess/diff: up to 100 receipts
+// whose shadow score under rulesVersion differs from their stored points.
+func getReprocessingDiff(c *gin.Context) {
+	version := c.Query("rulesVersion")
+	differs, err := store.List(c.Request.Context(), func(s *storedReceipt) bool {
+		return s.Shadow != nil && (version == "" || baseRulesVersion(s.Shadow.RulesVersion) == baseRulesVersion(version)) && s.Shadow.Points != s.Points
+	})
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	type diff struct {
+		ID           string `json:"id"`
+		Points       int    `json:"points"`
+		RulesVersion string `json:"rulesVersion"`
+		ShadowPoints int    `json:"shadowPoints"`
+		ShadowRules  string `json:"shadowRulesVersion"`
+	}
+	diffs := make([]diff, 0, min(len(differs), 100))
+	for _, s := range differs[:min(len(differs), 100)] {
+		diffs = append(diffs, diff{s.ID, s.Points, s.RulesVersion, s.Shadow.Points, s.Shadow.RulesVersion})
+	}
+	c.JSON(http.StatusOK, gin.H{"total": len(differs), "receipts": diffs})
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// retailerProfile describes how a retailer's name and item descriptions
+// appear on receipts, and how its receipts are scored. The retailer_name rule
+// still counts the retailer text as submitted; Scoring scales other rules
+// for this retailer (0 switches a rule off) and Promotions add bonus points.
+//
+// Profiles come from the built-in list and RETAILER_PROFILES_FILE, and the
+// admin API's changes to them are kept in the store, override both, and
+// reach other replicas within RETAILER_REFRESH. Scoring overrides and
+// promotions are part of the version receipts record; see scoredVersion.
+type retailerProfile struct {
+	Canonical  string              `json:"canonical"`
+	Aliases    []string            `json:"aliases"`
+	Category   string              `json:"category,omitempty"`
+	Quirks     []descriptionQuirk  `json:"descriptionQuirks"`
+	Scoring    map[string]float64  `json:"scoringOverrides,omitempty"`
+	Promotions []retailerPromotion `json:"promotions,omitempty"`
+}
+
+// retailerPromotion awards Points to receipts purchased between Starts and
+// Ends, inclusive. Dates are YYYY-MM-DD; either may be empty for an open end.
+type retailerPromotion struct {
+	Name   string `json:"name"`
+	Points int    `json:"points"`
+	Starts string `json:"starts,omitempty"`
+	Ends   string `json:"ends,omitempty"`
+}
+
+// descriptionQuirk rewrites a description pattern a retailer's POS prints,
+// e.g. a leading SKU or a trailing tax flag.
+type descriptionQuirk struct {
+	Pattern string `json:"pattern"`
+	Replace string `json:"replace"`
+
+	re *regexp.Regexp
+}
+
+var defaultRetailerProfiles = []retailerProfile{
+	{Canonical: "Walmart", Aliases: []string{"Wal-Mart", "Walmart Supercenter", "Wal-Mart Supercenter", "WM Supercenter"},
+		Quirks: []descriptionQuirk{{Pattern: `^\d{6,}\s+`}, {Pattern: `\s+[NXT]$`}}},
+	{Canonical: "Target", Aliases: []string{"Target Store", "SuperTarget"}},
+	{Canonical: "Costco", Aliases: []string{"Costco Wholesale"}, Quirks: []descriptionQuirk{{Pattern: `^E?\d{4,}\s+`}}},
+	{Canonical: "Walgreens", Aliases: []string{"Walgreen Co"}},
+	{Canonical: "CVS", Aliases: []string{"CVS Pharmacy", "CVS/pharmacy"}},
+	{Canonical: "M&M Corner Market", Aliases: []string{"M and M Corner Market"}},
+}
+
+var (
+	storeNumberPattern = regexp.MustCompile(`(?i)\s*(#\s*\d+|\bstore\s+(no\.?\s*)?\d+|\bno\.\s*\d+)\s*$`)
+	nonAlnumPattern    = regexp.MustCompile(`[^a-z0-9]+`)
+
+	// retailerRecords holds one profile per retailer, keyed by the
+	// retailerKey of its canonical name; retailerProfiles indexes the same
+	// profiles by every name they match. Profiles are replaced, never
+	// modified, once installed.
+	retailerMu       sync.RWMutex
+	retailerRecords  = map[string]*retailerProfile{}
+	retailerProfiles = map[string]*retailerProfile{}
+	// baseRetailers are the built-in and file profiles, before the
+	// store's changes.
+	baseRetailers = map[string]*retailerProfile{}
+	// retailerScoring is a digest of every profile's scoring overrides and
+	// promotions and of the program time zone, "" when no profile has any
+	// and the zone is UTC.
+	retailerScoring string
+
+	retailerRefresh = envDuration("RETAILER_REFRESH", 30*time.Second)
+)
+
+// storedRetailer is a retailer change kept in the store; a nil Profile
+// records a deletion.
+type storedRetailer struct {
+	Profile *retailerProfile `json:"profile"`
+}
+
+// loadRetailerProfiles installs the built-in profiles and then those in
+// path, if given. File profiles replace built-in ones with the same
+// canonical name.
+func loadRetailerProfiles(path string) error {
+	profiles := append([]retailerProfile{}, defaultRetailerProfiles...)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var extra []retailerProfile
+		if err := json.Unmarshal(data, &extra); err != nil {
+			return fmt.Errorf("parse %s: %w", path, err)
+		}
+		profiles = append(profiles, extra...)
+	}
+
+	records := make(map[string]*retailerProfile)
+	for i := range profiles {
+		profile := &profiles[i]
+		if err := profile.validate(); err != nil {
+			return fmt.Errorf("retailer %q: %w", profile.Canonical, err)
+		}
+		records[retailerKey(profile.Canonical)] = profile
+	}
+
+	retailerMu.Lock()
+	baseRetailers = records
+	installRetailers(maps.Clone(records))
+	retailerMu.Unlock()
+	return nil
+}
+
+// loadStoredRetailers applies the retailer changes kept in the store over
+// the built-in and file profiles.
+func loadStoredRetailers(ctx context.Context) error {
+	changes, err := listRecordsJSON[storedRetailer](ctx, recordRetailers)
+	if err != nil {
+		return err
+	}
+	retailerMu.Lock()
+	defer retailerMu.Unlock()
+	records := maps.Clone(baseRetailers)
+	for key, change := range changes {
+		if change.Profile == nil {
+			delete(records, key)
+			continue
+		}
+		if err := change.Profile.validate(); err != nil {
+			return fmt.Errorf("stored retailer %q: %w", key, err)
+		}
+		records[key] = change.Profile
+	}
+	installRetailers(records)
+	return nil
+}
+
+func refreshRetailers(time.Time) {
+	if err := loadStoredRetailers(context.Background()); err != nil {
+		log.Printf("refreshing retailers: %v", err)
+	}
+}
+
+// installRetailers replaces the retailer records and rebuilds the name
+// index. Callers hold retailerMu.
+func installRetailers(records map[string]*retailerProfile) {
+	index := make(map[string]*retailerProfile)
+	for _, profile := range records {
+		for _, name := range append([]string{profile.Canonical}, profile.Aliases...) {
+			index[retailerKey(name)] = profile
+		}
+	}
+	retailerRecords = records
+	retailerProfiles = index
+	retailerScoring = scoringDigest(records, programZone)
+}
+
+// scoringDigest summarizes what of the profiles affects scoring, and the
+// program time zone the date and time rules read when it is not UTC.
+func scoringDigest(records map[string]*retailerProfile, zone *time.Location) string {
+	type scoring struct {
+		Scoring    map[string]float64  `json:"scoring,omitempty"`
+		Promotions []retailerPromotion `json:"promotions,omitempty"`
+	}
+	relevant := make(map[string]scoring)
+	for key, profile := range records {
+		if len(profile.Scoring) > 0 || len(profile.Promotions) > 0 {
+			relevant[key] = scoring{profile.Scoring, profile.Promotions}
+		}
+	}
+	var data []byte
+	switch {
+	case zone != time.UTC:
+		data, _ = json.Marshal(struct {
+			Retailers map[string]scoring `json:"retailers"`
+			Zone      string             `json:"zone"`
+		}{relevant, zone.String()})
+	case len(relevant) > 0:
+		data, _ = json.Marshal(relevant)
+	default:
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:4])
+}
+
+func retailerScoringDigest() string {
+	retailerMu.RLock()
+	defer retailerMu.RUnlock()
+	return retailerScoring
+}
+
+// validate normalizes the profile and compiles its description quirks.
+func (p *retailerProfile) validate() error {
+	p.Canonical = strings.TrimSpace(p.Canonical)
+	if retailerKey(p.Canonical) == "" {
+		return fmt.Errorf("canonical name is required")
+	}
+	p.Category = strings.ToLower(strings.TrimSpace(p.Category))
+	for _, alias := range p.Aliases {
+		if retailerKey(alias) == "" {
+			return fmt.Errorf("aliases must contain letters or digits")
+		}
+	}
+	for j := range p.Quirks {
+		re, err := regexp.Compile(p.Quirks[j].Pattern)
+		if err != nil {
+			return err
+		}
+		p.Quirks[j].re = re
+	}
+	for rule, factor := range p.Scoring {
+		if !knownRule(rule) {
+			return fmt.Errorf("unknown rule %q in scoring overrides", rule)
+		}
+		if factor < 0 {
+			return fmt.Errorf("scoring override for %s must not be negative", rule)
+		}
+	}
+	names := make(map[string]bool)
+	for _, promo := range p.Promotions {
+		if promo.Name == "" || names[promo.Name] {
+			return fmt.Errorf("promotion names must be unique and non-empty")
+		}
+		names[promo.Name] = true
+		if promo.Points <= 0 {
+			return fmt.Errorf("promotion %q must award a positive number of points", promo.Name)
+		}
+		for _, date := range []string{promo.Starts, promo.Ends} {
+			if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+				return fmt.Errorf("promotion %q dates must be YYYY-MM-DD", promo.Name)
+			}
+		}
+		if promo.Starts != "" && promo.Ends != "" && promo.Ends < promo.Starts {
+			return fmt.Errorf("promotion %q ends before it starts", promo.Name)
+		}
+	}
+	return nil
+}
+
+// activeOn reports whether the promotion covers a YYYY-MM-DD purchase date.
+func (p retailerPromotion) activeOn(date string) bool {
+	return (p.Starts == "" || date >= p.Starts) && (p.Ends == "" || date <= p.Ends)
+}
+
+// retailerKey reduces a retailer name to a comparison key: store numbers,
+// case, punctuation and spacing are dropped, so "WAL-MART #1234" and
+// "Walmart" both become "walmart". It is on the scoring path, so it only
+// runs the store number pattern on names ending in a digit and keeps
+// letters and digits by hand.
+func retailerKey(name string) string {
+	return string(appendRetailerKey(make([]byte, 0, len(name)), name))
+}
+
+func appendRetailerKey(key []byte, name string) []byte {
+	name = strings.TrimSpace(name)
+	if name != "" && '0' <= name[len(name)-1] && name[len(name)-1] <= '9' {
+		name = storeNumberPattern.ReplaceAllString(name, "")
+	}
+	for _, r := range name {
+		if r = unicode.ToLower(r); 'a' <= r && r <= 'z' || '0' <= r && r <= '9' {
+			key = append(key, byte(r))
+		}
+	}
+	return key
+}
+
+// lookupRetailer builds the key on the stack: the map lookup does not keep
+// it, so short names cost no allocation.
+func lookupRetailer(name string) *retailerProfile {
+	var buf [64]byte
+	key := appendRetailerKey(buf[:0], name)
+	retailerMu.RLock()
+	defer retailerMu.RUnlock()
+	return retailerProfiles[string(key)]
+}
+
+// normalizeRetailer returns the canonical retailer name: the profile's name
+// when one matches, otherwise the submitted name without its store number.
+func normalizeRetailer(name string) string {
+	if profile := lookupRetailer(name); profile != nil {
+		return profile.Canonical
+	}
+	return canonicalText(storeNumberPattern.ReplaceAllString(name, ""))
+}
+
+// normalizeDescription applies the retailer's description quirks and
+// collapses whitespace and case, for grouping items across receipts.
+func normalizeDescription(retailer, desc string) string {
+	desc = canonicalText(desc)
+	if profile := lookupRetailer(retailer); profile != nil {
+		for _, quirk := range profile.Quirks {
+			desc = quirk.re.ReplaceAllString(desc, quirk.Replace)
+		}
+	}
+	return strings.ToLower(canonicalText(desc))
+}
+
+// scoringOverride returns the retailer's factor for rule, if it has one. It
+// is safe to call on a nil profile.
+func (p *retailerProfile) scoringOverride(rule string) (float64, bool) {
+	if p == nil {
+		return 0, false
+	}
+	factor, ok := p.Scoring[rule]
+	return factor, ok
+}
+
+// retailerConflict returns the name of another retailer already matching one
+// of profile's names, or "".
+func retailerConflict(profile *retailerProfile) string {
+	own := retailerKey(profile.Canonical)
+	for _, name := range append([]string{profile.Canonical}, profile.Aliases...) {
+		if other, ok := retailerProfiles[retailerKey(name)]; ok && retailerKey(other.Canonical) != own {
+			return other.Canonical
+		}
+	}
+	return ""
+}
+
+func listRetailers(c *gin.Context) {
+	retailerMu.RLock()
+	profiles := make([]retailerProfile, 0, len(retailerRecords))
+	for _, profile := range retailerRecords {
+		profiles = append(profiles, *profile)
+	}
+	retailerMu.RUnlock()
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Canonical < profiles[j].Canonical })
+
+	c.JSON(http.StatusOK, gin.H{"retailers": profiles})
+}
+
+func getRetailer(c *gin.Context) {
+	retailerMu.RLock()
+	profile, ok := retailerRecords[retailerKey(c.Param("name"))]
+	retailerMu.RUnlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Retailer not found"})
+		return
+	}
+	c.JSON(http.StatusOK, profile)
+}
+
+func createRetailer(c *gin.Context) {
+	saveRetailer(c, "")
+}
+
+// updateRetailer replaces a retailer's record. The canonical name may
+// change; receipts already stored keep the name they were normalized to.
+func updateRetailer(c *gin.Context) {
+	saveRetailer(c, retailerKey(c.Param("name")))
+}
+
+// saveRetailer creates a retailer when replacing is empty and otherwise
+// replaces the record with that key.
+func saveRetailer(c *gin.Context, replacing string) {
+	var profile retailerProfile
+	if err := c.ShouldBindJSON(&profile); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+	if err := profile.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid retailer: " + err.Error()})
+		return
+	}
+	key := retailerKey(profile.Canonical)
+
+	retailerMu.RLock()
+	status, message := retailerChangeConflict(replacing, key, &profile)
+	retailerMu.RUnlock()
+	if status != 0 {
+		c.JSON(status, gin.H{"error": message})
+		return
+	}
+	err := store.Transact(c.Request.Context(), func(tx storeTx) error {
+		if replacing != "" && replacing != key {
+			if err := putStoredRetailer(tx, replacing, nil); err != nil {
+				return err
+			}
+		}
+		return putStoredRetailer(tx, key, &profile)
+	})
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	installRetailerChange(replacing, key, &profile)
+
+	if replacing == "" {
+		c.JSON(http.StatusCreated, profile)
+		return
+	}
+	c.JSON(http.StatusOK, profile)
+}
+
+// retailerChangeConflict checks that replacing, when set, exists and that
+// profile, saved under key, takes no other retailer's name. It returns the
+// status and message to answer with, or 0. Callers hold retailerMu.
+func retailerChangeConflict(replacing, key string, profile *retailerProfile) (int, string) {
+	if replacing != "" {
+		if _, ok := retailerRecords[replacing]; !ok {
+			return http.StatusNotFound, "Retailer not found"
+		}
+	}
+	if _, exists := retailerRecords[key]; exists && key != replacing {
+		return http.StatusConflict, "Retailer already exists"
+	}
+	if other := retailerConflict(profile); other != "" && retailerKey(other) != replacing {
+		return http.StatusConflict, "Name already belongs to retailer " + other
+	}
+	return 0, ""
+}
+
+// installRetailerChange applies a committed change to the installed
+// records: replacing is removed and profile, when not nil, is added under
+// key. The store is written with no retailer lock held, since scoring
+// inside store transactions takes retailerMu; if another change got in
+// between and the check no longer passes, the records are reloaded from
+// the store instead.
+func installRetailerChange(replacing, key string, profile *retailerProfile) {
+	retailerMu.Lock()
+	if profile != nil {
+		if status, _ := retailerChangeConflict(replacing, key, profile); status != 0 {
+			retailerMu.Unlock()
+			refreshRetailers(time.Time{})
+			return
+		}
+	}
+	records := make(map[string]*retailerProfile, len(retailerRecords)+1)
+	for k, v := range retailerRecords {
+		if k != replacing && k != key {
+			records[k] = v
+		}
+	}
+	if profile != nil {
+		records[key] = profile
+	}
+	installRetailers(records)
+	retailerMu.Unlock()
+}
+
+func deleteRetailer(c *gin.Context) {
+	key := retailerKey(c.Param("name"))
+	retailerMu.RLock()
+	_, ok := retailerRecords[key]
+	retailerMu.RUnlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Retailer not found"})
+		return
+	}
+	err := store.Transact(c.Request.Context(), func(tx storeTx) error { return putStoredRetailer(tx, key, nil) })
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	installRetailerChange("", key, nil)
+	c.Status(http.StatusNoContent)
+}
+
+func putStoredRetailer(tx storeTx, key string, profile *retailerProfile) error {
+	data, err := json.Marshal(storedRetailer{Profile: profile})
+	if err != nil {
+		return err
+	}
+	return tx.PutRecord(recordRetailers, key, data)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scoring inside a store transaction looks retailers up, so saving a
+// retailer must not hold retailerMu while it waits for the store.
+func TestSaveRetailerDuringStoreTransaction(t *testing.T) {
+	saved := store
+	defer func() { store = saved }()
+	store = newMemoryStore()
+	if err := loadRetailerProfiles(""); err != nil {
+		t.Fatal(err)
+	}
+	defer loadRetailerProfiles("")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.PUT("/admin/retailers/:name", updateRetailer)
+	saveDone := make(chan int)
+	txDone := make(chan error)
+	go func() {
+		txDone <- store.Transact(context.Background(), func(storeTx) error {
+			go func() {
+				w := httptest.NewRecorder()
+				body := `{"canonical": "Target", "aliases": ["Target Store"], "scoringOverrides": {"retailer_name": 2}}`
+				r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/admin/retailers/target", strings.NewReader(body)))
+				saveDone <- w.Code
+			}()
+			// Let the save reach the store, then score as an approval would.
+			time.Sleep(50 * time.Millisecond)
+			lookupRetailer("Target")
+			return nil
+		})
+	}()
+	select {
+	case err := <-txDone:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("retailer lookup inside a transaction deadlocked with a retailer save")
+	}
+	if code := <-saveDone; code != http.StatusOK {
+		t.Errorf("save answered %d", code)
+	}
+	if factor, _ := lookupRetailer("Target").scoringOverride("retailer_name"); factor != 2 {
+		t.Errorf("saved override not installed: %v", factor)
+	}
+}
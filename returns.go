@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+var (
+	errAlreadyReturned = errors.New("item already returned")
+	errBadReturnItem   = errors.New("no such item")
+)
+
+// returnItems serves POST /receipts/:id/return with {"items": [0, 2],
+// "reason": "..."}. Items are indexes into the receipt's items; an empty
+// list returns everything still kept. The kept items are re-scored under the
+// receipt's rules version and the drop from the points it was scored with,
+// less what earlier returns took back, is recorded as a negative ledger
+// entry. Other ledger entries, such as goodwill or redemptions, do not
+// change what a return takes back. A return never adds points, even when
+// the smaller receipt happens to score higher.
+func returnItems(c *gin.Context) {
+	var req struct {
+		Items  []int  `json:"items"`
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+			return
+		}
+	}
+
+	ctx := c.Request.Context()
+	var entry ledgerEntry
+	stored, err := applyTx(ctx, c.Param("id"), func(tx storeTx, s *storedReceipt) error {
+		if s.Status != receiptAccepted {
+			return errNotAccepted
+		}
+		items := req.Items
+		if len(items) == 0 {
+			for i := range s.Receipt.Items {
+				if !slices.Contains(s.ReturnedItems, i) {
+					items = append(items, i)
+				}
+			}
+		}
+		seen := make(map[int]bool)
+		for _, i := range items {
+			if i < 0 || i >= len(s.Receipt.Items) {
+				return errBadReturnItem
+			}
+			if seen[i] || slices.Contains(s.ReturnedItems, i) {
+				return errAlreadyReturned
+			}
+			seen[i] = true
+		}
+		if len(items) == 0 {
+			return errAlreadyReturned
+		}
+
+		carry, err := receiptCarry(ctx, s)
+		if err != nil {
+			return err
+		}
+		returned := append(append([]int{}, s.ReturnedItems...), items...)
+		kept, err := keptBreakdown(ctx, s, returned)
+		if err != nil {
+			return err
+		}
+		remaining := totalPoints(kept)
+		s.ReturnedItems = returned
+		slices.Sort(s.ReturnedItems)
+		entry = ledgerEntry{
+			ID:        uuid.New().String(),
+			Kind:      "return",
+			Points:    min(0, remaining-s.Points+clawedBack(s)),
+			Reason:    strings.TrimSpace(req.Reason),
+			CreatedAt: clock.Now().UTC(),
+		}
+		s.Ledger = append(s.Ledger, entry)
+		events := newEvents(s, eventReceiptReturned, entry.CreatedAt, receiptReturnedPayload{
+			ID:            s.ID,
+			Items:         items,
+			PointsClawed:  -entry.Points,
+			Points:        s.netPoints(),
+			FullyReturned: len(s.ReturnedItems) == len(s.Receipt.Items),
+			Metadata:      s.Receipt.Metadata,
+		})
+		tx.Emit(events...)
+		tx.Emit(pointsAdjustedEvents(s, entry)...)
+		return moveCarry(ctx, tx, s, carry)
+	})
+	switch {
+	case errors.Is(err, errNotAccepted):
+		c.JSON(http.StatusConflict, gin.H{"error": "Receipt has not been accepted"})
+	case errors.Is(err, errAlreadyReturned):
+		c.JSON(http.StatusConflict, gin.H{"error": "Items have already been returned"})
+	case errors.Is(err, errBadReturnItem):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Items must be indexes into the receipt's items"})
+	case err != nil:
+		if !requestExpired(c, err) {
+			storeFailure(c, err)
+		}
+	default:
+		c.JSON(http.StatusOK, gin.H{
+			"id":            stored.ID,
+			"points":        stored.netPoints(),
+			"returnedItems": stored.ReturnedItems,
+			"entry":         entry,
+		})
+	}
+}
+
+// clawedBack is how many points earlier returns took back.
+func clawedBack(s *storedReceipt) int {
+	clawed := 0
+	for _, entry := range s.Ledger {
+		if entry.Kind == "return" {
+			clawed -= entry.Points
+		}
+	}
+	return clawed
+}
+
+// keptBreakdown scores what is left of the receipt once the returned items
+// and their prices are taken off it. A fully returned receipt keeps nothing.
+func keptBreakdown(ctx context.Context, s *storedReceipt, returned []int) ([]ruleResult, error) {
+	if len(returned) == len(s.Receipt.Items) {
+		return nil, nil
+	}
+	total, err := parseCents(s.Receipt.Total)
+	if err != nil {
+		return nil, err
+	}
+	kept := s.Receipt
+	kept.Items = nil
+	for i, item := range s.Receipt.Items {
+		if !slices.Contains(returned, i) {
+			kept.Items = append(kept.Items, item)
+			continue
+		}
+		price, err := parseCents(item.Price)
+		if err != nil {
+			return nil, err
+		}
+		total -= price
+	}
+	kept.Total = formatCents(max(0, total))
+
+	rules := rulesetByVersion(s.RulesVersion)
+	if rules == nil {
+		rules = stableRuleset
+	}
+	return rules.score(ctx, kept)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// candidateRulesConfig is the RULES_CANDIDATE_FILE document describing a
+// rules version under rollout, e.g.
+//
+//	{"version": "v2-beta", "percent": 10,
+//	 "disabled": ["afternoon_purchase"], "scale": {"round_dollar_total": 1.5},
+//	 "rounding": {"item_description_length": {"mode": "half_up"}}}
+type candidateRulesConfig struct {
+	Version  string                    `json:"version"`
+	Percent  int                       `json:"percent"`
+	Disabled []string                  `json:"disabled"`
+	Scale    map[string]float64        `json:"scale"`
+	Rounding map[string]roundingPolicy `json:"rounding"`
+}
+
+var (
+	candidateRuleset *ruleset
+	candidatePercent int
+
+	receiptsScoredByVersion = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "receipt_rules_scored_total",
+		Help: "Receipts scored, by rules version.",
+	}, []string{"rules_version"})
+	pointsByVersion = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "receipt_rules_points",
+		Help:    "Points awarded per receipt, by rules version.",
+		Buckets: prometheus.ExponentialBuckets(5, 2, 8),
+	}, []string{"rules_version"})
+)
+
+// loadCandidateRules enables a blue/green rollout: the candidate ruleset
+// scores the given percentage of receipts and the stable one the rest.
+func loadCandidateRules(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var cfg candidateRulesConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	if cfg.Version == "" || cfg.Version == stableRuleset.version {
+		return fmt.Errorf("candidate version must be set and differ from %s", stableRuleset.version)
+	}
+	if cfg.Percent < 0 || cfg.Percent > 100 {
+		return fmt.Errorf("percent must be between 0 and 100")
+	}
+	rs := &ruleset{version: cfg.Version, disabled: make(map[string]bool), scale: cfg.Scale, rounding: cfg.Rounding}
+	for _, name := range cfg.Disabled {
+		if !knownRule(name) {
+			return fmt.Errorf("unknown rule %q", name)
+		}
+		rs.disabled[name] = true
+	}
+	for name, factor := range cfg.Scale {
+		if !knownRule(name) || factor < 0 {
+			return fmt.Errorf("scale for %q must name a rule and be non-negative", name)
+		}
+	}
+	if err := validateRounding(cfg.Rounding); err != nil {
+		return err
+	}
+	candidateRuleset, candidatePercent = rs, cfg.Percent
+	return nil
+}
+
+// rulesetForReceipt picks the ruleset for a receipt. The choice hashes the
+// receipt's identity, so resubmissions of the same receipt always land on
+// the same version.
+func rulesetForReceipt(hash string) *ruleset {
+	if candidateRuleset == nil || len(hash) < 4 {
+		return stableRuleset
+	}
+	b, err := hex.DecodeString(hash[:4])
+	if err != nil {
+		return stableRuleset
+	}
+	if (int(b[0])<<8|int(b[1]))%100 < candidatePercent {
+		return candidateRuleset
+	}
+	return stableRuleset
+}
+
+// rulesetByVersion finds the ruleset a receipt was scored with, or nil when
+// that version is no longer deployed.
+func rulesetByVersion(version string) *ruleset {
+	version = baseRulesVersion(version)
+	switch {
+	case version == stableRuleset.version:
+		return stableRuleset
+	case candidateRuleset != nil && version == candidateRuleset.version:
+		return candidateRuleset
+	}
+	return nil
+}
+
+func observeScoring(version string, points int) {
+	version = baseRulesVersion(version)
+	receiptsScoredByVersion.WithLabelValues(version).Inc()
+	pointsByVersion.WithLabelValues(version).Observe(float64(points))
+}
+
+// getRulesRollout serves GET /admin/rules/rollout.
+func getRulesRollout(c *gin.Context) {
+	resp := gin.H{"stable": stableRuleset.version}
+	if stableRuleset.rounding != nil {
+		resp["stableRounding"] = stableRuleset.rounding
+	}
+	if candidateRuleset != nil {
+		disabled := make([]string, 0, len(candidateRuleset.disabled))
+		for _, rule := range pointsRules {
+			if candidateRuleset.disabled[rule.name] {
+				disabled = append(disabled, rule.name)
+			}
+		}
+		resp["candidate"] = gin.H{
+			"version":  candidateRuleset.version,
+			"percent":  candidatePercent,
+			"disabled": disabled,
+			"scale":    candidateRuleset.scale,
+			"rounding": candidateRuleset.rounding,
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type retailerRollup struct {
+	Receipts   int
+	Items      int
+	SpendCents int64
+	Points     int64
+}
+
+// retailerDaily holds one rollup per canonical retailer per UTC day.
+var retailerDaily = make(map[int64]map[string]*retailerRollup)
+
+func recordRetailerRollup(daily map[int64]map[string]*retailerRollup, day int64, stored *storedReceipt) {
+	byRetailer, ok := daily[day]
+	if !ok {
+		byRetailer = make(map[string]*retailerRollup)
+		daily[day] = byRetailer
+	}
+	rollup, ok := byRetailer[stored.Retailer]
+	if !ok {
+		rollup = &retailerRollup{}
+		byRetailer[stored.Retailer] = rollup
+	}
+	rollup.Receipts++
+	rollup.Items += len(stored.Receipt.Items)
+	rollup.Points += int64(stored.Points)
+	if cents, err := parseCents(stored.Receipt.Total); err == nil {
+		rollup.SpendCents += cents
+	}
+}
+
+// getRetailerAnalytics serves GET /analytics/retailers, summing the daily
+// rollups between from and to (default: the last 30 days).
+func getRetailerAnalytics(c *gin.Context) {
+	from, to, err := timeRange(c, 30*24*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid time range: use RFC 3339 timestamps or YYYY-MM-DD dates with from before to"})
+		return
+	}
+	from = startOfDay(from)
+	if to.Sub(from)/(24*time.Hour) > maxSeriesBuckets {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Requested range has too many buckets"})
+		return
+	}
+
+	stats := retailerStatsBetween(from, to)
+	privacy := privacyFor(c)
+	if privacy != nil {
+		released := stats[:0]
+		for _, stat := range stats {
+			figure := "retailers/" + stat.Retailer
+			n, ok := privacy.count(figure, stat.Receipts)
+			if !ok {
+				continue
+			}
+			spend := privacy.spend(figure, stat.spendCents)
+			stat.Receipts, stat.TotalPoints = n, privacy.points(figure, stat.TotalPoints)
+			stat.TotalSpend, stat.AverageSpend, stat.spendCents = formatCents(spend), formatCents(spend/int64(n)), spend
+			stat.AverageBasketSize = float64(privacy.items(figure, stat.items)) / float64(n)
+			released = append(released, stat)
+		}
+		stats = released
+		sortRetailerStats(stats)
+	}
+	resp := gin.H{"from": from, "to": to, "retailers": stats}
+	privacy.describe(resp)
+	c.JSON(http.StatusOK, resp)
+}
+
+type retailerStats struct {
+	Retailer          string  `json:"retailer"`
+	Receipts          int     `json:"receipts"`
+	TotalSpend        string  `json:"totalSpend"`
+	TotalPoints       int64   `json:"totalPoints"`
+	AverageBasketSize float64 `json:"averageBasketSize"`
+	AverageSpend      string  `json:"averageSpend"`
+
+	spendCents int64
+	items      int
+}
+
+// retailerStatsBetween sums the daily rollups for days starting in
+// [from, to), busiest retailer first.
+func retailerStatsBetween(from, to time.Time) []retailerStats {
+	analyticsMu.RLock()
+	defer analyticsMu.RUnlock()
+	return retailerStatsIn(retailerDaily, from, to)
+}
+
+func retailerStatsIn(daily map[int64]map[string]*retailerRollup, from, to time.Time) []retailerStats {
+	totals := make(map[string]*retailerRollup)
+	for day := startOfDay(from); day.Before(to); day = day.AddDate(0, 0, 1) {
+		for retailer, rollup := range daily[day.Unix()] {
+			sum, ok := totals[retailer]
+			if !ok {
+				sum = &retailerRollup{}
+				totals[retailer] = sum
+			}
+			sum.Receipts += rollup.Receipts
+			sum.Items += rollup.Items
+			sum.SpendCents += rollup.SpendCents
+			sum.Points += rollup.Points
+		}
+	}
+
+	stats := make([]retailerStats, 0, len(totals))
+	for retailer, sum := range totals {
+		stats = append(stats, retailerStats{
+			Retailer:          retailer,
+			Receipts:          sum.Receipts,
+			TotalSpend:        formatCents(sum.SpendCents),
+			TotalPoints:       sum.Points,
+			AverageBasketSize: float64(sum.Items) / float64(sum.Receipts),
+			AverageSpend:      formatCents(sum.SpendCents / int64(sum.Receipts)),
+			spendCents:        sum.SpendCents,
+			items:             sum.Items,
+		})
+	}
+	sortRetailerStats(stats)
+	return stats
+}
+
+// sortRetailerStats puts the busiest retailer first.
+func sortRetailerStats(stats []retailerStats) {
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Receipts != stats[j].Receipts {
+			return stats[i].Receipts > stats[j].Receipts
+		}
+		return stats[i].Retailer < stats[j].Retailer
+	})
+}
+
+// parseCents converts a decimal money string such as "35.35" to cents.
+func parseCents(amount string) (int64, error) {
+	amount = canonicalAmount(amount)
+	whole, frac, ok := strings.Cut(amount, ".")
+	if !ok || len(frac) != 2 {
+		return 0, fmt.Errorf("invalid amount %q", amount)
+	}
+	w, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	f, err := strconv.ParseInt(frac, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if strings.HasPrefix(whole, "-") {
+		return w*100 - f, nil
+	}
+	return w*100 + f, nil
+}
+
+func formatCents(cents int64) string {
+	sign := ""
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+)
+
+// roundingPolicy says how a rule turns fractional points into whole ones:
+// "ceil", "floor", "half_up" (halves round away from zero) or "accrue",
+// which awards the whole part and keeps the fraction for the customer's
+// later receipts; see fractions.go. Multiplier is
+// the rate of rules that award a share of an amount, such as 0.2 of an item
+// price; it is zero for rules that award fixed points.
+type roundingPolicy struct {
+	Mode       string  `json:"mode,omitempty"`
+	Multiplier float64 `json:"multiplier,omitempty"`
+}
+
+const (
+	roundCeil   = "ceil"
+	roundFloor  = "floor"
+	roundHalfUp = "half_up"
+	roundAccrue = "accrue"
+)
+
+// defaultRounding is used when a rule's fixed points are scaled.
+var defaultRounding = roundingPolicy{Mode: roundHalfUp}
+
+func (p roundingPolicy) round(x float64) int {
+	switch p.Mode {
+	case roundCeil:
+		return int(math.Ceil(x))
+	case roundFloor, roundAccrue:
+		return int(math.Floor(x))
+	default:
+		return int(math.Round(x))
+	}
+}
+
+// split rounds x, returning the fraction the accrue mode keeps back, to
+// the nearest micropoint; other modes keep nothing.
+func (p roundingPolicy) split(x float64) (int, float64) {
+	whole := p.round(x)
+	if p.Mode != roundAccrue {
+		return whole, 0
+	}
+	fraction := math.Round((x-float64(whole))*microPoints) / microPoints
+	if fraction >= 1 {
+		return whole + 1, 0
+	}
+	return whole, fraction
+}
+
+// policyFor returns the rule's rounding in this ruleset: its default with
+// any configured mode or multiplier on top.
+func (rs *ruleset) policyFor(rule pointsRule) roundingPolicy {
+	policy := rule.rounding
+	if override, ok := rs.rounding[rule.name]; ok {
+		if override.Mode != "" {
+			policy.Mode = override.Mode
+		}
+		if override.Multiplier != 0 {
+			policy.Multiplier = override.Multiplier
+		}
+	}
+	return policy
+}
+
+func validateRounding(rounding map[string]roundingPolicy) error {
+	for name, policy := range rounding {
+		var rule *pointsRule
+		for i := range pointsRules {
+			if pointsRules[i].name == name {
+				rule = &pointsRules[i]
+			}
+		}
+		if rule == nil {
+			return fmt.Errorf("rounding for unknown rule %q", name)
+		}
+		switch policy.Mode {
+		case "", roundCeil, roundFloor, roundHalfUp, roundAccrue:
+		default:
+			return fmt.Errorf("rounding for %q: mode must be ceil, floor, half_up or accrue", name)
+		}
+		if policy.Multiplier < 0 || policy.Multiplier > 0 && rule.rounding.Multiplier == 0 {
+			return fmt.Errorf("rounding for %q: multiplier must be positive and the rule must have one", name)
+		}
+	}
+	return nil
+}
+
+// loadRoundingPolicies changes the stable ruleset's rounding from the
+// RULES_ROUNDING_FILE document, e.g.
+//
+//	{"version": "v1-floor",
+//	 "rules": {"item_description_length": {"mode": "floor", "multiplier": 0.25}}}
+//
+// The version replaces the stable rules version, since receipts scored
+// under the new rounding must be told apart from those scored before.
+func loadRoundingPolicies(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var cfg struct {
+		Version string                    `json:"version"`
+		Rules   map[string]roundingPolicy `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	if cfg.Version == "" || cfg.Version == rulesVersion {
+		return fmt.Errorf("version must be set and differ from %s", rulesVersion)
+	}
+	if err := validateRounding(cfg.Rules); err != nil {
+		return err
+	}
+	stableRuleset.version, stableRuleset.rounding = cfg.Version, cfg.Rules
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// routeTemplate is a registered route split into path segments; segments
+// starting with ':' or '*' are parameters.
+type routeTemplate struct {
+	method   string
+	segments []string
+	static   int
+}
+
+// tolerantRouter resolves requests whose path differs from a registered
+// route only by a trailing slash or by the case of its fixed segments, such
+// as POST /Receipts/process/. The path is rewritten before routing instead
+// of redirected, because many POS clients do not replay a POST body on a
+// redirect. Parameter segments such as receipt IDs keep their case.
+type tolerantRouter struct {
+	engine    *gin.Engine
+	templates []routeTemplate
+}
+
+// newTolerantRouter must be called after every route is registered.
+func newTolerantRouter(engine *gin.Engine) *tolerantRouter {
+	engine.RedirectTrailingSlash = false
+	t := &tolerantRouter{engine: engine}
+	for _, route := range engine.Routes() {
+		tmpl := routeTemplate{method: route.Method, segments: strings.Split(strings.Trim(route.Path, "/"), "/")}
+		for _, seg := range tmpl.segments {
+			if !isParamSegment(seg) {
+				tmpl.static++
+			}
+		}
+		t.templates = append(t.templates, tmpl)
+	}
+	// Prefer the most specific route when several templates fit.
+	sort.SliceStable(t.templates, func(i, j int) bool { return t.templates[i].static > t.templates[j].static })
+	return t
+}
+
+func isParamSegment(seg string) bool {
+	return strings.HasPrefix(seg, ":") || strings.HasPrefix(seg, "*")
+}
+
+func (t *tolerantRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := req.URL.Path
+	if len(path) > 1 && (strings.HasSuffix(path, "/") || strings.ToLower(path) != path) {
+		if fixed, ok := t.resolve(req.Method, path); ok {
+			req.URL.Path = fixed
+			req.URL.RawPath = ""
+		}
+	}
+	t.engine.ServeHTTP(w, req)
+}
+
+// resolve returns the canonical spelling of path for method, if any route
+// matches it tolerantly.
+func (t *tolerantRouter) resolve(method, path string) (string, bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, tmpl := range t.templates {
+		if tmpl.method != method || len(tmpl.segments) != len(segments) {
+			continue
+		}
+		fixed := make([]string, len(segments))
+		matched := true
+		for i, seg := range tmpl.segments {
+			switch {
+			case isParamSegment(seg):
+				fixed[i] = segments[i]
+			case strings.EqualFold(seg, segments[i]):
+				fixed[i] = seg
+			default:
+				matched = false
+			}
+			if !matched {
+				break
+			}
+		}
+		if matched {
+			return "/" + strings.Join(fixed, "/"), true
+		}
+	}
+	return "", false
+}
+
+// configureGinMode runs Gin in release mode unless GIN_MODE asks otherwise.
+func configureGinMode() {
+	if os.Getenv(gin.EnvGinMode) == "" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+}
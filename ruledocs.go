@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ruleDoc describes a rule as it currently scores, for clients rendering
+// how points are earned. Points are per unit; a rule with a multiplier
+// instead awards that share of an amount, rounded per its rounding mode.
+// Scale, when present, multiplies everything the rule awards.
+type ruleDoc struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Points      int             `json:"points,omitempty"`
+	Unit        string          `json:"unit"`
+	Params      map[string]any  `json:"params,omitempty"`
+	Scale       float64         `json:"scale,omitempty"`
+	Rounding    *roundingPolicy `json:"rounding,omitempty"`
+}
+
+type promotionDoc struct {
+	Name   string `json:"name"`
+	Points int    `json:"points"`
+	Starts string `json:"starts,omitempty"`
+	Ends   string `json:"ends,omitempty"`
+}
+
+// getRules serves GET /rules: the stable ruleset's enabled rules with their
+// points and parameters, or those of a deployed ?version=. With
+// ?retailer=, that retailer's scoring overrides are applied and its
+// promotions running today are listed.
+func getRules(c *gin.Context) {
+	rs := stableRuleset
+	if version := c.Query("version"); version != "" {
+		if rs = rulesetByVersion(version); rs == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Rules version is not deployed"})
+			return
+		}
+	}
+	var profile *retailerProfile
+	if name := c.Query("retailer"); name != "" {
+		profile = lookupRetailer(name)
+	}
+
+	docs := make([]ruleDoc, 0, len(pointsRules))
+	for _, rule := range pointsRules {
+		if rs.disabled[rule.name] {
+			continue
+		}
+		doc := ruleDoc{Name: rule.name, Description: rule.description, Points: rule.points, Unit: rule.unit, Params: rule.params}
+		factor, scaled := rs.scale[rule.name]
+		if !scaled {
+			factor = 1
+		}
+		if override, ok := profile.scoringOverride(rule.name); ok {
+			factor, scaled = factor*override, true
+		}
+		policy := rs.policyFor(rule)
+		if scaled {
+			doc.Scale = factor
+		}
+		if scaled || policy.Multiplier != 0 {
+			doc.Rounding = &policy
+		}
+		docs = append(docs, doc)
+	}
+	resp := gin.H{"version": rs.version, "rules": docs}
+	if profile != nil {
+		today := clock.Now().In(programZone).Format(time.DateOnly)
+		promotions := make([]promotionDoc, 0, len(profile.Promotions))
+		for _, promo := range profile.Promotions {
+			if promo.activeOn(today) {
+				promotions = append(promotions, promotionDoc(promo))
+			}
+		}
+		resp["retailer"] = profile.Canonical
+		resp["promotions"] = promotions
+	}
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ruleResult is the contribution of one rule to a receipt's points. Rules
+// that apply per item report one result per item, with Item set to the
+// item's index.
+type ruleResult struct {
+	Rule   string `json:"rule"`
+	Item   *int   `json:"item,omitempty"`
+	Points int    `json:"points"`
+	// Fraction is what the accrue rounding mode kept back from Points, to
+	// be awarded once it adds up; see fractions.go.
+	Fraction float64 `json:"fraction,omitempty"`
+}
+
+type pointsRule struct {
+	name        string
+	description string
+	// points is what the rule awards per unit (a receipt, a character, a
+	// pair of items), or 0 when the award is a share of an amount. params
+	// are the rule's other thresholds; both are published by GET /rules.
+	points int
+	unit   string
+	params map[string]any
+	// apply appends the rule's results to dst.
+	apply func(dst []ruleResult, rule *pointsRule, receipt Receipt, policy roundingPolicy) []ruleResult
+	// rounding is the rule's default policy; rulesets may override it.
+	rounding roundingPolicy
+}
+
+// rulesVersion identifies the scoring rules below. It is recorded on every
+// stored receipt and must change whenever a rule's behaviour changes.
+const rulesVersion = "v1"
+
+// Thresholds the rules test, shared with the parameters GET /rules
+// publishes.
+const (
+	totalOverThreshold      = 10.00
+	descriptionLengthFactor = 3
+	afternoonFromHour       = 14
+	afternoonToHour         = 16
+)
+
+var pointsRules = []pointsRule{
+	{"retailer_name", "One point for every alphanumeric character in the retailer name.", 1, "character", nil, func(dst []ruleResult, rule *pointsRule, receipt Receipt, _ roundingPolicy) []ruleResult {
+		return rule.award(dst, countAlphanumeric(receipt.Retailer))
+	}, defaultRounding},
+	{"round_dollar_total", "50 points if the total is a round dollar amount with no cents.", 50, "receipt", nil, func(dst []ruleResult, rule *pointsRule, receipt Receipt, _ roundingPolicy) []ruleResult {
+		if total, err := strconv.ParseFloat(receipt.Total, 64); err == nil && total == math.Floor(total) {
+			return rule.award(dst, 1)
+		}
+		return dst
+	}, defaultRounding},
+	{"quarter_multiple_total", "25 points if the total is a multiple of 0.25.", 25, "receipt", map[string]any{"multipleOf": 0.25}, func(dst []ruleResult, rule *pointsRule, receipt Receipt, _ roundingPolicy) []ruleResult {
+		if total, err := strconv.ParseFloat(receipt.Total, 64); err == nil && math.Mod(total, 0.25) == 0 {
+			return rule.award(dst, 1)
+		}
+		return dst
+	}, defaultRounding},
+	{"total_over_ten", "5 points if the total is greater than 10.00.", 5, "receipt", map[string]any{"greaterThan": totalOverThreshold}, func(dst []ruleResult, rule *pointsRule, receipt Receipt, _ roundingPolicy) []ruleResult {
+		if total, err := strconv.ParseFloat(receipt.Total, 64); err == nil && total > totalOverThreshold {
+			return rule.award(dst, 1)
+		}
+		return dst
+	}, defaultRounding},
+	{"item_pairs", "5 points for every two items on the receipt.", 5, "pair of items", nil, func(dst []ruleResult, rule *pointsRule, receipt Receipt, _ roundingPolicy) []ruleResult {
+		return rule.award(dst, len(receipt.Items)/2)
+	}, defaultRounding},
+	{"item_description_length", "If the trimmed length of an item description is a multiple of 3, the item price multiplied by 0.2 and rounded up.", 0, "item", map[string]any{"lengthMultipleOf": descriptionLengthFactor}, func(dst []ruleResult, rule *pointsRule, receipt Receipt, policy roundingPolicy) []ruleResult {
+		for i, item := range receipt.Items {
+			desc := strings.TrimSpace(item.ShortDescription)
+			if len(desc)%descriptionLengthFactor != 0 {
+				continue
+			}
+			if price, err := strconv.ParseFloat(item.Price, 64); err == nil {
+				if points, fraction := policy.split(price * policy.Multiplier); points != 0 || fraction != 0 {
+					dst = append(dst, ruleResult{Rule: rule.name, Item: itemIndex(i), Points: points, Fraction: fraction})
+				}
+			}
+		}
+		return dst
+	}, roundingPolicy{Mode: roundCeil, Multiplier: 0.2}},
+	{"odd_purchase_day", "6 points if the day in the purchase date is odd.", 6, "receipt", map[string]any{"timeZone": programZone.String()}, func(dst []ruleResult, rule *pointsRule, receipt Receipt, _ roundingPolicy) []ruleResult {
+		if at, ok := programPurchaseTime(receipt); ok && at.Day()%2 != 0 {
+			return rule.award(dst, 1)
+		}
+		return dst
+	}, defaultRounding},
+	{"afternoon_purchase", "10 points if the time of purchase is after 2:00pm and before 4:00pm.", 10, "receipt", map[string]any{"fromHour": afternoonFromHour, "beforeHour": afternoonToHour, "timeZone": programZone.String()}, func(dst []ruleResult, rule *pointsRule, receipt Receipt, _ roundingPolicy) []ruleResult {
+		if t, ok := programPurchaseTime(receipt); ok {
+			if t.Hour() >= afternoonFromHour && t.Hour() < afternoonToHour {
+				return rule.award(dst, 1)
+			}
+		}
+		return dst
+	}, defaultRounding},
+}
+
+func knownRule(name string) bool {
+	for _, rule := range pointsRules {
+		if rule.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// award appends the rule's points for units of what it counts.
+func (r *pointsRule) award(dst []ruleResult, units int) []ruleResult {
+	if units == 0 || r.points == 0 {
+		return dst
+	}
+	return append(dst, ruleResult{Rule: r.name, Points: units * r.points})
+}
+
+// countAlphanumeric counts ASCII letters and digits.
+func countAlphanumeric(s string) int {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+			n++
+		}
+	}
+	return n
+}
+
+// ruleset is a version of the scoring rules: pointsRules with some rules
+// switched off, their points scaled or their rounding changed. The stable
+// ruleset uses every rule as written unless RULES_ROUNDING_FILE is set.
+type ruleset struct {
+	version  string
+	disabled map[string]bool
+	scale    map[string]float64
+	rounding map[string]roundingPolicy
+}
+
+var stableRuleset = &ruleset{version: rulesVersion}
+
+// scoredVersion is the version recorded on receipts rs scores. Points also
+// depend on retailer scoring overrides and promotions and on the program
+// time zone, so while any are set or the zone is not UTC a digest of them
+// is appended, as in "v1+3fa2c901": changing them changes the recorded
+// version as changing the rules does.
+func (rs *ruleset) scoredVersion() string {
+	if digest := retailerScoringDigest(); digest != "" {
+		return rs.version + "+" + digest
+	}
+	return rs.version
+}
+
+// baseRulesVersion strips the scoring digest from a recorded version.
+func baseRulesVersion(version string) string {
+	base, _, _ := strings.Cut(version, "+")
+	return base
+}
+
+// Most receipts carry one to three items, so those take a fast path: their
+// scratch results come from a pool and their per-item results point into a
+// shared index table, leaving the returned slice as the only allocation.
+// Larger receipts allocate their scratch space, so the pool never keeps
+// oversized buffers alive.
+const smallReceiptItems = 3
+
+var (
+	smallScratch = sync.Pool{New: func() any {
+		s := make([]ruleResult, 0, len(pointsRules)+smallReceiptItems)
+		return &s
+	}}
+	// Results never write through Item, so they can share these.
+	smallItemIndexes = [smallReceiptItems]int{0, 1, 2}
+)
+
+func itemIndex(i int) *int {
+	if i < len(smallItemIndexes) {
+		return &smallItemIndexes[i]
+	}
+	return &i
+}
+
+// score evaluates the ruleset and returns the results of rules that
+// awarded points, in rule order, followed by the retailer's promotions for
+// the purchase date. The retailer's scoring overrides apply on top of the
+// ruleset's own scaling. It stops early once ctx is done.
+func (rs *ruleset) score(ctx context.Context, receipt Receipt) ([]ruleResult, error) {
+	if len(receipt.Items) > smallReceiptItems {
+		results, err := rs.scoreInto(ctx, make([]ruleResult, 0, len(pointsRules)+len(receipt.Items)), receipt)
+		if len(results) == 0 {
+			return nil, err
+		}
+		return results, err
+	}
+	scratch := smallScratch.Get().(*[]ruleResult)
+	results, err := rs.scoreInto(ctx, (*scratch)[:0], receipt)
+	var out []ruleResult
+	if err == nil && len(results) > 0 {
+		out = slices.Clone(results)
+	}
+	*scratch = results[:0]
+	smallScratch.Put(scratch)
+	return out, err
+}
+
+func (rs *ruleset) scoreInto(ctx context.Context, results []ruleResult, receipt Receipt) ([]ruleResult, error) {
+	profile := lookupRetailer(receipt.Retailer)
+	for i := range pointsRules {
+		rule := &pointsRules[i]
+		if err := ctx.Err(); err != nil {
+			return results[:0], err
+		}
+		if rs.disabled[rule.name] {
+			continue
+		}
+		factor, scaled := rs.scale[rule.name]
+		if !scaled {
+			factor = 1
+		}
+		if override, ok := profile.scoringOverride(rule.name); ok {
+			factor, scaled = factor*override, true
+		}
+		policy := rs.policyFor(*rule)
+		start := len(results)
+		results = rule.apply(results, rule, receipt, policy)
+		kept := results[:start]
+		for _, result := range results[start:] {
+			if scaled {
+				result.Points, result.Fraction = policy.split((float64(result.Points) + result.Fraction) * factor)
+			}
+			if result.Points != 0 || result.Fraction != 0 {
+				kept = append(kept, result)
+			}
+		}
+		results = kept
+	}
+	if profile != nil {
+		for _, promo := range profile.Promotions {
+			if promo.activeOn(receipt.PurchaseDate) {
+				results = append(results, ruleResult{Rule: "promotion:" + promo.Name, Points: promo.Points})
+			}
+		}
+	}
+	return results, nil
+}
+
+// scoreReceipt scores with the stable ruleset.
+func scoreReceipt(ctx context.Context, receipt Receipt) ([]ruleResult, error) {
+	return stableRuleset.score(ctx, receipt)
+}
+
+func totalPoints(results []ruleResult) int {
+	points := 0
+	for _, result := range results {
+		points += result.Points
+	}
+	return points
+}
+
+// calculatePoints is a receipt's points under the stable ruleset, or ctx's
+// error once it is done.
+func calculatePoints(ctx context.Context, receipt Receipt) (int, error) {
+	results, err := scoreReceipt(ctx, receipt)
+	return totalPoints(results), err
+}
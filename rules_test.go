@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+var (
+	smallBenchReceipt = Receipt{
+		Retailer:     "Target",
+		PurchaseDate: "2022-01-01",
+		PurchaseTime: "13:01",
+		Items:        []Item{{ShortDescription: "Mountain Dew 12PK", Price: "6.49"}},
+		Total:        "6.49",
+	}
+	largeBenchReceipt = Receipt{
+		Retailer:     "Target",
+		PurchaseDate: "2022-01-01",
+		PurchaseTime: "13:01",
+		Items: []Item{
+			{ShortDescription: "Mountain Dew 12PK", Price: "6.49"},
+			{ShortDescription: "Emils Cheese Pizza", Price: "12.25"},
+			{ShortDescription: "Knorr Creamy Chicken", Price: "1.26"},
+			{ShortDescription: "Doritos Nacho Cheese", Price: "3.35"},
+			{ShortDescription: "   Klarbrunn 12-PK 12 FL OZ  ", Price: "12.00"},
+		},
+		Total: "35.35",
+	}
+)
+
+// Small receipts take the pooled fast path, so the returned results should
+// be their only allocation.
+func TestScoreSmallReceiptAllocations(t *testing.T) {
+	ctx := context.Background()
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := scoreReceipt(ctx, smallBenchReceipt); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > 1 {
+		t.Errorf("scoring a one-item receipt allocated %.1f times, want at most 1", allocs)
+	}
+}
+
+func TestScoreFastPathMatchesSlowPath(t *testing.T) {
+	ctx := context.Background()
+	for _, receipt := range []Receipt{smallBenchReceipt, largeBenchReceipt} {
+		fast, err := scoreReceipt(ctx, receipt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slow, err := stableRuleset.scoreInto(ctx, nil, receipt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if totalPoints(fast) != totalPoints(slow) || len(fast) != len(slow) {
+			t.Errorf("%d items: fast path gave %v, slow path %v", len(receipt.Items), fast, slow)
+		}
+	}
+}
+
+func BenchmarkScoreSmallReceipt(b *testing.B) {
+	ctx := context.Background()
+	b.ReportAllocs()
+	for range b.N {
+		scoreReceipt(ctx, smallBenchReceipt)
+	}
+}
+
+// BenchmarkScoreSmallReceiptUnpooled scores the same receipt the way
+// larger ones are, for comparison with BenchmarkScoreSmallReceipt.
+func BenchmarkScoreSmallReceiptUnpooled(b *testing.B) {
+	ctx := context.Background()
+	b.ReportAllocs()
+	for range b.N {
+		stableRuleset.scoreInto(ctx, make([]ruleResult, 0, len(pointsRules)+len(smallBenchReceipt.Items)), smallBenchReceipt)
+	}
+}
+
+func BenchmarkScoreLargeReceipt(b *testing.B) {
+	ctx := context.Background()
+	b.ReportAllocs()
+	for range b.N {
+		scoreReceipt(ctx, largeBenchReceipt)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// s3Client is a minimal S3 (or S3-compatible) client signing requests with
+// AWS Signature Version 4. Objects are addressed path-style.
+type s3Client struct {
+	awsCredentials
+	endpoint string
+	region   string
+	http     *http.Client
+}
+
+// awsCredentials sign requests to AWS services.
+type awsCredentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+func awsCredentialsFromEnv() awsCredentials {
+	return awsCredentials{
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+var errS3NotConfigured = errors.New("S3 credentials are not configured")
+
+// s3FromEnv reads AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN,
+// AWS_REGION (default us-east-1) and S3_ENDPOINT (default the AWS regional
+// endpoint).
+func s3FromEnv() (*s3Client, error) {
+	client := &s3Client{
+		awsCredentials: awsCredentialsFromEnv(),
+		endpoint:       os.Getenv("S3_ENDPOINT"),
+		region:         os.Getenv("AWS_REGION"),
+		http:           &http.Client{Timeout: time.Minute},
+	}
+	if client.accessKey == "" || client.secretKey == "" {
+		return nil, errS3NotConfigured
+	}
+	if client.region == "" {
+		client.region = "us-east-1"
+	}
+	if client.endpoint == "" {
+		client.endpoint = "https://s3." + client.region + ".amazonaws.com"
+	}
+	client.endpoint = strings.TrimSuffix(client.endpoint, "/")
+	return client, nil
+}
+
+func (c *s3Client) PutObject(ctx context.Context, bucket, key, contentType string, body []byte) error {
+	req, err := c.newRequest(ctx, http.MethodPut, bucket, key, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return breakerFor("s3").Do(func() error {
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			return fmt.Errorf("s3 put %s/%s: %s: %s", bucket, key, resp.Status, bytes.TrimSpace(msg))
+		}
+		return nil
+	})
+}
+
+func (c *s3Client) GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, bucket, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	var body io.ReadCloser
+	err = breakerFor("s3").Do(func() error {
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode/100 != 2 {
+			defer resp.Body.Close()
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			return fmt.Errorf("s3 get %s/%s: %s: %s", bucket, key, resp.Status, bytes.TrimSpace(msg))
+		}
+		body = resp.Body
+		return nil
+	})
+	return body, err
+}
+
+func (c *s3Client) newRequest(ctx context.Context, method, bucket, key string, body []byte) (*http.Request, error) {
+	path := "/" + bucket + "/" + strings.TrimPrefix(key, "/")
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+s3EscapePath(path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	c.sign(req, body, time.Now().UTC(), c.region, "s3")
+	return req, nil
+}
+
+// sign adds a Signature Version 4 Authorization header for service in
+// region.
+func (c awsCredentials) sign(req *http.Request, body []byte, now time.Time, region, service string) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+		signed = append(signed, "x-amz-security-token")
+	}
+	if req.Header.Get("X-Amz-Target") != "" {
+		signed = append(signed, "x-amz-target")
+	}
+
+	var headers strings.Builder
+	for _, name := range signed {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(signed, ";")
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+// s3EscapePath percent-encodes everything but unreserved characters and
+// slashes, as SigV4 canonical URIs require.
+func s3EscapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		ch := path[i]
+		if ch == '/' || ch == '-' || ch == '_' || ch == '.' || ch == '~' ||
+			('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') || ('0' <= ch && ch <= '9') {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", ch)
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
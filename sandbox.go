@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sandboxMode (SANDBOX_MODE=true) is for integration environments. It
+// replaces the clock with one integrators can move, so they can exercise
+// time-window bonuses, point holds and submission deadlines without waiting.
+// The clock is shared by every tenant on the instance.
+var sandboxMode = os.Getenv("SANDBOX_MODE") == "true"
+
+// sandboxClock keeps running at wall-clock speed from the time it was last
+// set to, so receipts submitted after setting it still get distinct,
+// ordered timestamps.
+type sandboxClock struct {
+	mu     sync.Mutex
+	offset time.Duration
+}
+
+func (c *sandboxClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().Add(c.offset)
+}
+
+func (c *sandboxClock) Set(now time.Time) {
+	c.mu.Lock()
+	c.offset = time.Until(now)
+	c.mu.Unlock()
+}
+
+func (c *sandboxClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.offset += d
+	c.mu.Unlock()
+}
+
+func (c *sandboxClock) Reset() {
+	c.mu.Lock()
+	c.offset = 0
+	c.mu.Unlock()
+}
+
+func (c *sandboxClock) state() gin.H {
+	c.mu.Lock()
+	offset := c.offset
+	c.mu.Unlock()
+	return gin.H{"now": time.Now().Add(offset).UTC(), "offset": offset.Round(time.Second).String()}
+}
+
+var virtualClock = &sandboxClock{}
+
+// registerSandbox installs the sandbox clock and its routes when sandbox
+// mode is on.
+func registerSandbox(r *gin.Engine) {
+	if !sandboxMode {
+		return
+	}
+	clock = virtualClock
+	r.GET("/sandbox/clock", getSandboxClock)
+	r.POST("/sandbox/clock", setSandboxClock)
+	r.DELETE("/sandbox/clock", resetSandboxClock)
+}
+
+func getSandboxClock(c *gin.Context) {
+	c.JSON(http.StatusOK, virtualClock.state())
+}
+
+// setSandboxClock serves POST /sandbox/clock with either {"now": RFC 3339
+// time} or {"advance": duration such as "36h"}.
+func setSandboxClock(c *gin.Context) {
+	var req struct {
+		Now     *time.Time `json:"now"`
+		Advance string     `json:"advance"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+	switch {
+	case req.Now != nil && req.Advance == "":
+		virtualClock.Set(*req.Now)
+	case req.Now == nil && req.Advance != "":
+		d, err := time.ParseDuration(req.Advance)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Advance must be a duration such as 36h"})
+			return
+		}
+		virtualClock.Advance(d)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Give exactly one of now and advance"})
+		return
+	}
+	c.JSON(http.StatusOK, virtualClock.state())
+}
+
+func resetSandboxClock(c *gin.Context) {
+	virtualClock.Reset()
+	c.JSON(http.StatusOK, virtualClock.state())
+}
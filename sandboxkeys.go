@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Partners building an integration get sandbox API keys, issued with
+// POST /admin/sandbox/keys {"partner": "acme"}. A request whose X-API-Key
+// is a sandbox key acts for the partner's sandbox tenant, "sbx-acme",
+// whatever its X-Tenant-ID says, so its synthetic receipts are stored apart
+// from every real tenant's; real requests cannot name an sbx- tenant.
+// Duplicate detection does not cross between a sandbox tenant and any
+// other, and sandbox receipts are left out of analytics, the warehouse and
+// exports, and out of usage reports unless asked for by tenant. Sandbox tenants run
+// under SANDBOX_MAX_IN_FLIGHT rather than TENANT_MAX_IN_FLIGHT (twice it by
+// default), and every night a job deletes their receipts from before the
+// day began, in the program's time zone.
+//
+// Keys are signed with SANDBOX_KEY_SECRET rather than stored, so every
+// replica accepts them and rotating the secret revokes them all. Without a
+// secret no keys are issued, and requests presenting one are refused. This
+// is unrelated to SANDBOX_MODE's virtual clock.
+
+const (
+	sandboxKeyPrefix    = "sbx_"
+	sandboxTenantPrefix = "sbx-"
+	sandboxTenantKey    = "sandboxTenant"
+)
+
+var (
+	sandboxKeySecret   = os.Getenv("SANDBOX_KEY_SECRET")
+	sandboxMaxInFlight = envInt("SANDBOX_MAX_IN_FLIGHT", 2*tenantMaxInFlight)
+
+	sandboxPartnerPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,39}$`)
+)
+
+func isSandboxTenant(tenant string) bool {
+	return strings.HasPrefix(tenant, sandboxTenantPrefix)
+}
+
+func sandboxKeyMAC(partner string) string {
+	mac := hmac.New(sha256.New, []byte(sandboxKeySecret))
+	mac.Write([]byte("sandbox-key:" + partner))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func sandboxKey(partner string) string {
+	return sandboxKeyPrefix + partner + "_" + sandboxKeyMAC(partner)
+}
+
+// sandboxKeyPartner returns the partner a sandbox key was issued to, if it
+// is valid.
+func sandboxKeyPartner(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, sandboxKeyPrefix)
+	if !ok || sandboxKeySecret == "" {
+		return "", false
+	}
+	i := strings.LastIndexByte(rest, '_')
+	if i < 0 || !sandboxPartnerPattern.MatchString(rest[:i]) {
+		return "", false
+	}
+	if !hmac.Equal([]byte(rest[i+1:]), []byte(sandboxKeyMAC(rest[:i]))) {
+		return "", false
+	}
+	return rest[:i], true
+}
+
+// authenticateSandbox is middleware binding a request with a sandbox key
+// to its partner's sandbox tenant, and refusing one whose key is invalid
+// rather than letting its data into a real tenant.
+func authenticateSandbox(c *gin.Context) {
+	key := strings.TrimSpace(c.GetHeader("X-API-Key"))
+	if !strings.HasPrefix(key, sandboxKeyPrefix) {
+		c.Next()
+		return
+	}
+	partner, ok := sandboxKeyPartner(key)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid sandbox API key"})
+		return
+	}
+	c.Set(sandboxTenantKey, sandboxTenantPrefix+partner)
+	c.Next()
+}
+
+// issueSandboxKey serves POST /admin/sandbox/keys.
+func issueSandboxKey(c *gin.Context) {
+	if sandboxKeySecret == "" {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Sandbox keys need SANDBOX_KEY_SECRET"})
+		return
+	}
+	var req struct {
+		Partner string `json:"partner"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || !sandboxPartnerPattern.MatchString(req.Partner) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Partner must be 1-40 lowercase letters, digits or hyphens"})
+		return
+	}
+	log.Printf("sandbox: issued a key to partner %s", req.Partner)
+	c.JSON(http.StatusCreated, gin.H{
+		"partner": req.Partner,
+		"tenant":  sandboxTenantPrefix + req.Partner,
+		"apiKey":  sandboxKey(req.Partner),
+	})
+}
+
+// purgeSandboxReceipts deletes sandbox tenants' receipts created before
+// today, then rebuilds the fraction carry without them.
+func purgeSandboxReceipts(now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	today := startOfDay(now.In(programZone))
+	deleted, err := deleteReceipts(ctx, "sandbox_purge", func(s *storedReceipt) bool {
+		return isSandboxTenant(s.Tenant) && s.CreatedAt.Before(today)
+	})
+	if err != nil {
+		log.Printf("sandbox: purging receipts: %v", err)
+		return
+	}
+	if len(deleted) == 0 {
+		return
+	}
+	log.Printf("sandbox: purged %d receipts created before %s", len(deleted), today.Format(time.DateOnly))
+}
+
+// duplicateKey is the key a receipt is indexed by to find duplicates.
+// Sandbox receipts are only duplicates of their own tenant's.
+func (s *storedReceipt) duplicateKey() string {
+	if isSandboxTenant(s.Tenant) {
+		return s.Tenant + ":" + s.Hash
+	}
+	return s.Hash
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// backgroundJob is periodic work such as report delivery. Jobs are
+// registered before the scheduler starts and each runs on its own ticker.
+// Cluster jobs act on shared state and only run on the elected leader, so
+// anything they read or remember between runs must live in the store: a
+// new leader has none of the old one's memory. The others maintain
+// per-replica state and run everywhere.
+type backgroundJob struct {
+	name     string
+	interval time.Duration
+	run      func(now time.Time)
+	cluster  bool
+}
+
+var backgroundJobs []backgroundJob
+
+func registerJob(name string, interval time.Duration, run func(now time.Time)) {
+	backgroundJobs = append(backgroundJobs, backgroundJob{name: name, interval: interval, run: run})
+}
+
+// registerClusterJob registers a job that must run exactly once across
+// replicas, such as report delivery.
+func registerClusterJob(name string, interval time.Duration, run func(now time.Time)) {
+	backgroundJobs = append(backgroundJobs, backgroundJob{name: name, interval: interval, run: run, cluster: true})
+}
+
+func runScheduler(ctx context.Context) {
+	go leader.run(ctx)
+	for _, job := range backgroundJobs {
+		go runJob(ctx, job)
+	}
+}
+
+func runJob(ctx context.Context, job backgroundJob) {
+	ticker := time.NewTicker(job.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			runJobOnce(job, clock.Now())
+		}
+	}
+}
+
+func runJobOnce(job backgroundJob, now time.Time) {
+	if job.cluster && !leader.IsLeader() {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("job %s panicked: %v", job.name, r)
+		}
+	}()
+	job.run(now)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// currentSchemaVersion is the receipt shape the scoring code works with.
+// Payloads without a schemaVersion are treated as version 1, the original
+// retailer/date/time/items/total shape.
+//
+//	1 -> 2: adds receipt currency (default "USD") and item quantity (default 1)
+//	2 -> 3: adds item category (default "uncategorized")
+const currentSchemaVersion = 3
+
+var receiptMigrations = map[int]func(doc map[string]any) error{
+	1: migrateReceiptV1ToV2,
+	2: migrateReceiptV2ToV3,
+}
+
+var (
+	errInvalidReceiptJSON  = errors.New("invalid receipt JSON")
+	errUnsupportedSchema   = errors.New("unsupported schema version")
+	errInvalidReceiptShape = errors.New("invalid receipt shape")
+)
+
+// decodeReceipt reads a receipt payload of any supported schema version and
+// upgrades it to the current one.
+func decodeReceipt(r io.Reader) (Receipt, error) {
+	var receipt Receipt
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var doc map[string]any
+	if err := dec.Decode(&doc); err != nil || doc == nil {
+		return receipt, errInvalidReceiptJSON
+	}
+	if err := upgradeReceipt(doc); err != nil {
+		return receipt, err
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return receipt, errInvalidReceiptJSON
+	}
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&receipt); err != nil {
+		return receipt, errInvalidReceiptJSON
+	}
+	return receipt, nil
+}
+
+func upgradeReceipt(doc map[string]any) error {
+	version, err := schemaVersionOf(doc)
+	if err != nil {
+		return err
+	}
+	for version < currentSchemaVersion {
+		migrate, ok := receiptMigrations[version]
+		if !ok {
+			return fmt.Errorf("%w: no migration from version %d", errUnsupportedSchema, version)
+		}
+		if err := migrate(doc); err != nil {
+			return err
+		}
+		version++
+	}
+	doc["schemaVersion"] = currentSchemaVersion
+	return nil
+}
+
+func schemaVersionOf(doc map[string]any) (int, error) {
+	raw, ok := doc["schemaVersion"]
+	if !ok || raw == nil {
+		return 1, nil
+	}
+	num, ok := raw.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("%w: schemaVersion must be a number", errUnsupportedSchema)
+	}
+	value, err := num.Float64()
+	if err != nil || value != math.Trunc(value) || value < 1 || value > currentSchemaVersion {
+		return 0, fmt.Errorf("%w: %s", errUnsupportedSchema, num)
+	}
+	return int(value), nil
+}
+
+func migrateReceiptV1ToV2(doc map[string]any) error {
+	if _, ok := doc["currency"]; !ok {
+		doc["currency"] = "USD"
+	}
+	return eachItem(doc, func(item map[string]any) {
+		if _, ok := item["quantity"]; !ok {
+			item["quantity"] = 1
+		}
+	})
+}
+
+func migrateReceiptV2ToV3(doc map[string]any) error {
+	return eachItem(doc, func(item map[string]any) {
+		if _, ok := item["category"]; !ok {
+			item["category"] = "uncategorized"
+		}
+	})
+}
+
+func eachItem(doc map[string]any, fn func(item map[string]any)) error {
+	raw, ok := doc["items"]
+	if !ok || raw == nil {
+		return nil
+	}
+	items, ok := raw.([]any)
+	if !ok {
+		return fmt.Errorf("%w: items must be an array", errInvalidReceiptShape)
+	}
+	for _, entry := range items {
+		item, ok := entry.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%w: each item must be an object", errInvalidReceiptShape)
+		}
+		fn(item)
+	}
+	return nil
+}
+
+// jsonAmount accepts a money value written either as a JSON string or as a
+// JSON number. Numbers are converted to the canonical decimal string, so
+// "total": 9 and "total": "9.00" decode to the same receipt.
+type jsonAmount string
+
+func (a *jsonAmount) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*a = jsonAmount(s)
+		return nil
+	}
+	if !decimalPattern.Match(data) {
+		return fmt.Errorf("amount %s is not a plain decimal", data)
+	}
+	*a = jsonAmount(canonicalAmount(string(data)))
+	return nil
+}
+
+func (r *Receipt) UnmarshalJSON(data []byte) error {
+	type plain Receipt
+	aux := struct {
+		*plain
+		Total jsonAmount `json:"total"`
+	}{plain: (*plain)(r)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	r.Total = string(aux.Total)
+	return nil
+}
+
+func (item *Item) UnmarshalJSON(data []byte) error {
+	type plain Item
+	aux := struct {
+		*plain
+		Price jsonAmount `json:"price"`
+	}{plain: (*plain)(item)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	item.Price = string(aux.Price)
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDecodeReceiptMigrations(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		currency string
+		quantity int
+		category string
+	}{
+		{
+			name:     "version 1 without schemaVersion",
+			payload:  `{"retailer":"Target","total":"6.49","items":[{"shortDescription":"Dew","price":"6.49"}]}`,
+			currency: "USD", quantity: 1, category: "uncategorized",
+		},
+		{
+			name:     "explicit version 1",
+			payload:  `{"schemaVersion":1,"retailer":"Target","total":"6.49","items":[{"shortDescription":"Dew","price":"6.49"}]}`,
+			currency: "USD", quantity: 1, category: "uncategorized",
+		},
+		{
+			name:     "version 1 keeps fields it already has",
+			payload:  `{"retailer":"Target","total":"6.49","currency":"EUR","items":[{"shortDescription":"Dew","price":"6.49","quantity":3}]}`,
+			currency: "EUR", quantity: 3, category: "uncategorized",
+		},
+		{
+			name:     "version 2",
+			payload:  `{"schemaVersion":2,"retailer":"Target","total":"6.49","currency":"CAD","items":[{"shortDescription":"Dew","price":"6.49","quantity":2}]}`,
+			currency: "CAD", quantity: 2, category: "uncategorized",
+		},
+		{
+			name:     "version 2 keeps a category it already has",
+			payload:  `{"schemaVersion":2,"retailer":"Target","total":"6.49","currency":"CAD","items":[{"shortDescription":"Dew","price":"6.49","quantity":2,"category":"drinks"}]}`,
+			currency: "CAD", quantity: 2, category: "drinks",
+		},
+		{
+			name:     "current version is left alone",
+			payload:  `{"schemaVersion":3,"retailer":"Target","total":"6.49","currency":"USD","items":[{"shortDescription":"Dew","price":"6.49","quantity":4,"category":"drinks"}]}`,
+			currency: "USD", quantity: 4, category: "drinks",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt, err := decodeReceipt(strings.NewReader(tt.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if receipt.SchemaVersion != currentSchemaVersion {
+				t.Errorf("schemaVersion = %d, want %d", receipt.SchemaVersion, currentSchemaVersion)
+			}
+			if receipt.Currency != tt.currency {
+				t.Errorf("currency = %q, want %q", receipt.Currency, tt.currency)
+			}
+			if len(receipt.Items) != 1 {
+				t.Fatalf("decoded %d items", len(receipt.Items))
+			}
+			item := receipt.Items[0]
+			if item.Quantity != tt.quantity || item.Category != tt.category {
+				t.Errorf("item = %+v, want quantity %d and category %q", item, tt.quantity, tt.category)
+			}
+			if receipt.Retailer != "Target" || receipt.Total != "6.49" || item.Price != "6.49" {
+				t.Errorf("original fields changed: %+v", receipt)
+			}
+		})
+	}
+}
+
+func TestDecodeReceiptRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    error
+	}{
+		{"not JSON", `{"retailer":`, errInvalidReceiptJSON},
+		{"not an object", `null`, errInvalidReceiptJSON},
+		{"version 0", `{"schemaVersion":0}`, errUnsupportedSchema},
+		{"future version", `{"schemaVersion":4}`, errUnsupportedSchema},
+		{"fractional version", `{"schemaVersion":1.5}`, errUnsupportedSchema},
+		{"string version", `{"schemaVersion":"2"}`, errUnsupportedSchema},
+		{"items not an array", `{"items":{}}`, errInvalidReceiptShape},
+		{"item not an object", `{"items":["Dew"]}`, errInvalidReceiptShape},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeReceipt(strings.NewReader(tt.payload)); !errors.Is(err, tt.want) {
+				t.Errorf("decodeReceipt returned %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeReceiptNumericAmounts(t *testing.T) {
+	receipt, err := decodeReceipt(strings.NewReader(`{"total":9,"items":[{"shortDescription":"Dew","price":6.5}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Total != "9.00" || receipt.Items[0].Price != "6.50" {
+		t.Errorf("total %q and price %q, want 9.00 and 6.50", receipt.Total, receipt.Items[0].Price)
+	}
+}
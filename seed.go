@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+// Starting with --seed-demo, or with SEED_DEMO=true, stores a curated set of
+// example receipts, the two from the API specification among them, so demos
+// and local frontend development have data from the first request.
+// SEED_DEMO_FILE replaces the built-in set with a JSON array of receipts,
+// and SEED_DEMO_TENANT picks the tenant they go to. Seeded receipts are
+// scored and stored like any submission, but as imports, so the submission
+// deadline does not apply to their old purchase dates. Each gets an ID
+// derived from its position, so restarting on a persistent store does not
+// seed them twice.
+
+//go:embed demo/receipts.json
+var demoReceipts []byte
+
+var (
+	seedDemo       = os.Getenv("SEED_DEMO") == "true" || slices.Contains(os.Args[1:], "--seed-demo")
+	seedDemoTenant = envString("SEED_DEMO_TENANT", defaultTenant)
+
+	seedNamespace = uuid.MustParse("2b7e6c0d-93f4-4a1e-b8d2-5c6a0f9e3d17")
+)
+
+const seedSource = "demo"
+
+func seedDemoReceipts(ctx context.Context) error {
+	data := demoReceipts
+	if path := os.Getenv("SEED_DEMO_FILE"); path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return err
+		}
+	}
+	var docs []json.RawMessage
+	if err := json.Unmarshal(data, &docs); err != nil {
+		return fmt.Errorf("parse demo receipts: %w", err)
+	}
+	seeded := 0
+	for n, doc := range docs {
+		receipt, err := decodeReceipt(bytes.NewReader(doc))
+		if err != nil {
+			return fmt.Errorf("demo receipt %d: %w", n, err)
+		}
+		id := receiptID(seedDemoTenant, uuid.NewSHA1(seedNamespace, []byte(fmt.Sprintf("%s#%d", seedDemoTenant, n))))
+		if _, err := store.Get(ctx, id); err == nil {
+			continue
+		} else if !errors.Is(err, errReceiptNotFound) {
+			return err
+		}
+		_, err = submitReceipt(ctx, submission{id: id, tenant: seedDemoTenant, receipt: receipt, backfill: seedSource, channel: channelBatch})
+		if err != nil {
+			return fmt.Errorf("demo receipt %d: %w", n, err)
+		}
+		seeded++
+	}
+	log.Printf("seeded %d demo receipts into tenant %s (%d already present)", seeded, seedDemoTenant, len(docs)-seeded)
+	return nil
+}
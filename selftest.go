@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The scoring corpus is a set of receipts with the points each is expected
+// to earn, the two from the API specification among them, kept in
+// selftest/corpus.json; SELFTEST_CORPUS_FILE replaces it for deployments
+// whose rules differ from the defaults. POST /admin/selftest scores every
+// receipt with the running rules, stored nowhere, and reports each one
+// whose points differ from the expected value, so a deploy can be checked
+// against a live instance. ?ruleset=candidate scores with the rollout
+// candidate instead of the stable rules. GET /admin/selftest/corpus lists
+// the corpus. The selftest subcommand scores the corpus without starting
+// the server, for CI, exiting 1 when any receipt diverges.
+//
+// After an intended scoring change, the expected points are updated in the
+// same change as the rules.
+
+//go:embed selftest/corpus.json
+var builtinCorpus []byte
+
+type corpusCase struct {
+	Name    string  `json:"name"`
+	Receipt Receipt `json:"receipt"`
+	Points  int     `json:"points"`
+}
+
+var scoringCorpus []corpusCase
+
+func loadScoringCorpus(path string) error {
+	data := builtinCorpus
+	if path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return err
+		}
+	}
+	var raw []struct {
+		Name    string          `json:"name"`
+		Receipt json.RawMessage `json:"receipt"`
+		Points  int             `json:"points"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("parse corpus: %w", err)
+	}
+	corpus := make([]corpusCase, 0, len(raw))
+	for i, r := range raw {
+		if r.Name == "" {
+			return fmt.Errorf("corpus case %d: name is required", i)
+		}
+		receipt, err := decodeReceipt(bytes.NewReader(r.Receipt))
+		if err != nil {
+			return fmt.Errorf("corpus case %q: %w", r.Name, err)
+		}
+		corpus = append(corpus, corpusCase{Name: r.Name, Receipt: receipt, Points: r.Points})
+	}
+	scoringCorpus = corpus
+	return nil
+}
+
+type selftestFailure struct {
+	Name      string       `json:"name"`
+	Expected  int          `json:"expected"`
+	Actual    *int         `json:"actual,omitempty"`
+	Error     string       `json:"error,omitempty"`
+	Errors    []fieldError `json:"errors,omitempty"`
+	Breakdown []ruleResult `json:"breakdown,omitempty"`
+}
+
+// scoreCase scores one corpus receipt the way submitReceipt does, returning
+// a failure when it does not earn the expected points.
+func scoreCase(ctx context.Context, rules *ruleset, cc corpusCase) (*selftestFailure, error) {
+	receipt := cc.Receipt
+	if _, err := correctTotal(ctx, &receipt); err != nil {
+		return nil, err
+	}
+	failure := &selftestFailure{Name: cc.Name, Expected: cc.Points}
+	if errs := validateReceipt(receipt); errs != nil {
+		failure.Error, failure.Errors = "Receipt failed validation", errs
+		return failure, nil
+	}
+	breakdown, err := rules.score(ctx, receipt)
+	if err != nil {
+		return nil, err
+	}
+	points := totalPoints(breakdown)
+	if points == cc.Points {
+		return nil, nil
+	}
+	failure.Actual, failure.Breakdown = &points, breakdown
+	return failure, nil
+}
+
+// scoreCorpus scores the whole corpus, returning the failing cases.
+func scoreCorpus(ctx context.Context, rules *ruleset) ([]selftestFailure, error) {
+	failures := []selftestFailure{}
+	for _, cc := range scoringCorpus {
+		failure, err := scoreCase(ctx, rules, cc)
+		if err != nil {
+			return nil, err
+		}
+		if failure != nil {
+			failures = append(failures, *failure)
+		}
+	}
+	return failures, nil
+}
+
+// selftestRuleset returns the ruleset named stable or candidate, or the
+// status and message of the error when there is none.
+func selftestRuleset(name string) (*ruleset, int, string) {
+	switch name {
+	case "", "stable":
+		return stableRuleset, 0, ""
+	case "candidate":
+		if candidateRuleset == nil {
+			return nil, http.StatusNotFound, "No candidate ruleset is deployed"
+		}
+		return candidateRuleset, 0, ""
+	}
+	return nil, http.StatusBadRequest, "Ruleset must be stable or candidate"
+}
+
+func selftestReport(rules *ruleset, failures []selftestFailure, took time.Duration) gin.H {
+	return gin.H{
+		"rulesVersion": rules.version,
+		"cases":        len(scoringCorpus),
+		"passed":       len(scoringCorpus) - len(failures),
+		"ok":           len(failures) == 0,
+		"failures":     failures,
+		"durationMs":   took.Milliseconds(),
+	}
+}
+
+func runSelftest(c *gin.Context) {
+	rules, status, msg := selftestRuleset(c.Query("ruleset"))
+	if rules == nil {
+		c.JSON(status, gin.H{"error": msg})
+		return
+	}
+	start := time.Now()
+	failures, err := scoreCorpus(c.Request.Context(), rules)
+	if err != nil {
+		if !requestExpired(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Scoring failed: " + err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, selftestReport(rules, failures, time.Since(start)))
+}
+
+// runSelftestCommand implements the selftest subcommand, printing the same
+// report as POST /admin/selftest.
+func runSelftestCommand(args []string) int {
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	name := fs.String("ruleset", "stable", "stable or candidate")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	rules, _, msg := selftestRuleset(*name)
+	if rules == nil {
+		log.Printf("selftest: %s", msg)
+		return 2
+	}
+	start := time.Now()
+	failures, err := scoreCorpus(context.Background(), rules)
+	if err != nil {
+		log.Printf("selftest: %v", err)
+		return 1
+	}
+	out, _ := json.MarshalIndent(selftestReport(rules, failures, time.Since(start)), "", "  ")
+	fmt.Println(string(out))
+	if len(failures) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func getScoringCorpus(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"cases": scoringCorpus})
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// TestScoringCorpus runs the golden corpus in CI, so a scoring change that
+// moves any receipt's points fails here until the corpus is updated with it.
+func TestScoringCorpus(t *testing.T) {
+	saved := scoringCorpus
+	defer func() { scoringCorpus = saved }()
+	if err := loadScoringCorpus("selftest/corpus.json"); err != nil {
+		t.Fatal(err)
+	}
+	if len(scoringCorpus) == 0 {
+		t.Fatal("the corpus is empty")
+	}
+	failures, err := scoreCorpus(context.Background(), stableRuleset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range failures {
+		if f.Actual == nil {
+			t.Errorf("%s: %s %v", f.Name, f.Error, f.Errors)
+			continue
+		}
+		t.Errorf("%s: scored %d, want %d (%v)", f.Name, *f.Actual, f.Expected, f.Breakdown)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Points earned by an accepted receipt are pending until its hold window
+// has passed or an admin settles it, and available after that. The window
+// (POINTS_HOLD_WINDOW, default 0: available at once) is fixed on each
+// receipt when it is accepted, so changing it does not move existing
+// receipts.
+//
+// Points expiry is a separate business rule, off unless POINTS_EXPIRE_AFTER
+// is set (e.g. "8760h" for a year). With it set, points accepted from then
+// on expire that long after they were accepted: they stop counting towards
+// pending, available and total balances and are reported as expired
+// instead, and, with CUSTOMER_EMAILS, customers are warned beforehand.
+// Receipts accepted while it was unset never expire, and unsetting it does
+// not lift the expiry from receipts already given one. The setting is
+// reported as pointsExpireAfter by GET /capabilities.
+
+const (
+	pointsPending   = "pending"
+	pointsAvailable = "available"
+	pointsExpired   = "expired"
+
+	rescoreKind = "rescore"
+)
+
+var (
+	pointsHoldWindow  = envDuration("POINTS_HOLD_WINDOW", 0)
+	pointsExpireAfter = envDuration("POINTS_EXPIRE_AFTER", 0)
+
+	errNotAccepted = errors.New("receipt has not been accepted")
+)
+
+// ledgerEntry is a points adjustment recorded against a receipt after it
+// was scored. Entries share the receipt's pending or available state. A
+// rescore entry records a change to the score itself: its points are
+// already in the receipt's Points, and it is kept so past balances can be
+// worked out.
+type ledgerEntry struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Points    int       `json:"points"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// pointsAdjustedEvents emits points.adjusted, or points.redeemed for a
+// redemption, for a new ledger entry that changes the receipt's points.
+func pointsAdjustedEvents(s *storedReceipt, entry ledgerEntry) []outboxEvent {
+	if entry.Points == 0 {
+		return nil
+	}
+	typ := eventPointsAdjusted
+	if entry.Kind == redemptionKind {
+		typ = eventPointsRedeemed
+	}
+	return newEvents(s, typ, entry.CreatedAt, pointsChangedPayload{
+		ReceiptID: s.ID,
+		Entry:     entry,
+		Points:    s.netPoints(),
+		Metadata:  s.Receipt.Metadata,
+	})
+}
+
+// netPoints is the receipt's score plus its ledger entries, rescores
+// aside.
+func (s *storedReceipt) netPoints() int {
+	points := s.Points
+	for _, entry := range s.Ledger {
+		if entry.Kind != rescoreKind {
+			points += entry.Points
+		}
+	}
+	return points
+}
+
+// startHold sets when an accepted receipt's points settle on their own,
+// and when they expire.
+func startHold(s *storedReceipt) {
+	s.SettlesAt = s.AcceptedAt.Add(pointsHoldWindow)
+	if pointsExpireAfter > 0 {
+		s.ExpiresAt = s.AcceptedAt.Add(pointsExpireAfter)
+	}
+}
+
+// availableAt is when the receipt's points became, or will become,
+// available.
+func (s *storedReceipt) availableAt() time.Time {
+	if !s.SettledAt.IsZero() && s.SettledAt.Before(s.SettlesAt) {
+		return s.SettledAt
+	}
+	return s.SettlesAt
+}
+
+func (s *storedReceipt) pointsState(now time.Time) string {
+	if !s.ExpiresAt.IsZero() && !now.Before(s.ExpiresAt) {
+		return pointsExpired
+	}
+	if now.Before(s.availableAt()) {
+		return pointsPending
+	}
+	return pointsAvailable
+}
+
+// settleReceipt serves POST /admin/receipts/:id/settle, making a receipt's
+// pending points available immediately. Settling available points is a
+// no-op.
+func settleReceipt(c *gin.Context) {
+	now := clock.Now()
+	stored, err := store.Update(c.Request.Context(), c.Param("id"), func(s *storedReceipt) {
+		if s.Status == receiptAccepted && s.pointsState(now) == pointsPending {
+			s.SettledAt = now
+		}
+	})
+	if err == nil && stored.Status != receiptAccepted {
+		err = errNotAccepted
+	}
+	if errors.Is(err, errNotAccepted) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Receipt has not been accepted", "status": stored.Status})
+		return
+	}
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": stored.ID, "points": stored.netPoints(), "state": stored.pointsState(now), "availableAt": stored.availableAt().UTC()})
+}
+
+// pointsAt is netPoints as of t: the score as it stood then, the current
+// one less the rescores since, plus the other entries recorded by then.
+func (s *storedReceipt) pointsAt(t time.Time) int {
+	points := s.Points
+	for _, entry := range s.Ledger {
+		switch {
+		case entry.Kind == rescoreKind:
+			if entry.CreatedAt.After(t) {
+				points -= entry.Points
+			}
+		case !entry.CreatedAt.After(t):
+			points += entry.Points
+		}
+	}
+	return points
+}
+
+// getBalance serves GET /customers/:id/balance: the customer's accepted
+// points in the request's tenant, split into pending and available, with
+// expired points counted apart. With ?asOf the balance is worked out from
+// the ledger as it stood then, for reconciling a past period; a date means
+// the end of that day, UTC, or now for today. Purged receipts are no longer
+// counted; a rescored receipt counts the score it had then.
+func getBalance(c *gin.Context) {
+	now := clock.Now()
+	asOf := now
+	if raw := c.Query("asOf"); raw != "" {
+		t, err := parseTimeParam(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "asOf must be an RFC 3339 timestamp or a YYYY-MM-DD date"})
+			return
+		}
+		if t.After(now) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "asOf must not be in the future"})
+			return
+		}
+		if _, dateErr := time.Parse("2006-01-02", raw); dateErr == nil {
+			t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		if t.Before(now) {
+			asOf = t
+		}
+	}
+	tenant, customer := tenantID(c), c.Param("id")
+	receipts, err := store.List(c.Request.Context(), func(s *storedReceipt) bool {
+		return s.Tenant == tenant && s.Receipt.CustomerID == customer && s.Status == receiptAccepted && !s.AcceptedAt.After(asOf)
+	})
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	var pending, available, expired int
+	var nextAvailable, nextExpiring *time.Time
+	for _, s := range receipts {
+		switch s.pointsState(asOf) {
+		case pointsExpired:
+			expired += s.pointsAt(asOf)
+			continue
+		case pointsAvailable:
+			available += s.pointsAt(asOf)
+			if at := s.ExpiresAt.UTC(); !s.ExpiresAt.IsZero() && (nextExpiring == nil || at.Before(*nextExpiring)) {
+				nextExpiring = &at
+			}
+			continue
+		}
+		pending += s.pointsAt(asOf)
+		if at := s.availableAt().UTC(); nextAvailable == nil || at.Before(*nextAvailable) {
+			nextAvailable = &at
+		}
+	}
+	resp := gin.H{
+		"customerId":      customer,
+		"pending":         pending,
+		"available":       available,
+		"total":           pending + available,
+		"receipts":        len(receipts),
+		"nextAvailableAt": nextAvailable,
+	}
+	if pointsExpireAfter > 0 || expired != 0 {
+		resp["expired"] = expired
+		resp["nextExpiringAt"] = nextExpiring
+	}
+	if c.Query("asOf") != "" {
+		resp["asOf"] = asOf.UTC()
+	}
+	displayPoints(resp, tenant, "pending", "available", "total", "expired")
+	c.JSON(http.StatusOK, resp)
+}
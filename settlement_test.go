@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPointsAtUndoesLaterRescores(t *testing.T) {
+	accepted := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	s := &storedReceipt{
+		Points:     40,
+		AcceptedAt: accepted,
+		Ledger: []ledgerEntry{
+			{Kind: "goodwill", Points: 5, CreatedAt: accepted.Add(24 * time.Hour)},
+			// Repaired from 30 to 40 two days in.
+			{Kind: rescoreKind, Points: 10, CreatedAt: accepted.Add(48 * time.Hour)},
+		},
+	}
+	tests := []struct {
+		at   time.Time
+		want int
+	}{
+		{accepted, 30},
+		{accepted.Add(36 * time.Hour), 35},
+		{accepted.Add(72 * time.Hour), 45},
+	}
+	for _, tt := range tests {
+		if got := s.pointsAt(tt.at); got != tt.want {
+			t.Errorf("points at %s = %d, want %d", tt.at, got, tt.want)
+		}
+	}
+	if got := s.netPoints(); got != 45 {
+		t.Errorf("net points = %d, want 45: the rescore is already in Points", got)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /admin/receipts/:id/similar lists the stored receipts most like the
+// given one, in any tenant and for any customer, so support can spot one
+// purchase submitted several times in slightly different forms, which the
+// exact-hash duplicate check misses. Each candidate is scored from 0 to 1
+// on four signals, combined as a weighted average:
+//
+//   - retailer: 1 for the same normalized retailer, otherwise the overlap
+//     of the words in the two names
+//   - date: 1 for the same purchase date, falling to 0 beyond
+//     dateWindowDays apart
+//   - total: 1 for the same total, falling to 0 as the totals differ by
+//     totalTolerance of the larger
+//   - items: the overlap of the item descriptions, counting repeats
+//
+// SIMILARITY_FILE sets the weights, the windows and the default minimum
+// score, as {"weights": {"retailer": 1, "date": 1, "total": 1, "items": 1},
+// "dateWindowDays": 3, "totalTolerance": 0.1, "minScore": 0.7}, which are
+// the defaults for any it leaves out. ?minScore and ?limit (default 20, at
+// most 100) apply per request, and ?tenant keeps to one tenant. Sandbox
+// receipts are only compared with each other.
+
+type similarityConfig struct {
+	Weights struct {
+		Retailer float64 `json:"retailer"`
+		Date     float64 `json:"date"`
+		Total    float64 `json:"total"`
+		Items    float64 `json:"items"`
+	} `json:"weights"`
+	DateWindowDays int     `json:"dateWindowDays"`
+	TotalTolerance float64 `json:"totalTolerance"`
+	MinScore       float64 `json:"minScore"`
+}
+
+var similarity = defaultSimilarity()
+
+func defaultSimilarity() similarityConfig {
+	var cfg similarityConfig
+	cfg.Weights.Retailer, cfg.Weights.Date, cfg.Weights.Total, cfg.Weights.Items = 1, 1, 1, 1
+	cfg.DateWindowDays = 3
+	cfg.TotalTolerance = 0.1
+	cfg.MinScore = 0.7
+	return cfg
+}
+
+func loadSimilarityConfig(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	cfg := defaultSimilarity()
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	w := cfg.Weights
+	if w.Retailer < 0 || w.Date < 0 || w.Total < 0 || w.Items < 0 || w.Retailer+w.Date+w.Total+w.Items == 0 {
+		return fmt.Errorf("weights must not be negative, and one must be positive")
+	}
+	if cfg.DateWindowDays < 0 || cfg.TotalTolerance <= 0 || cfg.MinScore < 0 || cfg.MinScore > 1 {
+		return fmt.Errorf("dateWindowDays must not be negative, totalTolerance must be positive and minScore between 0 and 1")
+	}
+	similarity = cfg
+	return nil
+}
+
+// similarityScores is how alike two receipts are on each signal.
+type similarityScores struct {
+	Retailer float64 `json:"retailer"`
+	Date     float64 `json:"date"`
+	Total    float64 `json:"total"`
+	Items    float64 `json:"items"`
+}
+
+func (cfg similarityConfig) score(a, b *storedReceipt) (float64, similarityScores) {
+	scores := similarityScores{
+		Retailer: retailerSimilarity(a, b),
+		Date:     cfg.dateSimilarity(a.Receipt.PurchaseDate, b.Receipt.PurchaseDate),
+		Total:    cfg.totalSimilarity(a.Receipt.Total, b.Receipt.Total),
+		Items:    itemSimilarity(a.Receipt.Items, b.Receipt.Items),
+	}
+	w := cfg.Weights
+	sum := w.Retailer*scores.Retailer + w.Date*scores.Date + w.Total*scores.Total + w.Items*scores.Items
+	return sum / (w.Retailer + w.Date + w.Total + w.Items), scores
+}
+
+func retailerSimilarity(a, b *storedReceipt) float64 {
+	if a.Retailer == b.Retailer {
+		return 1
+	}
+	return overlap(strings.Fields(strings.ToLower(a.Retailer)), strings.Fields(strings.ToLower(b.Retailer)))
+}
+
+func (cfg similarityConfig) dateSimilarity(a, b string) float64 {
+	da, errA := time.Parse(time.DateOnly, a)
+	db, errB := time.Parse(time.DateOnly, b)
+	if errA != nil || errB != nil {
+		return 0
+	}
+	days := math.Abs(da.Sub(db).Hours() / 24)
+	return math.Max(0, 1-days/float64(cfg.DateWindowDays+1))
+}
+
+func (cfg similarityConfig) totalSimilarity(a, b string) float64 {
+	ca, errA := parseCents(a)
+	cb, errB := parseCents(b)
+	if errA != nil || errB != nil {
+		return 0
+	}
+	larger := math.Max(math.Abs(float64(ca)), math.Abs(float64(cb)))
+	if larger == 0 {
+		return 1
+	}
+	diff := math.Abs(float64(ca-cb)) / larger
+	return math.Max(0, 1-diff/cfg.TotalTolerance)
+}
+
+func itemSimilarity(a, b []Item) float64 {
+	names := func(items []Item) []string {
+		out := make([]string, len(items))
+		for i, item := range items {
+			out[i] = strings.ToLower(canonicalText(item.ShortDescription))
+		}
+		return out
+	}
+	return overlap(names(a), names(b))
+}
+
+func roundScore(score float64) float64 {
+	return math.Round(score*1000) / 1000
+}
+
+// overlap is the Jaccard similarity of two multisets.
+func overlap(a, b []string) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+	counts := make(map[string]int, len(a))
+	for _, s := range a {
+		counts[s]++
+	}
+	shared := 0
+	for _, s := range b {
+		if counts[s] > 0 {
+			counts[s]--
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+type similarReceipt struct {
+	ID           string           `json:"id"`
+	Tenant       string           `json:"tenant"`
+	CustomerID   string           `json:"customerId,omitempty"`
+	Retailer     string           `json:"retailer"`
+	PurchaseDate string           `json:"purchaseDate"`
+	Total        string           `json:"total"`
+	Status       string           `json:"status"`
+	Points       int              `json:"points"`
+	CreatedAt    time.Time        `json:"createdAt"`
+	Score        float64          `json:"score"`
+	Scores       similarityScores `json:"scores"`
+}
+
+// rankedSimilar is a match numbered in the order the store listed it.
+type rankedSimilar struct {
+	similarReceipt
+	order int
+}
+
+// similarHeap keeps the best matches found so far with the worst on top,
+// so a search holds at most limit of them however many receipts match.
+type similarHeap []rankedSimilar
+
+func (h similarHeap) Len() int { return len(h) }
+func (h similarHeap) Less(i, j int) bool {
+	if h[i].Score != h[j].Score {
+		return h[i].Score < h[j].Score
+	}
+	return h[i].order > h[j].order
+}
+func (h similarHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *similarHeap) Push(x any)   { *h = append(*h, x.(rankedSimilar)) }
+func (h *similarHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func findSimilarReceipts(c *gin.Context) {
+	minScore, limit := similarity.MinScore, 20
+	if raw := c.Query("minScore"); raw != "" {
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil || v < 0 || v > 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "minScore must be between 0 and 1"})
+			return
+		}
+		minScore = v
+	}
+	if raw := c.Query("limit"); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 1 || v > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Limit must be between 1 and 100"})
+			return
+		}
+		limit = v
+	}
+	target, err := store.Get(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	tenant := c.Query("tenant")
+	sandbox := isSandboxTenant(target.Tenant)
+	best := &similarHeap{}
+	found := 0
+	_, err = store.List(c.Request.Context(), func(s *storedReceipt) bool {
+		if s.ID == target.ID || isSandboxTenant(s.Tenant) != sandbox || (tenant != "" && s.Tenant != tenant) {
+			return false
+		}
+		score, scores := similarity.score(target, s)
+		if score < minScore {
+			return false
+		}
+		found++
+		// Ties go to the receipt listed first, which is already kept.
+		if best.Len() == limit && roundScore(score) <= (*best)[0].Score {
+			return false
+		}
+		match := rankedSimilar{order: found, similarReceipt: similarReceipt{
+			ID:           s.ID,
+			Tenant:       s.Tenant,
+			CustomerID:   s.Receipt.CustomerID,
+			Retailer:     s.Retailer,
+			PurchaseDate: s.Receipt.PurchaseDate,
+			Total:        s.Receipt.Total,
+			Status:       s.Status,
+			Points:       s.netPoints(),
+			CreatedAt:    s.CreatedAt.UTC(),
+			Score:        roundScore(score),
+			Scores: similarityScores{
+				Retailer: roundScore(scores.Retailer),
+				Date:     roundScore(scores.Date),
+				Total:    roundScore(scores.Total),
+				Items:    roundScore(scores.Items),
+			},
+		}}
+		if best.Len() == limit {
+			(*best)[0] = match
+			heap.Fix(best, 0)
+		} else {
+			heap.Push(best, match)
+		}
+		return false
+	})
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	matches := make([]similarReceipt, best.Len())
+	for i := len(matches) - 1; i >= 0; i-- {
+		matches[i] = heap.Pop(best).(rankedSimilar).similarReceipt
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":       target.ID,
+		"minScore": minScore,
+		"similar":  matches,
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSimilarReceiptsKeepsBestWithinLimit(t *testing.T) {
+	saved := store
+	defer func() { store = saved }()
+	store = newMemoryStore()
+
+	now := time.Now()
+	totals := []string{"10.00", "10.50", "10.90", "10.20", "10.80", "10.05"}
+	for i, total := range totals {
+		stored := &storedReceipt{ID: receiptID(defaultTenant, testUUID(i)), Tenant: defaultTenant, Retailer: "Target", Hash: total, Status: receiptAccepted, CreatedAt: now,
+			Receipt: Receipt{Retailer: "Target", PurchaseDate: "2026-10-01", Total: total, Items: []Item{{ShortDescription: "Pizza", Price: total}}}}
+		if _, err := store.Create(context.Background(), stored, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/admin/receipts/:id/similar", findSimilarReceipts)
+	for limit, want := range map[int][]string{1: {"10.05"}, 3: {"10.05", "10.20", "10.50"}, 10: {"10.05", "10.20", "10.50", "10.80", "10.90"}} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/admin/receipts/%s/similar?minScore=0&limit=%d", receiptID(defaultTenant, testUUID(0)), limit), nil))
+		var body struct{ Similar []similarReceipt }
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("limit %d: %d %s", limit, w.Code, w.Body)
+		}
+		var got []string
+		for _, match := range body.Similar {
+			got = append(got, match.Total)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("limit %d: similar totals %v, want %v", limit, got, want)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// receiptFact is the row streamed to the warehouse for each processed
+// receipt. A matching ClickHouse table:
+//
+//	CREATE TABLE receipt_facts (
+//	    receipt_id String, processed_at DateTime64(3, 'UTC'),
+//	    retailer LowCardinality(String), retailer_raw String,
+//	    purchase_date Date, total_cents Int64, item_count UInt32, points Int64
+//	) ENGINE = MergeTree ORDER BY (retailer, processed_at)
+type receiptFact struct {
+	ReceiptID    string `json:"receipt_id"`
+	ProcessedAt  string `json:"processed_at"`
+	Retailer     string `json:"retailer"`
+	RetailerRaw  string `json:"retailer_raw"`
+	PurchaseDate string `json:"purchase_date"`
+	TotalCents   int64  `json:"total_cents"`
+	ItemCount    int    `json:"item_count"`
+	Points       int    `json:"points"`
+}
+
+// clickHouseSink batches facts from a bounded channel and inserts them over
+// ClickHouse's HTTP interface. When the channel is full, publishers wait up
+// to enqueueTimeout and then drop the fact, so a slow warehouse applies
+// backpressure without stalling ingestion indefinitely.
+type clickHouseSink struct {
+	endpoint       string
+	table          string
+	user           string
+	password       string
+	batchSize      int
+	flushInterval  time.Duration
+	enqueueTimeout time.Duration
+	facts          chan receiptFact
+	http           *http.Client
+
+	dropped  atomic.Int64
+	inserted atomic.Int64
+	failed   atomic.Int64
+}
+
+var warehouse *clickHouseSink
+
+// newClickHouseSinkFromEnv returns nil unless CLICKHOUSE_URL is set.
+func newClickHouseSinkFromEnv() *clickHouseSink {
+	endpoint := os.Getenv("CLICKHOUSE_URL")
+	if endpoint == "" {
+		return nil
+	}
+	table := os.Getenv("CLICKHOUSE_TABLE")
+	if table == "" {
+		table = "receipt_facts"
+	}
+	return &clickHouseSink{
+		endpoint:       endpoint,
+		table:          table,
+		user:           os.Getenv("CLICKHOUSE_USER"),
+		password:       os.Getenv("CLICKHOUSE_PASSWORD"),
+		batchSize:      envInt("CLICKHOUSE_BATCH_SIZE", 500),
+		flushInterval:  envDuration("CLICKHOUSE_FLUSH_INTERVAL", 5*time.Second),
+		enqueueTimeout: envDuration("CLICKHOUSE_ENQUEUE_TIMEOUT", 100*time.Millisecond),
+		facts:          make(chan receiptFact, envInt("CLICKHOUSE_BUFFER", 10000)),
+		http:           &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func publishFact(stored *storedReceipt) {
+	if warehouse == nil {
+		return
+	}
+	fact := receiptFact{
+		ReceiptID:    stored.ID,
+		ProcessedAt:  stored.CreatedAt.UTC().Format("2006-01-02 15:04:05.000"),
+		Retailer:     stored.Retailer,
+		RetailerRaw:  stored.Receipt.Retailer,
+		PurchaseDate: stored.Receipt.PurchaseDate,
+		ItemCount:    len(stored.Receipt.Items),
+		Points:       stored.Points,
+	}
+	fact.TotalCents, _ = parseCents(stored.Receipt.Total)
+	warehouse.enqueue(fact)
+}
+
+func (s *clickHouseSink) enqueue(fact receiptFact) {
+	select {
+	case s.facts <- fact:
+		return
+	default:
+	}
+	timer := time.NewTimer(s.enqueueTimeout)
+	defer timer.Stop()
+	select {
+	case s.facts <- fact:
+	case <-timer.C:
+		if s.dropped.Add(1)%1000 == 1 {
+			log.Printf("clickhouse sink: buffer full, %d facts dropped so far", s.dropped.Load())
+		}
+	}
+}
+
+// run drains the channel until ctx is done, then flushes what is buffered.
+func (s *clickHouseSink) run(ctx context.Context) {
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	batch := make([]receiptFact, 0, s.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		s.insertWithRetry(batch)
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case fact := <-s.facts:
+			batch = append(batch, fact)
+			if len(batch) >= s.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			for {
+				select {
+				case fact := <-s.facts:
+					batch = append(batch, fact)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *clickHouseSink) insertWithRetry(batch []receiptFact) {
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := breakerFor("clickhouse").Do(func() error { return s.insert(batch) })
+		if err == nil {
+			s.inserted.Add(int64(len(batch)))
+			return
+		}
+		if attempt == 3 {
+			s.failed.Add(int64(len(batch)))
+			log.Printf("clickhouse sink: dropping batch of %d after %d attempts: %v", len(batch), attempt, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (s *clickHouseSink) insert(batch []receiptFact) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, fact := range batch {
+		if err := enc.Encode(fact); err != nil {
+			return err
+		}
+	}
+
+	query := url.Values{"query": {fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", s.table)}}
+	req, err := http.NewRequest(http.MethodPost, s.endpoint+"/?"+query.Encode(), &body)
+	if err != nil {
+		return err
+	}
+	if s.user != "" {
+		req.Header.Set("X-ClickHouse-User", s.user)
+		req.Header.Set("X-ClickHouse-Key", s.password)
+	}
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
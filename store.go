@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	errReceiptNotFound = errors.New("receipt not found")
+	errRecordNotFound  = errors.New("record not found")
+)
+
+// storeError classifies a backend failure. Transient errors (timeouts, lost
+// connections, a busy database) are worth retrying and surface as 503 with
+// Retry-After; anything else is permanent and surfaces as 500.
+type storeError struct {
+	Op        string
+	Err       error
+	Transient bool
+}
+
+func (e *storeError) Error() string { return fmt.Sprintf("store %s: %v", e.Op, e.Err) }
+func (e *storeError) Unwrap() error { return e.Err }
+
+func isTransientStoreError(err error) bool {
+	var se *storeError
+	return errors.As(err, &se) && se.Transient
+}
+
+// receiptStore persists processed receipts. Implementations return
+// errReceiptNotFound for unknown IDs and wrap backend failures in
+// *storeError. Returned receipts are copies; changes go through Update.
+type receiptStore interface {
+	// Create saves a new receipt and appends events to the outbox in the
+	// same transaction. When a receipt with the same hash was stored
+	// before, duplicateOf is its ID.
+	Create(ctx context.Context, stored *storedReceipt, events []outboxEvent) (duplicateOf string, err error)
+	Get(ctx context.Context, id string) (*storedReceipt, error)
+	// Update applies fn to the stored receipt atomically and returns the
+	// result.
+	Update(ctx context.Context, id string, fn func(*storedReceipt)) (*storedReceipt, error)
+	// Apply is Update for state transitions: fn may refuse the change by
+	// returning an error, which is passed through with nothing written, and
+	// the events it returns join the outbox in the same transaction.
+	Apply(ctx context.Context, id string, fn func(*storedReceipt) ([]outboxEvent, error)) (*storedReceipt, error)
+	// List returns the receipts accepted by match, oldest first, as of one
+	// point in time. Writers are not held up while it runs.
+	List(ctx context.Context, match func(*storedReceipt) bool) ([]*storedReceipt, error)
+	// PendingEvents returns up to limit undelivered outbox events, oldest
+	// first; AckEvents removes delivered ones.
+	PendingEvents(ctx context.Context, limit int) ([]outboxEvent, error)
+	AckEvents(ctx context.Context, ids []string) error
+	// Transact runs fn as one transaction spanning several receipts: its
+	// writes and events are committed together if fn returns nil, and none
+	// of them are if it returns an error, which is passed through. A SQL
+	// backend maps this onto BEGIN/COMMIT; key-value backends use their
+	// own transactions or hold their write lock for the duration. fn must
+	// use tx, not the store, and must not retain tx.
+	Transact(ctx context.Context, fn func(tx storeTx) error) error
+	// Records are the small documents kept beside receipts, such as
+	// settings and registries, as JSON by kind and key. Unknown keys are
+	// errRecordNotFound.
+	GetRecord(ctx context.Context, kind, key string) ([]byte, error)
+	PutRecord(ctx context.Context, kind, key string, value []byte) error
+	DeleteRecord(ctx context.Context, kind, key string) error
+	// ListRecords returns every record of a kind by key.
+	ListRecords(ctx context.Context, kind string) (map[string][]byte, error)
+}
+
+// storeTx is the store as seen inside Transact. Reads see the
+// transaction's own writes.
+type storeTx interface {
+	recordTx
+	Get(id string) (*storedReceipt, error)
+	// List is receiptStore.List within the transaction.
+	List(match func(*storedReceipt) bool) ([]*storedReceipt, error)
+	// Put replaces an existing receipt; unknown IDs are errReceiptNotFound.
+	Put(stored *storedReceipt) error
+	// Delete removes a receipt, and its hash from the duplicate index if
+	// it was the first stored under it. Its outbox events are kept.
+	Delete(id string) error
+	// Emit adds events to the outbox on commit.
+	Emit(events ...outboxEvent)
+}
+
+// applyTx is receiptStore.Apply for a change that also reads or writes
+// records: fn changes s and may use tx, and both are committed together.
+// Events are emitted with tx.Emit.
+func applyTx(ctx context.Context, id string, fn func(tx storeTx, s *storedReceipt) error) (*storedReceipt, error) {
+	var updated *storedReceipt
+	err := store.Transact(ctx, func(tx storeTx) error {
+		s, err := tx.Get(id)
+		if err != nil {
+			return err
+		}
+		if err := fn(tx, s); err != nil {
+			return err
+		}
+		updated = s
+		return tx.Put(s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// store is replaced in main with the backend from openStoreFromEnv.
+var store receiptStore = &breakerStore{next: newMemoryStore(), breaker: breakerFor("store")}
+
+var storeRetryAfter = envDuration("STORE_RETRY_AFTER", time.Second)
+
+// storeFailure answers a request whose store call failed.
+func storeFailure(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errReceiptNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Receipt ID not found"})
+	case requestExpired(c, err):
+	case errors.As(err, new(*tenantKeyError)):
+		errorResponse(c, http.StatusServiceUnavailable, "tenant_key_unavailable", "Receipt is encrypted under a tenant key that cannot be used")
+	case isTransientStoreError(err):
+		c.Header("Retry-After", strconv.Itoa(max(1, int(storeRetryAfter.Round(time.Second)/time.Second))))
+		errorResponse(c, http.StatusServiceUnavailable, "store_unavailable", "Receipt store is temporarily unavailable")
+	default:
+		errorResponse(c, http.StatusInternalServerError, "store_error", "Receipt store error")
+	}
+}
+
+// receiptCursor is a position in List order: oldest first, and by ID among
+// receipts stored at the same instant, so a walk behind a cursor neither
+// skips nor repeats receipts.
+type receiptCursor struct {
+	CreatedAt time.Time `json:"createdAt"`
+	ID        string    `json:"id"`
+}
+
+func cursorOf(s *storedReceipt) receiptCursor {
+	return receiptCursor{CreatedAt: s.CreatedAt, ID: s.ID}
+}
+
+func (c receiptCursor) before(other receiptCursor) bool {
+	if !c.CreatedAt.Equal(other.CreatedAt) {
+		return c.CreatedAt.Before(other.CreatedAt)
+	}
+	return c.ID < other.ID
+}
+
+func (s *storedReceipt) clone() *storedReceipt {
+	copied := *s
+	copied.Tags = append([]string(nil), s.Tags...)
+	copied.Notes = append([]receiptNote(nil), s.Notes...)
+	copied.Breakdown = append([]ruleResult(nil), s.Breakdown...)
+	copied.Ledger = append([]ledgerEntry(nil), s.Ledger...)
+	copied.ReturnedItems = append([]int(nil), s.ReturnedItems...)
+	copied.Disputes = append([]dispute(nil), s.Disputes...)
+	copied.Corrections = append([]receiptCorrection(nil), s.Corrections...)
+	return &copied
+}
+
+// memoryStore keeps receipts copy-on-write, so List reads a consistent
+// snapshot without holding the lock writers need: a large export then
+// costs writers a copy of the changes since the last generation, not a
+// pass over every receipt. The receipts are an immutable base map, the
+// changes frozen while they are folded into a new base, if any, and the
+// changes since, which writers add to. Once the changes outgrow
+// memoryFoldMin and an eighth of the base, they are frozen and folded into
+// the next generation's base in the background. Stored receipts are never
+// changed in place; writers store a modified clone.
+type memoryStore struct {
+	mu           sync.Mutex
+	base, frozen map[string]*storedReceipt
+	changes      map[string]*storedReceipt // a nil receipt is a deletion
+	folding      bool
+	hashes       map[string]string
+	outbox       []outboxEvent
+	records      map[string]map[string][]byte // kind -> key -> value
+
+	// Kept up to date under mu; read without it for metrics.
+	receiptCount, outboxCount, bytes atomic.Int64
+}
+
+const memoryFoldMin = 1024
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		base:    make(map[string]*storedReceipt),
+		changes: make(map[string]*storedReceipt),
+		hashes:  make(map[string]string),
+		records: make(map[string]map[string][]byte),
+	}
+}
+
+// receiptView is a read-only view of a memory store's receipts: layers of
+// changes over a base, newest first, where a nil receipt is a deletion.
+type receiptView []map[string]*storedReceipt
+
+func (v receiptView) get(id string) (*storedReceipt, bool) {
+	for _, layer := range v {
+		if stored, ok := layer[id]; ok {
+			return stored, stored != nil
+		}
+	}
+	return nil, false
+}
+
+// each calls fn for every receipt in the view until fn returns false.
+func (v receiptView) each(fn func(stored *storedReceipt) bool) {
+	for i, layer := range v {
+	next:
+		for id, stored := range layer {
+			if stored == nil {
+				continue
+			}
+			for _, newer := range v[:i] {
+				if _, ok := newer[id]; ok {
+					continue next
+				}
+			}
+			if !fn(stored) {
+				return
+			}
+		}
+	}
+}
+
+// view returns the receipts as they are now; call with mu held and do not
+// use it once mu is released.
+func (s *memoryStore) view() receiptView {
+	if s.frozen != nil {
+		return receiptView{s.changes, s.frozen, s.base}
+	}
+	return receiptView{s.changes, s.base}
+}
+
+// snapshot returns the receipts as they are now, for use without mu.
+func (s *memoryStore) snapshot() receiptView {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := s.view()
+	v[0] = maps.Clone(s.changes)
+	return v
+}
+
+// set stores or, with a nil receipt, deletes a receipt; call with mu held.
+func (s *memoryStore) set(id string, stored *storedReceipt) {
+	s.changes[id] = stored
+	if s.folding || len(s.changes) < max(memoryFoldMin, len(s.base)/8) {
+		return
+	}
+	s.folding = true
+	s.frozen, s.changes = s.changes, make(map[string]*storedReceipt)
+	base, frozen := s.base, s.frozen
+	go func() {
+		next := maps.Clone(base)
+		for id, stored := range frozen {
+			if stored == nil {
+				delete(next, id)
+			} else {
+				next[id] = stored
+			}
+		}
+		s.mu.Lock()
+		s.base, s.frozen, s.folding = next, nil, false
+		s.mu.Unlock()
+	}()
+}
+
+func (s *memoryStore) Create(ctx context.Context, stored *storedReceipt, events []outboxEvent) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.view().get(stored.ID); ok {
+		s.bytes.Add(-old.approxSize())
+	} else {
+		s.receiptCount.Add(1)
+	}
+	s.set(stored.ID, stored.clone())
+	s.bytes.Add(stored.approxSize())
+	duplicateOf, duplicate := s.hashes[stored.duplicateKey()]
+	if !duplicate {
+		s.hashes[stored.duplicateKey()] = stored.ID
+	}
+	s.appendOutbox(events)
+	return duplicateOf, nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, id string) (*storedReceipt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	stored, ok := s.view().get(id)
+	s.mu.Unlock()
+	if !ok {
+		return nil, errReceiptNotFound
+	}
+	return stored.clone(), nil
+}
+
+func (s *memoryStore) Update(ctx context.Context, id string, fn func(*storedReceipt)) (*storedReceipt, error) {
+	return s.Apply(ctx, id, func(stored *storedReceipt) ([]outboxEvent, error) {
+		fn(stored)
+		return nil, nil
+	})
+}
+
+func (s *memoryStore) Apply(ctx context.Context, id string, fn func(*storedReceipt) ([]outboxEvent, error)) (*storedReceipt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.view().get(id)
+	if !ok {
+		return nil, errReceiptNotFound
+	}
+	updated := stored.clone()
+	events, err := fn(updated)
+	if err != nil {
+		return nil, err
+	}
+	s.set(id, updated)
+	s.bytes.Add(updated.approxSize() - stored.approxSize())
+	s.appendOutbox(events)
+	return updated.clone(), nil
+}
+
+func (s *memoryStore) List(ctx context.Context, match func(*storedReceipt) bool) ([]*storedReceipt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	matched := make([]*storedReceipt, 0)
+	var err error
+	s.snapshot().each(func(stored *storedReceipt) bool {
+		if err = ctx.Err(); err != nil {
+			return false
+		}
+		if match == nil || match(stored) {
+			matched = append(matched, stored.clone())
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(matched, func(i, j int) bool { return cursorOf(matched[i]).before(cursorOf(matched[j])) })
+	return matched, nil
+}
+
+func (s *memoryStore) PendingEvents(ctx context.Context, limit int) ([]outboxEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]outboxEvent(nil), s.outbox[:min(limit, len(s.outbox))]...), nil
+}
+
+func (s *memoryStore) AckEvents(ctx context.Context, ids []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	acked := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		acked[id] = true
+	}
+	s.mu.Lock()
+	kept := s.outbox[:0]
+	for _, event := range s.outbox {
+		if !acked[event.ID] {
+			kept = append(kept, event)
+		} else {
+			s.outboxCount.Add(-1)
+			s.bytes.Add(-event.approxSize())
+		}
+	}
+	s.outbox = kept
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryStore) Transact(ctx context.Context, fn func(tx storeTx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx := &memoryTx{ctx: ctx, s: s, writes: make(map[string]*storedReceipt), recordWrites: make(map[recordKey][]byte)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	for k, value := range tx.recordWrites {
+		s.setRecord(k.kind, k.key, value)
+	}
+	for id, updated := range tx.writes {
+		old, _ := s.view().get(id)
+		if updated == nil {
+			s.set(id, nil)
+			if s.hashes[old.duplicateKey()] == id {
+				delete(s.hashes, old.duplicateKey())
+			}
+			s.receiptCount.Add(-1)
+			s.bytes.Add(-old.approxSize())
+			continue
+		}
+		s.bytes.Add(updated.approxSize() - old.approxSize())
+		s.set(id, updated)
+	}
+	s.appendOutbox(tx.events)
+	return nil
+}
+
+// memoryTx buffers a transaction's writes until it commits; the store's
+// lock is held throughout. A nil write is a deletion.
+type memoryTx struct {
+	ctx    context.Context
+	s      *memoryStore
+	writes map[string]*storedReceipt
+	events []outboxEvent
+	// recordWrites are record changes; a nil value is a deletion.
+	recordWrites map[recordKey][]byte
+}
+
+// view layers the transaction's writes over the store's receipts.
+func (tx *memoryTx) view() receiptView {
+	return append(receiptView{tx.writes}, tx.s.view()...)
+}
+
+func (tx *memoryTx) current(id string) (*storedReceipt, bool) {
+	return tx.view().get(id)
+}
+
+func (tx *memoryTx) Get(id string) (*storedReceipt, error) {
+	stored, ok := tx.current(id)
+	if !ok {
+		return nil, errReceiptNotFound
+	}
+	return stored.clone(), nil
+}
+
+func (tx *memoryTx) List(match func(*storedReceipt) bool) ([]*storedReceipt, error) {
+	matched := make([]*storedReceipt, 0)
+	var err error
+	tx.view().each(func(stored *storedReceipt) bool {
+		if err = tx.ctx.Err(); err != nil {
+			return false
+		}
+		if match == nil || match(stored) {
+			matched = append(matched, stored.clone())
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(matched, func(i, j int) bool { return cursorOf(matched[i]).before(cursorOf(matched[j])) })
+	return matched, nil
+}
+
+func (tx *memoryTx) Put(stored *storedReceipt) error {
+	if _, ok := tx.current(stored.ID); !ok {
+		return errReceiptNotFound
+	}
+	tx.writes[stored.ID] = stored.clone()
+	return nil
+}
+
+func (tx *memoryTx) Delete(id string) error {
+	if _, ok := tx.current(id); !ok {
+		return errReceiptNotFound
+	}
+	tx.writes[id] = nil
+	return nil
+}
+
+func (tx *memoryTx) Emit(events ...outboxEvent) {
+	tx.events = append(tx.events, events...)
+}
+
+func (tx *memoryTx) GetRecord(kind, key string) ([]byte, error) {
+	if value, ok := tx.recordWrites[recordKey{kind, key}]; ok {
+		if value == nil {
+			return nil, errRecordNotFound
+		}
+		return bytes.Clone(value), nil
+	}
+	value, ok := tx.s.records[kind][key]
+	if !ok {
+		return nil, errRecordNotFound
+	}
+	return bytes.Clone(value), nil
+}
+
+func (tx *memoryTx) PutRecord(kind, key string, value []byte) error {
+	tx.recordWrites[recordKey{kind, key}] = bytes.Clone(value)
+	return nil
+}
+
+func (tx *memoryTx) DeleteRecord(kind, key string) error {
+	tx.recordWrites[recordKey{kind, key}] = nil
+	return nil
+}
+
+func (s *memoryStore) GetRecord(ctx context.Context, kind, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.records[kind][key]
+	if !ok {
+		return nil, errRecordNotFound
+	}
+	return bytes.Clone(value), nil
+}
+
+func (s *memoryStore) PutRecord(ctx context.Context, kind, key string, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setRecord(kind, key, bytes.Clone(value))
+	return nil
+}
+
+func (s *memoryStore) DeleteRecord(ctx context.Context, kind, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setRecord(kind, key, nil)
+	return nil
+}
+
+func (s *memoryStore) ListRecords(ctx context.Context, kind string) (map[string][]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make(map[string][]byte, len(s.records[kind]))
+	for key, value := range s.records[kind] {
+		records[key] = bytes.Clone(value)
+	}
+	return records, nil
+}
+
+// setRecord stores or, with a nil value, deletes a record; call with mu
+// held.
+func (s *memoryStore) setRecord(kind, key string, value []byte) {
+	if value == nil {
+		delete(s.records[kind], key)
+		return
+	}
+	if s.records[kind] == nil {
+		s.records[kind] = make(map[string][]byte)
+	}
+	s.records[kind][key] = value
+}
+
+// appendOutbox queues events; the caller holds mu.
+func (s *memoryStore) appendOutbox(events []outboxEvent) {
+	s.outbox = append(s.outbox, events...)
+	for _, event := range events {
+		s.outboxCount.Add(1)
+		s.bytes.Add(event.approxSize())
+	}
+}
+
+func (s *memoryStore) size() storeSize {
+	bytes := s.bytes.Load()
+	return storeSize{Receipts: s.receiptCount.Load(), Outbox: s.outboxCount.Load(), Bytes: bytes, HeapBytes: bytes}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"runtime/metrics"
+	"time"
+	"unsafe"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Store gauges let capacity alerts fire on growth rather than on latency.
+// Backends keep their counts up to date as they write, so a scrape only
+// reads a few atomics. The GC figures are estimates: the store's share of
+// the live heap, and that share of the GC pause time since the last sample.
+
+// storeSize is what a backend reports about its footprint.
+type storeSize struct {
+	Receipts  int64
+	Outbox    int64
+	Bytes     int64 // retained by the backend: heap for memory, file for bolt
+	HeapBytes int64 // the part of Bytes that lives on the Go heap
+}
+
+// sizedStore is implemented by backends that track their size.
+type sizedStore interface {
+	size() storeSize
+}
+
+func currentStoreSize() storeSize {
+	if sized, ok := store.(sizedStore); ok {
+		return sized.size()
+	}
+	return storeSize{}
+}
+
+var (
+	storeReceiptsGauge = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "receipt_store_receipts",
+		Help: "Receipts held by the store.",
+	}, func() float64 { return float64(currentStoreSize().Receipts) })
+	storeOutboxGauge = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "receipt_store_outbox_events",
+		Help: "Undelivered events in the store's outbox.",
+	}, func() float64 { return float64(currentStoreSize().Outbox) })
+	storeBytesGauge = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "receipt_store_retained_bytes",
+		Help: "Approximate bytes retained by the store (heap for the memory backend, database file for bolt).",
+	}, func() float64 { return float64(currentStoreSize().Bytes) })
+	storeHeapFraction = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "receipt_store_heap_fraction",
+		Help: "Estimated share of the live Go heap held by the store, as of the last sample.",
+	})
+	storeGCPause = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "receipt_store_gc_pause_seconds_total",
+		Help: "GC pause time attributed to the store in proportion to its share of the live heap.",
+	})
+)
+
+var storeMetricsInterval = envDuration("STORE_METRICS_INTERVAL", 15*time.Second)
+
+// runStoreMetrics samples the runtime's GC counters until ctx is done.
+func runStoreMetrics(ctx context.Context) {
+	samples := []metrics.Sample{
+		{Name: "/gc/heap/live:bytes"},
+		{Name: "/sched/pauses/total/gc:seconds"},
+	}
+	metrics.Read(samples)
+	lastPause := pauseSeconds(samples[1].Value)
+	ticker := time.NewTicker(storeMetricsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		metrics.Read(samples)
+		share := 0.0
+		if samples[0].Value.Kind() == metrics.KindUint64 {
+			if live := samples[0].Value.Uint64(); live > 0 {
+				share = min(1, float64(currentStoreSize().HeapBytes)/float64(live))
+			}
+		}
+		pause := pauseSeconds(samples[1].Value)
+		storeHeapFraction.Set(share)
+		storeGCPause.Add(max(0, pause-lastPause) * share)
+		lastPause = pause
+	}
+}
+
+// pauseSeconds estimates the total of a pause histogram from its bucket
+// bounds.
+func pauseSeconds(v metrics.Value) float64 {
+	if v.Kind() != metrics.KindFloat64Histogram {
+		return 0
+	}
+	h := v.Float64Histogram()
+	total := 0.0
+	for i, n := range h.Counts {
+		bound := h.Buckets[i+1]
+		if bound > 1e9 { // the last bucket is open-ended
+			bound = h.Buckets[i]
+		}
+		total += float64(n) * bound
+	}
+	return total
+}
+
+// approxSize estimates the heap a stored receipt holds: its structs plus
+// the bytes of its strings. It is meant to be cheap, not exact.
+func (s *storedReceipt) approxSize() int64 {
+	n := int(unsafe.Sizeof(*s)) + len(s.ID) + len(s.Tenant) + len(s.Retailer) + len(s.RulesVersion) + len(s.Hash) + len(s.Backfill) + len(s.Channel)
+	r := s.Receipt
+	n += len(r.Retailer) + len(r.PurchaseDate) + len(r.PurchaseTime) + len(r.Total) + len(r.Currency) + len(r.CustomerID) + len(r.TimeZone)
+	if s.Sealed != nil {
+		n += int(unsafe.Sizeof(*s.Sealed)) + len(s.Sealed.KeyRef) + len(s.Sealed.WrappedKey) + len(s.Sealed.Nonce) + len(s.Sealed.Data)
+	}
+	for _, item := range r.Items {
+		n += int(unsafe.Sizeof(item)) + len(item.ShortDescription) + len(item.Price) + len(item.Category)
+	}
+	for key, value := range r.Metadata {
+		n += len(key) + len(value)
+	}
+	for _, rule := range s.Breakdown {
+		n += int(unsafe.Sizeof(rule)) + len(rule.Rule)
+	}
+	for _, tag := range s.Tags {
+		n += int(unsafe.Sizeof(tag)) + len(tag)
+	}
+	for _, note := range s.Notes {
+		n += int(unsafe.Sizeof(note)) + len(note.Text)
+	}
+	for _, entry := range s.Ledger {
+		n += int(unsafe.Sizeof(entry)) + len(entry.ID) + len(entry.Kind) + len(entry.Reason)
+	}
+	for _, d := range s.Disputes {
+		n += int(unsafe.Sizeof(d)) + len(d.ID) + len(d.Status) + len(d.Reason) + len(d.Resolution)
+	}
+	for _, c := range s.Corrections {
+		n += int(unsafe.Sizeof(c)) + len(c.Field) + len(c.Original) + len(c.Corrected) + len(c.Reason)
+	}
+	for _, reason := range s.QuarantineReasons {
+		n += int(unsafe.Sizeof(reason)) + len(reason)
+	}
+	n += len(s.ReturnedItems) * int(unsafe.Sizeof(0))
+	return int64(n)
+}
+
+func (e outboxEvent) approxSize() int64 {
+	return int64(unsafe.Sizeof(e)) + int64(len(e.ID)+len(e.Type)+len(e.Tenant)+len(e.Payload))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Request bodies may be sent gzip-compressed with Content-Encoding: gzip;
+// handlers only see the decompressed body, which is capped at
+// MAX_DECOMPRESSED_BYTES except on the streaming endpoint.
+//
+// POST /receipts/process/stream takes the batch endpoint's entries as
+// NDJSON, one {"correlationKey": ..., "receipt": {...}} object or bare
+// receipt per line, and answers with one batch result per line as each is
+// processed, then a summary line, so a multi-GB nightly file is never held
+// in memory on either side. Results are flushed whenever the service has
+// caught up with the input. Each receipt gets REQUEST_TIMEOUT_PROCESS; the
+// stream as a whole gets REQUEST_TIMEOUT_STREAM. A line over
+// STREAM_MAX_LINE_BYTES, or a body that cannot be read, ends the stream
+// with an error line.
+
+const ndjsonContentType = "application/x-ndjson"
+
+var (
+	maxDecompressedBytes = int64(envInt("MAX_DECOMPRESSED_BYTES", 64<<20))
+	streamMaxLineBytes   = envInt("STREAM_MAX_LINE_BYTES", 1<<20)
+)
+
+const streamPath = "/receipts/process/stream"
+
+// gzipBody closes the decompressor and the request body beneath it.
+type gzipBody struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (b gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+// decompressRequest is middleware decoding gzip request bodies.
+func decompressRequest(c *gin.Context) {
+	switch strings.ToLower(strings.TrimSpace(c.GetHeader("Content-Encoding"))) {
+	case "", "identity":
+		c.Next()
+		return
+	case "gzip", "x-gzip":
+	default:
+		c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported Content-Encoding: use gzip"})
+		return
+	}
+	zr, err := gzip.NewReader(c.Request.Body)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid gzip body"})
+		return
+	}
+	var body io.ReadCloser = gzipBody{zr, c.Request.Body}
+	if c.FullPath() != streamPath {
+		body = http.MaxBytesReader(c.Writer, body, maxDecompressedBytes)
+	}
+	c.Request.Body = body
+	c.Request.ContentLength = -1
+	c.Request.Header.Del("Content-Encoding")
+	c.Request.Header.Del("Content-Length")
+	c.Next()
+}
+
+// processBatchStream serves POST /receipts/process/stream; see above.
+func processBatchStream(c *gin.Context) {
+	channel, ok := submissionChannel(c, channelBatch)
+	if !ok {
+		return
+	}
+	// Results are written while the body is still being read.
+	if err := http.NewResponseController(c.Writer).EnableFullDuplex(); err != nil {
+		log.Printf("stream: full duplex unavailable: %v", err)
+	}
+	ctx := c.Request.Context()
+	tenant := tenantID(c)
+	c.Header("Content-Type", ndjsonContentType)
+	c.Status(http.StatusOK)
+	out := json.NewEncoder(c.Writer)
+	in := bufio.NewReaderSize(c.Request.Body, streamMaxLineBytes)
+	counts := map[string]int{receiptAccepted: 0, receiptQuarantined: 0, receiptRejected: 0}
+	summary := func() gin.H {
+		return gin.H{
+			"accepted":    counts[receiptAccepted],
+			"quarantined": counts[receiptQuarantined],
+			"rejected":    counts[receiptRejected],
+		}
+	}
+
+	for index, lineNo := 0, 0; ; {
+		// Flushing before the first read would deny a client waiting on
+		// Expect: 100-continue its go-ahead.
+		if index > 0 && in.Buffered() == 0 {
+			c.Writer.Flush()
+		}
+		line, err := in.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			resp := summary()
+			resp["error"] = "Line " + strconv.Itoa(lineNo+1) + " is longer than " + strconv.Itoa(streamMaxLineBytes) + " bytes"
+			out.Encode(resp)
+			return
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			resp := summary()
+			resp["error"] = "Could not read the request body"
+			out.Encode(resp)
+			return
+		}
+		lineNo++
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			var entry batchEntry
+			if json.Unmarshal(trimmed, &entry) != nil || entry.Receipt == nil {
+				entry = batchEntry{Receipt: append(json.RawMessage(nil), trimmed...)}
+			}
+			recordCtx, cancel := context.WithTimeout(ctx, routeTimeouts["/receipts/process"])
+			result, submitErr := submitBatchEntry(recordCtx, tenant, channel, index, entry)
+			cancel()
+			// A receipt stored just before a deadline is reported as
+			// stored; only a submission the deadline stopped timed out.
+			if errors.Is(submitErr, context.DeadlineExceeded) || errors.Is(submitErr, context.Canceled) {
+				if ctx.Err() != nil {
+					resp := summary()
+					resp["error"] = "Request timed out"
+					out.Encode(resp)
+					return
+				}
+				result = batchResult{Index: index, CorrelationKey: entry.CorrelationKey, Status: receiptRejected, Error: "Receipt timed out"}
+			}
+			result.Line = lineNo
+			counts[result.Status]++
+			out.Encode(result)
+			index++
+		}
+		if errors.Is(err, io.EOF) {
+			out.Encode(summary())
+			return
+		}
+	}
+}
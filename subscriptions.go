@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Webhook subscriptions let API clients receive events without operator
+// config. With WEBHOOK_SUBSCRIPTIONS=true the outbox relay fans each event
+// out to the subscriptions of the event's tenant whose filter matches its
+// type. Managing subscriptions needs a managed API key; a subscription
+// belongs to the key that created it, and its replacements after rotation,
+// and to the key's tenant.
+//
+// Subscription URLs are the client's choice, so deliveries refuse to
+// connect to loopback, private, link-local and other non-public addresses,
+// whatever the host name resolves to at the time. WEBHOOK_ALLOW_PRIVATE=true
+// lifts that, for development.
+//
+// Each delivery is a POST of one event, signed with the subscription's
+// secret as X-Webhook-Signature: sha256=<hex HMAC of the body>. Failed
+// deliveries are retried with backoff; once the outbox relay has handed an
+// event over, retries live in memory only. Each subscription also keeps its
+// last WEBHOOK_HISTORY_LIMIT events so a consumer that was down can ask for
+// them again with POST /webhooks/subscriptions/:id/replay. Subscriptions
+// can opt into batched, ordered deliveries instead; see webhookbatches.go.
+//
+// Subscriptions and their secrets are kept as webhook_subscriptions store
+// records, so any replica can manage them and they survive restarts; each
+// replica loads the records it has not seen before dispatching or serving a
+// request. Delivery counters, retries and the event history live in the
+// memory of the replica that delivers, which for outbox events is the
+// leader, so they start over when leadership moves.
+
+var (
+	subscriptionsEnabled      = os.Getenv("WEBHOOK_SUBSCRIPTIONS") == "true"
+	subscriptionsAllowPrivate = os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true"
+	errSubscriptionAddress    = errors.New("webhook address is not public")
+)
+
+// subscriptionClient delivers to subscription URLs, checking each address
+// it dials. It uses no proxy, which would dial on its behalf.
+var subscriptionClient = &http.Client{
+	Timeout: 15 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(_, address string, _ syscall.RawConn) error {
+				if subscriptionsAllowPrivate {
+					return nil
+				}
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip, err := netip.ParseAddr(host)
+				if err != nil || !publicAddr(ip.Unmap()) {
+					return errSubscriptionAddress
+				}
+				return nil
+			},
+		}).DialContext,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// publicAddr reports whether ip is a unicast address on the internet.
+func publicAddr(ip netip.Addr) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() &&
+		!netip.MustParsePrefix("100.64.0.0/10").Contains(ip) && !netip.MustParsePrefix("fc00::/7").Contains(ip)
+}
+
+var subscribableEvents = []string{
+	eventReceiptProcessed,
+	eventReceiptReturned,
+	eventReceiptDeleted,
+	eventPointsAdjusted,
+	eventPointsRedeemed,
+	eventDisputeOpened,
+	eventDisputeResolved,
+	eventAPIKeyChanged,
+}
+
+var (
+	subscriptionRetryDelays = []time.Duration{time.Second, 10 * time.Second, time.Minute}
+	subscriptionHistory     = envInt("WEBHOOK_HISTORY_LIMIT", 1000)
+)
+
+type webhookSubscription struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Digest, when set, schedules a weekly digest.weekly event; see digest.go.
+	Digest *digestSchedule `json:"digest,omitempty"`
+	// Batch, when set, delivers events in batches; see webhookbatches.go.
+	Batch *batchPolicy `json:"batch,omitempty"`
+
+	tenant        string
+	owner         string // managed API key lineage
+	secret        string
+	history       []outboxEvent // oldest first
+	digestThrough time.Time     // end of the week the last digest covered
+	batcher       *subscriptionBatcher
+
+	Delivered     int        `json:"delivered"`
+	Failed        int        `json:"failed"`
+	LastAttemptAt *time.Time `json:"lastAttemptAt,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+}
+
+// storedSubscription is a subscription as kept in the store.
+type storedSubscription struct {
+	ID            string          `json:"id"`
+	URL           string          `json:"url"`
+	Events        []string        `json:"events"`
+	CreatedAt     time.Time       `json:"createdAt"`
+	Digest        *digestSchedule `json:"digest,omitempty"`
+	Batch         *batchPolicy    `json:"batch,omitempty"`
+	Tenant        string          `json:"tenant"`
+	Owner         string          `json:"owner"`
+	Secret        string          `json:"secret"`
+	DigestThrough time.Time       `json:"digestThrough"`
+}
+
+func (s *webhookSubscription) stored() storedSubscription {
+	return storedSubscription{
+		ID:            s.ID,
+		URL:           s.URL,
+		Events:        s.Events,
+		CreatedAt:     s.CreatedAt,
+		Digest:        s.Digest,
+		Batch:         s.Batch,
+		Tenant:        s.tenant,
+		Owner:         s.owner,
+		Secret:        s.secret,
+		DigestThrough: s.digestThrough,
+	}
+}
+
+// syncSubscriptions brings this replica's subscriptions in line with the
+// store: records it has not seen are added and subscriptions deleted
+// elsewhere are dropped. Subscriptions it already has keep their delivery
+// state.
+func syncSubscriptions(ctx context.Context) error {
+	records, err := listRecordsJSON[storedSubscription](ctx, recordSubscriptions)
+	if err != nil {
+		return err
+	}
+	subscriptionsMu.Lock()
+	defer subscriptionsMu.Unlock()
+	for id, sub := range subscriptions {
+		if _, ok := records[id]; !ok {
+			delete(subscriptions, id)
+			if sub.batcher != nil {
+				sub.batcher.stop()
+			}
+		}
+	}
+	for id, record := range records {
+		if sub, ok := subscriptions[id]; ok {
+			if record.DigestThrough.After(sub.digestThrough) {
+				sub.digestThrough = record.DigestThrough
+			}
+			continue
+		}
+		if record.Digest != nil {
+			if msg := record.Digest.normalize(); msg != "" {
+				log.Printf("webhook subscription %s: %s", id, msg)
+				continue
+			}
+		}
+		sub := &webhookSubscription{
+			ID:            record.ID,
+			URL:           record.URL,
+			Events:        record.Events,
+			CreatedAt:     record.CreatedAt,
+			Digest:        record.Digest,
+			Batch:         record.Batch,
+			tenant:        record.Tenant,
+			owner:         record.Owner,
+			secret:        record.Secret,
+			digestThrough: record.DigestThrough,
+		}
+		if sub.Batch != nil {
+			sub.batcher = newSubscriptionBatcher(sub)
+		}
+		subscriptions[id] = sub
+	}
+	return nil
+}
+
+func (s *webhookSubscription) wants(event outboxEvent) bool {
+	return s.tenant == event.Tenant && (len(s.Events) == 0 || slices.Contains(s.Events, event.Type))
+}
+
+type subscriptionDelivery struct {
+	sub   *webhookSubscription
+	event outboxEvent
+}
+
+var (
+	subscriptionsMu sync.Mutex
+	subscriptions   = make(map[string]*webhookSubscription)
+
+	// Deliveries of bulk events wait in their own queue; see webhookbatches.go.
+	subscriptionQueue     = make(chan subscriptionDelivery, envInt("WEBHOOK_SUBSCRIPTION_QUEUE", 10000))
+	subscriptionBulkQueue = make(chan subscriptionDelivery, cap(subscriptionQueue))
+)
+
+// dispatchSubscriptions queues events for every matching subscription.
+func dispatchSubscriptions(ctx context.Context, events []outboxEvent) {
+	if !subscriptionsEnabled {
+		return
+	}
+	if err := syncSubscriptions(ctx); err != nil {
+		log.Printf("webhook subscriptions: %v", err)
+	}
+	subscriptionsMu.Lock()
+	defer subscriptionsMu.Unlock()
+	for _, event := range events {
+		for _, sub := range subscriptions {
+			if !sub.wants(event) {
+				continue
+			}
+			sub.queue(event)
+		}
+	}
+}
+
+// queue keeps event in the subscription's history and queues it for
+// delivery. The caller holds subscriptionsMu.
+func (s *webhookSubscription) queue(event outboxEvent) {
+	s.history = append(s.history, event)
+	if len(s.history) > subscriptionHistory {
+		s.history = s.history[len(s.history)-subscriptionHistory:]
+	}
+	if !s.enqueue(event) {
+		s.Failed++
+		s.LastError = "delivery queue full"
+	}
+}
+
+// enqueue hands event to the subscription's batcher or the shared delivery
+// queue, reporting false when it is full. The caller holds subscriptionsMu.
+func (s *webhookSubscription) enqueue(event outboxEvent) bool {
+	if s.batcher != nil {
+		return s.batcher.add(event)
+	}
+	queue := subscriptionQueue
+	if event.Priority == priorityBulk {
+		queue = subscriptionBulkQueue
+	}
+	select {
+	case queue <- subscriptionDelivery{s, event}:
+		return true
+	default:
+		return false
+	}
+}
+
+// runSubscriptionDeliveries sends queued deliveries with the given number
+// of workers until ctx is done. Workers take a bulk delivery only when no
+// live one is waiting.
+func runSubscriptionDeliveries(ctx context.Context, workers int) {
+	for range workers {
+		go func() {
+			for {
+				select {
+				case d := <-subscriptionQueue:
+					deliverWithRetry(ctx, d)
+					continue
+				default:
+				}
+				select {
+				case d := <-subscriptionQueue:
+					deliverWithRetry(ctx, d)
+				case d := <-subscriptionBulkQueue:
+					deliverWithRetry(ctx, d)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
+
+func deliverWithRetry(ctx context.Context, d subscriptionDelivery) {
+	retryDelivery(ctx, d.sub, "event "+d.event.ID, 1, func() error {
+		return deliverEvent(ctx, d.sub, d.event)
+	})
+}
+
+// retryDelivery calls send, which delivers n events, until it succeeds, the
+// retries run out or the subscription is deleted.
+func retryDelivery(ctx context.Context, sub *webhookSubscription, what string, n int, send func() error) {
+	for attempt := 0; ; attempt++ {
+		err := send()
+		now := time.Now().UTC()
+		subscriptionsMu.Lock()
+		sub.LastAttemptAt = &now
+		if err == nil {
+			sub.Delivered += n
+			sub.LastError = ""
+		} else {
+			sub.LastError = err.Error()
+		}
+		_, active := subscriptions[sub.ID]
+		subscriptionsMu.Unlock()
+		if err == nil || !active {
+			return
+		}
+		if attempt == len(subscriptionRetryDelays) {
+			subscriptionsMu.Lock()
+			sub.Failed += n
+			subscriptionsMu.Unlock()
+			log.Printf("webhook subscription %s: giving up on %s: %v", sub.ID, what, err)
+			return
+		}
+		select {
+		case <-time.After(subscriptionRetryDelays[attempt]):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func deliverEvent(ctx context.Context, sub *webhookSubscription, event outboxEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return postSubscription(ctx, sub, body, map[string]string{"X-Webhook-Event": event.Type})
+}
+
+// postSubscription posts a signed body to the subscription's URL.
+func postSubscription(ctx context.Context, sub *webhookSubscription, body []byte, headers map[string]string) error {
+	mac := hmac.New(sha256.New, []byte(sub.secret))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	return webhookBreaker(sub.URL).Do(func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "receipt-processor")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		req.Header.Set("X-Webhook-Signature", signature)
+		resp, err := subscriptionClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("webhook %s: %s", sub.URL, resp.Status)
+		}
+		return nil
+	})
+}
+
+// requireSubscriptions rejects subscription requests when the feature is
+// off or the caller has no managed API key to own subscriptions with, and
+// loads the subscriptions other replicas created. authenticateAPIKey has
+// already bound the request to the key's tenant.
+func requireSubscriptions(c *gin.Context) {
+	if !subscriptionsEnabled {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Webhook subscriptions are not enabled"})
+		return
+	}
+	if c.GetString(apiKeyOwnerKey) == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "A managed API key is required"})
+		return
+	}
+	if err := syncSubscriptions(c.Request.Context()); err != nil {
+		storeFailure(c, err)
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// ownSubscription returns the caller's subscription named by :id.
+func ownSubscription(c *gin.Context) (*webhookSubscription, bool) {
+	sub, ok := subscriptions[c.Param("id")]
+	if !ok || sub.tenant != tenantID(c) || sub.owner != c.GetString(apiKeyOwnerKey) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+		return nil, false
+	}
+	return sub, true
+}
+
+func listSubscriptions(c *gin.Context) {
+	tenant, owner := tenantID(c), c.GetString(apiKeyOwnerKey)
+	subscriptionsMu.Lock()
+	list := make([]webhookSubscription, 0)
+	for _, sub := range subscriptions {
+		if sub.tenant == tenant && sub.owner == owner {
+			list = append(list, *sub)
+		}
+	}
+	subscriptionsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	c.JSON(http.StatusOK, gin.H{"subscriptions": list})
+}
+
+// createSubscription serves POST /webhooks/subscriptions with {"url": ...,
+// "events": [...], "digest": {...}, "batch": {...}}; no events means every
+// event type, and digest and batch are optional. The signing secret is only
+// ever returned here.
+func createSubscription(c *gin.Context) {
+	var req struct {
+		URL    string          `json:"url"`
+		Events []string        `json:"events"`
+		Digest *digestSchedule `json:"digest"`
+		Batch  *batchPolicy    `json:"batch"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+	if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "URL must be an absolute http(s) URL"})
+		return
+	}
+	for _, typ := range req.Events {
+		if !slices.Contains(subscribableEvents, typ) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown event type: " + typ, "events": subscribableEvents})
+			return
+		}
+	}
+	if req.Digest != nil {
+		if msg := req.Digest.normalize(); msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+	}
+	if req.Batch != nil {
+		if msg := req.Batch.normalize(); msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+	}
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create subscription"})
+		return
+	}
+	sub := &webhookSubscription{
+		ID:        uuid.New().String(),
+		URL:       req.URL,
+		Events:    slices.Compact(slices.Sorted(slices.Values(req.Events))),
+		CreatedAt: clock.Now().UTC(),
+		tenant:    tenantID(c),
+		owner:     c.GetString(apiKeyOwnerKey),
+		secret:    hex.EncodeToString(secret),
+	}
+	if sub.Events == nil {
+		sub.Events = []string{}
+	}
+	if sub.Digest = req.Digest; sub.Digest != nil {
+		sub.digestThrough = sub.Digest.weekEnd(sub.CreatedAt)
+	}
+	sub.Batch = req.Batch
+	if err := putRecordJSON(c.Request.Context(), recordSubscriptions, sub.ID, sub.stored()); err != nil {
+		storeFailure(c, err)
+		return
+	}
+	if sub.Batch != nil {
+		sub.batcher = newSubscriptionBatcher(sub)
+	}
+	subscriptionsMu.Lock()
+	subscriptions[sub.ID] = sub
+	view := *sub
+	subscriptionsMu.Unlock()
+	c.JSON(http.StatusCreated, gin.H{"subscription": view, "secret": sub.secret})
+}
+
+func deleteSubscription(c *gin.Context) {
+	subscriptionsMu.Lock()
+	sub, ok := ownSubscription(c)
+	subscriptionsMu.Unlock()
+	if !ok {
+		return
+	}
+	if err := store.DeleteRecord(c.Request.Context(), recordSubscriptions, sub.ID); err != nil {
+		storeFailure(c, err)
+		return
+	}
+	subscriptionsMu.Lock()
+	if subscriptions[sub.ID] == sub {
+		delete(subscriptions, sub.ID)
+		if sub.batcher != nil {
+			sub.batcher.stop()
+		}
+	}
+	subscriptionsMu.Unlock()
+	c.Status(http.StatusNoContent)
+}
+
+// testSubscription serves POST /webhooks/subscriptions/:id/test: it sends
+// a webhook.test event straight away, without retries, and reports the
+// outcome.
+func testSubscription(c *gin.Context) {
+	subscriptionsMu.Lock()
+	sub, ok := ownSubscription(c)
+	subscriptionsMu.Unlock()
+	if !ok {
+		return
+	}
+	payload, _ := json.Marshal(gin.H{"subscription": sub.ID, "message": "Test delivery"})
+	event := outboxEvent{
+		ID:        uuid.New().String(),
+		Type:      "webhook.test",
+		Tenant:    sub.tenant,
+		Payload:   payload,
+		CreatedAt: clock.Now().UTC(),
+	}
+	if err := deliverEvent(c.Request.Context(), sub, event); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Test delivery failed: " + err.Error(), "eventId": event.ID})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"delivered": true, "eventId": event.ID})
+}
+
+// replaySubscription serves POST /webhooks/subscriptions/:id/replay: it
+// queues the subscription's kept events created in [from, to) for delivery
+// again, defaulting to the last 24 hours.
+func replaySubscription(c *gin.Context) {
+	from, to, err := timeRange(c, 24*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid time range: use RFC 3339 timestamps or YYYY-MM-DD dates with from before to"})
+		return
+	}
+	subscriptionsMu.Lock()
+	sub, ok := ownSubscription(c)
+	var replay []outboxEvent
+	queued := 0
+	if ok {
+		for _, event := range sub.history {
+			if !event.CreatedAt.Before(from) && event.CreatedAt.Before(to) {
+				replay = append(replay, event)
+				if sub.enqueue(event) {
+					queued++
+				}
+			}
+		}
+	}
+	subscriptionsMu.Unlock()
+	if !ok {
+		return
+	}
+	status := http.StatusAccepted
+	if queued < len(replay) {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, gin.H{
+		"from":    from,
+		"to":      to,
+		"matched": len(replay),
+		"queued":  queued,
+	})
+}
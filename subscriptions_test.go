@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSubscriptionsReachOtherReplicas(t *testing.T) {
+	savedStore, savedEnabled, savedSubs := store, subscriptionsEnabled, subscriptions
+	defer func() { store, subscriptionsEnabled, subscriptions = savedStore, savedEnabled, savedSubs }()
+	store, subscriptionsEnabled = newMemoryStore(), true
+	subscriptions = make(map[string]*webhookSubscription)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set(apiKeyOwnerKey, "key1")
+		c.Next()
+	})
+	hooks := r.Group("/webhooks/subscriptions", requireSubscriptions)
+	hooks.POST("", createSubscription)
+	hooks.DELETE("/:id", deleteSubscription)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/webhooks/subscriptions", strings.NewReader(`{"url": "https://hooks.example.com/receipts"}`)))
+	var created struct {
+		Subscription struct{ ID string }
+		Secret       string
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+
+	// The leader, or this replica after a restart, has never seen it.
+	subscriptions = make(map[string]*webhookSubscription)
+	queued := len(subscriptionQueue)
+	dispatchSubscriptions(context.Background(), []outboxEvent{{ID: "e1", Type: eventReceiptProcessed, Tenant: defaultTenant}})
+	sub := subscriptions[created.Subscription.ID]
+	if sub == nil || sub.secret != created.Secret || len(subscriptionQueue) != queued+1 {
+		t.Fatalf("subscription not loaded for dispatch: %+v, %d queued", sub, len(subscriptionQueue)-queued)
+	}
+	<-subscriptionQueue
+
+	// Deleting it on another replica stops the dispatching one too.
+	subscriptions = make(map[string]*webhookSubscription)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/webhooks/subscriptions/"+created.Subscription.ID, nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	subscriptions = map[string]*webhookSubscription{sub.ID: sub}
+	dispatchSubscriptions(context.Background(), []outboxEvent{{ID: "e2", Type: eventReceiptProcessed, Tenant: defaultTenant}})
+	if len(subscriptions) != 0 || len(subscriptionQueue) != queued {
+		t.Errorf("deleted subscription still dispatched to: %d subscriptions, %d queued", len(subscriptions), len(subscriptionQueue)-queued)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type receiptNote struct {
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type tagRequest struct {
+	Tags []string `json:"tags"`
+	Note string   `json:"note"`
+}
+
+type receiptSummary struct {
+	ID       string   `json:"id"`
+	Retailer string   `json:"retailer"`
+	Points   int      `json:"points"`
+	Hash     string   `json:"hash"`
+	Status   string   `json:"status"`
+	Tags     []string `json:"tags"`
+	Channel  string   `json:"channel,omitempty"`
+
+	ProcessedAt time.Time `json:"processedAt"`
+}
+
+func getTags(c *gin.Context) {
+	stored, err := store.Get(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, tagsResponse(stored))
+}
+
+func addTags(c *gin.Context) {
+	var req tagRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+
+	tags := make([]string, 0, len(req.Tags))
+	for _, tag := range req.Tags {
+		tag = normalizeTag(tag)
+		if tag == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Tags must not be empty"})
+			return
+		}
+		tags = append(tags, tag)
+	}
+	note := strings.TrimSpace(req.Note)
+	if len(tags) == 0 && note == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one tag or a note is required"})
+		return
+	}
+
+	stored, err := store.Update(c.Request.Context(), c.Param("id"), func(stored *storedReceipt) {
+		for _, tag := range tags {
+			if !hasTag(stored, tag) {
+				stored.Tags = append(stored.Tags, tag)
+			}
+		}
+		if note != "" {
+			stored.Notes = append(stored.Notes, receiptNote{Text: note, CreatedAt: clock.Now()})
+		}
+	})
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, tagsResponse(stored))
+}
+
+func removeTag(c *gin.Context) {
+	tag := normalizeTag(c.Param("tag"))
+	stored, err := store.Update(c.Request.Context(), c.Param("id"), func(stored *storedReceipt) {
+		kept := stored.Tags[:0]
+		for _, t := range stored.Tags {
+			if t != tag {
+				kept = append(kept, t)
+			}
+		}
+		stored.Tags = kept
+	})
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, tagsResponse(stored))
+}
+
+// listReceipts returns a page of the tenant's stored receipts oldest first;
+// see paginate.
+// Repeated ?tag= values narrow the result to receipts carrying every given
+// tag, ?retailer= matches any spelling that normalizes to the same
+// retailer, and ?channel= keeps receipts from one submission channel.
+func listReceipts(c *gin.Context) {
+	retailer := ""
+	if name := c.Query("retailer"); name != "" {
+		retailer = normalizeRetailer(name)
+	}
+	var filter []string
+	for _, tag := range c.QueryArray("tag") {
+		if tag = normalizeTag(tag); tag != "" {
+			filter = append(filter, tag)
+		}
+	}
+
+	tenant, channel := tenantID(c), c.Query("channel")
+	matched, err := store.List(c.Request.Context(), func(stored *storedReceipt) bool {
+		return stored.Tenant == tenant && (retailer == "" || stored.Retailer == retailer) && (channel == "" || stored.Channel == channel) && hasAllTags(stored, filter)
+	})
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	page, next, ok := paginate(c, matched)
+	if !ok {
+		return
+	}
+	summaries := make([]receiptSummary, 0, len(page))
+	for _, stored := range page {
+		summaries = append(summaries, receiptSummary{
+			ID:       stored.ID,
+			Retailer: stored.Retailer,
+			Points:   stored.Points,
+			Hash:     stored.Hash,
+			Status:   stored.Status,
+			Tags:     append([]string{}, stored.Tags...),
+			Channel:  stored.Channel,
+
+			ProcessedAt: stored.CreatedAt.UTC(),
+		})
+	}
+
+	resp := gin.H{"receipts": summaries}
+	if next != "" {
+		resp["nextCursor"] = next
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func tagsResponse(stored *storedReceipt) gin.H {
+	return gin.H{
+		"id":    stored.ID,
+		"tags":  append([]string{}, stored.Tags...),
+		"notes": append([]receiptNote{}, stored.Notes...),
+	}
+}
+
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+func hasTag(stored *storedReceipt, tag string) bool {
+	for _, t := range stored.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAllTags(stored *storedReceipt, tags []string) bool {
+	for _, tag := range tags {
+		if !hasTag(stored, tag) {
+			return false
+		}
+	}
+	return true
+}
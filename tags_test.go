@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestListReceiptsKeepsToTenant(t *testing.T) {
+	saved, savedSecret := store, sandboxKeySecret
+	defer func() { store, sandboxKeySecret = saved, savedSecret }()
+	store, sandboxKeySecret = newMemoryStore(), "secret"
+
+	now := time.Now()
+	for i, tenant := range []string{defaultTenant, "acme", sandboxTenantPrefix + "partner"} {
+		stored := &storedReceipt{ID: receiptID(tenant, testUUID(i)), Tenant: tenant, Retailer: "Target", Hash: tenant, Status: receiptAccepted, CreatedAt: now}
+		if _, err := store.Create(context.Background(), stored, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(authenticateSandbox)
+	r.GET("/receipts", listReceipts)
+	for name, header := range map[string][2]string{
+		defaultTenant:                   {},
+		"acme":                          {"X-Tenant-ID", "acme"},
+		sandboxTenantPrefix + "partner": {"X-API-Key", sandboxKey("partner")},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/receipts", nil)
+		if header[0] != "" {
+			req.Header.Set(header[0], header[1])
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var body struct{ Receipts []receiptSummary }
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", name, w.Code, w.Body)
+		}
+		if len(body.Receipts) != 1 || body.Receipts[0].Hash != name {
+			t.Errorf("%s listed %+v", name, body.Receipts)
+		}
+	}
+}
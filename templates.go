@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Receipt templates hold the fields a recurring submission shares, such as
+// the retailer and its usual items. Submitting from a template merges the
+// request body over the template field by field, so a body with just
+// purchaseDate, purchaseTime and total completes a template with the
+// retailer and items. Templates belong to the request's tenant.
+
+type receiptTemplate struct {
+	Name   string         `json:"name"`
+	Fields map[string]any `json:"fields"`
+}
+
+type templateKey struct {
+	Tenant string
+	Name   string
+}
+
+var (
+	templateNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+	templatesMu sync.Mutex
+	templates   = make(map[templateKey]receiptTemplate)
+)
+
+func templateKeyFor(c *gin.Context) templateKey {
+	return templateKey{Tenant: tenantID(c), Name: c.Param("name")}
+}
+
+func listTemplates(c *gin.Context) {
+	tenant := tenantID(c)
+	templatesMu.Lock()
+	list := make([]receiptTemplate, 0)
+	for key, t := range templates {
+		if key.Tenant == tenant {
+			list = append(list, t)
+		}
+	}
+	templatesMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	c.JSON(http.StatusOK, gin.H{"templates": list})
+}
+
+func getTemplate(c *gin.Context) {
+	templatesMu.Lock()
+	t, ok := templates[templateKeyFor(c)]
+	templatesMu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+// putTemplate serves PUT /receipts/templates/:name. The body is a partial
+// receipt document; fields it sets must have the receipt's types.
+func putTemplate(c *gin.Context) {
+	key := templateKeyFor(c)
+	if !templateNamePattern.MatchString(key.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Template names are lowercase letters, digits, - and _"})
+		return
+	}
+	var fields map[string]any
+	dec := json.NewDecoder(c.Request.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil || fields == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+	data, _ := json.Marshal(fields)
+	var partial Receipt
+	if err := json.Unmarshal(data, &partial); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Template fields do not match the receipt format"})
+		return
+	}
+
+	t := receiptTemplate{Name: key.Name, Fields: fields}
+	templatesMu.Lock()
+	_, existed := templates[key]
+	templates[key] = t
+	templatesMu.Unlock()
+	if existed {
+		c.JSON(http.StatusOK, t)
+		return
+	}
+	c.JSON(http.StatusCreated, t)
+}
+
+func deleteTemplate(c *gin.Context) {
+	key := templateKeyFor(c)
+	templatesMu.Lock()
+	_, ok := templates[key]
+	delete(templates, key)
+	templatesMu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// processFromTemplate serves POST /receipts/process/from-template/:name
+// with the fields that vary between submissions.
+func processFromTemplate(c *gin.Context) {
+	templatesMu.Lock()
+	t, ok := templates[templateKeyFor(c)]
+	templatesMu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+		return
+	}
+
+	var overrides map[string]any
+	dec := json.NewDecoder(c.Request.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&overrides); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+	merged := make(map[string]any, len(t.Fields)+len(overrides))
+	for k, v := range t.Fields {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		merged[k] = v
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+
+	done := beginStage(c.Request.Context(), stageDecode)
+	receipt, err := decodeReceipt(bytes.NewReader(data))
+	done(err)
+	if errors.Is(err, errUnsupportedSchema) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported schemaVersion"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The template and request do not make a valid receipt"})
+		return
+	}
+	channel, ok := submissionChannel(c, channelAPI)
+	if !ok {
+		return
+	}
+	result, err := submitReceipt(c.Request.Context(), submission{tenant: tenantID(c), receipt: receipt, channel: channel})
+	if err != nil {
+		submissionFailure(c, err)
+		return
+	}
+	respondSubmitted(c, result)
+}
@@ -0,0 +1,781 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// A tenant can have its receipts encrypted at rest under a key it controls.
+// TENANT_KEYS_FILE maps tenants to key references, e.g.
+//
+//	{"acme": "aws-kms:arn:aws:kms:eu-west-1:111122223333:key/1234abcd-…", "beta": "local:beta-2026"}
+//
+// and a tenant sets its own with PUT /settings/encryption-key, which needs
+// the tenant's managed API key or admin credentials. Keys set that way are
+// kept in the store, override the file, and reach other replicas within
+// TENANT_KEYS_REFRESH. A tenant whose stored key this replica cannot load
+// has its writes refused rather than stored unsealed. An aws-kms
+// reference names a KMS key that the service's AWS credentials may use for
+// GenerateDataKey and Decrypt; a local reference names a 256-bit key kept
+// base64-encoded in TENANT_LOCAL_KEYS_DIR/<name>.key, for development.
+//
+// The submitted receipt is sealed with AES-256-GCM under a data key wrapped
+// by the tenant's key, and stored with the wrapped data key and the key
+// reference. Derived fields (retailer, points, breakdown, ledger) stay
+// readable to the store. Data keys are reused for new writes, and unwrapped
+// ones cached, for TENANT_DATA_KEY_TTL, so KMS is not called per request;
+// revoking a key takes effect within that time.
+//
+// Rotating is setting a new reference: new writes use it, and older
+// receipts open with the key they were sealed under for as long as it stays
+// usable. POST /settings/encryption-key/reseal moves them, and any receipts
+// stored before the tenant had a key, onto the current one.
+//
+// When a tenant's key cannot be used (disabled, access revoked, KMS
+// unreachable) only that tenant's receipts are affected: reading or
+// changing one answers 503 tenant_key_unavailable, and listings leave them
+// out. The store's circuit breaker does not count these failures.
+
+var (
+	localKeysDir = os.Getenv("TENANT_LOCAL_KEYS_DIR")
+	dataKeyTTL   = envDuration("TENANT_DATA_KEY_TTL", time.Hour)
+	// tenantKeysRefresh is how often keys set on other replicas are picked up.
+	tenantKeysRefresh = envDuration("TENANT_KEYS_REFRESH", 30*time.Second)
+)
+
+var (
+	tenantKeysMu   sync.RWMutex
+	tenantKeys     = map[string]string{} // tenant → key reference
+	fileTenantKeys = map[string]string{}
+	// lockedTenants have a stored key this replica cannot load.
+	lockedTenants = map[string]bool{}
+)
+
+// kmsRegionPattern is what an AWS region looks like, e.g. eu-west-1. The
+// region in a key ARN becomes part of the KMS host name.
+var kmsRegionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d$`)
+
+// tenantKeyRecord is a key assignment kept in the store. An empty KeyRef
+// records that the tenant removed its key.
+type tenantKeyRecord struct {
+	KeyRef string `json:"keyRef"`
+}
+
+var tenantKeyFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "receipt_tenant_key_failures_total",
+	Help: "Receipts that could not be sealed or opened because their tenant's key was unusable, by tenant and operation.",
+}, []string{"tenant", "op"})
+
+func loadTenantKeys(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]string)
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	for tenant, keyRef := range keys {
+		if !tenantPattern.MatchString(tenant) {
+			return fmt.Errorf("invalid tenant %q", tenant)
+		}
+		if _, _, err := providerFor(keyRef); err != nil {
+			return fmt.Errorf("key for %q: %w", tenant, err)
+		}
+	}
+	fileTenantKeys = keys
+	tenantKeys = maps.Clone(keys)
+	return nil
+}
+
+// loadStoredTenantKeys applies the key assignments kept in the store over
+// those from TENANT_KEYS_FILE.
+func loadStoredTenantKeys(ctx context.Context) error {
+	records, err := listRecordsJSON[tenantKeyRecord](ctx, recordTenantKeys)
+	if err != nil {
+		return err
+	}
+	keys := maps.Clone(fileTenantKeys)
+	locked := make(map[string]bool)
+	for tenant, record := range records {
+		delete(keys, tenant)
+		if record.KeyRef == "" {
+			continue
+		}
+		if _, _, err := providerFor(record.KeyRef); err != nil {
+			log.Printf("tenant %s key %q cannot be loaded, refusing its writes: %v", tenant, record.KeyRef, err)
+			locked[tenant] = true
+			continue
+		}
+		keys[tenant] = record.KeyRef
+	}
+	tenantKeysMu.Lock()
+	tenantKeys, lockedTenants = keys, locked
+	tenantKeysMu.Unlock()
+	return nil
+}
+
+func refreshTenantKeys(time.Time) {
+	if err := loadStoredTenantKeys(context.Background()); err != nil {
+		log.Printf("refreshing tenant keys: %v", err)
+	}
+}
+
+func tenantKeyRef(tenant string) string {
+	tenantKeysMu.RLock()
+	defer tenantKeysMu.RUnlock()
+	return tenantKeys[tenant]
+}
+
+func tenantKeyLocked(tenant string) bool {
+	tenantKeysMu.RLock()
+	defer tenantKeysMu.RUnlock()
+	return lockedTenants[tenant]
+}
+
+// tenantKeyError is a failure to use a tenant's key. It concerns the
+// tenant, not the store.
+type tenantKeyError struct {
+	Tenant string
+	KeyRef string
+	Err    error
+}
+
+func (e *tenantKeyError) Error() string {
+	return fmt.Sprintf("tenant %s key %s: %v", e.Tenant, e.KeyRef, e.Err)
+}
+func (e *tenantKeyError) Unwrap() error { return e.Err }
+
+// keyProvider wraps and unwraps data keys under a tenant's key.
+type keyProvider interface {
+	generateDataKey(ctx context.Context, keyID string) (plain, wrapped []byte, err error)
+	decryptDataKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// providerFor splits a key reference into its provider and the key it
+// names there.
+func providerFor(keyRef string) (keyProvider, string, error) {
+	scheme, keyID, _ := strings.Cut(keyRef, ":")
+	if keyID == "" {
+		return nil, "", errors.New("key reference must look like aws-kms:<key ARN or ID> or local:<name>")
+	}
+	switch scheme {
+	case "aws-kms":
+		if _, err := kmsRegion(keyID, ""); err != nil {
+			return nil, "", err
+		}
+		client, err := kmsFromEnv()
+		if err != nil {
+			return nil, "", err
+		}
+		return client, keyID, nil
+	case "local":
+		if _, err := localMasterKey(keyID); err != nil {
+			return nil, "", err
+		}
+		return localKeys{}, keyID, nil
+	default:
+		return nil, "", fmt.Errorf("unknown key provider %q (want aws-kms or local)", scheme)
+	}
+}
+
+// probeKey checks that a data key can be generated under keyRef and
+// unwrapped again, the two things sealing and opening need.
+func probeKey(ctx context.Context, keyRef string) error {
+	provider, keyID, err := providerFor(keyRef)
+	if err != nil {
+		return err
+	}
+	plain, wrapped, err := provider.generateDataKey(ctx, keyID)
+	if err != nil {
+		return err
+	}
+	unwrapped, err := provider.decryptDataKey(ctx, keyID, wrapped)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(plain, unwrapped) {
+		return errors.New("data key does not round-trip")
+	}
+	return nil
+}
+
+// maxOpenedDataKeys bounds the unwrapped key cache.
+const maxOpenedDataKeys = 4096
+
+// currentDataKeys caches the data key each key reference seals new writes
+// with, and openedDataKeys data keys already unwrapped, keyed by reference
+// and wrapped key.
+var (
+	currentDataKeys = newCache[string, cachedDataKey]("current_data_keys", 0, dataKeyTTL)
+	openedDataKeys  = newCache[string, cachedDataKey]("opened_data_keys", maxOpenedDataKeys, dataKeyTTL)
+)
+
+type cachedDataKey struct {
+	plain, wrapped []byte
+}
+
+func currentDataKey(ctx context.Context, keyRef string) (cachedDataKey, error) {
+	if key, ok := currentDataKeys.get(keyRef); ok {
+		return key, nil
+	}
+	provider, keyID, err := providerFor(keyRef)
+	if err != nil {
+		return cachedDataKey{}, err
+	}
+	plain, wrapped, err := provider.generateDataKey(ctx, keyID)
+	if err != nil {
+		return cachedDataKey{}, err
+	}
+	key := cachedDataKey{plain: plain, wrapped: wrapped}
+	currentDataKeys.set(keyRef, key, 0)
+	openedDataKeys.set(keyRef+"\x00"+string(wrapped), key, 0)
+	return key, nil
+}
+
+func openDataKey(ctx context.Context, keyRef string, wrapped []byte) ([]byte, error) {
+	cacheKey := keyRef + "\x00" + string(wrapped)
+	if key, ok := openedDataKeys.get(cacheKey); ok {
+		return key.plain, nil
+	}
+	provider, keyID, err := providerFor(keyRef)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := provider.decryptDataKey(ctx, keyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	openedDataKeys.set(cacheKey, cachedDataKey{plain: plain, wrapped: wrapped}, 0)
+	return plain, nil
+}
+
+// sealedReceipt is a submitted receipt encrypted under its tenant's key.
+type sealedReceipt struct {
+	KeyRef     string
+	WrappedKey []byte
+	Nonce      []byte
+	Data       []byte
+	// openErr is set on the copy of an unreadable receipt handed to a List
+	// match function.
+	openErr error
+}
+
+// sealAAD binds a sealed receipt to the record it belongs to.
+func sealAAD(s *storedReceipt) []byte { return []byte(s.Tenant + "/" + s.ID) }
+
+// sealReceipt encrypts s.Receipt under the tenant's key, or under the key
+// it was last sealed with when the tenant no longer has one. Receipts of
+// tenants without keys are left as they are.
+func sealReceipt(ctx context.Context, s *storedReceipt) error {
+	keyRef := tenantKeyRef(s.Tenant)
+	if keyRef == "" && s.Sealed != nil {
+		keyRef = s.Sealed.KeyRef
+	}
+	if keyRef == "" {
+		if tenantKeyLocked(s.Tenant) {
+			tenantKeyFailures.WithLabelValues(tenantLabel(s.Tenant), "seal").Inc()
+			return &tenantKeyError{Tenant: s.Tenant, Err: errors.New("tenant key is not loaded")}
+		}
+		return nil
+	}
+	key, err := currentDataKey(ctx, keyRef)
+	if err != nil {
+		tenantKeyFailures.WithLabelValues(tenantLabel(s.Tenant), "seal").Inc()
+		return &tenantKeyError{Tenant: s.Tenant, KeyRef: keyRef, Err: err}
+	}
+	plain, err := json.Marshal(s.Receipt)
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(key.plain)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	s.Sealed = &sealedReceipt{KeyRef: keyRef, WrappedKey: key.wrapped, Nonce: nonce, Data: aead.Seal(nil, nonce, plain, sealAAD(s))}
+	s.Receipt = Receipt{}
+	return nil
+}
+
+// openReceipt decrypts a sealed receipt into s.Receipt. Sealed is kept, so
+// callers can see which key it was under.
+func openReceipt(ctx context.Context, s *storedReceipt) error {
+	if s.Sealed == nil {
+		return nil
+	}
+	err := func() error {
+		key, err := openDataKey(ctx, s.Sealed.KeyRef, s.Sealed.WrappedKey)
+		if err != nil {
+			return err
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return err
+		}
+		plain, err := aead.Open(nil, s.Sealed.Nonce, s.Sealed.Data, sealAAD(s))
+		if err != nil {
+			return errors.New("sealed receipt does not decrypt")
+		}
+		return json.Unmarshal(plain, &s.Receipt)
+	}()
+	if err != nil {
+		tenantKeyFailures.WithLabelValues(tenantLabel(s.Tenant), "open").Inc()
+		return &tenantKeyError{Tenant: s.Tenant, KeyRef: s.Sealed.KeyRef, Err: err}
+	}
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealedStore seals receipts on their way into next and opens them on the
+// way out.
+type sealedStore struct {
+	next receiptStore
+}
+
+func (s *sealedStore) size() storeSize {
+	if sized, ok := s.next.(sizedStore); ok {
+		return sized.size()
+	}
+	return storeSize{}
+}
+
+func (s *sealedStore) compaction() *boltCompaction {
+	if c, ok := s.next.(compactableStore); ok {
+		return c.compaction()
+	}
+	return nil
+}
+
+func (s *sealedStore) Create(ctx context.Context, stored *storedReceipt, events []outboxEvent) (string, error) {
+	if tenantKeyRef(stored.Tenant) != "" || tenantKeyLocked(stored.Tenant) {
+		stored = stored.clone()
+		if err := sealReceipt(ctx, stored); err != nil {
+			return "", err
+		}
+	}
+	return s.next.Create(ctx, stored, events)
+}
+
+func (s *sealedStore) Get(ctx context.Context, id string) (*storedReceipt, error) {
+	stored, err := s.next.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := openReceipt(ctx, stored); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+func (s *sealedStore) Update(ctx context.Context, id string, fn func(*storedReceipt)) (*storedReceipt, error) {
+	return s.Apply(ctx, id, func(stored *storedReceipt) ([]outboxEvent, error) {
+		fn(stored)
+		return nil, nil
+	})
+}
+
+func (s *sealedStore) Apply(ctx context.Context, id string, fn func(*storedReceipt) ([]outboxEvent, error)) (*storedReceipt, error) {
+	stored, err := s.next.Apply(ctx, id, func(stored *storedReceipt) ([]outboxEvent, error) {
+		if err := openReceipt(ctx, stored); err != nil {
+			return nil, err
+		}
+		events, err := fn(stored)
+		if err != nil {
+			return nil, err
+		}
+		return events, sealReceipt(ctx, stored)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := openReceipt(ctx, stored); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+func (s *sealedStore) List(ctx context.Context, match func(*storedReceipt) bool) ([]*storedReceipt, error) {
+	return listOpened(ctx, func(m func(*storedReceipt) bool) ([]*storedReceipt, error) { return s.next.List(ctx, m) }, match)
+}
+
+// listOpened runs list with a match function that opens each receipt
+// before match sees it, and collects the opened copies itself. A receipt
+// that cannot be opened is left out, so one tenant's key cannot fail
+// another's listing; match still sees it, with an empty Receipt and
+// Sealed.openErr set, so callers can tell it is missing.
+func listOpened(ctx context.Context, list func(func(*storedReceipt) bool) ([]*storedReceipt, error), match func(*storedReceipt) bool) ([]*storedReceipt, error) {
+	matched := make([]*storedReceipt, 0)
+	_, err := list(func(stored *storedReceipt) bool {
+		opened := stored.clone()
+		if err := openReceipt(ctx, opened); err != nil {
+			sealed := *stored.Sealed
+			sealed.openErr = err
+			opened.Sealed = &sealed
+			if match != nil {
+				match(opened)
+			}
+			return false
+		}
+		if match == nil || match(opened) {
+			matched = append(matched, opened)
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(matched, func(i, j int) bool { return cursorOf(matched[i]).before(cursorOf(matched[j])) })
+	return matched, nil
+}
+
+func (s *sealedStore) PendingEvents(ctx context.Context, limit int) ([]outboxEvent, error) {
+	return s.next.PendingEvents(ctx, limit)
+}
+
+func (s *sealedStore) AckEvents(ctx context.Context, ids []string) error {
+	return s.next.AckEvents(ctx, ids)
+}
+
+func (s *sealedStore) Transact(ctx context.Context, fn func(tx storeTx) error) error {
+	return s.next.Transact(ctx, func(tx storeTx) error {
+		return fn(&sealedTx{ctx: ctx, next: tx})
+	})
+}
+
+type sealedTx struct {
+	ctx  context.Context
+	next storeTx
+}
+
+func (tx *sealedTx) Get(id string) (*storedReceipt, error) {
+	stored, err := tx.next.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := openReceipt(tx.ctx, stored); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+func (tx *sealedTx) List(match func(*storedReceipt) bool) ([]*storedReceipt, error) {
+	return listOpened(tx.ctx, tx.next.List, match)
+}
+
+func (tx *sealedTx) Put(stored *storedReceipt) error {
+	stored = stored.clone()
+	if err := sealReceipt(tx.ctx, stored); err != nil {
+		return err
+	}
+	return tx.next.Put(stored)
+}
+
+func (tx *sealedTx) Delete(id string) error     { return tx.next.Delete(id) }
+func (tx *sealedTx) Emit(events ...outboxEvent) { tx.next.Emit(events...) }
+
+// Records are not tenant data and pass through unsealed.
+func (tx *sealedTx) GetRecord(kind, key string) ([]byte, error) { return tx.next.GetRecord(kind, key) }
+func (tx *sealedTx) PutRecord(kind, key string, value []byte) error {
+	return tx.next.PutRecord(kind, key, value)
+}
+func (tx *sealedTx) DeleteRecord(kind, key string) error { return tx.next.DeleteRecord(kind, key) }
+
+func (s *sealedStore) GetRecord(ctx context.Context, kind, key string) ([]byte, error) {
+	return s.next.GetRecord(ctx, kind, key)
+}
+
+func (s *sealedStore) PutRecord(ctx context.Context, kind, key string, value []byte) error {
+	return s.next.PutRecord(ctx, kind, key, value)
+}
+
+func (s *sealedStore) DeleteRecord(ctx context.Context, kind, key string) error {
+	return s.next.DeleteRecord(ctx, kind, key)
+}
+
+func (s *sealedStore) ListRecords(ctx context.Context, kind string) (map[string][]byte, error) {
+	return s.next.ListRecords(ctx, kind)
+}
+
+// localKeys wraps data keys with AES-GCM under a key read from
+// TENANT_LOCAL_KEYS_DIR.
+type localKeys struct{}
+
+func localMasterKey(name string) (cipher.AEAD, error) {
+	if localKeysDir == "" {
+		return nil, errors.New("local keys need TENANT_LOCAL_KEYS_DIR")
+	}
+	if !tenantPattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid local key name %q", name)
+	}
+	data, err := os.ReadFile(filepath.Join(localKeysDir, name+".key"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no local key named %s", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("local key %s must be 32 bytes, base64-encoded", name)
+	}
+	return newGCM(key)
+}
+
+func (localKeys) generateDataKey(_ context.Context, name string) (plain, wrapped []byte, err error) {
+	master, err := localMasterKey(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	plain = make([]byte, 32)
+	nonce := make([]byte, master.NonceSize())
+	if _, err := rand.Read(plain); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return plain, master.Seal(nonce, nonce, plain, nil), nil
+}
+
+func (localKeys) decryptDataKey(_ context.Context, name string, wrapped []byte) ([]byte, error) {
+	master, err := localMasterKey(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < master.NonceSize() {
+		return nil, errors.New("wrapped data key is truncated")
+	}
+	nonce, sealed := wrapped[:master.NonceSize()], wrapped[master.NonceSize():]
+	plain, err := master.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("data key was not wrapped by local key %s", name)
+	}
+	return plain, nil
+}
+
+// kmsClient calls the AWS KMS JSON API, signing with the credentials S3
+// uses. Requests go to the region in the key's ARN, or AWS_REGION for bare
+// key IDs and aliases; KMS_ENDPOINT overrides the endpoint.
+type kmsClient struct {
+	awsCredentials
+	endpoint string
+	region   string
+	http     *http.Client
+}
+
+var kmsFromEnv = sync.OnceValues(func() (*kmsClient, error) {
+	client := &kmsClient{
+		awsCredentials: awsCredentialsFromEnv(),
+		endpoint:       strings.TrimSuffix(os.Getenv("KMS_ENDPOINT"), "/"),
+		region:         os.Getenv("AWS_REGION"),
+		http:           &http.Client{Timeout: 10 * time.Second},
+	}
+	if client.accessKey == "" || client.secretKey == "" {
+		return nil, errors.New("aws-kms keys need AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if client.region == "" {
+		client.region = "us-east-1"
+	}
+	return client, nil
+})
+
+// kmsRegion is the region a key ARN names, or fallback for a bare key ID.
+func kmsRegion(keyID, fallback string) (string, error) {
+	parts := strings.Split(keyID, ":")
+	if len(parts) <= 3 || parts[0] != "arn" {
+		return fallback, nil
+	}
+	if !kmsRegionPattern.MatchString(parts[3]) {
+		return "", fmt.Errorf("invalid region %q in key ARN", parts[3])
+	}
+	return parts[3], nil
+}
+
+func (k *kmsClient) call(ctx context.Context, keyID, action string, in, out any) error {
+	region, err := kmsRegion(keyID, k.region)
+	if err != nil {
+		return err
+	}
+	endpoint := k.endpoint
+	if endpoint == "" {
+		endpoint = "https://kms." + region + ".amazonaws.com"
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	k.sign(req, body, time.Now().UTC(), region, "kms")
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var kmsErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(msg, &kmsErr) == nil && kmsErr.Type != "" {
+			return fmt.Errorf("kms %s: %s: %s", action, kmsErr.Type, kmsErr.Message)
+		}
+		return fmt.Errorf("kms %s: %s: %s", action, resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (k *kmsClient) generateDataKey(ctx context.Context, keyID string) (plain, wrapped []byte, err error) {
+	var out struct {
+		CiphertextBlob []byte
+		Plaintext      []byte
+	}
+	if err := k.call(ctx, keyID, "GenerateDataKey", map[string]string{"KeyId": keyID, "KeySpec": "AES_256"}, &out); err != nil {
+		return nil, nil, err
+	}
+	return out.Plaintext, out.CiphertextBlob, nil
+}
+
+func (k *kmsClient) decryptDataKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	var out struct{ Plaintext []byte }
+	in := map[string]any{"KeyId": keyID, "CiphertextBlob": wrapped}
+	if err := k.call(ctx, keyID, "Decrypt", in, &out); err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+// getEncryptionKey serves GET /settings/encryption-key for the request's
+// tenant.
+func getEncryptionKey(c *gin.Context) {
+	keyRef := tenantKeyRef(tenantID(c))
+	c.JSON(http.StatusOK, gin.H{"keyRef": keyRef, "configured": keyRef != ""})
+}
+
+// putEncryptionKey sets the key the tenant's receipts are sealed with from
+// now on, after checking it can be used.
+func putEncryptionKey(c *gin.Context) {
+	var body struct {
+		KeyRef string `json:"keyRef"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+	keyRef := strings.TrimSpace(body.KeyRef)
+	if err := probeKey(c.Request.Context(), keyRef); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Encryption key is not usable: " + err.Error()})
+		return
+	}
+	tenant := tenantID(c)
+	if err := putRecordJSON(c.Request.Context(), recordTenantKeys, tenant, tenantKeyRecord{KeyRef: keyRef}); err != nil {
+		storeFailure(c, err)
+		return
+	}
+	tenantKeysMu.Lock()
+	previous := tenantKeys[tenant]
+	tenantKeys[tenant] = keyRef
+	delete(lockedTenants, tenant)
+	tenantKeysMu.Unlock()
+	if previous != keyRef {
+		log.Printf("tenant %s encryption key changed from %q to %q", tenant, previous, keyRef)
+	}
+	c.JSON(http.StatusOK, gin.H{"keyRef": keyRef, "configured": true})
+}
+
+// deleteEncryptionKey stops sealing the tenant's new receipts. Receipts
+// already sealed stay sealed under their key.
+func deleteEncryptionKey(c *gin.Context) {
+	tenant := tenantID(c)
+	if err := putRecordJSON(c.Request.Context(), recordTenantKeys, tenant, tenantKeyRecord{}); err != nil {
+		storeFailure(c, err)
+		return
+	}
+	tenantKeysMu.Lock()
+	delete(tenantKeys, tenant)
+	delete(lockedTenants, tenant)
+	tenantKeysMu.Unlock()
+	c.Status(http.StatusNoContent)
+}
+
+// resealReceipts serves POST /settings/encryption-key/reseal: the tenant's
+// receipts not sealed under its current key are resealed under it in one
+// transaction. Receipts whose old key is unusable are counted and left.
+func resealReceipts(c *gin.Context) {
+	tenant := tenantID(c)
+	keyRef := tenantKeyRef(tenant)
+	if keyRef == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Tenant has no encryption key"})
+		return
+	}
+	var resealed, unreadable int
+	err := store.Transact(c.Request.Context(), func(tx storeTx) error {
+		unreadable = 0
+		stale, err := tx.List(func(s *storedReceipt) bool {
+			if s.Tenant != tenant {
+				return false
+			}
+			if s.Sealed != nil && s.Sealed.openErr != nil {
+				unreadable++
+				return false
+			}
+			return s.Sealed == nil || s.Sealed.KeyRef != keyRef
+		})
+		if err != nil {
+			return err
+		}
+		for _, s := range stale {
+			if err := tx.Put(s); err != nil {
+				return err
+			}
+		}
+		resealed = len(stale)
+		return nil
+	})
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"keyRef": keyRef, "resealed": resealed, "unreadable": unreadable})
+}
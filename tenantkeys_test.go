@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Receipts created at the same instant keep the (CreatedAt, ID) order page
+// cursors rely on, whatever order the backend lists them in.
+func TestListOpenedOrdersTiesByID(t *testing.T) {
+	now := time.Now()
+	listed := []*storedReceipt{
+		{ID: "c", CreatedAt: now},
+		{ID: "a", CreatedAt: now.Add(time.Second)},
+		{ID: "b", CreatedAt: now},
+		{ID: "a", CreatedAt: now},
+	}
+	list := func(match func(*storedReceipt) bool) ([]*storedReceipt, error) {
+		for _, s := range listed {
+			match(s)
+		}
+		return nil, nil
+	}
+	opened, err := listOpened(context.Background(), list, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(opened); i++ {
+		if !cursorOf(opened[i-1]).before(cursorOf(opened[i])) {
+			t.Fatalf("listed out of cursor order at %d: %s@%v after %s@%v", i, opened[i].ID, opened[i].CreatedAt, opened[i-1].ID, opened[i-1].CreatedAt)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// With TENANT_MAX_IN_FLIGHT set, a tenant may have at most that many
+// requests running at once, so one tenant pushing a backfill through the
+// batch endpoint cannot take every handler from the others. A request over
+// its tenant's cap waits up to TENANT_QUEUE_WAIT for a slot, within its own
+// deadline, and is then refused with 429 tenant_concurrency. The cap is
+// per tenant, not a total: TENANT_CONCURRENCY_FILE, a JSON object of tenant
+// to limit, sets it for named tenants, where 0 leaves that tenant uncapped.
+// Sandbox tenants get SANDBOX_MAX_IN_FLIGHT instead of TENANT_MAX_IN_FLIGHT.
+// Admin routes and /metrics are not counted.
+//
+// Responses under a cap carry X-RateLimit-Limit and X-RateLimit-Remaining,
+// the tenant's cap and the slots left when the request started, and once
+// the tenant is using TENANT_SOFT_LIMIT (0.8 by default) of its cap, a
+// Warning header, so integrators can slow down before they meet 429s.
+
+var (
+	tenantMaxInFlight = envInt("TENANT_MAX_IN_FLIGHT", 0)
+	tenantQueueWait   = envDuration("TENANT_QUEUE_WAIT", 100*time.Millisecond)
+	tenantSoftLimit   = envFloat("TENANT_SOFT_LIMIT", 0.8)
+
+	tenantLimitsMu sync.RWMutex
+	tenantLimits   map[string]int
+)
+
+var tenantThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "receipt_tenant_concurrency_rejected_total",
+	Help: "Requests refused because their tenant had its maximum number of requests in flight.",
+}, []string{"tenant"})
+
+var tenantNearLimit = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "receipt_tenant_concurrency_warnings_total",
+	Help: "Requests answered with a warning because their tenant was near its concurrency cap.",
+}, []string{"tenant"})
+
+var tenantInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "receipt_tenant_requests_in_flight",
+	Help: "Requests running per tenant, for tenants under a concurrency cap.",
+}, []string{"tenant"})
+
+func loadTenantLimits(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	limits := make(map[string]int)
+	if err := json.Unmarshal(data, &limits); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	for tenant, limit := range limits {
+		if !tenantPattern.MatchString(tenant) {
+			return fmt.Errorf("invalid tenant %q", tenant)
+		}
+		if limit < 0 {
+			return fmt.Errorf("limit for %q must not be negative", tenant)
+		}
+	}
+	tenantLimitsMu.Lock()
+	tenantLimits = limits
+	tenantLimitsMu.Unlock()
+	return nil
+}
+
+func tenantLimit(tenant string) int {
+	tenantLimitsMu.RLock()
+	defer tenantLimitsMu.RUnlock()
+	if limit, ok := tenantLimits[tenant]; ok {
+		return limit
+	}
+	if isSandboxTenant(tenant) {
+		return sandboxMaxInFlight
+	}
+	return tenantMaxInFlight
+}
+
+// tenantSlots is a tenant's semaphore, kept while any request holds or
+// waits for a slot.
+type tenantSlots struct {
+	sem   chan struct{}
+	users int
+}
+
+var (
+	tenantSlotsMu     sync.Mutex
+	tenantSlotsByName = make(map[string]*tenantSlots)
+)
+
+// limitTenantConcurrency is middleware holding a slot of the requesting
+// tenant's cap while the request runs.
+func limitTenantConcurrency(c *gin.Context) {
+	path := c.FullPath()
+	if path == "/metrics" || path == drainStatusPath || strings.HasPrefix(path, "/admin") {
+		c.Next()
+		return
+	}
+	tenant := tenantID(c)
+	limit := tenantLimit(tenant)
+	if limit <= 0 {
+		c.Next()
+		return
+	}
+
+	tenantSlotsMu.Lock()
+	slots := tenantSlotsByName[tenant]
+	if slots == nil {
+		slots = &tenantSlots{sem: make(chan struct{}, limit)}
+		tenantSlotsByName[tenant] = slots
+	}
+	slots.users++
+	tenantSlotsMu.Unlock()
+	defer func() {
+		tenantSlotsMu.Lock()
+		if slots.users--; slots.users == 0 {
+			delete(tenantSlotsByName, tenant)
+		}
+		tenantSlotsMu.Unlock()
+	}()
+
+	select {
+	case slots.sem <- struct{}{}:
+	default:
+		wait := time.NewTimer(tenantQueueWait)
+		defer wait.Stop()
+		select {
+		case slots.sem <- struct{}{}:
+		case <-wait.C:
+			tenantRefused(c, tenant, limit)
+			return
+		case <-c.Request.Context().Done():
+			tenantRefused(c, tenant, limit)
+			return
+		}
+	}
+	inUse := len(slots.sem)
+	c.Header("X-RateLimit-Limit", strconv.Itoa(limit))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(limit-inUse))
+	if float64(inUse) >= tenantSoftLimit*float64(limit) {
+		tenantNearLimit.WithLabelValues(tenantLabel(tenant)).Inc()
+		c.Header("Warning", fmt.Sprintf(`199 - "Tenant is using %d of its %d concurrent requests"`, inUse, limit))
+	}
+	gauge := tenantInFlight.WithLabelValues(tenantLabel(tenant))
+	gauge.Inc()
+	defer func() {
+		<-slots.sem
+		gauge.Dec()
+	}()
+	c.Next()
+}
+
+func tenantRefused(c *gin.Context, tenant string, limit int) {
+	tenantThrottled.WithLabelValues(tenantLabel(tenant)).Inc()
+	c.Header("Retry-After", "1")
+	c.Header("X-RateLimit-Limit", strconv.Itoa(limit))
+	c.Header("X-RateLimit-Remaining", "0")
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+		"error": "Too many requests in flight for this tenant",
+		"code":  "tenant_concurrency",
+		"limit": limit,
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// overflowTenant is the label used once tenantLabels is full, so a flood of
+// new tenant IDs cannot grow the metric series without bound.
+const overflowTenant = "other"
+
+var tenantRequestDuration = promauto.NewSummaryVec(prometheus.SummaryOpts{
+	Name:       "receipt_tenant_request_duration_seconds",
+	Help:       "Request latency by tenant, as percentiles over the last ten minutes.",
+	Objectives: latencyObjectives(os.Getenv("TENANT_LATENCY_QUANTILES")),
+	MaxAge:     10 * time.Minute,
+}, []string{"tenant"})
+
+var tenantRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "receipt_tenant_requests_total",
+	Help: "Requests by tenant and status class (2xx, 3xx, 4xx or 5xx).",
+}, []string{"tenant", "class"})
+
+// tenantLabels admits the first TENANT_METRICS_LIMIT tenants seen as their
+// own label values; later tenants are reported as "other".
+var tenantLabels = struct {
+	sync.Mutex
+	seen  map[string]bool
+	limit int
+}{seen: make(map[string]bool), limit: envInt("TENANT_METRICS_LIMIT", 50)}
+
+// latencyObjectives parses a comma-separated quantile list such as
+// "0.5,0.9,0.99". Each quantile gets an error margin of a tenth of its
+// distance from 1.
+func latencyObjectives(raw string) map[float64]float64 {
+	if raw == "" {
+		raw = "0.5,0.9,0.95,0.99"
+	}
+	objectives := make(map[float64]float64)
+	for _, field := range strings.Split(raw, ",") {
+		q, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || q <= 0 || q >= 1 {
+			log.Fatalf("TENANT_LATENCY_QUANTILES: invalid quantile %q", field)
+		}
+		objectives[q] = (1 - q) / 10
+	}
+	return objectives
+}
+
+func tenantLabel(tenant string) string {
+	tenantLabels.Lock()
+	defer tenantLabels.Unlock()
+	if tenantLabels.seen[tenant] {
+		return tenant
+	}
+	if len(tenantLabels.seen) >= tenantLabels.limit {
+		return overflowTenant
+	}
+	tenantLabels.seen[tenant] = true
+	return tenant
+}
+
+// observeTenant is middleware recording latency and status class per tenant.
+func observeTenant(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	tenant := tenantLabel(tenantID(c))
+	tenantRequestDuration.WithLabelValues(tenant).Observe(time.Since(start).Seconds())
+	class := strconv.Itoa(c.Writer.Status()/100) + "xx"
+	tenantRequestsTotal.WithLabelValues(tenant, class).Inc()
+}
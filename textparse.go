@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// textTemplate turns a plain-text receipt, as printed, into a Receipt.
+// Detect picks the template for a text; the other patterns are matched line
+// by line and must capture the named groups date, time, desc and price, and
+// total. Lines matching Skip (subtotals, tax, tenders) are never items.
+type textTemplate struct {
+	Name        string   `json:"name"`
+	Retailer    string   `json:"retailer,omitempty"` // empty: the first line of the text
+	Detect      string   `json:"detect"`
+	Date        string   `json:"date"`
+	DateLayouts []string `json:"dateLayouts"`
+	Time        string   `json:"time"`
+	TimeLayouts []string `json:"timeLayouts"`
+	Item        string   `json:"item"`
+	Total       string   `json:"total"`
+	Skip        string   `json:"skip"`
+
+	detect, date, clock, item, total, skip *regexp.Regexp
+}
+
+const (
+	genericSkip  = `(?i)\b(sub\s*-?total|tax|change|cash|visa|mastercard|amex|debit|credit|balance|tend|payment|savings)\b`
+	genericTotal = `(?i)^\s*(?:order\s+)?total\s*:?\s*\$?\s*(?P<total>\d+\.\d{2})\b`
+	genericTime  = `(?P<time>\b\d{1,2}:\d{2}(?::\d{2})?(?:\s*[AaPp][Mm])?)`
+)
+
+var (
+	genericDateLayouts = []string{"01/02/2006", "1/2/2006", "01/02/06", "1/2/06", "2006-01-02"}
+	genericTimeLayouts = []string{"15:04", "15:04:05", "3:04 PM", "3:04PM", "3:04:05 PM"}
+)
+
+// genericTextTemplate is tried when no retailer template detects the text.
+var genericTextTemplate = textTemplate{
+	Name:        "generic",
+	Date:        `(?P<date>\b\d{1,2}/\d{1,2}/\d{2,4}\b|\b\d{4}-\d{2}-\d{2}\b)`,
+	DateLayouts: genericDateLayouts,
+	Time:        genericTime,
+	TimeLayouts: genericTimeLayouts,
+	Item:        `^\s*(?P<desc>.*?[A-Za-z].*?)\s+\$?(?P<price>\d+\.\d{2})\s*[A-Z]?\s*$`,
+	Total:       genericTotal,
+	Skip:        genericSkip,
+}
+
+var builtinTextTemplates = []textTemplate{
+	{
+		Name:        "walmart",
+		Retailer:    "Walmart",
+		Detect:      `(?i)\bwal-?mart\b`,
+		Date:        `(?P<date>\b\d{2}/\d{2}/\d{2}\b)`,
+		DateLayouts: []string{"01/02/06"},
+		Time:        genericTime,
+		TimeLayouts: genericTimeLayouts,
+		// GV WHL MILK 007874235186 F 3.48 N
+		Item:  `^\s*(?P<desc>.+?)\s+\d{12}\s+(?:[A-Z]\s+)?(?P<price>\d+\.\d{2})\s*[A-Z]?\s*$`,
+		Total: genericTotal,
+		Skip:  genericSkip,
+	},
+	{
+		Name:        "target",
+		Retailer:    "Target",
+		Detect:      `(?i)\btarget\b`,
+		Date:        `(?P<date>\b\d{2}/\d{2}/\d{4}\b)`,
+		DateLayouts: []string{"01/02/2006"},
+		Time:        genericTime,
+		TimeLayouts: genericTimeLayouts,
+		// 212080154 MOUNTAIN DEW 12PK   NF $6.49
+		Item:  `^\s*(?:\d{9}\s+)?(?P<desc>.+?)\s+(?:[A-Z]{1,2}\s+)?\$(?P<price>\d+\.\d{2})\s*$`,
+		Total: genericTotal,
+		Skip:  genericSkip,
+	},
+}
+
+var textTemplates []textTemplate
+
+// loadTextTemplates installs the built-in templates and then those in path
+// (a JSON array), if given. File templates come first, so they win over a
+// built-in template that detects the same text.
+func loadTextTemplates(path string) error {
+	var templates []textTemplate
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &templates); err != nil {
+			return fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+	templates = append(templates, builtinTextTemplates...)
+	for i := range templates {
+		if err := templates[i].compile(); err != nil {
+			return fmt.Errorf("text template %q: %w", templates[i].Name, err)
+		}
+	}
+	if err := genericTextTemplate.compile(); err != nil {
+		return err
+	}
+	textTemplates = templates
+	return nil
+}
+
+func (t *textTemplate) compile() error {
+	if t.Name == "" {
+		return fmt.Errorf("a name is required")
+	}
+	patterns := []struct {
+		source string
+		re     **regexp.Regexp
+		groups []string
+	}{
+		{t.Detect, &t.detect, nil},
+		{t.Date, &t.date, []string{"date"}},
+		{t.Time, &t.clock, []string{"time"}},
+		{t.Item, &t.item, []string{"desc", "price"}},
+		{t.Total, &t.total, []string{"total"}},
+		{t.Skip, &t.skip, nil},
+	}
+	for _, p := range patterns {
+		if p.source == "" {
+			continue
+		}
+		re, err := regexp.Compile(p.source)
+		if err != nil {
+			return err
+		}
+		for _, group := range p.groups {
+			if re.SubexpIndex(group) < 0 {
+				return fmt.Errorf("pattern %q has no %q group", p.source, group)
+			}
+		}
+		*p.re = re
+	}
+	if t.item == nil || t.total == nil {
+		return fmt.Errorf("item and total patterns are required")
+	}
+	return nil
+}
+
+func textTemplateFor(text, name string) (*textTemplate, bool) {
+	for i := range textTemplates {
+		t := &textTemplates[i]
+		if name != "" && t.Name == name || name == "" && t.detect != nil && t.detect.MatchString(text) {
+			return t, true
+		}
+	}
+	if name == "" || name == genericTextTemplate.Name {
+		return &genericTextTemplate, true
+	}
+	return nil, false
+}
+
+// parse extracts what it can and lists the fields it could not find; the
+// receipt still goes through validation when submitted.
+func (t *textTemplate) parse(text string) (Receipt, []string) {
+	receipt := Receipt{SchemaVersion: currentSchemaVersion, Retailer: t.Retailer, Currency: "USD"}
+	var missing []string
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if receipt.Retailer == "" {
+			receipt.Retailer = canonicalText(line)
+			continue
+		}
+		if receipt.PurchaseDate == "" && t.date != nil {
+			if m := t.date.FindStringSubmatch(line); m != nil {
+				receipt.PurchaseDate = parseLayouts(m[t.date.SubexpIndex("date")], t.DateLayouts, "2006-01-02")
+			}
+		}
+		if receipt.PurchaseTime == "" && t.clock != nil {
+			if m := t.clock.FindStringSubmatch(line); m != nil {
+				raw := strings.ToUpper(m[t.clock.SubexpIndex("time")])
+				receipt.PurchaseTime = parseLayouts(raw, t.TimeLayouts, "15:04")
+			}
+		}
+		if m := t.total.FindStringSubmatch(line); m != nil {
+			receipt.Total = m[t.total.SubexpIndex("total")]
+			continue
+		}
+		if t.skip != nil && t.skip.MatchString(line) {
+			continue
+		}
+		if m := t.item.FindStringSubmatch(line); m != nil {
+			receipt.Items = append(receipt.Items, Item{
+				ShortDescription: canonicalText(m[t.item.SubexpIndex("desc")]),
+				Price:            m[t.item.SubexpIndex("price")],
+				Quantity:         1,
+				Category:         "uncategorized",
+			})
+		}
+	}
+	fields := []struct{ name, value string }{
+		{"retailer", receipt.Retailer},
+		{"purchaseDate", receipt.PurchaseDate},
+		{"purchaseTime", receipt.PurchaseTime},
+		{"total", receipt.Total},
+	}
+	for _, field := range fields {
+		if field.value == "" {
+			missing = append(missing, field.name)
+		}
+	}
+	if len(receipt.Items) == 0 {
+		missing = append(missing, "items")
+	}
+	return receipt, missing
+}
+
+// parseLayouts reformats raw with the first layout that parses it, or
+// returns "".
+func parseLayouts(raw string, layouts []string, out string) string {
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, strings.TrimSpace(raw)); err == nil {
+			return t.Format(out)
+		}
+	}
+	return ""
+}
+
+// parseReceiptText serves POST /receipts/parse-text. The body is the
+// receipt text; ?template= forces a template instead of detecting one. The
+// response is the parsed receipt, ready for /receipts/process, with any
+// fields that could not be found and the validation errors it would get.
+func parseReceiptText(c *gin.Context) {
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil || strings.TrimSpace(string(data)) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Receipt text is required"})
+		return
+	}
+	text := string(data)
+	t, ok := textTemplateFor(text, c.Query("template"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown text template"})
+		return
+	}
+	receipt, missing := t.parse(text)
+	resp := gin.H{"template": t.Name, "receipt": receipt}
+	if missing != nil {
+		resp["missing"] = missing
+	}
+	if errs := validateReceipt(receipt); errs != nil {
+		resp["errors"] = errs
+	}
+	c.JSON(http.StatusOK, resp)
+}
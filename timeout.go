@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errorResponse aborts with the structured error envelope: a human-readable
+// "error" message plus a stable machine-readable "code".
+func errorResponse(c *gin.Context, status int, code, message string) {
+	c.AbortWithStatusJSON(status, gin.H{"error": message, "code": code})
+}
+
+var (
+	defaultRequestTimeout = envDuration("REQUEST_TIMEOUT", 5*time.Second)
+
+	// routeTimeouts overrides defaultRequestTimeout for routes, keyed by
+	// their registered path, that legitimately take longer.
+	routeTimeouts = map[string]time.Duration{
+		"/receipts/process":        envDuration("REQUEST_TIMEOUT_PROCESS", 10*time.Second),
+		"/receipts/process/stream": envDuration("REQUEST_TIMEOUT_STREAM", 12*time.Hour),
+		"/receipts/:id/image":      envDuration("REQUEST_TIMEOUT_IMAGE", 30*time.Second),
+		"/receipts/:id/points":     pointsMaxWait + defaultRequestTimeout,
+		"/admin/reports/:id/run":   2 * time.Minute,
+		"/admin/exports/:name/run": 5 * time.Minute,
+	}
+)
+
+// withRequestTimeout gives each request a context deadline. Handlers pass
+// c.Request.Context() to scoring and storage and bail out with
+// requestExpired; if a handler returns past the deadline without writing a
+// response, a 504 is sent for it.
+func withRequestTimeout(c *gin.Context) {
+	timeout, ok := routeTimeouts[c.FullPath()]
+	if !ok {
+		timeout = defaultRequestTimeout
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+	c.Request = c.Request.WithContext(ctx)
+
+	c.Next()
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) && !c.Writer.Written() {
+		errorResponse(c, http.StatusGatewayTimeout, "timeout", "Request timed out")
+	}
+}
+
+// requestExpired writes the 504 envelope and reports true when err stems
+// from the request deadline.
+func requestExpired(c *gin.Context, err error) bool {
+	if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+		return false
+	}
+	errorResponse(c, http.StatusGatewayTimeout, "timeout", "Request timed out")
+	return true
+}
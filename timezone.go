@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+	_ "time/tzdata" // zone rules for PROGRAM_TIMEZONE and receipt time zones
+)
+
+// Date and time rules (odd purchase day, the 2–4pm bonus) are evaluated on
+// the program's wall clock, PROGRAM_TIMEZONE (an IANA zone, UTC by
+// default). A receipt's purchase date and time are wall-clock readings in
+// its optional timeZone, or in the program zone when it has none, and are
+// converted with the zones' DST rules rather than a fixed offset.
+//
+// Two local readings need a policy. In the spring-forward gap the reading
+// does not exist; it is taken as the same distance past the transition, so
+// 02:30 on the night clocks jump from 02:00 to 03:00 becomes 03:30. In the
+// fall-back overlap the reading happens twice; the first occurrence wins.
+//
+// A program zone other than UTC is folded into the rules version recorded
+// on receipts (see scoredVersion), since it changes what those rules award.
+
+var programZone = programZoneFromEnv()
+
+func programZoneFromEnv() *time.Location {
+	name := os.Getenv("PROGRAM_TIMEZONE")
+	if name == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Fatalf("PROGRAM_TIMEZONE: %v", err)
+	}
+	return loc
+}
+
+// programPurchaseTime returns the receipt's purchase moment on the program
+// clock, or false when its date, time or zone do not parse.
+func programPurchaseTime(receipt Receipt) (time.Time, bool) {
+	date, err := time.Parse(time.DateOnly, receipt.PurchaseDate)
+	if err != nil {
+		return time.Time{}, false
+	}
+	hm, err := time.Parse("15:04", receipt.PurchaseTime)
+	if err != nil {
+		return time.Time{}, false
+	}
+	wall := date.Add(time.Duration(hm.Hour())*time.Hour + time.Duration(hm.Minute())*time.Minute)
+	loc := programZone
+	if receipt.TimeZone != "" {
+		if loc, err = loadZone(receipt.TimeZone); err != nil {
+			return time.Time{}, false
+		}
+	}
+	return resolveWallClock(wall, loc).In(programZone), true
+}
+
+var zones = newCache[string, *time.Location]("time_zones", 1024, 0)
+
+// loadZone is time.LoadLocation with a cache: loading reads and parses the
+// zone's rules every time, which is too slow to do per receipt.
+func loadZone(name string) (*time.Location, error) {
+	if loc, ok := zones.get(name); ok {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	zones.set(name, loc, 0)
+	return loc, nil
+}
+
+// resolveWallClock finds the instant a wall-clock reading (given in UTC
+// fields) names in loc, applying the gap and overlap policy above.
+func resolveWallClock(wall time.Time, loc *time.Location) time.Time {
+	// Any transition near the reading lies between the offsets in force a
+	// day either side of it.
+	_, before := wall.Add(-24 * time.Hour).In(loc).Zone()
+	_, after := wall.Add(24 * time.Hour).In(loc).Zone()
+	var found time.Time
+	for _, offset := range []int{before, after} {
+		t := wall.Add(-time.Duration(offset) * time.Second)
+		if sameWallClock(t.In(loc), wall) && (found.IsZero() || t.Before(found)) {
+			found = t
+		}
+	}
+	if found.IsZero() {
+		// In the gap: reading with the offset from before the jump lands
+		// the same distance past it.
+		found = wall.Add(-time.Duration(before) * time.Second)
+	}
+	return found
+}
+
+func sameWallClock(t, wall time.Time) bool {
+	y1, m1, d1 := t.Date()
+	y2, m2, d2 := wall.Date()
+	return y1 == y2 && m1 == m2 && d1 == d2 && t.Hour() == wall.Hour() && t.Minute() == wall.Minute()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func mustZone(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestResolveWallClockAcrossDST(t *testing.T) {
+	tests := []struct {
+		name, zone, wall, want string
+	}{
+		{"standard time", "America/New_York", "2024-01-15 12:00", "2024-01-15T17:00:00Z"},
+		{"daylight time", "America/New_York", "2024-07-01 12:00", "2024-07-01T16:00:00Z"},
+		// 02:00 EST jumps to 03:00 EDT; 02:30 does not exist.
+		{"spring forward gap", "America/New_York", "2024-03-10 02:30", "2024-03-10T07:30:00Z"},
+		{"just before spring forward", "America/New_York", "2024-03-10 01:59", "2024-03-10T06:59:00Z"},
+		{"just after spring forward", "America/New_York", "2024-03-10 03:00", "2024-03-10T07:00:00Z"},
+		// 02:00 EDT falls back to 01:00 EST; 01:30 happens twice.
+		{"fall back overlap", "America/New_York", "2024-11-03 01:30", "2024-11-03T05:30:00Z"},
+		{"after fall back", "America/New_York", "2024-11-03 02:30", "2024-11-03T07:30:00Z"},
+		{"southern spring forward gap", "Australia/Sydney", "2024-10-06 02:30", "2024-10-05T16:30:00Z"},
+		{"southern fall back overlap", "Australia/Sydney", "2024-04-07 02:30", "2024-04-06T15:30:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wall, err := time.Parse("2006-01-02 15:04", tt.wall)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := resolveWallClock(wall, mustZone(t, tt.zone)).UTC().Format(time.RFC3339)
+			if got != tt.want {
+				t.Errorf("%s in %s = %s, want %s", tt.wall, tt.zone, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProgramPurchaseTimeUsesReceiptZone(t *testing.T) {
+	saved := programZone
+	defer func() { programZone = saved }()
+	programZone = mustZone(t, "Europe/Berlin")
+
+	receipt := Receipt{PurchaseDate: "2024-03-31", PurchaseTime: "02:30"}
+	got, ok := programPurchaseTime(receipt)
+	// Berlin springs forward at 02:00 that night, so 02:30 reads as 03:30 CEST.
+	if !ok || got.Format("2006-01-02 15:04 MST") != "2024-03-31 03:30 CEST" {
+		t.Errorf("program-zone reading = %v, %v", got, ok)
+	}
+
+	receipt.TimeZone = "America/New_York"
+	got, ok = programPurchaseTime(receipt)
+	if !ok || got.Format("2006-01-02 15:04 MST") != "2024-03-31 08:30 CEST" {
+		t.Errorf("receipt-zone reading = %v, %v", got, ok)
+	}
+
+	receipt.TimeZone = "Mars/Olympus_Mons"
+	if _, ok := programPurchaseTime(receipt); ok {
+		t.Error("unknown zone parsed")
+	}
+}
+
+func TestScoringDigestIncludesProgramZone(t *testing.T) {
+	if got := scoringDigest(nil, time.UTC); got != "" {
+		t.Errorf("UTC with no overrides has digest %q, want none", got)
+	}
+	newYork := scoringDigest(nil, mustZone(t, "America/New_York"))
+	berlin := scoringDigest(nil, mustZone(t, "Europe/Berlin"))
+	if newYork == "" || berlin == "" || newYork == berlin {
+		t.Errorf("zone digests %q and %q should be set and differ", newYork, berlin)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Latency histograms carry the trace ID of a sampled request as an
+// OpenMetrics exemplar, so a spike on a dashboard leads to a trace of one of
+// the slow requests behind it. The service does no tracing itself: the trace
+// is whatever the caller or the gateway in front of it started and passed in
+// a W3C traceparent header. /metrics serves the OpenMetrics format, which is
+// the one that carries exemplars, to scrapers that ask for it. Async jobs
+// keep the trace of the request that queued them.
+
+type traceIDKey struct{}
+
+var requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "receipt_http_request_duration_seconds",
+	Help:    "Request latency by route and status class.",
+	Buckets: prometheus.ExponentialBuckets(0.001, 2.5, 10),
+}, []string{"route", "class"})
+
+// traceContext records the request's trace ID, when it belongs to a sampled
+// trace, in the request context, and times the request.
+func traceContext(c *gin.Context) {
+	start := time.Now()
+	if id, ok := sampledTraceID(c.GetHeader("traceparent")); ok {
+		c.Request = c.Request.WithContext(withTraceID(c.Request.Context(), id))
+	}
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	class := strconv.Itoa(c.Writer.Status()/100) + "xx"
+	observeTraced(c.Request.Context(), requestDuration.WithLabelValues(route, class), time.Since(start).Seconds())
+}
+
+// sampledTraceID returns the trace ID of a version 00 traceparent header
+// whose sampled flag is set.
+func sampledTraceID(header string) (string, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", false
+	}
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || strings.ToLower(parts[1]) != parts[1] || allZero(traceID) {
+		return "", false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || flags[0]&0x01 == 0 {
+		return "", false
+	}
+	return parts[1], true
+}
+
+func allZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func withTraceID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, traceIDKey{}, id)
+}
+
+func traceID(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey{}).(string)
+	return id
+}
+
+// observeTraced observes v, with the trace ID in ctx as its exemplar when
+// there is one.
+func observeTraced(ctx context.Context, obs prometheus.Observer, v float64) {
+	id := traceID(ctx)
+	if eo, ok := obs.(prometheus.ExemplarObserver); ok && id != "" {
+		eo.ObserveWithExemplar(v, prometheus.Labels{"trace_id": id})
+		return
+	}
+	obs.Observe(v)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The admin UI is a static page under /ui that drives the admin API from
+// the browser. It sits behind requireAdminUI, so the browser asks for the
+// admin token once and sends it with every later API call.
+
+//go:embed ui
+var uiAssets embed.FS
+
+func registerUI(r *gin.Engine) {
+	assets, err := fs.Sub(uiAssets, "ui")
+	if err != nil {
+		panic(err)
+	}
+	index, err := fs.ReadFile(assets, "index.html")
+	if err != nil {
+		panic(err)
+	}
+	ui := r.Group("/ui", requireAdminUI)
+	ui.GET("", func(c *gin.Context) { c.Data(http.StatusOK, "text/html; charset=utf-8", index) })
+	ui.StaticFS("/assets", http.FS(assets))
+}
+
+// getAdminReceipt serves GET /admin/receipts/:id with everything stored
+// about a receipt.
+func getAdminReceipt(c *gin.Context) {
+	stored, err := store.Get(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		storeFailure(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":                stored.ID,
+		"tenant":            stored.Tenant,
+		"retailer":          stored.Retailer,
+		"receipt":           stored.Receipt,
+		"status":            stored.Status,
+		"quarantineReasons": stored.QuarantineReasons,
+		"points":            stored.netPoints(),
+		"earned":            stored.Points,
+		"rulesVersion":      stored.RulesVersion,
+		"breakdown":         stored.Breakdown,
+		"ledger":            stored.Ledger,
+		"disputes":          stored.Disputes,
+		"tags":              stored.Tags,
+		"hash":              stored.Hash,
+		"hasImage":          stored.HasImage,
+		"hasThumbnail":      stored.HasThumbnail,
+		"createdAt":         stored.CreatedAt.UTC(),
+	})
+}
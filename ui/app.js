@@ -0,0 +1,172 @@
+// The page is served behind HTTP Basic auth with ADMIN_TOKEN as the
+// password, so the browser sends the same credentials on these fetches.
+// Changes also need the CSRF token the page was given in a cookie.
+function csrfToken() {
+  const match = document.cookie.match(/(?:^|; )admin_csrf=([^;]*)/);
+  return match ? decodeURIComponent(match[1]) : "";
+}
+
+async function api(path, options) {
+  options = options || {};
+  if (options.method && options.method !== "GET") {
+    options.headers = Object.assign({ "X-CSRF-Token": csrfToken() }, options.headers);
+  }
+  const resp = await fetch(path, options);
+  if (resp.status === 204) return null;
+  const body = await resp.json();
+  if (!resp.ok) throw new Error(body.error || resp.statusText);
+  return body;
+}
+
+function el(tag, text) {
+  const node = document.createElement(tag);
+  if (text !== undefined) node.textContent = text;
+  return node;
+}
+
+function row(cells) {
+  const tr = el("tr");
+  for (const cell of cells) {
+    const td = el("td");
+    if (cell instanceof Node) td.append(cell); else td.textContent = cell;
+    tr.append(td);
+  }
+  return tr;
+}
+
+// Receipts
+
+let receiptCursor = "";
+
+async function loadReceipts(event, more) {
+  if (event) event.preventDefault();
+  const form = new FormData(document.getElementById("receipt-filter"));
+  const params = new URLSearchParams();
+  for (const [key, value] of form) if (value) params.append(key, value);
+  if (more) params.set("cursor", receiptCursor);
+  const body = await api("/receipts?" + params);
+  const tbody = document.querySelector("#receipt-list tbody");
+  if (!more) tbody.replaceChildren();
+  for (const r of body.receipts) {
+    const tr = row([el("code", r.id.slice(0, 8)), r.retailer, r.points, r.status, (r.tags || []).join(", ")]);
+    tr.onclick = () => showReceipt(r.id);
+    tbody.append(tr);
+  }
+  receiptCursor = body.nextCursor || "";
+  document.getElementById("receipt-more").hidden = !receiptCursor;
+}
+
+async function showReceipt(id) {
+  const panel = document.getElementById("receipt-detail");
+  panel.hidden = false;
+  panel.replaceChildren(el("p", "Loading…"));
+  const r = await api("/admin/receipts/" + id);
+  const items = el("table");
+  items.append(row(["Item", "Price"]));
+  r.receipt.items.forEach((item, i) => items.append(row([i + ": " + item.shortDescription, item.price])));
+  const rules = el("table");
+  rules.append(row(["Rule", "Points"]));
+  for (const result of r.breakdown || []) {
+    rules.append(row([result.rule + (result.item !== undefined ? " (item " + result.item + ")" : ""), result.points]));
+  }
+  rules.append(row([el("strong", "Total"), el("strong", String(r.points))]));
+  panel.replaceChildren(
+    el("h3", r.retailer),
+    el("p", `${r.receipt.purchaseDate} ${r.receipt.purchaseTime} · total ${r.receipt.total} · ${r.status} · rules ${r.rulesVersion || "-"}`),
+    el("h4", "Points breakdown"), rules,
+    el("h4", "Items"), items,
+  );
+  if (r.hasThumbnail) {
+    const thumb = el("img");
+    thumb.className = "thumbnail";
+    thumb.alt = "Receipt image";
+    thumb.src = "/admin/receipts/" + id + "/thumbnail";
+    const link = el("a");
+    link.href = "/receipts/" + id + "/image";
+    link.target = "_blank";
+    link.append(thumb);
+    panel.insertBefore(link, panel.children[2]);
+  }
+  if (r.ledger && r.ledger.length) {
+    const ledger = el("table");
+    for (const entry of r.ledger) ledger.append(row([entry.kind, entry.points, entry.reason || ""]));
+    panel.append(el("h4", "Ledger"), ledger);
+  }
+}
+
+// Rules
+
+async function loadRules() {
+  document.getElementById("rollout").textContent = JSON.stringify(await api("/admin/rules/rollout"), null, 2);
+  const body = await api("/admin/retailers");
+  const tbody = document.querySelector("#retailer-list tbody");
+  tbody.replaceChildren();
+  for (const p of body.retailers) {
+    const remove = el("button", "Delete");
+    remove.onclick = async (event) => {
+      event.stopPropagation();
+      if (!confirm("Delete " + p.canonical + "?")) return;
+      await api("/admin/retailers/" + encodeURIComponent(p.canonical), { method: "DELETE" });
+      loadRules();
+    };
+    const tr = row([p.canonical, p.category || "", (p.aliases || []).join(", "),
+      JSON.stringify(p.scoringOverrides || {}), (p.promotions || []).map((promo) => promo.name).join(", "), remove]);
+    tr.onclick = () => {
+      document.querySelector("#retailer-form textarea").value = JSON.stringify(p, null, 2);
+    };
+    tbody.append(tr);
+  }
+}
+
+async function saveRetailer(event) {
+  event.preventDefault();
+  const form = event.target;
+  const message = form.querySelector(".message");
+  message.textContent = "";
+  try {
+    const profile = JSON.parse(form.profile.value);
+    const existing = await fetch("/admin/retailers/" + encodeURIComponent(profile.canonical));
+    const method = existing.ok ? "PUT" : "POST";
+    const path = existing.ok ? "/admin/retailers/" + encodeURIComponent(profile.canonical) : "/admin/retailers";
+    await api(path, { method, headers: { "Content-Type": "application/json" }, body: JSON.stringify(profile) });
+    loadRules();
+  } catch (err) {
+    message.textContent = err.message;
+  }
+}
+
+// Live
+
+async function loadLive() {
+  const body = await api("/analytics/live");
+  const cards = document.getElementById("live-windows");
+  cards.replaceChildren();
+  for (const [name, w] of Object.entries(body.windows)) {
+    const card = el("div");
+    card.append(el("span", name), el("strong", w.receiptsPerMinute.toFixed(1) + "/min"),
+      el("span", `${(w.errorRate * 100).toFixed(1)}% errors · ${(w.rejectionRate * 100).toFixed(1)}% rejected`));
+    cards.append(card);
+  }
+  const tbody = document.querySelector("#live-retailers tbody");
+  tbody.replaceChildren(...body.topRetailers.map((r) => row([r.retailer, r.receipts])));
+}
+
+// Navigation
+
+const loaders = { receipts: loadReceipts, rules: loadRules, live: loadLive };
+let liveTimer;
+
+function route() {
+  const current = (location.hash || "#receipts").slice(1);
+  for (const section of document.querySelectorAll("main > section")) section.hidden = section.id !== current;
+  for (const link of document.querySelectorAll("nav a")) link.classList.toggle("active", link.hash === "#" + current);
+  clearInterval(liveTimer);
+  if (current === "live") liveTimer = setInterval(loadLive, 5000);
+  (loaders[current] || loadReceipts)().catch((err) => alert(err.message));
+}
+
+document.getElementById("receipt-filter").onsubmit = loadReceipts;
+document.getElementById("receipt-more").onclick = () => loadReceipts(null, true).catch((err) => alert(err.message));
+document.getElementById("retailer-form").onsubmit = saveRetailer;
+window.onhashchange = route;
+route();
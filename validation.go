@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Receipts are validated against the API's field formats before they are
+// scored; a receipt that fails gets 400 listing every failed field. With
+// VALIDATE_ITEM_TOTALS=true the item prices must also add up to the total
+// exactly (quarantine's total_mismatch check is the lenient alternative).
+// Metadata is limited to RECEIPT_METADATA_MAX_KEYS entries and
+// RECEIPT_METADATA_MAX_BYTES of keys and values together.
+
+var (
+	retailerPattern = regexp.MustCompile(`^[\w\s\-&]+$`)
+	amountPattern   = regexp.MustCompile(`^\d+\.\d{2}$`)
+	timePattern     = regexp.MustCompile(`^\d{2}:\d{2}$`)
+
+	validateItemTotals = os.Getenv("VALIDATE_ITEM_TOTALS") == "true"
+
+	metadataMaxKeys  = envInt("RECEIPT_METADATA_MAX_KEYS", 20)
+	metadataMaxBytes = envInt("RECEIPT_METADATA_MAX_BYTES", 2048)
+)
+
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validateReceipt returns the receipt's field errors, or nil.
+func validateReceipt(receipt Receipt) []fieldError {
+	var errs []fieldError
+	fail := func(field, format string, args ...any) {
+		errs = append(errs, fieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if strings.TrimSpace(receipt.Retailer) == "" {
+		fail("retailer", "is required")
+	} else if !retailerPattern.MatchString(receipt.Retailer) {
+		fail("retailer", "may only contain letters, digits, spaces, - and &")
+	}
+	if _, err := time.Parse("2006-01-02", receipt.PurchaseDate); err != nil {
+		fail("purchaseDate", "must be a calendar date as YYYY-MM-DD")
+	}
+	if _, err := time.Parse("15:04", receipt.PurchaseTime); err != nil || !timePattern.MatchString(receipt.PurchaseTime) {
+		fail("purchaseTime", "must be a 24-hour time as HH:MM")
+	}
+	if receipt.TimeZone != "" {
+		if _, err := loadZone(receipt.TimeZone); err != nil {
+			fail("timeZone", "must be an IANA time zone such as America/Chicago")
+		}
+	}
+	totalValid := amountPattern.MatchString(receipt.Total)
+	if !totalValid {
+		fail("total", "must be an amount with two decimals, such as 6.49")
+	}
+	if len(receipt.Items) == 0 {
+		fail("items", "must include at least one item")
+	}
+	pricesValid := true
+	var sum int64
+	for i, item := range receipt.Items {
+		if strings.TrimSpace(item.ShortDescription) == "" {
+			fail(fmt.Sprintf("items[%d].shortDescription", i), "is required")
+		}
+		if !amountPattern.MatchString(item.Price) {
+			fail(fmt.Sprintf("items[%d].price", i), "must be an amount with two decimals, such as 6.49")
+			pricesValid = false
+			continue
+		}
+		if item.Quantity < 1 {
+			fail(fmt.Sprintf("items[%d].quantity", i), "must be at least 1")
+		}
+		cents, _ := parseCents(item.Price)
+		sum += cents
+	}
+	if len(receipt.Metadata) > metadataMaxKeys {
+		fail("metadata", "may have at most %d keys", metadataMaxKeys)
+	}
+	size := 0
+	for key, value := range receipt.Metadata {
+		if strings.TrimSpace(key) == "" {
+			fail("metadata", "keys must not be empty")
+		}
+		size += len(key) + len(value)
+	}
+	if size > metadataMaxBytes {
+		fail("metadata", "keys and values may total at most %d bytes", metadataMaxBytes)
+	}
+	if validateItemTotals && totalValid && pricesValid && len(receipt.Items) > 0 {
+		if total, _ := parseCents(receipt.Total); total != sum {
+			fail("total", "items sum to %s, not %s", formatCents(sum), formatCents(total))
+		}
+	}
+	return errs
+}
+
+func invalidReceipt(errs []fieldError) *submissionError {
+	return &submissionError{http.StatusBadRequest, gin.H{
+		"error":  "Receipt failed validation",
+		"code":   "invalid_receipt",
+		"errors": errs,
+	}}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A subscription created with {"batch": {"maxEvents": 100, "maxWaitSeconds":
+// 5}} is sent its events in batches instead of one request each, so a
+// backfill does not turn into a storm of requests at the consumer. A batch
+// goes out once it holds maxEvents events, or maxWaitSeconds after its
+// first event was queued, whichever comes first. It is one POST of
+// {"subscription": ..., "events": [...]}, signed like single deliveries,
+// with X-Webhook-Event: batch and X-Webhook-Batch-Size.
+//
+// Events about backfilled receipts have priority bulk (see outboxEvent) and
+// wait behind live ones: a batch is filled with the oldest live events
+// first and only then with bulk events, so a backfill being delivered does
+// not hold up live traffic. Unbatched subscriptions get the same treatment
+// from the shared delivery workers, which take a bulk event only when no
+// live one is queued.
+//
+// Each batched subscription delivers its batches one at a time, oldest
+// events of each priority first, and retries a batch before moving on to
+// the next. A receipt's events all have the same priority, so they always
+// arrive in the order they happened. Up to WEBHOOK_BATCH_QUEUE events wait
+// per subscription; beyond that they are counted as failed, as when the
+// shared delivery queue is full.
+
+var webhookBatchQueue = envInt("WEBHOOK_BATCH_QUEUE", 10000)
+
+type batchPolicy struct {
+	MaxEvents      int `json:"maxEvents"`
+	MaxWaitSeconds int `json:"maxWaitSeconds"`
+}
+
+// normalize fills in defaults and returns a message describing what is
+// invalid, if anything.
+func (p *batchPolicy) normalize() string {
+	if p.MaxEvents == 0 {
+		p.MaxEvents = 100
+	}
+	if p.MaxWaitSeconds == 0 {
+		p.MaxWaitSeconds = 5
+	}
+	if p.MaxEvents < 1 || p.MaxEvents > 1000 {
+		return "batch.maxEvents must be between 1 and 1000"
+	}
+	if p.MaxWaitSeconds < 1 || p.MaxWaitSeconds > 300 {
+		return "batch.maxWaitSeconds must be between 1 and 300"
+	}
+	return ""
+}
+
+// subscriptionBatcher holds a batched subscription's undelivered events,
+// guarded by subscriptionsMu, and runs the goroutine that sends them.
+type subscriptionBatcher struct {
+	sub *webhookSubscription
+	// live and bulk are the pending events of each priority, oldest first.
+	live, bulk []batchedEvent
+	wake       chan struct{}
+	stop       context.CancelFunc
+}
+
+type batchedEvent struct {
+	event  outboxEvent
+	queued time.Time
+}
+
+func newSubscriptionBatcher(sub *webhookSubscription) *subscriptionBatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &subscriptionBatcher{sub: sub, wake: make(chan struct{}, 1), stop: cancel}
+	go b.run(ctx)
+	return b
+}
+
+// add queues event, reporting false when the batcher is full. The caller
+// holds subscriptionsMu.
+func (b *subscriptionBatcher) add(event outboxEvent) bool {
+	if b.pending() >= webhookBatchQueue {
+		return false
+	}
+	queued := batchedEvent{event, time.Now()}
+	if event.Priority == priorityBulk {
+		b.bulk = append(b.bulk, queued)
+	} else {
+		b.live = append(b.live, queued)
+	}
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// pending counts the undelivered events. The caller holds subscriptionsMu.
+func (b *subscriptionBatcher) pending() int {
+	return len(b.live) + len(b.bulk)
+}
+
+// oldest returns when the longest-waiting pending event was queued. The
+// caller holds subscriptionsMu.
+func (b *subscriptionBatcher) oldest() time.Time {
+	switch {
+	case len(b.live) == 0:
+		return b.bulk[0].queued
+	case len(b.bulk) == 0 || b.live[0].queued.Before(b.bulk[0].queued):
+		return b.live[0].queued
+	default:
+		return b.bulk[0].queued
+	}
+}
+
+func (b *subscriptionBatcher) run(ctx context.Context) {
+	policy := *b.sub.Batch
+	wait := time.Duration(policy.MaxWaitSeconds) * time.Second
+	for ctx.Err() == nil {
+		subscriptionsMu.Lock()
+		n := b.pending()
+		var since time.Time
+		if n > 0 {
+			since = b.oldest()
+		}
+		subscriptionsMu.Unlock()
+
+		var due <-chan time.Time
+		if n >= policy.MaxEvents || (n > 0 && time.Since(since) >= wait) {
+			b.flush(ctx, policy.MaxEvents)
+			continue
+		} else if n > 0 {
+			due = time.After(time.Until(since.Add(wait)))
+		}
+		select {
+		case <-b.wake:
+		case <-due:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// flush delivers at most max pending events, the oldest live ones first and
+// then the oldest bulk ones.
+func (b *subscriptionBatcher) flush(ctx context.Context, max int) {
+	subscriptionsMu.Lock()
+	batch := make([]outboxEvent, 0, min(b.pending(), max))
+	for _, queue := range []*[]batchedEvent{&b.live, &b.bulk} {
+		n := min(len(*queue), max-len(batch))
+		for _, queued := range (*queue)[:n] {
+			batch = append(batch, queued.event)
+		}
+		*queue = (*queue)[n:]
+	}
+	subscriptionsMu.Unlock()
+
+	body, err := json.Marshal(gin.H{"subscription": b.sub.ID, "events": batch})
+	if err != nil {
+		return
+	}
+	what := fmt.Sprintf("batch of %d events from %s", len(batch), batch[0].ID)
+	retryDelivery(ctx, b.sub, what, len(batch), func() error {
+		return postSubscription(ctx, b.sub, body, map[string]string{
+			"X-Webhook-Event":      "batch",
+			"X-Webhook-Batch-Size": strconv.Itoa(len(batch)),
+		})
+	})
+}
+
+// batchBacklog returns how many events wait in subscription batchers, and
+// the most waiting for any one subscription.
+func batchBacklog() (total, most int) {
+	subscriptionsMu.Lock()
+	defer subscriptionsMu.Unlock()
+	for _, sub := range subscriptions {
+		if sub.batcher != nil {
+			n := sub.batcher.pending()
+			total += n
+			most = max(most, n)
+		}
+	}
+	return total, most
+}
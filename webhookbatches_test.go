@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBatcherFlushesLiveEventsFirst(t *testing.T) {
+	savedPrivate := subscriptionsAllowPrivate
+	defer func() { subscriptionsAllowPrivate = savedPrivate }()
+	subscriptionsAllowPrivate = true
+
+	var delivered [][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Events []outboxEvent }
+		json.NewDecoder(r.Body).Decode(&body)
+		var ids []string
+		for _, event := range body.Events {
+			ids = append(ids, event.ID)
+		}
+		delivered = append(delivered, ids)
+	}))
+	defer srv.Close()
+
+	sub := &webhookSubscription{ID: "s1", URL: srv.URL, Batch: &batchPolicy{MaxEvents: 3, MaxWaitSeconds: 5}}
+	b := &subscriptionBatcher{sub: sub, wake: make(chan struct{}, 1)}
+	start := time.Now()
+	for i, id := range []string{"bulk1", "live1", "bulk2", "live2", "bulk3"} {
+		event, queue := outboxEvent{ID: id}, &b.live
+		if id[:4] == "bulk" {
+			event.Priority, queue = priorityBulk, &b.bulk
+		}
+		b.add(event)
+		(*queue)[len(*queue)-1].queued = start.Add(time.Duration(i) * time.Second)
+	}
+
+	b.flush(context.Background(), 3)
+	if want := []string{"live1", "live2", "bulk1"}; len(delivered) != 1 || !slices.Equal(delivered[0], want) {
+		t.Fatalf("first batch %v, want %v", delivered, want)
+	}
+	// The leftovers wait from when they were queued, not from when the
+	// flushed batch started.
+	if b.pending() != 2 || !b.oldest().Equal(start.Add(2*time.Second)) {
+		t.Errorf("after flush: %d pending, oldest queued at +%v", b.pending(), b.oldest().Sub(start))
+	}
+	b.flush(context.Background(), 3)
+	if want := []string{"bulk2", "bulk3"}; len(delivered) != 2 || !slices.Equal(delivered[1], want) {
+		t.Errorf("second batch %v, want %v", delivered[1:], want)
+	}
+}
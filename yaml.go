@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// YAML is offered alongside JSON for tooling that authors receipts by hand:
+// receipt submissions may be sent as application/yaml, and JSON responses
+// (receipts, points, breakdowns and the rest) are re-encoded as YAML for
+// clients that prefer it in Accept. Handlers only ever see and write JSON.
+//
+// Receipt documents are small and flat, so YAML bodies are capped at
+// yamlMaxBytes and anchors and aliases are refused outright: expanding
+// aliases lets a few hundred bytes stand for gigabytes of nodes.
+
+const (
+	yamlContentType = "application/yaml"
+	yamlMaxBytes    = 1 << 20
+)
+
+var yamlMediaTypes = map[string]bool{
+	yamlContentType:      true,
+	"application/x-yaml": true,
+	"text/yaml":          true,
+}
+
+func isYAML(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return yamlMediaTypes[mediaType]
+}
+
+// yamlReceiptBody turns a YAML receipt body into JSON. Scalars for string
+// fields keep their text as written, so "total: 35.35" need not be quoted.
+func yamlReceiptBody(c *gin.Context) {
+	if !isYAML(c.GetHeader("Content-Type")) {
+		c.Next()
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, yamlMaxBytes+1))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid YAML format"})
+		return
+	}
+	if len(data) > yamlMaxBytes {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "YAML body exceeds the size limit"})
+		return
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid YAML format"})
+		return
+	}
+	if hasAliases(&doc) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "YAML anchors and aliases are not supported"})
+		return
+	}
+	body, err := json.Marshal(yamlValue(&doc, reflect.TypeOf(Receipt{})))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid YAML format"})
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	c.Request.ContentLength = int64(len(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Next()
+}
+
+// yamlValue converts a YAML node to a JSON-ready value, guided by the Go
+// type it will be decoded into (nil when unknown).
+func yamlValue(node *yaml.Node, t reflect.Type) any {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil
+		}
+		return yamlValue(node.Content[0], t)
+	case yaml.MappingNode:
+		m := make(map[string]any, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			m[key] = yamlValue(node.Content[i+1], jsonFieldType(t, key))
+		}
+		return m
+	case yaml.SequenceNode:
+		var elem reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elem = t.Elem()
+		}
+		list := make([]any, len(node.Content))
+		for i, child := range node.Content {
+			list[i] = yamlValue(child, elem)
+		}
+		return list
+	}
+	if node.Tag == "!!null" {
+		return nil
+	}
+	if t != nil && t.Kind() == reflect.String {
+		return node.Value
+	}
+	var v any
+	if err := node.Decode(&v); err != nil {
+		return node.Value
+	}
+	return v
+}
+
+// hasAliases reports whether the document uses anchors or aliases.
+func hasAliases(node *yaml.Node) bool {
+	if node.Kind == yaml.AliasNode || node.Anchor != "" {
+		return true
+	}
+	for _, child := range node.Content {
+		if hasAliases(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonFieldType is the type of the field a JSON key decodes into.
+func jsonFieldType(t reflect.Type, key string) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		return t.Elem()
+	case reflect.Struct:
+		for i := range t.NumField() {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "" {
+				name = field.Name
+			}
+			if strings.EqualFold(name, key) {
+				return field.Type
+			}
+		}
+	}
+	return nil
+}
+
+// negotiateYAML re-encodes JSON responses as YAML when the client's Accept
+// header prefers it.
+func negotiateYAML(c *gin.Context) {
+	c.Writer.Header().Add("Vary", "Accept")
+	if c.GetHeader("Accept") == "" || c.NegotiateFormat(gin.MIMEJSON, yamlContentType) != yamlContentType {
+		c.Next()
+		return
+	}
+	w := &heldWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	c.Next()
+	c.Writer = w.ResponseWriter
+
+	body := w.held.Bytes()
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), gin.MIMEJSON) {
+		w.ResponseWriter.Write(body)
+		return
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(body, &doc); err != nil {
+		w.ResponseWriter.Write(body)
+		return
+	}
+	plainStyle(&doc)
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		w.ResponseWriter.Write(body)
+		return
+	}
+	w.Header().Set("Content-Type", yamlContentType+"; charset=utf-8")
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.Write(out.Bytes())
+}
+
+// plainStyle drops the flow style and quoting JSON decodes with; the
+// encoder still quotes strings that would otherwise read as another type.
+func plainStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		plainStyle(child)
+	}
+}